@@ -1,10 +1,8 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/avast/retry-go"
@@ -19,6 +17,7 @@ import (
 	"github.com/caarlos0/env/v6"
 	"github.com/go-resty/resty/v2"
 
+	"github.com/shevchukeugeni/metrics/internal/agent"
 	"github.com/shevchukeugeni/metrics/internal/store"
 )
 
@@ -26,6 +25,11 @@ type Config struct {
 	ServerAddr     string `env:"ADDRESS"`
 	PollInterval   int    `env:"REPORT_INTERVAL"`
 	ReportInterval int    `env:"POLL_INTERVAL"`
+	Collectors     string `env:"COLLECTORS_CONFIG"`
+	Token          string `env:"AUTH_TOKEN"`
+	TLSCA          string `env:"TLS_CA_CERT"`
+	TLSCert        string `env:"TLS_CLIENT_CERT"`
+	TLSKey         string `env:"TLS_CLIENT_KEY"`
 }
 
 var cfg Config
@@ -34,6 +38,11 @@ func init() {
 	flag.StringVar(&cfg.ServerAddr, "a", "localhost:8080", "address and port to run server")
 	flag.IntVar(&cfg.ReportInterval, "r", 10, "report interval in seconds")
 	flag.IntVar(&cfg.PollInterval, "p", 2, "poll interval in seconds")
+	flag.StringVar(&cfg.Collectors, "collectors", "", "path to additional collectors config")
+	flag.StringVar(&cfg.Token, "token", "", "bearer token sent to the server")
+	flag.StringVar(&cfg.TLSCA, "tls-ca", "", "CA certificate to verify the server (enables https)")
+	flag.StringVar(&cfg.TLSCert, "tls-cert", "", "client certificate for mutual TLS (enables https)")
+	flag.StringVar(&cfg.TLSKey, "tls-key", "", "client certificate key for mutual TLS")
 }
 
 func main() {
@@ -50,7 +59,14 @@ func main() {
 	//	log.Fatalf("%s %s %s\n", flagRunAddr, "not responding", err.Error())
 	//}
 
+	logger, err := zap.NewDevelopment()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer logger.Sync()
+
 	metrics := store.NewRuntimeMetrics()
+	registry := agent.NewRegistry()
 
 	pollTicker := time.NewTicker(time.Duration(cfg.PollInterval) * time.Second)
 	defer pollTicker.Stop()
@@ -58,10 +74,31 @@ func main() {
 	defer reportTicker.Stop()
 
 	client := resty.New()
+	if cfg.Token != "" {
+		client.SetAuthToken(cfg.Token)
+	}
+
+	tlsCfg := agent.TLSConfig{CAFile: cfg.TLSCA, CertFile: cfg.TLSCert, KeyFile: cfg.TLSKey}
+	if tlsCfg.Enabled() {
+		tc, err := agent.NewTLSConfig(tlsCfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		client.SetTLSClientConfig(tc)
+	}
+	reportURL := agent.ServerURL(cfg.ServerAddr, "/updates/", tlsCfg.Enabled())
 
 	ctx, cancelFunc := context.WithCancel(context.Background())
 
+	if cfg.Collectors != "" {
+		err = startCollectors(ctx, logger, registry, cfg.Collectors)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	go func(ctx context.Context) {
+		var pending *agent.Batch
 		for {
 			select {
 			case <-ctx.Done():
@@ -71,54 +108,37 @@ func main() {
 
 				log.Println("Metrics are updated")
 			case <-reportTicker.C:
-				type mtrc struct {
-					ID    string  `json:"id"`
-					Mtype string  `json:"type"`
-					Value float64 `json:"value"`
-					Delta int64   `json:"delta"`
+				// Неотправленный батч уходит первым и тем же: новые приращения коллекторов
+				// копятся в реестре, пока он не доставлен.
+				if pending != nil {
+					if !report(client, reportURL, pending) {
+						continue
+					}
+					pending = nil
 				}
 
-				var mtrcs []mtrc
+				var mtrcs []types.Metrics
 
 				for k, v := range metrics.Gauge {
-					mtrcs = append(mtrcs, mtrc{ID: k, Mtype: types.Gauge, Value: v})
+					value := v
+					mtrcs = append(mtrcs, types.Metrics{ID: k, MType: types.Gauge, Value: &value})
 				}
 
 				for k, v := range metrics.Counter {
-					mtrcs = append(mtrcs, mtrc{ID: k, Mtype: types.Counter, Delta: v})
+					delta := v
+					mtrcs = append(mtrcs, types.Metrics{ID: k, MType: types.Counter, Delta: &delta})
 				}
 
-				data, err := json.Marshal(mtrcs)
-				if err != nil {
-					log.Println(err)
-					return
-				}
+				mtrcs = append(mtrcs, registry.Collect()...)
 
-				cdata, err := Compress(data)
+				batch, err := agent.NewBatch(mtrcs)
 				if err != nil {
 					log.Println(err)
 					return
 				}
-
-				var innerErr error
-
-				err = WithRetry(func() error {
-					_, innerErr = client.R().
-						SetHeader("Content-Type", "application/json").
-						SetHeader("Content-Encoding", "gzip").
-						SetBody(cdata).
-						Post(fmt.Sprintf("http://%s/updates/", cfg.ServerAddr))
-					if innerErr != nil {
-						return innerErr
-					}
-					return nil
-				}, "failed to send metric")
-				if err != nil {
-					log.Println(err)
-					return
+				if !report(client, reportURL, batch) {
+					pending = batch
 				}
-
-				log.Println("Report is sent!")
 			}
 		}
 	}(ctx)
@@ -130,21 +150,62 @@ func main() {
 	cancelFunc()
 }
 
-// Compress сжимает слайс байт.
-func Compress(data []byte) ([]byte, error) {
-	var b bytes.Buffer
-	w := gzip.NewWriter(&b)
-
-	_, err := w.Write(data)
+// startCollectors запускает коллекторы, описанные в конфиге, каждый в своей горутине.
+func startCollectors(ctx context.Context, logger *zap.Logger, registry *agent.Registry, path string) error {
+	acfg, err := agent.LoadConfig(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed write data to compress temporary buffer: %v", err)
+		return fmt.Errorf("failed to load collectors config: %w", err)
 	}
-	err = w.Close()
-	if err != nil {
-		return nil, fmt.Errorf("failed compress data: %v", err)
+
+	if len(acfg.Exec) > 0 {
+		ec, err := agent.NewExecCollector(logger, registry, acfg.Exec)
+		if err != nil {
+			return err
+		}
+		go ec.Start(ctx)
+	}
+
+	if len(acfg.Tail) > 0 {
+		tc, err := agent.NewTailCollector(logger, registry, acfg.Tail, acfg.TailState)
+		if err != nil {
+			return err
+		}
+		go tc.Start(ctx)
 	}
 
-	return b.Bytes(), nil
+	if len(acfg.Process) > 0 {
+		pc, err := agent.NewProcessCollector(logger, registry, acfg.Process, acfg.ProcRoot)
+		if err != nil {
+			return err
+		}
+		go pc.Start(ctx)
+	}
+
+	return nil
+}
+
+// report отправляет батч с повторами. false — батч не доставлен, но может пройти позже и
+// должен быть отправлен снова; батч, отклонённый из-за данных, отбрасывается.
+func report(client *resty.Client, url string, batch *agent.Batch) bool {
+	var sendErr error
+	err := WithRetry(func() error {
+		sendErr = batch.Send(client, url)
+		if errors.Is(sendErr, agent.ErrRejected) {
+			return retry.Unrecoverable(sendErr)
+		}
+		return sendErr
+	}, "failed to send metric")
+	if err == nil {
+		log.Println("Report is sent!")
+		return true
+	}
+
+	log.Println(err)
+	if errors.Is(sendErr, agent.ErrRejected) {
+		log.Println("dropping batch", batch.ID)
+		return true
+	}
+	return false
 }
 
 func WithRetry(fn func() error, warn string) error {
@@ -2,32 +2,111 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 	"go.uber.org/zap"
 
+	"github.com/shevchukeugeni/metrics/internal/alert"
+	"github.com/shevchukeugeni/metrics/internal/cluster"
+	"github.com/shevchukeugeni/metrics/internal/federation"
+	"github.com/shevchukeugeni/metrics/internal/replication"
 	"github.com/shevchukeugeni/metrics/internal/server"
 	"github.com/shevchukeugeni/metrics/internal/store"
+	"github.com/shevchukeugeni/metrics/internal/store/backend"
 	"github.com/shevchukeugeni/metrics/internal/store/postgres"
+	"github.com/shevchukeugeni/metrics/internal/store/postgres/migrations"
+	"github.com/shevchukeugeni/metrics/internal/store/sqlite"
+	"github.com/shevchukeugeni/metrics/internal/tenant"
 	"github.com/shevchukeugeni/metrics/internal/types"
 )
 
 var dcfg types.DumpConfig
 
-var flagRunAddr, dbURL string
+var pgcfg postgres.Config
+
+var sqcfg sqlite.Config
+
+var dbMaxConns int
+
+var flagRunAddr, dbURL, alertRules, adminToken, authTokens, storageBackend, tenantsConfig string
+
+var storageStrict, replicationLeader bool
+
+var replicaOf, replicaToken string
+
+var clusterMembers, clusterSelf, clusterToken string
+
+var upcfg federation.Config
+
+var tlscfg server.TLSConfig
+
+var peerTLS server.PeerTLSConfig
+
+var limits server.Limits
+
+var alertInterval, seriesTTL time.Duration
 
 func init() {
 	flag.UintVar(&dcfg.StoreInterval, "i", 300, "dump to file interval")
 	flag.BoolVar(&dcfg.Restore, "r", true, "restore data from file")
 	flag.StringVar(&dcfg.FileStoragePath, "f", "/tmp/metrics-db.json", "dump file path")
+	flag.UintVar(&dcfg.DumpGenerations, "dump-generations", 3, "number of previous dump files to keep")
+	flag.StringVar(&dcfg.DumpFormat, "dump-format", "json", "dump file format: json or binary")
+	flag.BoolVar(&dcfg.DumpCompress, "dump-compress", false, "compress dump file with zstd")
+	flag.StringVar(&dcfg.WALPath, "wal", "", "write-ahead log directory (empty disables)")
+	flag.StringVar(&dcfg.WALFsync, "wal-fsync", "interval", "wal fsync policy: always, interval or never")
+	flag.UintVar(&dcfg.WALSyncInterval, "wal-sync-interval", 1, "wal fsync interval in seconds for interval policy")
 
 	flag.StringVar(&flagRunAddr, "a", "localhost:8080", "address and port to run server")
 	flag.StringVar(&dbURL, "d", "", "database connection url")
+	flag.StringVar(&storageBackend, "storage", "", "storage backend: memory, file, postgres or sqlite (empty picks postgres if -d is set, else file)")
+	flag.BoolVar(&storageStrict, "storage-strict", false, "refuse to start if the chosen storage backend is unavailable")
+	flag.StringVar(&sqcfg.Path, "sqlite-path", "/tmp/metrics.db", "sqlite database file")
+	flag.BoolVar(&pgcfg.SkipMigrations, "skip-migrations", false, "do not apply schema migrations on startup (use the migrate command)")
+	flag.IntVar(&dbMaxConns, "db-max-conns", 0, "maximum size of the database connection pool (0 for pgxpool default)")
+	flag.DurationVar(&pgcfg.ConnectTimeout, "db-connect-timeout", 5*time.Second, "database connection timeout")
+	flag.DurationVar(&pgcfg.QueryTimeout, "db-query-timeout", 5*time.Second, "deadline for a single storage query")
+	flag.DurationVar(&pgcfg.MaxConnLifetime, "db-max-conn-lifetime", time.Hour, "maximum lifetime of a database connection")
+	flag.DurationVar(&pgcfg.MaxConnIdleTime, "db-max-conn-idle-time", 30*time.Minute, "maximum idle time of a database connection")
+	flag.DurationVar(&pgcfg.SampleRetention, "sample-retention", 0, "keep postgres metric history this long (0 disables history)")
+	flag.StringVar(&alertRules, "rules", "", "path to alerting rules file")
+	flag.DurationVar(&alertInterval, "alert-interval", 15*time.Second, "alerting rules evaluation interval")
+	flag.StringVar(&adminToken, "admin-token", "", "bearer token for /admin endpoints (empty disables them)")
+	flag.StringVar(&tlscfg.CertFile, "tls-cert", "", "server TLS certificate (enables https together with -tls-key)")
+	flag.StringVar(&tlscfg.KeyFile, "tls-key", "", "server TLS private key")
+	flag.StringVar(&tlscfg.ClientCAFile, "tls-client-ca", "", "CA for verifying agent client certificates (mutual TLS)")
+	flag.BoolVar(&tlscfg.RequireClientCert, "tls-require-client-cert", false, "reject connections without a valid client certificate")
+	flag.StringVar(&peerTLS.CAFile, "peer-tls-ca", "", "CA for verifying the leader, cluster nodes and the upstream server (enables https to them)")
+	flag.StringVar(&peerTLS.CertFile, "peer-tls-cert", "", "client certificate presented to the leader, cluster nodes and the upstream server")
+	flag.StringVar(&peerTLS.KeyFile, "peer-tls-key", "", "client certificate key for -peer-tls-cert")
+	flag.Float64Var(&limits.Rate, "client-rate", 0, "ingest requests per second allowed for one client (0 disables)")
+	flag.IntVar(&limits.Burst, "client-burst", 0, "ingest request burst for one client (0 allows one second of -client-rate)")
+	flag.Int64Var(&limits.MaxBodySize, "max-body-size", 10<<20, "maximum api request body size in bytes as sent (0 disables)")
+	flag.Int64Var(&limits.MaxDecompressedSize, "max-decompressed-size", 64<<20, "maximum api request body size in bytes after gzip decompression (0 disables)")
+	flag.IntVar(&limits.MaxBatch, "max-batch", 10000, "maximum number of metrics in one /updates/ request (0 disables)")
+	flag.StringVar(&authTokens, "auth-tokens", "", "path to file with hashed api tokens and their roles (empty leaves the api open)")
+	flag.BoolVar(&replicationLeader, "replication", false, "serve the update stream for replicas at /replication/stream")
+	flag.StringVar(&replicaOf, "replica-of", "", "leader address to replicate from (empty disables follower mode)")
+	flag.StringVar(&replicaToken, "replica-token", "", "bearer token for the leader's replication endpoints")
+	flag.StringVar(&clusterMembers, "cluster-members", "", "comma-separated addresses of all cluster nodes (empty disables cluster mode)")
+	flag.StringVar(&clusterSelf, "cluster-self", "", "address of this node in -cluster-members (defaults to -a)")
+	flag.StringVar(&clusterToken, "cluster-token", "", "bearer token with the admin role for requests to other cluster nodes (defaults to -admin-token)")
+	flag.StringVar(&upcfg.URL, "upstream", "", "parent server address to forward rolled-up metrics to (empty disables forwarding)")
+	flag.StringVar(&upcfg.Edge, "edge", "", "value of the edge label on forwarded series (defaults to the hostname)")
+	flag.StringVar(&upcfg.Token, "upstream-token", "", "bearer token for the parent server")
+	flag.DurationVar(&upcfg.Interval, "upstream-interval", 10*time.Second, "upstream forwarding interval")
+	flag.StringVar(&upcfg.Outbox, "upstream-outbox", "", "directory for data not yet delivered upstream (empty keeps it in memory)")
+	flag.StringVar(&tenantsConfig, "tenants", "", "path to tenants config with api keys and quotas (empty disables multi-tenancy)")
+	flag.DurationVar(&seriesTTL, "ttl", 0, "purge series not updated for this long (0 disables)")
 
 	if envRunAddr := os.Getenv("ADDRESS"); envRunAddr != "" {
 		flagRunAddr = envRunAddr
@@ -36,6 +115,174 @@ func init() {
 	if envDBURL := os.Getenv("DATABASE_DSN"); envDBURL != "" {
 		dbURL = envDBURL
 	}
+
+	if envStorageBackend := os.Getenv("STORAGE_BACKEND"); envStorageBackend != "" {
+		storageBackend = envStorageBackend
+	}
+
+	if envStorageStrict := os.Getenv("STORAGE_STRICT"); envStorageStrict != "" {
+		strict, err := strconv.ParseBool(envStorageStrict)
+		if err != nil {
+			log.Fatal(err)
+		}
+		storageStrict = strict
+	}
+
+	if envAlertRules := os.Getenv("ALERT_RULES"); envAlertRules != "" {
+		alertRules = envAlertRules
+	}
+
+	if envAdminToken := os.Getenv("ADMIN_TOKEN"); envAdminToken != "" {
+		adminToken = envAdminToken
+	}
+
+	if envTLSCert := os.Getenv("TLS_CERT"); envTLSCert != "" {
+		tlscfg.CertFile = envTLSCert
+	}
+
+	if envTLSKey := os.Getenv("TLS_KEY"); envTLSKey != "" {
+		tlscfg.KeyFile = envTLSKey
+	}
+
+	if envTLSClientCA := os.Getenv("TLS_CLIENT_CA"); envTLSClientCA != "" {
+		tlscfg.ClientCAFile = envTLSClientCA
+	}
+
+	if envPeerCA := os.Getenv("PEER_TLS_CA"); envPeerCA != "" {
+		peerTLS.CAFile = envPeerCA
+	}
+
+	if envPeerCert := os.Getenv("PEER_TLS_CERT"); envPeerCert != "" {
+		peerTLS.CertFile = envPeerCert
+	}
+
+	if envPeerKey := os.Getenv("PEER_TLS_KEY"); envPeerKey != "" {
+		peerTLS.KeyFile = envPeerKey
+	}
+
+	if envTLSRequire := os.Getenv("TLS_REQUIRE_CLIENT_CERT"); envTLSRequire != "" {
+		require, err := strconv.ParseBool(envTLSRequire)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlscfg.RequireClientCert = require
+	}
+
+	if envClientRate := os.Getenv("CLIENT_RATE_LIMIT"); envClientRate != "" {
+		rate, err := strconv.ParseFloat(envClientRate, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		limits.Rate = rate
+	}
+
+	if envClientBurst := os.Getenv("CLIENT_RATE_BURST"); envClientBurst != "" {
+		burst, err := strconv.Atoi(envClientBurst)
+		if err != nil {
+			log.Fatal(err)
+		}
+		limits.Burst = burst
+	}
+
+	if envMaxBodySize := os.Getenv("MAX_BODY_SIZE"); envMaxBodySize != "" {
+		size, err := strconv.ParseInt(envMaxBodySize, 10, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		limits.MaxBodySize = size
+	}
+
+	if envMaxDecompressedSize := os.Getenv("MAX_DECOMPRESSED_SIZE"); envMaxDecompressedSize != "" {
+		size, err := strconv.ParseInt(envMaxDecompressedSize, 10, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		limits.MaxDecompressedSize = size
+	}
+
+	if envMaxBatch := os.Getenv("MAX_BATCH"); envMaxBatch != "" {
+		batch, err := strconv.Atoi(envMaxBatch)
+		if err != nil {
+			log.Fatal(err)
+		}
+		limits.MaxBatch = batch
+	}
+
+	if envAuthTokens := os.Getenv("AUTH_TOKENS_FILE"); envAuthTokens != "" {
+		authTokens = envAuthTokens
+	}
+
+	if envReplication := os.Getenv("REPLICATION"); envReplication != "" {
+		leader, err := strconv.ParseBool(envReplication)
+		if err != nil {
+			log.Fatal(err)
+		}
+		replicationLeader = leader
+	}
+
+	if envReplicaOf := os.Getenv("REPLICA_OF"); envReplicaOf != "" {
+		replicaOf = envReplicaOf
+	}
+
+	if envReplicaToken := os.Getenv("REPLICA_TOKEN"); envReplicaToken != "" {
+		replicaToken = envReplicaToken
+	}
+
+	if envClusterMembers := os.Getenv("CLUSTER_MEMBERS"); envClusterMembers != "" {
+		clusterMembers = envClusterMembers
+	}
+
+	if envClusterSelf := os.Getenv("CLUSTER_SELF"); envClusterSelf != "" {
+		clusterSelf = envClusterSelf
+	}
+
+	if envClusterToken := os.Getenv("CLUSTER_TOKEN"); envClusterToken != "" {
+		clusterToken = envClusterToken
+	}
+
+	if envUpstream := os.Getenv("UPSTREAM_URL"); envUpstream != "" {
+		upcfg.URL = envUpstream
+	}
+
+	if envEdge := os.Getenv("EDGE_LABEL"); envEdge != "" {
+		upcfg.Edge = envEdge
+	}
+
+	if envUpstreamToken := os.Getenv("UPSTREAM_TOKEN"); envUpstreamToken != "" {
+		upcfg.Token = envUpstreamToken
+	}
+
+	if envUpstreamInterval := os.Getenv("UPSTREAM_INTERVAL"); envUpstreamInterval != "" {
+		interval, err := time.ParseDuration(envUpstreamInterval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		upcfg.Interval = interval
+	}
+
+	if envUpstreamOutbox := os.Getenv("UPSTREAM_OUTBOX"); envUpstreamOutbox != "" {
+		upcfg.Outbox = envUpstreamOutbox
+	}
+
+	if envTenantsConfig := os.Getenv("TENANTS_CONFIG"); envTenantsConfig != "" {
+		tenantsConfig = envTenantsConfig
+	}
+
+	if envAlertInterval := os.Getenv("ALERT_EVAL_INTERVAL"); envAlertInterval != "" {
+		interval, err := time.ParseDuration(envAlertInterval)
+		if err != nil {
+			log.Fatal(err)
+		}
+		alertInterval = interval
+	}
+
+	if envSeriesTTL := os.Getenv("SERIES_TTL"); envSeriesTTL != "" {
+		ttl, err := time.ParseDuration(envSeriesTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		seriesTTL = ttl
+	}
 }
 
 func main() {
@@ -46,42 +293,211 @@ func main() {
 		log.Fatal(err)
 	}
 
+	pgcfg.MaxConns = int32(dbMaxConns)
+	err = env.Parse(&pgcfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pgcfg.URL = dbURL
+
+	sqcfg.QueryTimeout = pgcfg.QueryTimeout
+	sqcfg.SkipMigrations = pgcfg.SkipMigrations
+	err = env.Parse(&sqcfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "migrate":
+			err = runMigrate(context.Background(), args[1:])
+		case "hash-token":
+			err = runHashToken(os.Stdin, os.Stdout)
+		default:
+			log.Fatalf("unknown command %q, usage: %s | hash-token < token", args[0], migrations.Usage)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	logger, err := zap.NewDevelopment()
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer logger.Sync()
 
+	// Эндпоинты /replication и /cluster меняют состояние узла, поэтому без токена не поднимаются.
+	internal := replicationLeader || replicaOf != "" || clusterMembers != ""
+	if internal && adminToken == "" && authTokens == "" {
+		logger.Fatal("replication and clustering require -admin-token or -auth-tokens")
+	}
+
+	// Ведомый, узлы кластера и пересылка на родителя ходят к другим серверам одним клиентским TLS.
+	var peerTLSConfig *tls.Config
+	if peerTLS.Enabled() {
+		peerTLSConfig, err = server.NewPeerTLSConfig(peerTLS)
+		if err != nil {
+			logger.Fatal("failed to configure peer TLS", zap.Error(err))
+		}
+	}
+	upcfg.TLS = peerTLSConfig
+
 	var (
 		router http.Handler
 		wg     sync.WaitGroup
 	)
 	ctx, cancelCtx := context.WithCancel(context.Background())
 
-	db, err := postgres.NewPostgresDB(postgres.Config{URL: dbURL})
+	storage, err := backend.Open(ctx, logger, backend.Config{
+		Backend:  storageBackend,
+		Strict:   storageStrict,
+		Dump:     &dcfg,
+		Postgres: pgcfg,
+		SQLite:   sqcfg,
+	}, &wg)
 	if err != nil {
-		logger.Error("failed to initialize db: " + err.Error())
+		logger.Fatal("failed to open storage", zap.Error(err))
 	}
-	defer db.Close()
+	defer storage.Close()
 
-	if db != nil {
-		dbStorage := postgres.NewStore(logger, db)
+	if storage.Dump != nil {
+		go storage.Dump.Start(ctx)
+	}
 
-		router = server.SetupRouter(logger, dbStorage, nil, db)
-	} else {
-		memStorage := store.NewMemStorage()
+	if storage.Partitions != nil {
+		go storage.Partitions.Start(ctx)
+	}
 
-		dumpWorker := store.NewDumpWorker(logger, &dcfg, memStorage, &wg)
+	ms := storage.Storage
+	opts := []server.Option{server.WithReadiness(storage)}
 
-		router = server.SetupRouter(logger, memStorage, dumpWorker, nil)
+	// Ведомый тоже публикует изменения: к нему можно подключить следующий узел, а после
+	// promote он сразу становится ведущим.
+	if replicationLeader || replicaOf != "" {
+		leader := replication.NewLeader(logger, ms)
+		ms = leader
 
-		if dumpWorker != nil {
-			go dumpWorker.Start(ctx)
+		var follower *replication.Follower
+		if replicaOf != "" {
+			follower = replication.NewFollower(logger, replicaOf, replicaToken, peerTLSConfig, leader)
+			go follower.Start(ctx)
+			opts = append(opts, server.WithReplica(follower))
 		}
+
+		opts = append(opts, server.WithReplication(replication.Handler(leader, follower)))
 	}
 
-	logger.Info("Running server on", zap.String("address", flagRunAddr))
-	err = http.ListenAndServe(flagRunAddr, router)
+	// Пересылаются только локальные серии: в кластере каждый узел отправляет свою долю,
+	// а ведомый не пересылает данные, которые уже переслал ведущий.
+	if upcfg.URL != "" {
+		if replicaOf != "" {
+			logger.Fatal("upstream forwarding is not supported on replicas")
+		}
+		if upcfg.Edge == "" {
+			upcfg.Edge, _ = os.Hostname()
+		}
+
+		forwarder, err := federation.NewForwarder(logger, ms, upcfg)
+		if err != nil {
+			logger.Fatal("failed to configure upstream forwarding", zap.Error(err))
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			forwarder.Start(ctx)
+		}()
+	}
+
+	if clusterMembers != "" {
+		if clusterSelf == "" {
+			clusterSelf = flagRunAddr
+		}
+		// Хешированные токены из -auth-tokens узел предъявить соседям не может, поэтому
+		// без -admin-token нужен отдельный токен для запросов к ним.
+		if clusterToken == "" {
+			clusterToken = adminToken
+		}
+		if clusterToken == "" {
+			logger.Fatal("cluster mode with -auth-tokens requires -cluster-token")
+		}
+
+		c, err := cluster.New(logger, clusterSelf, strings.Split(clusterMembers, ","), clusterToken, peerTLSConfig, ms)
+		if err != nil {
+			logger.Fatal("failed to configure cluster", zap.Error(err))
+		}
+		ms = c
+
+		opts = append(opts, server.WithCluster(c.Handler(limits.MaxBatch)))
+	}
+
+	// Арендаторы разделяются поверх кластера и репликации: соседние узлы и ведомые
+	// получают серии уже с меткой арендатора.
+	if tenantsConfig != "" {
+		tcfg, err := tenant.LoadConfig(tenantsConfig)
+		if err != nil {
+			logger.Fatal("failed to load tenants config", zap.Error(err))
+		}
+		ms = tenant.NewStorage(ms, tcfg)
+
+		opts = append(opts, server.WithTenants(tenant.Middleware(logger, tcfg)))
+	}
+
+	if janitor := store.NewJanitor(logger, ms, seriesTTL); janitor != nil {
+		go janitor.Start(ctx)
+	}
+
+	if alertRules != "" {
+		acfg, err := alert.LoadConfig(alertRules)
+		if err != nil {
+			logger.Fatal("failed to load alerting rules", zap.Error(err))
+		}
+
+		engine := alert.NewEngine(logger, ms, acfg.Rules, alertInterval)
+		for _, rcv := range acfg.Receivers {
+			webhook, err := alert.NewWebhook(logger, rcv)
+			if err != nil {
+				logger.Fatal("failed to configure alert receiver", zap.Error(err))
+			}
+			engine.AddNotifier(webhook)
+		}
+		go engine.Start(ctx)
+
+		opts = append(opts, server.WithAlerts(engine))
+	}
+
+	if adminToken != "" {
+		opts = append(opts, server.WithAdmin(adminToken))
+	}
+
+	if authTokens != "" {
+		tokens, err := server.LoadTokens(authTokens)
+		if err != nil {
+			logger.Fatal("failed to load api tokens", zap.Error(err))
+		}
+		opts = append(opts, server.WithAuth(tokens))
+	}
+
+	opts = append(opts, server.WithLimits(limits))
+
+	router = server.SetupRouter(logger, ms, storage.Dump, storage, opts...)
+
+	srv := &http.Server{Addr: flagRunAddr, Handler: router}
+	if tlscfg.Enabled() {
+		srv.TLSConfig, err = server.NewTLSConfig(tlscfg)
+		if err != nil {
+			logger.Fatal("failed to configure TLS", zap.Error(err))
+		}
+
+		logger.Info("Running server with TLS on", zap.String("address", flagRunAddr),
+			zap.Bool("client_certs", tlscfg.ClientCAFile != ""), zap.Bool("client_certs_required", tlscfg.RequireClientCert))
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		logger.Info("Running server on", zap.String("address", flagRunAddr))
+		err = srv.ListenAndServe()
+	}
 	if err != http.ErrServerClosed {
 		logger.Fatal("HTTP server ListenAndServe Error", zap.Error(err))
 	}
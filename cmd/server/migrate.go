@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/golang-migrate/migrate/v4"
+
+	"github.com/shevchukeugeni/metrics/internal/store/backend"
+	"github.com/shevchukeugeni/metrics/internal/store/postgres"
+	"github.com/shevchukeugeni/metrics/internal/store/postgres/migrations"
+	"github.com/shevchukeugeni/metrics/internal/store/sqlite"
+)
+
+// runMigrate выполняет `server [флаги] migrate ...` для базы, выбранной флагами -storage, -d и -sqlite-path.
+func runMigrate(ctx context.Context, args []string) error {
+	var (
+		m   *migrate.Migrate
+		err error
+	)
+
+	switch storageBackend {
+	case backend.SQLite:
+		m, err = sqlite.NewMigrator(ctx, sqcfg)
+	case "", backend.Postgres:
+		m, err = postgres.NewMigrator(ctx, pgcfg)
+	default:
+		return fmt.Errorf("storage backend %q has no schema to migrate", storageBackend)
+	}
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	return migrations.Run(m, args, os.Stdout)
+}
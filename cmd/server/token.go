@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/shevchukeugeni/metrics/internal/server"
+)
+
+// runHashToken выполняет `server hash-token`: читает токен из первой строки ввода
+// и печатает значение для поля sha256 файла токенов. Токен не передаётся аргументом,
+// чтобы он не попал в историю команд и список процессов.
+func runHashToken(in io.Reader, out io.Writer) error {
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	token := strings.TrimRight(line, "\r\n")
+	if token == "" {
+		return errors.New("empty token")
+	}
+
+	_, err = fmt.Fprintln(out, server.HashToken(token))
+	return err
+}
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+// ErrRejected — сервер отклонил батч из-за данных; повтор того же батча не поможет.
+var ErrRejected = errors.New("batch rejected by server")
+
+// Batch — сжатый батч метрик для /updates/ с идентификатором. Если отправка не удалась,
+// повторяют этот же батч, а не добавляют его приращения к следующему: кластер мог уже
+// записать часть батча и пропустит её только при том же идентификаторе и содержимом.
+type Batch struct {
+	ID   string
+	data []byte
+}
+
+func NewBatch(metrics []types.Metrics) (*Batch, error) {
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err = zw.Write(data); err != nil {
+		return nil, fmt.Errorf("failed write data to compress temporary buffer: %v", err)
+	}
+	if err = zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed compress data: %v", err)
+	}
+
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	return &Batch{ID: hex.EncodeToString(id), data: buf.Bytes()}, nil
+}
+
+// Send отправляет батч на url. Отказ из-за данных возвращается как ErrRejected, остальные
+// ошибки (сеть, перегрузка, сбой хранилища или узла кластера) — временные.
+func (b *Batch) Send(client *resty.Client, url string) error {
+	resp, err := client.R().
+		SetHeader("Content-Type", "application/json").
+		SetHeader("Content-Encoding", "gzip").
+		SetHeader(types.BatchIDHeader, b.ID).
+		SetBody(b.data).
+		Post(url)
+	if err != nil {
+		return err
+	}
+	if !resp.IsError() {
+		return nil
+	}
+
+	err = fmt.Errorf("failed to send metric: %s", resp.Status())
+	switch resp.StatusCode() {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return fmt.Errorf("%w: %v", ErrRejected, err)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+func TestBatch_Send(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	var ids []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		var metrics []types.Metrics
+		require.NoError(t, json.NewDecoder(zr).Decode(&metrics))
+		assert.Len(t, metrics, 1)
+
+		ids = append(ids, r.Header.Get(types.BatchIDHeader))
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	d := int64(1)
+	batch, err := NewBatch([]types.Metrics{{ID: "jobs", MType: types.Counter, Delta: &d}})
+	require.NoError(t, err)
+	client := resty.New()
+
+	// Сбой сервера временный, и повтор идёт с тем же идентификатором.
+	err = batch.Send(client, ts.URL)
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrRejected)
+
+	status = http.StatusOK
+	require.NoError(t, batch.Send(client, ts.URL))
+	require.Len(t, ids, 2)
+	assert.NotEmpty(t, ids[0])
+	assert.Equal(t, ids[0], ids[1])
+
+	status = http.StatusBadRequest
+	assert.ErrorIs(t, batch.Send(client, ts.URL), ErrRejected)
+
+	other, err := NewBatch(nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, batch.ID, other.ID)
+}
@@ -0,0 +1,31 @@
+package agent
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Config описывает дополнительные коллекторы агента, загружаемые из JSON-файла.
+type Config struct {
+	Exec []ExecConfig `json:"exec"`
+
+	Tail      []TailConfig `json:"tail"`
+	TailState string       `json:"tail_state"`
+
+	Process  []ProcessConfig `json:"process"`
+	ProcRoot string          `json:"proc_root"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err = json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,351 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+const (
+	FormatAuto   = "auto"
+	FormatSimple = "simple"
+	FormatInflux = "influx"
+
+	defaultExecInterval = 10 * time.Second
+	defaultExecTimeout  = 5 * time.Second
+
+	// execWaitDelay — сколько ждать закрытия вывода после завершения команды.
+	execWaitDelay = time.Second
+)
+
+// ExecConfig описывает одну команду, вывод которой превращается в метрики.
+type ExecConfig struct {
+	Name     string         `json:"name"`
+	Command  []string       `json:"command"`
+	Interval types.Duration `json:"interval"`
+	Timeout  types.Duration `json:"timeout"`
+	Format   string         `json:"format"`
+}
+
+// ExecCollector периодически запускает команды и разбирает их вывод в формате
+// `name type value` или Influx line protocol. Неудачные запуски и таймауты
+// сами становятся метриками с меткой command.
+type ExecCollector struct {
+	logger   *zap.Logger
+	registry *Registry
+	cfgs     []ExecConfig
+}
+
+func NewExecCollector(logger *zap.Logger, registry *Registry, cfgs []ExecConfig) (*ExecCollector, error) {
+	for i := range cfgs {
+		if cfgs[i].Name == "" {
+			return nil, errors.New("exec collector: empty name")
+		}
+		if len(cfgs[i].Command) == 0 {
+			return nil, fmt.Errorf("exec collector %s: empty command", cfgs[i].Name)
+		}
+		if cfgs[i].Interval <= 0 {
+			cfgs[i].Interval = types.Duration(defaultExecInterval)
+		}
+		if cfgs[i].Timeout <= 0 {
+			cfgs[i].Timeout = types.Duration(defaultExecTimeout)
+		}
+		switch cfgs[i].Format {
+		case "":
+			cfgs[i].Format = FormatAuto
+		case FormatAuto, FormatSimple, FormatInflux:
+		default:
+			return nil, fmt.Errorf("exec collector %s: unknown format %q", cfgs[i].Name, cfgs[i].Format)
+		}
+	}
+
+	return &ExecCollector{
+		logger:   logger,
+		registry: registry,
+		cfgs:     cfgs,
+	}, nil
+}
+
+// Start запускает каждую команду на своём интервале и блокируется до отмены контекста.
+func (ec *ExecCollector) Start(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for _, cfg := range ec.cfgs {
+		wg.Add(1)
+		go func(cfg ExecConfig) {
+			defer wg.Done()
+
+			ticker := time.NewTicker(cfg.Interval.Duration())
+			defer ticker.Stop()
+
+			ec.run(ctx, cfg)
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					ec.run(ctx, cfg)
+				}
+			}
+		}(cfg)
+	}
+
+	wg.Wait()
+}
+
+func (ec *ExecCollector) run(ctx context.Context, cfg ExecConfig) {
+	labels := map[string]string{"command": cfg.Name}
+
+	runCtx, cancel := context.WithTimeout(ctx, cfg.Timeout.Duration())
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(runCtx, cfg.Command[0], cfg.Command[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = execWaitDelay
+	setProcessGroup(cmd)
+
+	start := time.Now()
+	err := cmd.Run()
+	ec.registry.SetGauge(types.SeriesID("exec_duration_seconds", labels), time.Since(start).Seconds())
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		ec.logger.Warn("exec collector timed out", zap.String("command", cfg.Name),
+			zap.Duration("timeout", cfg.Timeout.Duration()))
+		ec.registry.AddCounter(types.SeriesID("exec_timeouts", labels), 1)
+		ec.registry.SetGauge(types.SeriesID("exec_success", labels), 0)
+		return
+	}
+
+	if err != nil {
+		ec.logger.Warn("exec collector failed", zap.String("command", cfg.Name),
+			zap.Error(err), zap.String("stderr", strings.TrimSpace(stderr.String())))
+		ec.registry.AddCounter(types.SeriesID("exec_failures", labels), 1)
+		ec.registry.SetGauge(types.SeriesID("exec_success", labels), 0)
+		return
+	}
+
+	metrics, parseErrs := ParseExecOutput(stdout.Bytes(), cfg.Format)
+	for _, perr := range parseErrs {
+		ec.logger.Warn("exec collector parse error", zap.String("command", cfg.Name), zap.Error(perr))
+	}
+	if len(parseErrs) > 0 {
+		ec.registry.AddCounter(types.SeriesID("exec_parse_errors", labels), int64(len(parseErrs)))
+	}
+
+	for _, m := range metrics {
+		switch m.MType {
+		case types.Gauge:
+			ec.registry.SetGauge(m.ID, *m.Value)
+		case types.Counter:
+			ec.registry.AddCounter(m.ID, *m.Delta)
+		}
+	}
+
+	ec.registry.SetGauge(types.SeriesID("exec_success", labels), 1)
+}
+
+// ParseExecOutput разбирает вывод команды построчно. Пустые строки и строки,
+// начинающиеся с #, пропускаются; ошибки разбора не прерывают обработку остальных строк.
+func ParseExecOutput(output []byte, format string) ([]types.Metrics, []error) {
+	var (
+		metrics []types.Metrics
+		errs    []error
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var (
+			parsed []types.Metrics
+			err    error
+		)
+
+		switch format {
+		case FormatSimple:
+			parsed, err = parseSimpleLine(line)
+		case FormatInflux:
+			parsed, err = parseInfluxLine(line)
+		default:
+			if isSimpleLine(line) {
+				parsed, err = parseSimpleLine(line)
+			} else {
+				parsed, err = parseInfluxLine(line)
+			}
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", n, err))
+			continue
+		}
+		metrics = append(metrics, parsed...)
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return metrics, errs
+}
+
+func isSimpleLine(line string) bool {
+	fields := strings.Fields(line)
+	return len(fields) == 3 && (fields[1] == types.Gauge || fields[1] == types.Counter)
+}
+
+// parseSimpleLine разбирает строку вида `name type value`.
+func parseSimpleLine(line string) ([]types.Metrics, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return nil, errors.New("expected `name type value`")
+	}
+
+	name, mtype, value := fields[0], fields[1], fields[2]
+
+	switch mtype {
+	case types.Gauge:
+		fValue, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, err
+		}
+		return []types.Metrics{{ID: name, MType: types.Gauge, Value: &fValue}}, nil
+	case types.Counter:
+		iValue, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return []types.Metrics{{ID: name, MType: types.Counter, Delta: &iValue}}, nil
+	default:
+		return nil, types.ErrUnknownType
+	}
+}
+
+// parseInfluxLine разбирает строку Influx line protocol:
+// measurement[,tag=value...] field=value[,field=value...] [timestamp].
+// Каждое числовое поле становится gauge с именем measurement_field и тегами в качестве меток.
+func parseInfluxLine(line string) ([]types.Metrics, error) {
+	parts := splitUnescaped(line, ' ')
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, errors.New("expected `measurement[,tags] fields [timestamp]`")
+	}
+
+	head := splitUnescaped(parts[0], ',')
+	measurement := unescapeInflux(head[0])
+	if measurement == "" {
+		return nil, errors.New("empty measurement")
+	}
+
+	labels := make(map[string]string, len(head)-1)
+	for _, tag := range head[1:] {
+		kv := splitUnescaped(tag, '=')
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		labels[unescapeInflux(kv[0])] = unescapeInflux(kv[1])
+	}
+
+	var metrics []types.Metrics
+	for _, field := range splitUnescaped(parts[1], ',') {
+		kv := splitUnescaped(field, '=')
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+
+		value, ok, err := parseInfluxValue(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", kv[0], err)
+		}
+		if !ok {
+			continue
+		}
+
+		id := types.SeriesID(measurement+"_"+unescapeInflux(kv[0]), labels)
+		metrics = append(metrics, types.Metrics{ID: id, MType: types.Gauge, Value: &value})
+	}
+
+	if len(metrics) == 0 {
+		return nil, errors.New("no numeric fields")
+	}
+
+	return metrics, nil
+}
+
+// parseInfluxValue возвращает числовое значение поля. Строковые поля пропускаются.
+func parseInfluxValue(raw string) (float64, bool, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		return 0, false, nil
+	case raw == "t" || raw == "T" || raw == "true" || raw == "True" || raw == "TRUE":
+		return 1, true, nil
+	case raw == "f" || raw == "F" || raw == "false" || raw == "False" || raw == "FALSE":
+		return 0, true, nil
+	case strings.HasSuffix(raw, "i") || strings.HasSuffix(raw, "u"):
+		v, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		return float64(v), err == nil, err
+	default:
+		v, err := strconv.ParseFloat(raw, 64)
+		return v, err == nil, err
+	}
+}
+
+// splitUnescaped делит строку по разделителю, пропуская экранированные
+// обратным слэшем символы и содержимое строк в двойных кавычках.
+func splitUnescaped(s string, sep byte) []string {
+	var (
+		parts   []string
+		escaped bool
+		quoted  bool
+		start   int
+	)
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			if sep == ' ' && i == start {
+				start = i + 1
+				continue
+			}
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	if start < len(s) {
+		parts = append(parts, s[start:])
+	}
+
+	return parts
+}
+
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	return strings.NewReplacer(`\ `, ` `, `\,`, `,`, `\=`, `=`, `\\`, `\`).Replace(s)
+}
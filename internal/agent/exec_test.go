@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+func TestParseExecOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		format   string
+		gauges   map[string]float64
+		counters map[string]int64
+		errs     int
+	}{
+		{
+			name:     "simple format",
+			output:   "queue_size gauge 12.5\nprocessed counter 3\n# comment\n\n",
+			format:   FormatSimple,
+			gauges:   map[string]float64{"queue_size": 12.5},
+			counters: map[string]int64{"processed": 3},
+		},
+		{
+			name:   "influx format",
+			output: "disk,host=a,mount=/data used=10i,free=2.5,ro=f,label=\"x y\" 1700000000000000000\n",
+			format: FormatInflux,
+			gauges: map[string]float64{
+				`disk_used{host="a",mount="/data"}`: 10,
+				`disk_free{host="a",mount="/data"}`: 2.5,
+				`disk_ro{host="a",mount="/data"}`:   0,
+			},
+		},
+		{
+			name:   "auto format",
+			output: "a gauge 1\ncpu,core=0 load=0.5\n",
+			format: FormatAuto,
+			gauges: map[string]float64{"a": 1, `cpu_load{core="0"}`: 0.5},
+		},
+		{
+			name:   "escaped influx tag",
+			output: `net,iface=eth\ 0 rx=1`,
+			format: FormatInflux,
+			gauges: map[string]float64{`net_rx{iface="eth 0"}`: 1},
+		},
+		{
+			name:   "bad lines",
+			output: "a gauge x\nb counter 1.5\nc histogram 1\nok gauge 1\n",
+			format: FormatSimple,
+			gauges: map[string]float64{"ok": 1},
+			errs:   3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics, errs := ParseExecOutput([]byte(tt.output), tt.format)
+			assert.Len(t, errs, tt.errs)
+
+			gauges, counters := map[string]float64{}, map[string]int64{}
+			for _, m := range metrics {
+				switch m.MType {
+				case types.Gauge:
+					gauges[m.ID] = *m.Value
+				case types.Counter:
+					counters[m.ID] = *m.Delta
+				}
+			}
+
+			if tt.gauges == nil {
+				tt.gauges = map[string]float64{}
+			}
+			if tt.counters == nil {
+				tt.counters = map[string]int64{}
+			}
+			assert.Equal(t, tt.gauges, gauges)
+			assert.Equal(t, tt.counters, counters)
+		})
+	}
+}
+
+func TestExecCollector_run(t *testing.T) {
+	registry := NewRegistry()
+
+	ec, err := NewExecCollector(zap.NewNop(), registry, []ExecConfig{
+		{Name: "ok", Command: []string{"sh", "-c", "echo 'jobs gauge 7'"}},
+		{Name: "fail", Command: []string{"sh", "-c", "exit 3"}},
+		{Name: "slow", Command: []string{"sh", "-c", "sleep 5; echo 'late gauge 1'"}, Timeout: types.Duration(50 * time.Millisecond)},
+	})
+	require.NoError(t, err)
+
+	start := time.Now()
+	for _, cfg := range ec.cfgs {
+		ec.run(context.Background(), cfg)
+	}
+	assert.Less(t, time.Since(start), 2*time.Second, "timeout must kill the whole process group")
+
+	gauges, counters := map[string]float64{}, map[string]int64{}
+	for _, m := range registry.Collect() {
+		switch m.MType {
+		case types.Gauge:
+			gauges[m.ID] = *m.Value
+		case types.Counter:
+			counters[m.ID] = *m.Delta
+		}
+	}
+
+	assert.Equal(t, float64(7), gauges["jobs"])
+	assert.NotContains(t, gauges, "late")
+	assert.Equal(t, float64(1), gauges[`exec_success{command="ok"}`])
+	assert.Equal(t, float64(0), gauges[`exec_success{command="fail"}`])
+	assert.Equal(t, float64(0), gauges[`exec_success{command="slow"}`])
+	assert.Equal(t, int64(1), counters[`exec_failures{command="fail"}`])
+	assert.Equal(t, int64(1), counters[`exec_timeouts{command="slow"}`])
+
+	for _, m := range registry.Collect() {
+		require.Equal(t, types.Gauge, m.MType, "counters must be drained after collect")
+	}
+}
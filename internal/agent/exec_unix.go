@@ -0,0 +1,17 @@
+//go:build unix
+
+package agent
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup запускает команду в отдельной группе процессов, чтобы по таймауту
+// завершить и её потомков: иначе sh убивается, а дочерний sleep держит stdout открытым.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,302 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+const (
+	defaultProcRoot        = "/proc"
+	defaultProcessInterval = 10 * time.Second
+
+	// clockTicks — значение sysconf(_SC_CLK_TCK), одинаковое на всех поддерживаемых Linux-платформах.
+	clockTicks = 100
+)
+
+// ProcessConfig выбирает процессы по регулярному выражению (по comm и cmdline) или по pid-файлу.
+type ProcessConfig struct {
+	Name     string         `json:"name"`
+	Pattern  string         `json:"pattern"`
+	Pidfile  string         `json:"pidfile"`
+	Interval types.Duration `json:"interval"`
+
+	re *regexp.Regexp
+}
+
+// ProcessCollector снимает CPU, RSS, число открытых дескрипторов и потоков выбранных процессов
+// из /proc/<pid>/stat, /status и /fd. Серии помечаются метками name и pid; серии завершившихся
+// процессов удаляются из реестра.
+type ProcessCollector struct {
+	logger   *zap.Logger
+	registry *Registry
+	cfgs     []ProcessConfig
+	procRoot string
+}
+
+func NewProcessCollector(logger *zap.Logger, registry *Registry, cfgs []ProcessConfig, procRoot string) (*ProcessCollector, error) {
+	for i := range cfgs {
+		if cfgs[i].Name == "" {
+			return nil, errors.New("process collector: empty name")
+		}
+		if (cfgs[i].Pattern == "") == (cfgs[i].Pidfile == "") {
+			return nil, fmt.Errorf("process collector %s: exactly one of pattern or pidfile is required", cfgs[i].Name)
+		}
+		if cfgs[i].Pattern != "" {
+			re, err := regexp.Compile(cfgs[i].Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("process collector %s: %w", cfgs[i].Name, err)
+			}
+			cfgs[i].re = re
+		}
+		if cfgs[i].Interval <= 0 {
+			cfgs[i].Interval = types.Duration(defaultProcessInterval)
+		}
+	}
+
+	if procRoot == "" {
+		procRoot = defaultProcRoot
+	}
+
+	return &ProcessCollector{
+		logger:   logger,
+		registry: registry,
+		cfgs:     cfgs,
+		procRoot: procRoot,
+	}, nil
+}
+
+// Start опрашивает процессы каждой группы на своём интервале и блокируется до отмены контекста.
+func (pc *ProcessCollector) Start(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for _, cfg := range pc.cfgs {
+		wg.Add(1)
+		go func(cfg ProcessConfig) {
+			defer wg.Done()
+
+			w := pc.newWatcher(cfg)
+
+			ticker := time.NewTicker(cfg.Interval.Duration())
+			defer ticker.Stop()
+
+			w.poll(time.Now())
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case now := <-ticker.C:
+					w.poll(now)
+				}
+			}
+		}(cfg)
+	}
+
+	wg.Wait()
+}
+
+type procSample struct {
+	cpu  float64
+	at   time.Time
+	ids  []string
+	comm string
+}
+
+// processWatcher помнит процессы, найденные при прошлом опросе, чтобы считать загрузку CPU
+// и убирать серии исчезнувших процессов.
+type processWatcher struct {
+	pc   *ProcessCollector
+	cfg  ProcessConfig
+	seen map[int]procSample
+}
+
+func (pc *ProcessCollector) newWatcher(cfg ProcessConfig) *processWatcher {
+	return &processWatcher{pc: pc, cfg: cfg, seen: make(map[int]procSample)}
+}
+
+func (w *processWatcher) poll(now time.Time) {
+	pids, err := w.find()
+	if err != nil {
+		w.pc.logger.Warn("process collector: lookup failed", zap.String("name", w.cfg.Name), zap.Error(err))
+	}
+
+	current := make(map[int]procSample, len(pids))
+	for _, pid := range pids {
+		sample, err := w.collect(pid, now)
+		if err != nil {
+			// Процесс мог завершиться между поиском и чтением.
+			w.pc.logger.Debug("process collector: read failed", zap.Int("pid", pid), zap.Error(err))
+			continue
+		}
+		current[pid] = sample
+	}
+
+	for pid, sample := range w.seen {
+		if _, ok := current[pid]; ok {
+			continue
+		}
+		for _, id := range sample.ids {
+			w.pc.registry.Delete(id)
+		}
+	}
+	w.seen = current
+
+	w.pc.registry.SetGauge(types.SeriesID("process_count", map[string]string{"name": w.cfg.Name}), float64(len(current)))
+}
+
+func (w *processWatcher) find() ([]int, error) {
+	if w.cfg.Pidfile != "" {
+		data, err := os.ReadFile(w.cfg.Pidfile)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pidfile %s: %w", w.cfg.Pidfile, err)
+		}
+		if _, err = os.Stat(filepath.Join(w.pc.procRoot, strconv.Itoa(pid))); err != nil {
+			return nil, nil
+		}
+		return []int{pid}, nil
+	}
+
+	entries, err := os.ReadDir(w.pc.procRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	self := os.Getpid()
+	var pids []int
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || pid == self {
+			continue
+		}
+
+		dir := filepath.Join(w.pc.procRoot, e.Name())
+		comm, _ := os.ReadFile(filepath.Join(dir, "comm"))
+		cmdline, _ := os.ReadFile(filepath.Join(dir, "cmdline"))
+		cmd := strings.TrimSpace(string(bytes.ReplaceAll(cmdline, []byte{0}, []byte{' '})))
+
+		if w.cfg.re.MatchString(strings.TrimSpace(string(comm))) || (cmd != "" && w.cfg.re.MatchString(cmd)) {
+			pids = append(pids, pid)
+		}
+	}
+
+	return pids, nil
+}
+
+func (w *processWatcher) collect(pid int, now time.Time) (procSample, error) {
+	dir := filepath.Join(w.pc.procRoot, strconv.Itoa(pid))
+
+	comm, cpu, err := readProcStat(filepath.Join(dir, "stat"))
+	if err != nil {
+		return procSample{}, err
+	}
+	status, err := readProcStatus(filepath.Join(dir, "status"))
+	if err != nil {
+		return procSample{}, err
+	}
+
+	labels := map[string]string{"name": w.cfg.Name, "pid": strconv.Itoa(pid)}
+	sample := procSample{cpu: cpu, at: now, comm: comm}
+
+	set := func(name string, value float64) {
+		id := types.SeriesID(name, labels)
+		w.pc.registry.SetGauge(id, value)
+		sample.ids = append(sample.ids, id)
+	}
+
+	set("process_cpu_seconds", cpu)
+	// Процесс с тем же pid, но другим comm — это уже другой процесс, загрузку считаем заново.
+	if prev, ok := w.seen[pid]; ok && prev.comm == comm && now.After(prev.at) && cpu >= prev.cpu {
+		set("process_cpu_percent", (cpu-prev.cpu)/now.Sub(prev.at).Seconds()*100)
+	}
+	if rss, ok := status["VmRSS"]; ok {
+		set("process_rss_bytes", rss*1024)
+	}
+	if threads, ok := status["Threads"]; ok {
+		set("process_threads", threads)
+	}
+	if fds, err := os.ReadDir(filepath.Join(dir, "fd")); err == nil {
+		set("process_open_fds", float64(len(fds)))
+	}
+
+	return sample, nil
+}
+
+// readProcStat возвращает comm и суммарное процессорное время (utime+stime) в секундах.
+func readProcStat(path string) (string, float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", 0, err
+	}
+
+	// comm может содержать пробелы и скобки, поэтому ищем последнюю закрывающую скобку.
+	open, end := bytes.IndexByte(data, '('), bytes.LastIndexByte(data, ')')
+	if open < 0 || end < open {
+		return "", 0, fmt.Errorf("malformed %s", path)
+	}
+
+	fields := strings.Fields(string(data[end+1:]))
+	// После comm идут поля начиная с state (3); utime и stime — поля 14 и 15.
+	if len(fields) < 13 {
+		return "", 0, fmt.Errorf("malformed %s", path)
+	}
+
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return string(data[open+1 : end]), float64(utime+stime) / clockTicks, nil
+}
+
+// readProcStatus возвращает числовые поля /proc/<pid>/status (значения в kB без единиц).
+func readProcStatus(path string) (map[string]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fields := make(map[string]float64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		parts := strings.Fields(value)
+		if len(parts) == 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			continue
+		}
+		fields[key] = v
+	}
+
+	return fields, scanner.Err()
+}
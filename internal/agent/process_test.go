@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func writeFakeProc(t *testing.T, root string, pid int, comm string, ticks int, rssKB int, fds int) {
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "fd"), 0755))
+
+	stat := strconv.Itoa(pid) + " (" + comm + ") S 1 1 1 0 -1 4194560 100 0 0 0 " +
+		strconv.Itoa(ticks) + " " + strconv.Itoa(ticks) + " 0 0 20 0 3 0 100 0 0\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0644))
+
+	status := "Name:\t" + comm + "\nVmRSS:\t" + strconv.Itoa(rssKB) + " kB\nThreads:\t3\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "status"), []byte(status), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "comm"), []byte(comm+"\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cmdline"), []byte("/usr/sbin/"+comm+"\x00-g\x00daemon off;"), 0644))
+
+	for i := 0; i < fds; i++ {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "fd", strconv.Itoa(i)), nil, 0644))
+	}
+}
+
+func TestProcessCollector_poll(t *testing.T) {
+	root := t.TempDir()
+	writeFakeProc(t, root, 100, "nginx", 50, 2048, 4)
+	writeFakeProc(t, root, 200, "nginx: worker", 10, 1024, 2)
+	writeFakeProc(t, root, 300, "postgres", 10, 1024, 2)
+
+	registry := NewRegistry()
+	pc, err := NewProcessCollector(zap.NewNop(), registry, []ProcessConfig{{Name: "nginx", Pattern: "^nginx"}}, root)
+	require.NoError(t, err)
+
+	w := pc.newWatcher(pc.cfgs[0])
+	start := time.Now()
+	w.poll(start)
+
+	gauges, _ := collectValues(registry)
+	assert.Equal(t, float64(2), gauges[`process_count{name="nginx"}`])
+	assert.Equal(t, float64(1), gauges[`process_cpu_seconds{name="nginx",pid="100"}`])
+	assert.Equal(t, float64(2048*1024), gauges[`process_rss_bytes{name="nginx",pid="100"}`])
+	assert.Equal(t, float64(3), gauges[`process_threads{name="nginx",pid="100"}`])
+	assert.Equal(t, float64(4), gauges[`process_open_fds{name="nginx",pid="100"}`])
+	assert.NotContains(t, gauges, `process_rss_bytes{name="nginx",pid="300"}`)
+
+	// Процесс 200 завершился, процесс 100 потратил ещё секунду CPU за 10 секунд.
+	require.NoError(t, os.RemoveAll(filepath.Join(root, "200")))
+	writeFakeProc(t, root, 100, "nginx", 100, 2048, 4)
+	w.poll(start.Add(10 * time.Second))
+
+	gauges, _ = collectValues(registry)
+	assert.Equal(t, float64(1), gauges[`process_count{name="nginx"}`])
+	assert.InDelta(t, 10, gauges[`process_cpu_percent{name="nginx",pid="100"}`], 0.001)
+	for id := range gauges {
+		assert.NotContains(t, id, `pid="200"`)
+	}
+}
+
+func TestProcessCollector_pidfile(t *testing.T) {
+	root := t.TempDir()
+	writeFakeProc(t, root, 42, "redis-server", 10, 512, 1)
+
+	pidfile := filepath.Join(t.TempDir(), "redis.pid")
+	require.NoError(t, os.WriteFile(pidfile, []byte("42\n"), 0644))
+
+	registry := NewRegistry()
+	pc, err := NewProcessCollector(zap.NewNop(), registry, []ProcessConfig{{Name: "redis", Pidfile: pidfile}}, root)
+	require.NoError(t, err)
+
+	w := pc.newWatcher(pc.cfgs[0])
+	w.poll(time.Now())
+
+	gauges, _ := collectValues(registry)
+	assert.Equal(t, float64(512*1024), gauges[`process_rss_bytes{name="redis",pid="42"}`])
+
+	require.NoError(t, os.Remove(pidfile))
+	w.poll(time.Now())
+
+	gauges, _ = collectValues(registry)
+	assert.Equal(t, map[string]float64{`process_count{name="redis"}`: 0}, gauges)
+}
+
+func TestReadProcStat_CommWithParens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stat")
+	require.NoError(t, os.WriteFile(path,
+		[]byte("7 (weird) name) R 1 1 1 0 -1 0 0 0 0 0 250 50 0 0 20 0 1 0 1 0 0\n"), 0644))
+
+	comm, cpu, err := readProcStat(path)
+	require.NoError(t, err)
+	assert.Equal(t, "weird) name", comm)
+	assert.Equal(t, float64(3), cpu)
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"sync"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+// Registry накапливает метрики, которые коллекторы собирают в своих горутинах,
+// до очередной отправки на сервер.
+type Registry struct {
+	mu       sync.Mutex
+	gauges   map[string]float64
+	counters map[string]int64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		gauges:   make(map[string]float64),
+		counters: make(map[string]int64),
+	}
+}
+
+func (r *Registry) SetGauge(id string, value float64) {
+	r.mu.Lock()
+	r.gauges[id] = value
+	r.mu.Unlock()
+}
+
+func (r *Registry) AddCounter(id string, delta int64) {
+	r.mu.Lock()
+	r.counters[id] += delta
+	r.mu.Unlock()
+}
+
+// Delete убирает серию, которая больше не должна отправляться.
+func (r *Registry) Delete(id string) {
+	r.mu.Lock()
+	delete(r.gauges, id)
+	delete(r.counters, id)
+	r.mu.Unlock()
+}
+
+// Collect возвращает текущие значения gauge и накопленные с прошлого вызова приращения counter.
+// Счётчики после вызова обнуляются, поэтому на сервер уходят именно дельты.
+func (r *Registry) Collect() []types.Metrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	metrics := make([]types.Metrics, 0, len(r.gauges)+len(r.counters))
+
+	for k, v := range r.gauges {
+		value := v
+		metrics = append(metrics, types.Metrics{ID: k, MType: types.Gauge, Value: &value})
+	}
+
+	for k, v := range r.counters {
+		delta := v
+		metrics = append(metrics, types.Metrics{ID: k, MType: types.Counter, Delta: &delta})
+	}
+	r.counters = make(map[string]int64)
+
+	return metrics
+}
@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+// collectValues раскладывает собранные метрики по типам.
+func collectValues(r *Registry) (map[string]float64, map[string]int64) {
+	gauges, counters := map[string]float64{}, map[string]int64{}
+	for _, m := range r.Collect() {
+		switch m.MType {
+		case types.Gauge:
+			gauges[m.ID] = *m.Value
+		case types.Counter:
+			counters[m.ID] = *m.Delta
+		}
+	}
+	return gauges, counters
+}
+
+func TestRegistry_Collect(t *testing.T) {
+	registry := NewRegistry()
+	registry.SetGauge("load", 1)
+	registry.AddCounter("jobs", 2)
+	registry.AddCounter("jobs", 3)
+
+	gauges, counters := collectValues(registry)
+	assert.Equal(t, map[string]float64{"load": 1}, gauges)
+	assert.Equal(t, map[string]int64{"jobs": 5}, counters)
+
+	// Приращения уходят один раз, gauge остаётся последним значением.
+	gauges, counters = collectValues(registry)
+	assert.Equal(t, map[string]float64{"load": 1}, gauges)
+	assert.Empty(t, counters)
+}
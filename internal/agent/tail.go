@@ -0,0 +1,409 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+const (
+	defaultTailInterval = time.Second
+
+	// fingerprintSize — сколько байт из начала файла используется, чтобы узнать файл после рестарта.
+	fingerprintSize = 512
+	// maxLineSize ограничивает недочитанный хвост строки, если в файл пишут без переводов строк.
+	maxLineSize = 64 * 1024
+)
+
+// TailConfig описывает файл, за которым следит коллектор, и правила разбора его строк.
+type TailConfig struct {
+	Path      string         `json:"path"`
+	Interval  types.Duration `json:"interval"`
+	FromStart bool           `json:"from_start"`
+	Rules     []TailRule     `json:"rules"`
+}
+
+// TailRule превращает совпадения регулярного выражения в метрику. Для counter без Value
+// каждое совпадение увеличивает счётчик на 1, иначе значение берётся из именованной группы Value.
+// Остальные именованные группы становятся метками серии.
+type TailRule struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Pattern string `json:"pattern"`
+	Value   string `json:"value"`
+
+	re *regexp.Regexp
+}
+
+type tailOffset struct {
+	Offset      int64  `json:"offset"`
+	Fingerprint uint32 `json:"fingerprint"`
+	HeadSize    int    `json:"head_size"`
+	// Discarding — позиция внутри слишком длинной строки, остаток которой пропускается.
+	Discarding bool `json:"discarding,omitempty"`
+}
+
+// TailCollector читает дописываемые в файлы строки, переживая ротацию и усечение файлов.
+// Позиции чтения сохраняются в statePath, чтобы после рестарта агента не пересчитывать строки.
+type TailCollector struct {
+	logger    *zap.Logger
+	registry  *Registry
+	cfgs      []TailConfig
+	statePath string
+
+	mu      sync.Mutex
+	offsets map[string]tailOffset
+}
+
+func NewTailCollector(logger *zap.Logger, registry *Registry, cfgs []TailConfig, statePath string) (*TailCollector, error) {
+	for i := range cfgs {
+		if cfgs[i].Path == "" {
+			return nil, errors.New("tail collector: empty path")
+		}
+		if cfgs[i].Interval <= 0 {
+			cfgs[i].Interval = types.Duration(defaultTailInterval)
+		}
+		for j := range cfgs[i].Rules {
+			rule := &cfgs[i].Rules[j]
+			if rule.Name == "" {
+				return nil, fmt.Errorf("tail collector %s: empty rule name", cfgs[i].Path)
+			}
+
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("tail collector %s: rule %s: %w", cfgs[i].Path, rule.Name, err)
+			}
+			rule.re = re
+
+			switch rule.Type {
+			case types.Counter:
+			case types.Gauge:
+				if rule.Value == "" {
+					return nil, fmt.Errorf("tail collector %s: gauge rule %s requires value group", cfgs[i].Path, rule.Name)
+				}
+			default:
+				return nil, fmt.Errorf("tail collector %s: rule %s: %w", cfgs[i].Path, rule.Name, types.ErrUnknownType)
+			}
+			if rule.Value != "" && re.SubexpIndex(rule.Value) < 0 {
+				return nil, fmt.Errorf("tail collector %s: rule %s: no group %q", cfgs[i].Path, rule.Name, rule.Value)
+			}
+		}
+	}
+
+	tc := &TailCollector{
+		logger:    logger,
+		registry:  registry,
+		cfgs:      cfgs,
+		statePath: statePath,
+		offsets:   make(map[string]tailOffset),
+	}
+
+	if statePath != "" {
+		data, err := os.ReadFile(statePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err = json.Unmarshal(data, &tc.offsets); err != nil {
+				logger.Error("failed to read tail offsets, starting over", zap.Error(err))
+				tc.offsets = make(map[string]tailOffset)
+			}
+		}
+	}
+
+	return tc, nil
+}
+
+// Start следит за всеми файлами и блокируется до отмены контекста.
+func (tc *TailCollector) Start(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for _, cfg := range tc.cfgs {
+		wg.Add(1)
+		go func(cfg TailConfig) {
+			defer wg.Done()
+
+			t := &tailer{tc: tc, cfg: cfg}
+			defer t.close()
+
+			ticker := time.NewTicker(cfg.Interval.Duration())
+			defer ticker.Stop()
+
+			t.poll()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					t.poll()
+				}
+			}
+		}(cfg)
+	}
+
+	wg.Wait()
+}
+
+func (tc *TailCollector) handleLine(cfg TailConfig, line []byte) {
+	for _, rule := range cfg.Rules {
+		match := rule.re.FindSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		labels := make(map[string]string)
+		var raw string
+		for i, group := range rule.re.SubexpNames() {
+			if group == "" || match[i] == nil {
+				continue
+			}
+			if group == rule.Value {
+				raw = string(match[i])
+				continue
+			}
+			labels[group] = string(match[i])
+		}
+		id := types.SeriesID(rule.Name, labels)
+
+		switch rule.Type {
+		case types.Counter:
+			if rule.Value == "" {
+				tc.registry.AddCounter(id, 1)
+				continue
+			}
+			delta, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				tc.logger.Debug("tail collector: bad counter value", zap.String("rule", rule.Name), zap.Error(err))
+				continue
+			}
+			tc.registry.AddCounter(id, delta)
+		case types.Gauge:
+			value, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				tc.logger.Debug("tail collector: bad gauge value", zap.String("rule", rule.Name), zap.Error(err))
+				continue
+			}
+			tc.registry.SetGauge(id, value)
+		}
+	}
+}
+
+func (tc *TailCollector) offset(path string) (tailOffset, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	off, ok := tc.offsets[path]
+	return off, ok
+}
+
+func (tc *TailCollector) saveOffset(path string, off tailOffset) {
+	if tc.statePath == "" {
+		return
+	}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	if tc.offsets[path] == off {
+		return
+	}
+	tc.offsets[path] = off
+
+	data, err := json.Marshal(tc.offsets)
+	if err != nil {
+		tc.logger.Error("failed to marshal tail offsets", zap.Error(err))
+		return
+	}
+
+	tmp := tc.statePath + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		tc.logger.Error("failed to save tail offsets", zap.Error(err))
+		return
+	}
+	if err = os.Rename(tmp, tc.statePath); err != nil {
+		tc.logger.Error("failed to save tail offsets", zap.Error(err))
+	}
+}
+
+// tailer хранит состояние чтения одного файла; используется только из своей горутины.
+type tailer struct {
+	tc  *TailCollector
+	cfg TailConfig
+
+	file    *os.File
+	info    os.FileInfo
+	offset  int64
+	partial []byte
+	// discarding — строка превысила maxLineSize, и её остаток до перевода строки пропускается.
+	discarding bool
+	started    bool
+}
+
+func (t *tailer) poll() {
+	if t.file == nil && !t.open() {
+		return
+	}
+
+	info, err := t.file.Stat()
+	if err != nil {
+		t.tc.logger.Warn("tail collector: stat failed", zap.String("path", t.cfg.Path), zap.Error(err))
+		t.close()
+		return
+	}
+
+	if info.Size() < t.offset {
+		t.tc.logger.Info("tail collector: file truncated", zap.String("path", t.cfg.Path))
+		t.offset = 0
+		t.partial, t.discarding = nil, false
+	}
+
+	t.read()
+
+	current, err := os.Stat(t.cfg.Path)
+	if err == nil && !os.SameFile(t.info, current) {
+		t.tc.logger.Info("tail collector: file rotated", zap.String("path", t.cfg.Path))
+		t.close()
+		if t.open() {
+			t.read()
+		}
+	}
+
+	t.persist()
+}
+
+// open открывает файл и выбирает позицию чтения: сохранённую, если файл тот же,
+// конец файла при первом запуске и начало файла после ротации.
+func (t *tailer) open() bool {
+	f, err := os.Open(filepath.Clean(t.cfg.Path))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// Файл, появившийся уже после старта агента, читаем с начала.
+			t.started = true
+		} else {
+			t.tc.logger.Warn("tail collector: open failed", zap.String("path", t.cfg.Path), zap.Error(err))
+		}
+		return false
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return false
+	}
+
+	t.file, t.info, t.offset, t.partial, t.discarding = f, info, 0, nil, false
+
+	if !t.started {
+		t.started = true
+
+		saved, ok := t.tc.offset(t.cfg.Path)
+		switch {
+		case ok && saved.Offset <= info.Size() && t.matches(saved):
+			t.offset, t.discarding = saved.Offset, saved.Discarding
+		case ok:
+			// Файл сменился, пока агент не работал — читаем новый целиком.
+		case !t.cfg.FromStart:
+			t.offset = info.Size()
+		}
+	}
+
+	return true
+}
+
+func (t *tailer) matches(saved tailOffset) bool {
+	sum, size := t.fingerprint(saved.HeadSize)
+	return size == saved.HeadSize && sum == saved.Fingerprint
+}
+
+// fingerprint считает контрольную сумму первых limit байт файла.
+func (t *tailer) fingerprint(limit int) (uint32, int) {
+	head := make([]byte, limit)
+	n, err := t.file.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, 0
+	}
+	return crc32.ChecksumIEEE(head[:n]), n
+}
+
+func (t *tailer) read() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := t.file.ReadAt(buf, t.offset)
+		if n > 0 {
+			t.offset += int64(n)
+			t.consume(buf[:n])
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				t.tc.logger.Warn("tail collector: read failed", zap.String("path", t.cfg.Path), zap.Error(err))
+			}
+			return
+		}
+	}
+}
+
+func (t *tailer) consume(data []byte) {
+	for len(data) > 0 {
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			if t.discarding {
+				return
+			}
+			t.partial = append(t.partial, data...)
+			if len(t.partial) > maxLineSize {
+				t.tc.logger.Warn("tail collector: line too long, skipping it", zap.String("path", t.cfg.Path), zap.Int("limit", maxLineSize))
+				t.partial, t.discarding = t.partial[:0], true
+			}
+			return
+		}
+
+		if t.discarding {
+			t.discarding = false
+			data = data[idx+1:]
+			continue
+		}
+
+		line := data[:idx]
+		if len(t.partial) > 0 {
+			line = append(t.partial, line...)
+			t.partial = t.partial[:0]
+		}
+		t.tc.handleLine(t.cfg, bytes.TrimRight(line, "\r"))
+
+		data = data[idx+1:]
+	}
+}
+
+// persist сохраняет позицию начала недочитанной строки, чтобы после рестарта дочитать её целиком.
+func (t *tailer) persist() {
+	if t.file == nil {
+		return
+	}
+	sum, size := t.fingerprint(fingerprintSize)
+	t.tc.saveOffset(t.cfg.Path, tailOffset{
+		Offset:      t.offset - int64(len(t.partial)),
+		Fingerprint: sum,
+		HeadSize:    size,
+		Discarding:  t.discarding,
+	})
+}
+
+func (t *tailer) close() {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
@@ -0,0 +1,122 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+func appendFile(t *testing.T, path, data string) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(data)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func newTestTailCollector(t *testing.T, registry *Registry, path, state string) *TailCollector {
+	tc, err := NewTailCollector(zap.NewNop(), registry, []TailConfig{{
+		Path:      path,
+		FromStart: true,
+		Rules: []TailRule{
+			{Name: "log_errors", Type: types.Counter, Pattern: `ERROR`},
+			{Name: "nginx_request_time", Type: types.Gauge, Pattern: `"(?P<method>[A-Z]+) [^"]*" (?P<status>\d+) rt=(?P<rt>[0-9.]+)`, Value: "rt"},
+		},
+	}}, state)
+	require.NoError(t, err)
+	return tc
+}
+
+func TestTailCollector(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	state := filepath.Join(dir, "offsets.json")
+
+	registry := NewRegistry()
+	tc := newTestTailCollector(t, registry, path, state)
+	tl := &tailer{tc: tc, cfg: tc.cfgs[0]}
+
+	// Файла ещё нет.
+	tl.poll()
+
+	appendFile(t, path, "INFO ok\nERROR boom\n\"GET /api\" 200 rt=0.25\nERROR par")
+	tl.poll()
+
+	gauges, counters := collectValues(registry)
+	assert.Equal(t, int64(1), counters["log_errors"])
+	assert.Equal(t, 0.25, gauges[`nginx_request_time{method="GET",status="200"}`])
+
+	// Дописываем вторую половину строки.
+	appendFile(t, path, "tial\n")
+	tl.poll()
+	_, counters = collectValues(registry)
+	assert.Equal(t, int64(1), counters["log_errors"])
+
+	// Ротация: старый файл переименован, пишется новый.
+	appendFile(t, path, "ERROR before rotate\n")
+	require.NoError(t, os.Rename(path, path+".1"))
+	appendFile(t, path, "ERROR after rotate\n")
+	tl.poll()
+	_, counters = collectValues(registry)
+	assert.Equal(t, int64(2), counters["log_errors"])
+
+	// Усечение.
+	require.NoError(t, os.Truncate(path, 0))
+	tl.poll()
+	appendFile(t, path, "ERROR after truncate\n")
+	tl.poll()
+	_, counters = collectValues(registry)
+	assert.Equal(t, int64(1), counters["log_errors"])
+	tl.close()
+
+	// Рестарт: сохранённая позиция не даёт пересчитать старые строки.
+	appendFile(t, path, "ERROR while stopped\n")
+	registry = NewRegistry()
+	tc = newTestTailCollector(t, registry, path, state)
+	tl = &tailer{tc: tc, cfg: tc.cfgs[0]}
+	tl.poll()
+	_, counters = collectValues(registry)
+	assert.Equal(t, int64(1), counters["log_errors"])
+	tl.close()
+}
+
+func TestTailCollector_LongLine(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	registry := NewRegistry()
+	tc := newTestTailCollector(t, registry, path, filepath.Join(dir, "state.json"))
+	tl := &tailer{tc: tc, cfg: tc.cfgs[0]}
+	defer tl.close()
+
+	// Строка длиннее maxLineSize приходит за два чтения: её хвост не считается отдельной строкой.
+	tl.consume([]byte("INFO " + strings.Repeat("x", maxLineSize)))
+	tl.consume([]byte("ERROR in the tail of a long line\nERROR real\n"))
+
+	_, counters := collectValues(registry)
+	assert.Equal(t, int64(1), counters["log_errors"])
+}
+
+func TestNewTailCollector_InvalidRules(t *testing.T) {
+	tests := []struct {
+		name string
+		rule TailRule
+	}{
+		{name: "bad regexp", rule: TailRule{Name: "a", Type: types.Counter, Pattern: "("}},
+		{name: "gauge without value", rule: TailRule{Name: "a", Type: types.Gauge, Pattern: "x"}},
+		{name: "unknown value group", rule: TailRule{Name: "a", Type: types.Gauge, Pattern: "(?P<v>x)", Value: "w"}},
+		{name: "unknown type", rule: TailRule{Name: "a", Type: "histogram", Pattern: "x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTailCollector(zap.NewNop(), NewRegistry(), []TailConfig{{Path: "x", Rules: []TailRule{tt.rule}}}, "")
+			assert.Error(t, err)
+		})
+	}
+}
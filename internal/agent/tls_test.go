@@ -0,0 +1,105 @@
+package agent
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeClientCert выпускает самоподписанный клиентский сертификат; сервер доверяет ему
+// напрямую, как собственному CA.
+func writeClientCert(t *testing.T, dir, cn string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	certPath, keyPath := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	return cert, certPath, keyPath
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, certPath, keyPath := writeClientCert(t, dir, "agent-dc1")
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.StartTLS()
+	defer ts.Close()
+
+	caPath := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600))
+
+	cfg := TLSConfig{CAFile: caPath, CertFile: certPath, KeyFile: keyPath}
+	require.True(t, cfg.Enabled())
+	tlsCfg, err := NewTLSConfig(cfg)
+	require.NoError(t, err)
+
+	resp, err := resty.New().SetTLSClientConfig(tlsCfg).R().Get(ServerURL(ts.Listener.Addr().String(), "/", cfg.Enabled()))
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode())
+	assert.Equal(t, "agent-dc1", resp.String())
+
+	// Без CA агент не доверяет сертификату сервера.
+	tlsCfg, err = NewTLSConfig(TLSConfig{CertFile: certPath, KeyFile: keyPath})
+	require.NoError(t, err)
+	_, err = resty.New().SetTLSClientConfig(tlsCfg).R().Get(ts.URL)
+	assert.Error(t, err)
+
+	_, err = NewTLSConfig(TLSConfig{CertFile: certPath})
+	assert.Error(t, err)
+	_, err = NewTLSConfig(TLSConfig{CAFile: keyPath})
+	assert.Error(t, err)
+}
+
+func TestServerURL(t *testing.T) {
+	tests := []struct {
+		addr   string
+		secure bool
+		want   string
+	}{
+		{addr: "localhost:8080", want: "http://localhost:8080/updates/"},
+		{addr: "localhost:8080", secure: true, want: "https://localhost:8080/updates/"},
+		{addr: "https://metrics.example.com/", want: "https://metrics.example.com/updates/"},
+		{addr: "http://localhost:8080", secure: true, want: "http://localhost:8080/updates/"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, ServerURL(tt.addr, "/updates/", tt.secure))
+	}
+}
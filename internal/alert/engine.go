@@ -0,0 +1,268 @@
+package alert
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+const (
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+
+	// resolvedRetention — сколько времени разрешённый алерт остаётся в списке /alerts.
+	resolvedRetention = 15 * time.Minute
+)
+
+// Source — часть хранилища метрик, нужная движку для вычисления правил.
+type Source interface {
+	GetMetric(context.Context, string) map[string]string
+}
+
+// Notifier получает полный список алертов после каждого вычисления правил.
+type Notifier interface {
+	Notify(ctx context.Context, alerts []Alert, now time.Time)
+}
+
+type Alert struct {
+	Rule        string            `json:"rule"`
+	State       string            `json:"state"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Value       *float64          `json:"value,omitempty"`
+	ActiveAt    time.Time         `json:"active_at"`
+	FiredAt     *time.Time        `json:"fired_at,omitempty"`
+	ResolvedAt  *time.Time        `json:"resolved_at,omitempty"`
+}
+
+// Engine периодически вычисляет правила по хранилищу и ведёт состояние алертов:
+// условие выполнено — pending, выполняется дольше For — firing, перестало выполняться — resolved.
+type Engine struct {
+	logger   *zap.Logger
+	source   Source
+	rules    []Rule
+	interval time.Duration
+
+	notifiers []Notifier
+
+	mu     sync.RWMutex
+	alerts map[string]*Alert
+}
+
+func NewEngine(logger *zap.Logger, source Source, rules []Rule, interval time.Duration) *Engine {
+	return &Engine{
+		logger:   logger,
+		source:   source,
+		rules:    rules,
+		interval: interval,
+		alerts:   make(map[string]*Alert),
+	}
+}
+
+// AddNotifier подписывает получателя на результаты вычисления правил. Вызывать до Start.
+func (e *Engine) AddNotifier(n Notifier) {
+	e.notifiers = append(e.notifiers, n)
+}
+
+// Start вычисляет правила раз в интервал. Каждый получатель уведомлений работает в своей
+// горутине и получает последний список алертов: медленный webhook не задерживает вычисление
+// правил, а пропущенные промежуточные списки ему не нужны.
+func (e *Engine) Start(ctx context.Context) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	queues := make([]chan update, len(e.notifiers))
+	for i, n := range e.notifiers {
+		queues[i] = make(chan update, 1)
+		wg.Add(1)
+		go func(n Notifier, q <-chan update) {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case u := <-q:
+					n.Notify(ctx, u.alerts, u.now)
+				}
+			}
+		}(n, queues[i])
+	}
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			e.Eval(ctx, now)
+
+			u := update{alerts: e.Alerts(), now: now}
+			for _, q := range queues {
+				// Получатель ещё не забрал прошлый список — заменяем его новым.
+				select {
+				case <-q:
+				default:
+				}
+				q <- u
+			}
+		}
+	}
+}
+
+type update struct {
+	alerts []Alert
+	now    time.Time
+}
+
+// Alerts возвращает копию текущих алертов, упорядоченную по правилу и меткам.
+func (e *Engine) Alerts() []Alert {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	keys := make([]string, 0, len(e.alerts))
+	for k := range e.alerts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	res := make([]Alert, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, *e.alerts[k])
+	}
+
+	return res
+}
+
+// Eval вычисляет все правила на момент now.
+func (e *Engine) Eval(ctx context.Context, now time.Time) {
+	series := map[string]map[string]string{
+		types.Gauge:   e.source.GetMetric(ctx, types.Gauge),
+		types.Counter: e.source.GetMetric(ctx, types.Counter),
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	active := make(map[string]struct{})
+
+	for _, rule := range e.rules {
+		for _, hit := range e.evalRule(rule, series[rule.Type]) {
+			key := types.SeriesID(rule.Name, hit.labels)
+			active[key] = struct{}{}
+
+			a, ok := e.alerts[key]
+			if !ok || a.State == StateResolved {
+				a = &Alert{
+					Rule:        rule.Name,
+					State:       StatePending,
+					Labels:      hit.labels,
+					Annotations: rule.Annotations,
+					ActiveAt:    now,
+				}
+				e.alerts[key] = a
+			}
+			a.Value = hit.value
+
+			if a.State == StatePending && now.Sub(a.ActiveAt) >= rule.For.Duration() {
+				firedAt := now
+				a.State = StateFiring
+				a.FiredAt = &firedAt
+				e.logger.Info("alert firing", zap.String("alert", key))
+			}
+		}
+	}
+
+	for key, a := range e.alerts {
+		if _, ok := active[key]; ok {
+			continue
+		}
+
+		switch a.State {
+		case StatePending:
+			delete(e.alerts, key)
+		case StateFiring:
+			resolvedAt := now
+			a.State = StateResolved
+			a.ResolvedAt = &resolvedAt
+			e.logger.Info("alert resolved", zap.String("alert", key))
+		case StateResolved:
+			if now.Sub(*a.ResolvedAt) > resolvedRetention {
+				delete(e.alerts, key)
+			}
+		}
+	}
+}
+
+type hit struct {
+	labels map[string]string
+	value  *float64
+}
+
+func (e *Engine) evalRule(rule Rule, metrics map[string]string) []hit {
+	var (
+		hits    []hit
+		matched bool
+	)
+
+	for id, raw := range metrics {
+		name, labels, err := types.ParseSeriesID(id)
+		if err != nil || name != rule.Metric || !matchLabels(labels, rule.Match) {
+			continue
+		}
+		matched = true
+
+		if rule.Kind != KindThreshold {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			e.logger.Warn("failed to parse metric value", zap.String("id", id), zap.Error(err))
+			continue
+		}
+		if !operators[rule.Op](value, rule.Threshold) {
+			continue
+		}
+
+		hits = append(hits, hit{labels: alertLabels(rule, labels), value: &value})
+	}
+
+	if rule.Kind == KindAbsent && !matched {
+		hits = append(hits, hit{labels: alertLabels(rule, rule.Match)})
+	}
+
+	return hits
+}
+
+func matchLabels(labels, match map[string]string) bool {
+	for k, v := range match {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// alertLabels объединяет метки серии и правила; alertname и metric добавляются всегда.
+func alertLabels(rule Rule, series map[string]string) map[string]string {
+	labels := make(map[string]string, len(series)+len(rule.Labels)+2)
+	for k, v := range series {
+		labels[k] = v
+	}
+	for k, v := range rule.Labels {
+		labels[k] = v
+	}
+	labels["alertname"] = rule.Name
+	labels["metric"] = rule.Metric
+
+	return labels
+}
@@ -0,0 +1,192 @@
+package alert
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+type fakeSource map[string]map[string]string
+
+func (fs fakeSource) GetMetric(_ context.Context, mtype string) map[string]string {
+	return fs[mtype]
+}
+
+func TestEngine_Threshold(t *testing.T) {
+	source := fakeSource{types.Gauge: {"HeapAlloc": "100"}}
+	rules := []Rule{{
+		Name:      "HighHeap",
+		Kind:      KindThreshold,
+		Metric:    "HeapAlloc",
+		Type:      types.Gauge,
+		Op:        ">",
+		Threshold: 1000,
+		For:       types.Duration(time.Minute),
+		Labels:    map[string]string{"severity": "page"},
+	}}
+
+	e := NewEngine(zap.NewNop(), source, rules, time.Second)
+	start := time.Now()
+
+	e.Eval(context.Background(), start)
+	assert.Empty(t, e.Alerts())
+
+	source[types.Gauge]["HeapAlloc"] = "2000"
+	e.Eval(context.Background(), start.Add(time.Second))
+	alerts := e.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StatePending, alerts[0].State)
+	assert.Equal(t, map[string]string{"alertname": "HighHeap", "metric": "HeapAlloc", "severity": "page"}, alerts[0].Labels)
+	assert.Equal(t, float64(2000), *alerts[0].Value)
+
+	e.Eval(context.Background(), start.Add(time.Minute+time.Second))
+	alerts = e.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StateFiring, alerts[0].State)
+	require.NotNil(t, alerts[0].FiredAt)
+
+	source[types.Gauge]["HeapAlloc"] = "10"
+	e.Eval(context.Background(), start.Add(2*time.Minute))
+	alerts = e.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StateResolved, alerts[0].State)
+	require.NotNil(t, alerts[0].ResolvedAt)
+
+	e.Eval(context.Background(), start.Add(2*time.Minute+resolvedRetention+time.Second))
+	assert.Empty(t, e.Alerts())
+}
+
+func TestEngine_PendingCleared(t *testing.T) {
+	source := fakeSource{types.Gauge: {`load{host="a"}`: "5", `load{host="b"}`: "1"}}
+	rules := []Rule{{Name: "HighLoad", Kind: KindThreshold, Metric: "load", Type: types.Gauge, Op: ">=", Threshold: 2, For: types.Duration(time.Minute)}}
+
+	e := NewEngine(zap.NewNop(), source, rules, time.Second)
+	now := time.Now()
+
+	e.Eval(context.Background(), now)
+	alerts := e.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, "a", alerts[0].Labels["host"])
+
+	source[types.Gauge][`load{host="a"}`] = "1"
+	e.Eval(context.Background(), now.Add(time.Second))
+	assert.Empty(t, e.Alerts())
+}
+
+func TestEngine_Absent(t *testing.T) {
+	source := fakeSource{types.Counter: {`requests{job="api"}`: "3"}}
+	rules := []Rule{{Name: "NoWorker", Kind: KindAbsent, Metric: "requests", Type: types.Counter, Match: map[string]string{"job": "worker"}}}
+
+	e := NewEngine(zap.NewNop(), source, rules, time.Second)
+	now := time.Now()
+
+	e.Eval(context.Background(), now)
+	alerts := e.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StateFiring, alerts[0].State)
+	assert.Equal(t, "worker", alerts[0].Labels["job"])
+	assert.Nil(t, alerts[0].Value)
+
+	source[types.Counter][`requests{job="worker"}`] = "1"
+	e.Eval(context.Background(), now.Add(time.Second))
+	alerts = e.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StateResolved, alerts[0].State)
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			data: `{"rules":[{"name":"HighHeap","metric":"HeapAlloc","op":">","threshold":1e9,"for":"5m"},
+				{"name":"NoPolls","kind":"absent","metric":"PollCount","type":"counter"}]}`,
+		},
+		{name: "unknown op", data: `{"rules":[{"name":"a","metric":"m","op":"~"}]}`, wantErr: true},
+		{name: "unknown kind", data: `{"rules":[{"name":"a","metric":"m","kind":"rate"}]}`, wantErr: true},
+		{name: "duplicate", data: `{"rules":[{"name":"a","metric":"m","op":">"},{"name":"a","metric":"m","op":"<"}]}`, wantErr: true},
+		{name: "bad duration", data: `{"rules":[{"name":"a","metric":"m","op":">","for":"soon"}]}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.json")
+			require.NoError(t, os.WriteFile(path, []byte(tt.data), 0644))
+
+			cfg, err := LoadConfig(path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			rules := cfg.Rules
+			assert.Equal(t, types.Gauge, rules[0].Type)
+			assert.Equal(t, KindThreshold, rules[0].Kind)
+			assert.Equal(t, 5*time.Minute, rules[0].For.Duration())
+		})
+	}
+}
+
+type blockingNotifier struct {
+	calls chan struct{}
+}
+
+func (bn *blockingNotifier) Notify(ctx context.Context, _ []Alert, _ time.Time) {
+	bn.calls <- struct{}{}
+	<-ctx.Done()
+}
+
+type countingSource struct {
+	evals chan struct{}
+}
+
+func (cs *countingSource) GetMetric(_ context.Context, mtype string) map[string]string {
+	if mtype == types.Gauge {
+		select {
+		case cs.evals <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func TestEngine_SlowNotifier(t *testing.T) {
+	source := &countingSource{evals: make(chan struct{}, 10)}
+	e := NewEngine(zap.NewNop(), source, nil, 5*time.Millisecond)
+	bn := &blockingNotifier{calls: make(chan struct{}, 10)}
+	e.AddNotifier(bn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		e.Start(ctx)
+		close(done)
+	}()
+
+	<-bn.calls
+	// Уведомление висит, а правила продолжают вычисляться.
+	for i := 0; i < 3; i++ {
+		select {
+		case <-source.evals:
+		case <-time.After(time.Second):
+			t.Fatal("rule evaluation is blocked by the notifier")
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("engine did not stop")
+	}
+}
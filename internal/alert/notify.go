@@ -0,0 +1,235 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/avast/retry-go"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+const (
+	defaultRepeatInterval = 4 * time.Hour
+	defaultWebhookTimeout = 10 * time.Second
+	defaultRetryAttempts  = 3
+
+	// defaultTemplate отправляет всю группу алертов как есть.
+	defaultTemplate = `{{ json . }}`
+)
+
+// Receiver описывает webhook, в который отправляются изменения состояния алертов.
+type Receiver struct {
+	Name           string            `json:"name"`
+	URL            string            `json:"url"`
+	Headers        map[string]string `json:"headers"`
+	Template       string            `json:"template"`
+	GroupBy        []string          `json:"group_by"`
+	RepeatInterval types.Duration    `json:"repeat_interval"`
+	Timeout        types.Duration    `json:"timeout"`
+	RetryAttempts  uint              `json:"retry_attempts"`
+}
+
+// Notification — данные, доступные в шаблоне тела запроса.
+type Notification struct {
+	Receiver    string            `json:"receiver"`
+	Status      string            `json:"status"`
+	GroupLabels map[string]string `json:"group_labels"`
+	Alerts      []Alert           `json:"alerts"`
+	Firing      []Alert           `json:"firing"`
+	Resolved    []Alert           `json:"resolved"`
+}
+
+type groupState struct {
+	fingerprint string
+	sentAt      time.Time
+}
+
+// Webhook группирует алерты по меткам GroupBy и отправляет группу, когда в ней меняется
+// набор firing/resolved алертов, а пока что-то горит — ещё и раз в RepeatInterval.
+type Webhook struct {
+	logger *zap.Logger
+	cfg    Receiver
+	tmpl   *template.Template
+	client *http.Client
+	delay  time.Duration
+
+	groups map[string]*groupState
+}
+
+func NewWebhook(logger *zap.Logger, cfg Receiver) (*Webhook, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("receiver without name")
+	}
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("receiver %s: empty url", cfg.Name)
+	}
+	if cfg.Template == "" {
+		cfg.Template = defaultTemplate
+	}
+	if cfg.RepeatInterval <= 0 {
+		cfg.RepeatInterval = types.Duration(defaultRepeatInterval)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = types.Duration(defaultWebhookTimeout)
+	}
+	if cfg.RetryAttempts == 0 {
+		cfg.RetryAttempts = defaultRetryAttempts
+	}
+
+	tmpl, err := template.New(cfg.Name).Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Parse(cfg.Template)
+	if err != nil {
+		return nil, fmt.Errorf("receiver %s: %w", cfg.Name, err)
+	}
+
+	return &Webhook{
+		logger: logger,
+		cfg:    cfg,
+		tmpl:   tmpl,
+		client: &http.Client{Timeout: cfg.Timeout.Duration()},
+		delay:  time.Second,
+		groups: make(map[string]*groupState),
+	}, nil
+}
+
+// Notify вызывается движком после каждого вычисления правил. Неотправленная группа
+// будет отправлена повторно при следующем вызове.
+func (wh *Webhook) Notify(ctx context.Context, alerts []Alert, now time.Time) {
+	groups := make(map[string][]Alert)
+	groupLabels := make(map[string]map[string]string)
+
+	for _, a := range alerts {
+		if a.State == StatePending {
+			continue
+		}
+
+		labels := make(map[string]string, len(wh.cfg.GroupBy))
+		for _, l := range wh.cfg.GroupBy {
+			labels[l] = a.Labels[l]
+		}
+		key := types.SeriesID("group", labels)
+
+		groups[key] = append(groups[key], a)
+		groupLabels[key] = labels
+	}
+
+	for key := range wh.groups {
+		if _, ok := groups[key]; !ok {
+			delete(wh.groups, key)
+		}
+	}
+
+	for key, group := range groups {
+		fp, firing := fingerprint(group)
+
+		st, ok := wh.groups[key]
+		switch {
+		case !ok && !firing:
+			// Группа, о которой мы ещё не сообщали, уже разрешилась — уведомлять не о чем.
+			wh.groups[key] = &groupState{fingerprint: fp, sentAt: now}
+			continue
+		case ok && st.fingerprint == fp && (!firing || now.Sub(st.sentAt) < wh.cfg.RepeatInterval.Duration()):
+			continue
+		}
+
+		if err := wh.send(ctx, groupLabels[key], group); err != nil {
+			wh.logger.Error("failed to send alert notification",
+				zap.String("receiver", wh.cfg.Name), zap.String("group", key), zap.Error(err))
+			continue
+		}
+
+		wh.groups[key] = &groupState{fingerprint: fp, sentAt: now}
+	}
+}
+
+func (wh *Webhook) send(ctx context.Context, groupLabels map[string]string, alerts []Alert) error {
+	n := Notification{
+		Receiver:    wh.cfg.Name,
+		Status:      StateResolved,
+		GroupLabels: groupLabels,
+		Alerts:      alerts,
+		Firing:      []Alert{},
+		Resolved:    []Alert{},
+	}
+	for _, a := range alerts {
+		if a.State == StateFiring {
+			n.Firing = append(n.Firing, a)
+			n.Status = StateFiring
+		} else {
+			n.Resolved = append(n.Resolved, a)
+		}
+	}
+
+	var body bytes.Buffer
+	if err := wh.tmpl.Execute(&body, n); err != nil {
+		return fmt.Errorf("failed to render template: %w", err)
+	}
+
+	return wh.withRetry(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.cfg.URL, bytes.NewReader(body.Bytes()))
+		if err != nil {
+			return retry.Unrecoverable(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range wh.cfg.Headers {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := wh.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode < 300:
+			return nil
+		case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+			return fmt.Errorf("receiver responded %s", resp.Status)
+		default:
+			return retry.Unrecoverable(fmt.Errorf("receiver responded %s", resp.Status))
+		}
+	}, "failed to send alert notification")
+}
+
+func (wh *Webhook) withRetry(ctx context.Context, fn func() error, warn string) error {
+	return retry.Do(fn,
+		retry.Context(ctx),
+		retry.Attempts(wh.cfg.RetryAttempts),
+		retry.Delay(wh.delay),
+		retry.DelayType(retry.BackOffDelay),
+		retry.LastErrorOnly(true),
+		retry.OnRetry(func(n uint, err error) {
+			wh.logger.Warn(warn, zap.String("receiver", wh.cfg.Name), zap.Uint("attempt", n), zap.Error(err))
+		}))
+}
+
+// fingerprint описывает состав группы: какие алерты в ней есть и в каком они состоянии.
+func fingerprint(alerts []Alert) (string, bool) {
+	var firing bool
+
+	keys := make([]string, 0, len(alerts))
+	for _, a := range alerts {
+		if a.State == StateFiring {
+			firing = true
+		}
+		keys = append(keys, a.State+":"+types.SeriesID(a.Rule, a.Labels))
+	}
+	sort.Strings(keys)
+
+	return strings.Join(keys, "\n"), firing
+}
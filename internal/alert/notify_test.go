@@ -0,0 +1,147 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+type receiver struct {
+	mu       sync.Mutex
+	bodies   []string
+	failures int
+}
+
+func (rc *receiver) handler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("X-Token"))
+
+		if rc.failures > 0 {
+			rc.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		rc.bodies = append(rc.bodies, string(body))
+	}
+}
+
+func (rc *receiver) received() []string {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]string(nil), rc.bodies...)
+}
+
+func firing(rule, host string) Alert {
+	return Alert{Rule: rule, State: StateFiring, Labels: map[string]string{"alertname": rule, "host": host}}
+}
+
+func TestWebhook_Notify(t *testing.T) {
+	rc := &receiver{}
+	ts := httptest.NewServer(rc.handler(t))
+	defer ts.Close()
+
+	wh, err := NewWebhook(zap.NewNop(), Receiver{
+		Name:           "chat",
+		URL:            ts.URL,
+		Headers:        map[string]string{"X-Token": "secret"},
+		Template:       `{"text":"[{{ .Status }}] {{ index .GroupLabels "alertname" }}: {{ len .Firing }} firing, {{ len .Resolved }} resolved"}`,
+		GroupBy:        []string{"alertname"},
+		RepeatInterval: types.Duration(time.Hour),
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	now := time.Now()
+
+	// pending алерты не отправляются
+	wh.Notify(ctx, []Alert{{Rule: "HighHeap", State: StatePending, Labels: map[string]string{"alertname": "HighHeap"}}}, now)
+	assert.Empty(t, rc.received())
+
+	// два алерта одного правила уходят одной группой, другое правило — отдельной
+	wh.Notify(ctx, []Alert{firing("HighHeap", "a"), firing("HighHeap", "b"), firing("NoPolls", "a")}, now)
+	assert.ElementsMatch(t, []string{
+		`{"text":"[firing] HighHeap: 2 firing, 0 resolved"}`,
+		`{"text":"[firing] NoPolls: 1 firing, 0 resolved"}`,
+	}, rc.received())
+
+	// без изменений до истечения repeat interval ничего не отправляется
+	wh.Notify(ctx, []Alert{firing("HighHeap", "a"), firing("HighHeap", "b"), firing("NoPolls", "a")}, now.Add(time.Minute))
+	assert.Len(t, rc.received(), 2)
+
+	// разрешение одного алерта меняет состав группы
+	resolved := firing("HighHeap", "b")
+	resolved.State = StateResolved
+	wh.Notify(ctx, []Alert{firing("HighHeap", "a"), resolved, firing("NoPolls", "a")}, now.Add(2*time.Minute))
+	bodies := rc.received()
+	require.Len(t, bodies, 3)
+	assert.Equal(t, `{"text":"[firing] HighHeap: 1 firing, 1 resolved"}`, bodies[2])
+
+	// по repeat interval горящие группы отправляются повторно
+	wh.Notify(ctx, []Alert{firing("HighHeap", "a"), resolved, firing("NoPolls", "a")}, now.Add(2*time.Hour))
+	assert.Len(t, rc.received(), 5)
+}
+
+func TestWebhook_Retry(t *testing.T) {
+	rc := &receiver{failures: 2}
+	ts := httptest.NewServer(rc.handler(t))
+	defer ts.Close()
+
+	wh, err := NewWebhook(zap.NewNop(), Receiver{
+		Name:    "incident",
+		URL:     ts.URL,
+		Headers: map[string]string{"X-Token": "secret"},
+	})
+	require.NoError(t, err)
+	wh.delay = time.Millisecond
+
+	wh.Notify(context.Background(), []Alert{firing("HighHeap", "a")}, time.Now())
+
+	bodies := rc.received()
+	require.Len(t, bodies, 1)
+
+	var n Notification
+	require.NoError(t, json.Unmarshal([]byte(bodies[0]), &n))
+	assert.Equal(t, "incident", n.Receiver)
+	assert.Equal(t, StateFiring, n.Status)
+	require.Len(t, n.Firing, 1)
+	assert.Equal(t, "HighHeap", n.Firing[0].Rule)
+}
+
+func TestWebhook_FailedSendIsRetriedOnNextNotify(t *testing.T) {
+	rc := &receiver{failures: 3}
+	ts := httptest.NewServer(rc.handler(t))
+	defer ts.Close()
+
+	wh, err := NewWebhook(zap.NewNop(), Receiver{
+		Name:    "chat",
+		URL:     ts.URL,
+		Headers: map[string]string{"X-Token": "secret"},
+	})
+	require.NoError(t, err)
+	wh.delay = time.Millisecond
+
+	now := time.Now()
+	wh.Notify(context.Background(), []Alert{firing("HighHeap", "a")}, now)
+	assert.Empty(t, rc.received())
+
+	wh.Notify(context.Background(), []Alert{firing("HighHeap", "a")}, now.Add(time.Second))
+	assert.Len(t, rc.received(), 1)
+}
@@ -0,0 +1,101 @@
+package alert
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+const (
+	KindThreshold = "threshold"
+	KindAbsent    = "absent"
+)
+
+// Rule описывает условие срабатывания алерта. Metric — имя метрики без меток; Match
+// дополнительно сужает выбор серий по значениям меток. Для threshold алерт заводится
+// на каждую подходящую серию, для absent — один алерт, если подходящих серий нет.
+type Rule struct {
+	Name        string            `json:"name"`
+	Kind        string            `json:"kind"`
+	Metric      string            `json:"metric"`
+	Type        string            `json:"type"`
+	Match       map[string]string `json:"match"`
+	Op          string            `json:"op"`
+	Threshold   float64           `json:"threshold"`
+	For         types.Duration    `json:"for"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// Config — содержимое файла с правилами алертинга и получателями уведомлений.
+type Config struct {
+	Rules     []Rule     `json:"rules"`
+	Receivers []Receiver `json:"receivers"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err = json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]struct{}, len(cfg.Rules))
+	for i := range cfg.Rules {
+		if err = cfg.Rules[i].validate(); err != nil {
+			return nil, err
+		}
+		if _, ok := names[cfg.Rules[i].Name]; ok {
+			return nil, fmt.Errorf("duplicate rule %s", cfg.Rules[i].Name)
+		}
+		names[cfg.Rules[i].Name] = struct{}{}
+	}
+
+	return cfg, nil
+}
+
+func (r *Rule) validate() error {
+	if r.Name == "" {
+		return errors.New("rule without name")
+	}
+	if r.Metric == "" {
+		return fmt.Errorf("rule %s: empty metric", r.Name)
+	}
+	if r.Type == "" {
+		r.Type = types.Gauge
+	}
+	if r.Type != types.Gauge && r.Type != types.Counter {
+		return fmt.Errorf("rule %s: %w", r.Name, types.ErrUnknownType)
+	}
+	if r.Kind == "" {
+		r.Kind = KindThreshold
+	}
+
+	switch r.Kind {
+	case KindThreshold:
+		if _, ok := operators[r.Op]; !ok {
+			return fmt.Errorf("rule %s: unknown operator %q", r.Name, r.Op)
+		}
+	case KindAbsent:
+	default:
+		return fmt.Errorf("rule %s: unknown kind %q", r.Name, r.Kind)
+	}
+
+	return nil
+}
+
+var operators = map[string]func(value, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+	"==": func(v, t float64) bool { return v == t },
+	"!=": func(v, t float64) bool { return v != t },
+}
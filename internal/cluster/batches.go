@@ -0,0 +1,88 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+const (
+	// batchTTL — сколько узел помнит применённые батчи; клиент повторяет отправку раньше.
+	batchTTL = 10 * time.Minute
+	// maxBatches ограничивает память под применённые батчи, если клиенты шлют их чаще.
+	maxBatches = 100000
+)
+
+var errBatchInFlight = errors.New("batch with the same id is being applied")
+
+// batches помнит части батчей, уже применённые к локальному хранилищу: повтор батча после
+// частичного сбоя не должен второй раз прибавить приращения counter на узлах, которые
+// свою часть уже записали. Ключ — идентификатор батча и хеш части, поэтому батч с чужим
+// содержимым под тем же идентификатором не пропускается.
+type batches struct {
+	mu    sync.Mutex
+	state map[string]bool // false — применяется, true — применён
+	order []batchEntry
+}
+
+type batchEntry struct {
+	key  string
+	done time.Time
+}
+
+func newBatches() *batches {
+	return &batches{state: make(map[string]bool)}
+}
+
+func batchKey(id string, part []types.Metrics) (string, error) {
+	data, err := json.Marshal(part)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return id + "/" + hex.EncodeToString(sum[:]), nil
+}
+
+// begin отмечает, что часть начали применять; apply == false, если она уже применена.
+func (b *batches) begin(key string) (apply bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	done, ok := b.state[key]
+	switch {
+	case !ok:
+		b.state[key] = false
+		return true, nil
+	case done:
+		return false, nil
+	default:
+		return false, errBatchInFlight
+	}
+}
+
+// finish запоминает применённую часть; после ошибки её можно применить заново.
+func (b *batches) finish(key string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err != nil {
+		delete(b.state, key)
+		return
+	}
+
+	now := time.Now()
+	b.state[key] = true
+	b.order = append(b.order, batchEntry{key: key, done: now})
+
+	n := 0
+	for n < len(b.order) && (len(b.order)-n > maxBatches || now.Sub(b.order[n].done) > batchTTL) {
+		delete(b.state, b.order[n].key)
+		n++
+	}
+	b.order = b.order[n:]
+}
@@ -0,0 +1,512 @@
+// Package cluster распределяет серии между несколькими серверами.
+//
+// Все узлы знают один и тот же статический список участников. Серия хранится на узле,
+// который выбирает Ring по её имени с метками. Cluster оборачивает локальное хранилище:
+// запись и чтение одной серии уходят её владельцу, а выборка всех серий опрашивает все
+// узлы и объединяет ответы.
+// Узлы общаются через внутренние эндпоинты /cluster/*, которые работают только
+// с локальным хранилищем, поэтому пересланный запрос не пересылается повторно.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/store"
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+const peerTimeout = 5 * time.Second
+
+// Cluster — хранилище, распределённое по узлам кластера.
+type Cluster struct {
+	logger *zap.Logger
+	local  store.MetricStorage
+	self   string
+	peers  []string
+	ring   *Ring
+	token  string
+	scheme string
+	client *http.Client
+	// applied — части батчей, уже записанные в локальное хранилище.
+	applied *batches
+}
+
+// New создаёт узел self кластера members. token — токен с ролью admin, который передаётся
+// соседям в Authorization: Bearer. С tc соседи без явной схемы в адресе опрашиваются по https.
+func New(logger *zap.Logger, self string, members []string, token string, tc *tls.Config, local store.MetricStorage) (*Cluster, error) {
+	seen := make(map[string]bool, len(members))
+	var peers []string
+	for _, m := range members {
+		if m == "" {
+			return nil, errors.New("empty cluster member")
+		}
+		if seen[m] {
+			return nil, fmt.Errorf("duplicate cluster member %q", m)
+		}
+		seen[m] = true
+		if m != self {
+			peers = append(peers, m)
+		}
+	}
+	if !seen[self] {
+		return nil, fmt.Errorf("node %q is not in the member list", self)
+	}
+
+	c := &Cluster{
+		logger:  logger,
+		local:   local,
+		self:    self,
+		peers:   peers,
+		ring:    NewRing(members),
+		token:   token,
+		scheme:  "http://",
+		client:  &http.Client{Timeout: peerTimeout},
+		applied: newBatches(),
+	}
+	if tc != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tc
+		c.client.Transport = transport
+		c.scheme = "https://"
+	}
+
+	return c, nil
+}
+
+// Owner возвращает узел, хранящий серию.
+func (c *Cluster) Owner(id string) string {
+	return c.ring.Owner(id)
+}
+
+// GetMetrics опрашивает все узлы. Недоступный узел не ломает чтение для просмотра: его
+// серии просто отсутствуют в ответе, а ошибка попадает в лог. Снимок и квоты читают через
+// GetCompleteMetrics, который неполный ответ не возвращает.
+func (c *Cluster) GetMetrics(ctx context.Context) map[string]store.Metric {
+	all, err := c.GetCompleteMetrics(ctx)
+	if errors.Is(err, types.ErrPartialResult) {
+		c.logger.Warn("cluster read failed, returning partial result", zap.Error(err))
+		return all
+	}
+	if err != nil {
+		return nil
+	}
+	return all
+}
+
+// GetCompleteMetrics опрашивает все узлы. Если ответили не все, вместе с объединённым
+// ответом остальных возвращается ошибка с types.ErrPartialResult.
+func (c *Cluster) GetCompleteMetrics(ctx context.Context) (map[string]store.Metric, error) {
+	local := c.local.GetMetrics(ctx)
+	if local == nil {
+		return nil, errors.New("unable to read local storage")
+	}
+
+	parts := map[string][]types.Metrics{c.self: store.Flatten(local)}
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs []error
+	)
+	for _, peer := range c.peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+
+			var metrics []types.Metrics
+			err := c.call(ctx, peer, http.MethodGet, "/metrics", nil, &metrics)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			parts[peer] = metrics
+		}(peer)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return merge(c.ring, parts), fmt.Errorf("%w: %w", types.ErrPartialResult, errors.Join(errs...))
+	}
+	return merge(c.ring, parts), nil
+}
+
+// merge объединяет ответы узлов. Пока серия не переехала целиком (например, после смены
+// состава), она может найтись на двух узлах: counter тогда складываются, а для gauge
+// берётся значение владельца.
+func merge(ring *Ring, parts map[string][]types.Metrics) map[string]store.Metric {
+	gauge, counter := store.Gauge{}, store.Counter{}
+	fromOwner := make(map[string]bool)
+
+	for member, metrics := range parts {
+		for _, m := range metrics {
+			switch m.MType {
+			case types.Gauge:
+				if m.Value == nil || fromOwner[m.ID] {
+					continue
+				}
+				gauge[m.ID] = *m.Value
+				fromOwner[m.ID] = ring.Owner(m.ID) == member
+			case types.Counter:
+				if m.Delta != nil {
+					counter[m.ID] += *m.Delta
+				}
+			}
+		}
+	}
+
+	return map[string]store.Metric{
+		types.Gauge:   gauge,
+		types.Counter: counter,
+	}
+}
+
+func (c *Cluster) GetMetric(ctx context.Context, mtype string) map[string]string {
+	if mtype != types.Gauge && mtype != types.Counter {
+		return nil
+	}
+
+	all := c.GetMetrics(ctx)
+	if all == nil {
+		return nil
+	}
+	return all[mtype].Get()
+}
+
+// GetValue читает серию у её владельца, не опрашивая остальные узлы. В отличие от
+// GetMetrics, остаток серии на прежнем владельце после смены состава не учитывается.
+func (c *Cluster) GetValue(ctx context.Context, mtype, name string) (string, bool, error) {
+	if mtype != types.Gauge && mtype != types.Counter {
+		return "", false, types.ErrUnknownType
+	}
+
+	owner := c.ring.Owner(name)
+	if owner == c.self {
+		return c.localValue(ctx, mtype, name)
+	}
+
+	var res valueResponse
+	err := c.call(ctx, owner, http.MethodPost, "/value", types.Metrics{ID: name, MType: mtype}, &res)
+	return res.Value, res.Found, err
+}
+
+func (c *Cluster) localValue(ctx context.Context, mtype, name string) (string, bool, error) {
+	if vr, ok := c.local.(store.ValueReader); ok {
+		return vr.GetValue(ctx, mtype, name)
+	}
+
+	metrics := c.local.GetMetric(ctx, mtype)
+	if metrics == nil {
+		return "", false, errors.New("unable to read storage")
+	}
+	value, ok := metrics[name]
+	return value, ok, nil
+}
+
+// Samples читает историю серии у её владельца.
+func (c *Cluster) Samples(ctx context.Context, mtype, name string, from, to time.Time) ([]types.Sample, error) {
+	if mtype != types.Gauge && mtype != types.Counter {
+		return nil, types.ErrUnknownType
+	}
+
+	owner := c.ring.Owner(name)
+	if owner == c.self {
+		return c.localSamples(ctx, mtype, name, from, to)
+	}
+
+	var samples []types.Sample
+	err := c.call(ctx, owner, http.MethodPost, "/samples", samplesRequest{Type: mtype, ID: name, From: from, To: to}, &samples)
+	var se *statusError
+	if errors.As(err, &se) && se.code == http.StatusNotImplemented {
+		return nil, types.ErrNoHistory
+	}
+	return samples, err
+}
+
+func (c *Cluster) localSamples(ctx context.Context, mtype, name string, from, to time.Time) ([]types.Sample, error) {
+	hs, ok := c.local.(store.HistoryStorage)
+	if !ok {
+		return nil, types.ErrNoHistory
+	}
+	return hs.Samples(ctx, mtype, name, from, to)
+}
+
+func (c *Cluster) UpdateMetric(ctx context.Context, mtype, name, value string) (any, error) {
+	mtr, err := parseMetric(mtype, name, value)
+	if err != nil {
+		return nil, err
+	}
+
+	owner := c.ring.Owner(name)
+	if owner == c.self {
+		return c.local.UpdateMetric(ctx, mtype, name, value)
+	}
+
+	var res types.Metrics
+	if err = c.call(ctx, owner, http.MethodPost, "/update", mtr, &res); err != nil {
+		return nil, err
+	}
+	if mtype == types.Counter && res.Delta != nil {
+		return *res.Delta, nil
+	}
+	if mtype == types.Gauge && res.Value != nil {
+		return *res.Value, nil
+	}
+	return nil, fmt.Errorf("node %s: empty metric value in response", owner)
+}
+
+// PartialWriteError — батч записан не целиком: узлы Failed не ответили или отказали, а
+// остальные владельцы свою часть могли уже записать. Повторять нужно тот же батч с тем же
+// идентификатором (types.BatchIDHeader): записанные части узлы пропустят.
+type PartialWriteError struct {
+	Failed []string
+	Err    error
+}
+
+func (e *PartialWriteError) Error() string {
+	return fmt.Sprintf("batch not applied on nodes %s: %v", strings.Join(e.Failed, ", "), e.Err)
+}
+
+// Unwrap не раскрывает ошибки узлов: отказ одного узла из-за данных не должен превращать
+// временный сбой остальных в окончательный отказ для клиента.
+func (e *PartialWriteError) Unwrap() error {
+	return types.ErrPartialResult
+}
+
+// UpdateMetrics раскладывает батч по владельцам и отправляет части параллельно. Батч
+// проверяется целиком до отправки; отказ одного узла не отменяет записи на остальных.
+// Если узлы отказали только из-за данных, возвращается их ошибка, иначе PartialWriteError.
+func (c *Cluster) UpdateMetrics(ctx context.Context, metrics []types.Metrics) error {
+	byOwner := make(map[string][]types.Metrics)
+	for _, mtr := range metrics {
+		if err := validate(mtr); err != nil {
+			return err
+		}
+		owner := c.ring.Owner(mtr.ID)
+		byOwner[owner] = append(byOwner[owner], mtr)
+	}
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		errs      []error
+		failed    []string
+		transient bool
+	)
+	for owner, part := range byOwner {
+		wg.Add(1)
+		go func(owner string, part []types.Metrics) {
+			defer wg.Done()
+
+			var err error
+			if owner == c.self {
+				err = c.applyLocal(ctx, part)
+			} else {
+				err = c.call(ctx, owner, http.MethodPost, "/updates", part, nil)
+			}
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				failed = append(failed, owner)
+				transient = transient || !types.IsInvalid(err)
+				mu.Unlock()
+			}
+		}(owner, part)
+	}
+	wg.Wait()
+
+	if !transient {
+		return errors.Join(errs...)
+	}
+	sort.Strings(failed)
+	return &PartialWriteError{Failed: failed, Err: errors.Join(errs...)}
+}
+
+// applyLocal записывает часть батча в локальное хранилище. Часть батча с идентификатором
+// записывается один раз: повтор после частичного сбоя её пропускает.
+func (c *Cluster) applyLocal(ctx context.Context, part []types.Metrics) error {
+	id := store.BatchID(ctx)
+	if id == "" {
+		return c.local.UpdateMetrics(ctx, part)
+	}
+
+	key, err := batchKey(id, part)
+	if err != nil {
+		return err
+	}
+	apply, err := c.applied.begin(key)
+	if !apply {
+		return err
+	}
+	err = c.local.UpdateMetrics(ctx, part)
+	c.applied.finish(key, err)
+	return err
+}
+
+func (c *Cluster) DeleteMetric(ctx context.Context, mtype, name string) (bool, error) {
+	if mtype != types.Gauge && mtype != types.Counter {
+		return false, types.ErrUnknownType
+	}
+
+	owner := c.ring.Owner(name)
+	if owner == c.self {
+		return c.local.DeleteMetric(ctx, mtype, name)
+	}
+
+	n, err := c.remoteDelete(ctx, owner, deleteRequest{Op: deleteMetric, Type: mtype, ID: name})
+	return n > 0, err
+}
+
+func (c *Cluster) DeleteMetricsByPrefix(ctx context.Context, prefix string) (int, error) {
+	return c.broadcastDelete(ctx, deleteRequest{Op: deletePrefix, Key: prefix})
+}
+
+func (c *Cluster) DeleteMetricsByLabel(ctx context.Context, key, value string) (int, error) {
+	return c.broadcastDelete(ctx, deleteRequest{Op: deleteLabel, Key: key, Value: value})
+}
+
+// PurgeStale работает только с локальными сериями: уборщик запущен на каждом узле.
+func (c *Cluster) PurgeStale(ctx context.Context, before time.Time) (int, error) {
+	return c.local.PurgeStale(ctx, before)
+}
+
+func (c *Cluster) broadcastDelete(ctx context.Context, req deleteRequest) (int, error) {
+	total, err := c.localDelete(ctx, req)
+	errs := []error{err}
+
+	for _, peer := range c.peers {
+		n, err := c.remoteDelete(ctx, peer, req)
+		total += n
+		errs = append(errs, err)
+	}
+
+	return total, errors.Join(errs...)
+}
+
+func (c *Cluster) remoteDelete(ctx context.Context, member string, req deleteRequest) (int, error) {
+	var res deleteResponse
+	if err := c.call(ctx, member, http.MethodPost, "/delete", req, &res); err != nil {
+		return 0, err
+	}
+	return res.Deleted, nil
+}
+
+// call выполняет запрос к внутреннему эндпоинту узла member.
+func (c *Cluster) call(ctx context.Context, member, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	base := member
+	if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
+		base = c.scheme + base
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, base+"/cluster"+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if id := store.BatchID(ctx); id != "" {
+		req.Header.Set(types.BatchIDHeader, id)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("node %s: %w", member, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &statusError{member: member, code: resp.StatusCode, status: resp.Status, msg: strings.TrimSpace(string(msg))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// statusError — узел ответил кодом, отличным от 200.
+type statusError struct {
+	member string
+	code   int
+	status string
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("node %s: %s: %s", e.member, e.status, e.msg)
+}
+
+// Unwrap сохраняет отказ из-за некорректных данных, чтобы ответить клиенту 400, а не 500.
+func (e *statusError) Unwrap() error {
+	if e.code == http.StatusBadRequest {
+		return types.ErrInvalidMetric
+	}
+	return nil
+}
+
+func parseMetric(mtype, name, value string) (types.Metrics, error) {
+	mtr := types.Metrics{ID: name, MType: mtype}
+	switch mtype {
+	case types.Gauge:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return mtr, err
+		}
+		mtr.Value = &v
+	case types.Counter:
+		d, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return mtr, err
+		}
+		mtr.Delta = &d
+	default:
+		return mtr, types.ErrUnknownType
+	}
+
+	return mtr, validate(mtr)
+}
+
+func validate(mtr types.Metrics) error {
+	if mtr.ID == "" {
+		return types.ErrIncorrectName
+	}
+	switch mtr.MType {
+	case types.Gauge:
+		if mtr.Value == nil {
+			return types.ErrEmptyValue
+		}
+	case types.Counter:
+		if mtr.Delta == nil {
+			return types.ErrEmptyValue
+		}
+	default:
+		return types.ErrUnknownType
+	}
+	return nil
+}
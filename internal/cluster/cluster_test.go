@@ -0,0 +1,481 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/agent"
+	"github.com/shevchukeugeni/metrics/internal/server"
+	"github.com/shevchukeugeni/metrics/internal/store"
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+func TestRing(t *testing.T) {
+	members := []string{"a:8080", "b:8080", "c:8080"}
+	ring := NewRing(members)
+
+	owners := make(map[string]string)
+	load := make(map[string]int)
+	for i := 0; i < 30000; i++ {
+		id := fmt.Sprintf(`requests{host="h%d"}`, i)
+		owners[id] = ring.Owner(id)
+		load[owners[id]]++
+	}
+	for _, m := range members {
+		assert.InDelta(t, 10000, load[m], 2500, "node %s", m)
+	}
+
+	// Порядок меток не влияет на владельца.
+	assert.Equal(t, ring.Owner(`cpu{core="1",host="a"}`), ring.Owner(`cpu{host="a",core="1"}`))
+
+	// Новый узел забирает примерно четверть серий, остальные остаются на месте.
+	grown := NewRing(append(members, "d:8080"))
+	moved := 0
+	for id, owner := range owners {
+		if o := grown.Owner(id); o != owner {
+			assert.Equal(t, "d:8080", o)
+			moved++
+		}
+	}
+	assert.InDelta(t, 7500, moved, 2000)
+}
+
+type testNode struct {
+	local   *store.MemStorage
+	cluster *Cluster
+	ts      *httptest.Server
+}
+
+// startCluster поднимает n узлов в одном процессе; адреса известны заранее, потому что
+// слушающие сокеты открываются до создания узлов.
+func startCluster(t *testing.T, n int, token string) []*testNode {
+	return startClusterWith(t, n, token, func(ms *store.MemStorage) store.MetricStorage { return ms })
+}
+
+// startClusterWith позволяет обернуть локальное хранилище каждого узла.
+func startClusterWith(t *testing.T, n int, token string, wrap func(*store.MemStorage) store.MetricStorage) []*testNode {
+	listeners := make([]net.Listener, n)
+	members := make([]string, n)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners[i], members[i] = l, l.Addr().String()
+	}
+
+	nodes := make([]*testNode, n)
+	for i := range nodes {
+		local := store.NewMemStorage()
+		c, err := New(zap.NewNop(), members[i], members, token, nil, wrap(local))
+		require.NoError(t, err)
+
+		opts := []server.Option{server.WithCluster(c.Handler(0))}
+		if token != "" {
+			opts = append(opts, server.WithAdmin(token))
+		}
+		ts := httptest.NewUnstartedServer(server.SetupRouter(zap.NewNop(), c, nil, nil, opts...))
+		ts.Listener.Close()
+		ts.Listener = listeners[i]
+		ts.Start()
+		t.Cleanup(ts.Close)
+
+		nodes[i] = &testNode{local: local, cluster: c, ts: ts}
+	}
+
+	return nodes
+}
+
+func post(t *testing.T, url string, body any) (int, string) {
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+
+	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	res, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(res)
+}
+
+func counter(id string, d int64) types.Metrics {
+	return types.Metrics{ID: id, MType: types.Counter, Delta: &d}
+}
+
+func gauge(id string, v float64) types.Metrics {
+	return types.Metrics{ID: id, MType: types.Gauge, Value: &v}
+}
+
+func TestCluster(t *testing.T) {
+	ctx := context.Background()
+	nodes := startCluster(t, 3, "secret")
+
+	var batch []types.Metrics
+	for i := 0; i < 60; i++ {
+		batch = append(batch, counter(fmt.Sprintf(`requests{host="h%d"}`, i), 1), gauge(fmt.Sprintf(`cpu{host="h%d"}`, i), float64(i)))
+	}
+
+	// Батч, пришедший на любой узел, раскладывается по владельцам.
+	code, _ := post(t, nodes[0].ts.URL+"/updates/", batch)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = post(t, nodes[1].ts.URL+"/updates/", batch[:2])
+	require.Equal(t, http.StatusOK, code)
+
+	total := 0
+	for _, n := range nodes {
+		local := n.local.GetMetric(ctx, types.Counter)
+		assert.NotEmpty(t, local, "every node should own some series")
+		for id := range local {
+			assert.Equal(t, n.ts.Listener.Addr().String(), n.cluster.Owner(id))
+		}
+		total += len(local)
+	}
+	assert.Equal(t, 60, total)
+
+	// Чтение с любого узла видит все серии.
+	for _, n := range nodes {
+		counters := n.cluster.GetMetric(ctx, types.Counter)
+		assert.Len(t, counters, 60)
+		assert.Equal(t, "2", counters[`requests{host="h0"}`])
+		assert.Equal(t, "1", counters[`requests{host="h1"}`])
+		assert.Equal(t, "42", n.cluster.GetMetric(ctx, types.Gauge)[`cpu{host="h42"}`])
+	}
+
+	// Одиночная запись и чтение через публичный API на узле, который не владеет серией.
+	id := `requests{host="h7"}`
+	var via *testNode
+	for _, n := range nodes {
+		if n.cluster.Owner(id) != n.ts.Listener.Addr().String() {
+			via = n
+			break
+		}
+	}
+	code, body := post(t, via.ts.URL+"/update/", counter(id, 5))
+	require.Equal(t, http.StatusOK, code, body)
+	assert.JSONEq(t, `{"id":"requests{host=\"h7\"}","type":"counter","delta":6}`, body)
+
+	code, body = post(t, via.ts.URL+"/value/", types.Metrics{ID: id, MType: types.Counter})
+	require.Equal(t, http.StatusOK, code, body)
+	assert.JSONEq(t, `{"id":"requests{host=\"h7\"}","type":"counter","delta":6}`, body)
+
+	// Удаление по метке расходится по всем узлам.
+	req, err := http.NewRequest(http.MethodDelete, nodes[2].ts.URL+"/value/?label=host=h3", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotContains(t, nodes[0].cluster.GetMetric(ctx, types.Counter), `requests{host="h3"}`)
+	assert.NotContains(t, nodes[0].cluster.GetMetric(ctx, types.Gauge), `cpu{host="h3"}`)
+
+	ok, err := nodes[0].cluster.DeleteMetric(ctx, types.Counter, id)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Len(t, nodes[1].cluster.GetMetric(ctx, types.Counter), 58)
+
+	// Внутренние эндпоинты закрыты токеном.
+	code, _ = post(t, nodes[0].ts.URL+"/cluster/updates", batch)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestCluster_NodeDown(t *testing.T) {
+	ctx := context.Background()
+	nodes := startCluster(t, 3, "secret")
+
+	var batch []types.Metrics
+	for i := 0; i < 30; i++ {
+		batch = append(batch, counter(fmt.Sprintf(`requests{host="h%d"}`, i), 1))
+	}
+	require.NoError(t, nodes[0].cluster.UpdateMetrics(ctx, batch))
+
+	down := nodes[2]
+	lost := len(down.local.GetMetric(ctx, types.Counter))
+	down.ts.Close()
+
+	// Чтение возвращает серии доступных узлов, запись на недоступный узел — ошибку.
+	assert.Len(t, nodes[0].cluster.GetMetric(ctx, types.Counter), 30-lost)
+	_, err := nodes[0].cluster.GetCompleteMetrics(ctx)
+	assert.ErrorIs(t, err, types.ErrPartialResult)
+
+	// Снимок без серий недоступного узла не отдаётся.
+	req, err := http.NewRequest(http.MethodGet, nodes[0].ts.URL+"/admin/snapshot", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	var pe *PartialWriteError
+	require.ErrorAs(t, nodes[0].cluster.UpdateMetrics(ctx, batch), &pe)
+	assert.Equal(t, []string{down.ts.Listener.Addr().String()}, pe.Failed)
+
+	for id := range down.local.GetMetric(ctx, types.Counter) {
+		_, err := nodes[1].cluster.UpdateMetric(ctx, types.Counter, id, "1")
+		assert.Error(t, err)
+		break
+	}
+}
+
+// flakyStorage отказывает в записи, пока выставлен fail.
+type flakyStorage struct {
+	*store.MemStorage
+	fail *atomic.Bool
+}
+
+func (f flakyStorage) UpdateMetrics(ctx context.Context, metrics []types.Metrics) error {
+	if f.fail.Load() {
+		return errors.New("disk is full")
+	}
+	return f.MemStorage.UpdateMetrics(ctx, metrics)
+}
+
+func TestCluster_RetryAfterPartialWrite(t *testing.T) {
+	ctx := context.Background()
+	var fail atomic.Bool
+	i := 0
+	nodes := startClusterWith(t, 3, "secret", func(ms *store.MemStorage) store.MetricStorage {
+		i++
+		if i == 3 {
+			return flakyStorage{MemStorage: ms, fail: &fail}
+		}
+		return ms
+	})
+
+	var metrics []types.Metrics
+	for i := 0; i < 30; i++ {
+		metrics = append(metrics, counter(fmt.Sprintf(`requests{host="h%d"}`, i), 1))
+	}
+	batch, err := agent.NewBatch(metrics)
+	require.NoError(t, err)
+	client := resty.New()
+	url := nodes[0].ts.URL + "/updates/"
+
+	// Третий узел не может записать свою часть: клиент получает временную ошибку и
+	// повторяет тот же батч, пока узел не поправится.
+	fail.Store(true)
+	for attempt := 0; attempt < 2; attempt++ {
+		err = batch.Send(client, url)
+		require.Error(t, err)
+		assert.NotErrorIs(t, err, agent.ErrRejected)
+		assert.Contains(t, err.Error(), "503")
+	}
+	fail.Store(false)
+	require.NoError(t, batch.Send(client, url))
+	require.NoError(t, batch.Send(client, url))
+
+	// Каждое приращение учтено ровно один раз, хотя узлы, записавшие свою часть с первой
+	// попытки, получили батч четыре раза.
+	got := nodes[1].cluster.GetMetric(ctx, types.Counter)
+	require.Len(t, got, 30)
+	for id, v := range got {
+		assert.Equal(t, "1", v, id)
+	}
+	for _, n := range nodes {
+		assert.NotEmpty(t, n.local.GetMetric(ctx, types.Counter))
+	}
+}
+
+// historyStorage отдаёт историю из одной точки с текущим значением gauge.
+type historyStorage struct {
+	*store.MemStorage
+}
+
+func (h historyStorage) Samples(ctx context.Context, mtype, name string, from, to time.Time) ([]types.Sample, error) {
+	value, ok := h.GetMetric(ctx, mtype)[name]
+	if !ok {
+		return []types.Sample{}, nil
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	return []types.Sample{{Time: from, Value: &v}}, err
+}
+
+func TestCluster_PointReads(t *testing.T) {
+	ctx := context.Background()
+	nodes := startClusterWith(t, 2, "secret", func(ms *store.MemStorage) store.MetricStorage {
+		return historyStorage{ms}
+	})
+
+	id := "HeapAlloc"
+	owner, other := nodes[0], nodes[1]
+	if owner.cluster.Owner(id) != owner.ts.Listener.Addr().String() {
+		owner, other = other, owner
+	}
+	_, err := other.cluster.UpdateMetric(ctx, types.Gauge, id, "1.5")
+	require.NoError(t, err)
+	// Устаревшая копия на другом узле не должна попасть в чтение одной серии.
+	_, err = other.local.UpdateMetric(ctx, types.Gauge, id, "99")
+	require.NoError(t, err)
+	orphan := ""
+	for i := 0; orphan == ""; i++ {
+		if name := "Orphan" + strconv.Itoa(i); other.cluster.Owner(name) == owner.ts.Listener.Addr().String() {
+			orphan = name
+		}
+	}
+	_, err = other.local.UpdateMetric(ctx, types.Gauge, orphan, "1")
+	require.NoError(t, err)
+
+	value, ok, err := other.cluster.GetValue(ctx, types.Gauge, id)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "1.5", value)
+
+	_, ok, err = other.cluster.GetValue(ctx, types.Gauge, orphan)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	resp, err := http.Get(other.ts.URL + "/value/gauge/" + id)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "1.5", string(body))
+
+	// История читается у владельца серии.
+	samples, err := other.cluster.Samples(ctx, types.Gauge, id, time.Now().Add(-time.Hour), time.Now())
+	require.NoError(t, err)
+	require.Len(t, samples, 1)
+	assert.Equal(t, 1.5, *samples[0].Value)
+
+	resp, err = http.Get(other.ts.URL + "/history?type=gauge&id=" + id)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestCluster_TLS(t *testing.T) {
+	// Сертификат httptest один для всех серверов, поэтому узлы запускаются до создания
+	// кластера, а обработчики подставляются после.
+	var (
+		servers  [2]*httptest.Server
+		handlers [2]http.Handler
+		members  []string
+	)
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlers[i].ServeHTTP(w, r)
+		}))
+		servers[i].StartTLS()
+		t.Cleanup(servers[i].Close)
+		members = append(members, servers[i].Listener.Addr().String())
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(servers[0].Certificate())
+
+	var nodes [2]*Cluster
+	for i := range nodes {
+		c, err := New(zap.NewNop(), members[i], members, "secret", &tls.Config{RootCAs: pool}, store.NewMemStorage())
+		require.NoError(t, err)
+		handlers[i] = server.SetupRouter(zap.NewNop(), c, nil, nil, server.WithCluster(c.Handler(0)), server.WithAdmin("secret"))
+		nodes[i] = c
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		_, err := nodes[0].UpdateMetric(ctx, types.Counter, "Requests"+strconv.Itoa(i), "1")
+		require.NoError(t, err)
+	}
+	assert.Len(t, nodes[1].GetMetric(ctx, types.Counter), 20)
+
+	// Без доверенного CA соседи по https недоступны.
+	c, err := New(zap.NewNop(), members[0], members, "secret", &tls.Config{}, store.NewMemStorage())
+	require.NoError(t, err)
+	for i := 0; ; i++ {
+		if name := "Requests" + strconv.Itoa(i); c.Owner(name) == members[1] {
+			_, err = c.UpdateMetric(ctx, types.Counter, name, "1")
+			assert.ErrorContains(t, err, "certificate")
+			break
+		}
+	}
+}
+
+func TestCluster_NoHistory(t *testing.T) {
+	ctx := context.Background()
+	nodes := startCluster(t, 2, "secret")
+
+	for _, n := range nodes {
+		_, err := n.cluster.Samples(ctx, types.Gauge, "HeapAlloc", time.Now().Add(-time.Hour), time.Now())
+		assert.ErrorIs(t, err, types.ErrNoHistory)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	ring := NewRing([]string{"a", "b"})
+	id := "HeapAlloc"
+	owner, other := ring.Owner(id), "a"
+	if owner == "a" {
+		other = "b"
+	}
+
+	// Серия застала смену состава: counter складываются, gauge берётся у владельца.
+	for _, order := range [][2]string{{owner, other}, {other, owner}} {
+		parts := map[string][]types.Metrics{
+			order[0]: {counter("PollCount", 2)},
+			order[1]: {counter("PollCount", 3)},
+		}
+		parts[owner] = append(parts[owner], gauge(id, 1))
+		parts[other] = append(parts[other], gauge(id, 2))
+
+		all := merge(ring, parts)
+		assert.Equal(t, map[string]string{"PollCount": "5"}, all[types.Counter].Get())
+		assert.Equal(t, map[string]string{id: "1"}, all[types.Gauge].Get())
+	}
+}
+
+func TestNew(t *testing.T) {
+	local := store.NewMemStorage()
+
+	_, err := New(zap.NewNop(), "a", []string{"b", "c"}, "", nil, local)
+	assert.Error(t, err)
+	_, err = New(zap.NewNop(), "a", []string{"a", "a"}, "", nil, local)
+	assert.Error(t, err)
+	_, err = New(zap.NewNop(), "a", []string{"a", ""}, "", nil, local)
+	assert.Error(t, err)
+
+	c, err := New(zap.NewNop(), "a", []string{"a", "b"}, "", nil, local)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b"}, c.peers)
+}
+
+func TestHandler_Limits(t *testing.T) {
+	c, err := New(zap.NewNop(), "a", []string{"a"}, "secret", nil, store.NewMemStorage())
+	require.NoError(t, err)
+	ts := httptest.NewServer(server.SetupRouter(zap.NewNop(), c, nil, nil, server.WithCluster(c.Handler(2)),
+		server.WithAdmin("secret"), server.WithLimits(server.Limits{MaxBodySize: 1 << 10, MaxDecompressedSize: 4 << 10})))
+	defer ts.Close()
+
+	send := func(body []byte) int {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/cluster/updates", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Соседу пересылаются распакованные данные, поэтому тело может быть больше MaxBodySize.
+	pad := strings.Repeat(" ", 2<<10)
+	assert.Equal(t, http.StatusOK, send([]byte(`[{"id":"a","type":"counter","delta":1}]`+pad)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, send([]byte(`[{"id":"a","type":"counter","delta":1}]`+pad+pad)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, send([]byte(`[{"id":"a","type":"counter","delta":1},{"id":"b","type":"counter","delta":1},{"id":"c","type":"counter","delta":1}]`)))
+}
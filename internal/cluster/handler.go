@@ -0,0 +1,217 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/store"
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+const (
+	deleteMetric = "metric"
+	deletePrefix = "prefix"
+	deleteLabel  = "label"
+)
+
+type deleteRequest struct {
+	Op    string `json:"op"`
+	Type  string `json:"type,omitempty"`
+	ID    string `json:"id,omitempty"`
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+type deleteResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+type valueResponse struct {
+	Found bool   `json:"found"`
+	Value string `json:"value,omitempty"`
+}
+
+type samplesRequest struct {
+	Type string    `json:"type"`
+	ID   string    `json:"id"`
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// Handler отдаёт внутренние эндпоинты для монтирования под /cluster. Они работают только
+// с локальным хранилищем узла:
+//
+//	POST /update  — одна серия, в ответе новое значение;
+//	POST /updates — батч, часть с types.BatchIDHeader применяется один раз;
+//	GET  /metrics — все локальные серии;
+//	POST /value   — значение одной серии;
+//	POST /samples — история одной серии, 501 если история выключена;
+//	POST /delete  — удаление серии, по префиксу или по метке.
+//
+// maxBatch ограничивает длину батча в /updates так же, как публичный /updates/; 0 снимает
+// ограничение.
+func (c *Cluster) Handler(maxBatch int) http.Handler {
+	rtr := chi.NewRouter()
+	rtr.Post("/update", c.handleUpdate)
+	rtr.Post("/updates", func(w http.ResponseWriter, r *http.Request) {
+		c.handleUpdates(w, r, maxBatch)
+	})
+	rtr.Get("/metrics", c.handleMetrics)
+	rtr.Post("/value", c.handleValue)
+	rtr.Post("/samples", c.handleSamples)
+	rtr.Post("/delete", c.handleDelete)
+	return rtr
+}
+
+func (c *Cluster) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	var mtr types.Metrics
+	if err := json.NewDecoder(r.Body).Decode(&mtr); err != nil {
+		http.Error(w, "Unable to decode json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validate(mtr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var value string
+	if mtr.MType == types.Counter {
+		value = fmt.Sprint(*mtr.Delta)
+	} else {
+		value = fmt.Sprint(*mtr.Value)
+	}
+	res, err := c.local.UpdateMetric(r.Context(), mtr.MType, mtr.ID, value)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	switch v := res.(type) {
+	case int64:
+		mtr.Delta = &v
+	case float64:
+		mtr.Value = &v
+	}
+	c.writeJSON(w, mtr)
+}
+
+func (c *Cluster) handleUpdates(w http.ResponseWriter, r *http.Request, maxBatch int) {
+	var metrics []types.Metrics
+	if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+		http.Error(w, "Unable to decode json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if maxBatch > 0 && len(metrics) > maxBatch {
+		http.Error(w, fmt.Sprintf("batch of %d metrics exceeds the limit of %d", len(metrics), maxBatch), http.StatusRequestEntityTooLarge)
+		return
+	}
+	ctx := r.Context()
+	if id := r.Header.Get(types.BatchIDHeader); id != "" {
+		ctx = store.WithBatchID(ctx, id)
+	}
+	if err := c.applyLocal(ctx, metrics); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *Cluster) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	all := c.local.GetMetrics(r.Context())
+	if all == nil {
+		http.Error(w, "Unable to read storage", http.StatusInternalServerError)
+		return
+	}
+	c.writeJSON(w, store.Flatten(all))
+}
+
+func (c *Cluster) handleValue(w http.ResponseWriter, r *http.Request) {
+	var req types.Metrics
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Unable to decode json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	value, ok, err := c.localValue(r.Context(), req.MType, req.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.writeJSON(w, valueResponse{Found: ok, Value: value})
+}
+
+func (c *Cluster) handleSamples(w http.ResponseWriter, r *http.Request) {
+	var req samplesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Unable to decode json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	samples, err := c.localSamples(r.Context(), req.Type, req.ID, req.From, req.To)
+	switch {
+	case errors.Is(err, types.ErrNoHistory):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	case err != nil:
+		writeError(w, err)
+		return
+	}
+	c.writeJSON(w, samples)
+}
+
+func (c *Cluster) handleDelete(w http.ResponseWriter, r *http.Request) {
+	var req deleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Unable to decode json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n, err := c.localDelete(r.Context(), req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	c.writeJSON(w, deleteResponse{Deleted: n})
+}
+
+func (c *Cluster) localDelete(ctx context.Context, req deleteRequest) (int, error) {
+	switch req.Op {
+	case deleteMetric:
+		ok, err := c.local.DeleteMetric(ctx, req.Type, req.ID)
+		if ok {
+			return 1, err
+		}
+		return 0, err
+	case deletePrefix:
+		return c.local.DeleteMetricsByPrefix(ctx, req.Key)
+	case deleteLabel:
+		return c.local.DeleteMetricsByLabel(ctx, req.Key, req.Value)
+	default:
+		return 0, fmt.Errorf("unknown delete operation %q", req.Op)
+	}
+}
+
+// writeError отвечает 400 на некорректные данные и 500 на сбой локального хранилища:
+// узел, переславший запрос, отличает по коду отказ от временной ошибки.
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	if types.IsInvalid(err) {
+		code = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), code)
+}
+
+func (c *Cluster) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		c.logger.Error("failed to write cluster response", zap.Error(err))
+	}
+}
@@ -0,0 +1,78 @@
+package cluster
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+// virtualNodes — точек на кольце на один узел: чем больше, тем ровнее распределение серий.
+const virtualNodes = 128
+
+// Ring распределяет серии по узлам согласованным хешированием: при добавлении или
+// удалении узла переезжает лишь доля серий, примерно равная 1/N.
+type Ring struct {
+	points []point
+}
+
+type point struct {
+	hash   uint64
+	member string
+}
+
+func NewRing(members []string) *Ring {
+	r := &Ring{points: make([]point, 0, len(members)*virtualNodes)}
+	for _, m := range members {
+		for i := 0; i < virtualNodes; i++ {
+			r.points = append(r.points, point{hash: hash(m + "#" + strconv.Itoa(i)), member: m})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash == r.points[j].hash {
+			return r.points[i].member < r.points[j].member
+		}
+		return r.points[i].hash < r.points[j].hash
+	})
+
+	return r
+}
+
+// Owner возвращает узел, хранящий серию id. Ключ — имя с метками в каноническом виде,
+// поэтому порядок меток в запросе не влияет на выбор узла.
+func (r *Ring) Owner(id string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	h := hash(seriesKey(id))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].member
+}
+
+func seriesKey(id string) string {
+	name, labels, err := types.ParseSeriesID(id)
+	if err != nil {
+		return id
+	}
+	return types.SeriesID(name, labels)
+}
+
+// hash — FNV-1a с перемешиванием из splitmix64: у похожих строк FNV даёт близкие значения,
+// а точки кольца должны быть разбросаны равномерно.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,282 @@
+// Package federation пересылает метрики пограничного сервера на центральный.
+//
+// Пограничный сервер собирает метрики агентов своего датацентра и раз в интервал
+// отправляет на /updates/ родителя свёрнутый батч: текущие значения gauge и приращения
+// counter с прошлой отправки. Каждая серия получает метку edge с именем узла; метка,
+// поставленная нижним уровнем иерархии, сохраняется. Пока родитель недоступен, данные
+// копятся в Outbox и уходят после восстановления связи.
+package federation
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/store"
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+// EdgeLabel — метка, которой помечаются серии пограничного сервера.
+const EdgeLabel = "edge"
+
+const (
+	upstreamTimeout = 10 * time.Second
+	shutdownTimeout = 5 * time.Second
+
+	// batchSize держит запросы к родителю ниже его ограничения на длину батча; если
+	// родитель ограничивает размер тела сильнее, батч уменьшается после ответа 413.
+	batchSize = 1000
+)
+
+// Snapshotter — хранилище, с которого снимаются пересылаемые данные.
+type Snapshotter interface {
+	GetMetrics(ctx context.Context) map[string]store.Metric
+}
+
+// Config описывает пересылку на родительский сервер.
+type Config struct {
+	// URL — адрес родителя; если схема не указана, подставляется https:// при заданном TLS
+	// и http:// без него.
+	URL string
+	// Edge — значение метки edge.
+	Edge     string
+	Token    string
+	Interval time.Duration
+	// Outbox — каталог для неотправленных данных; пустой каталог держит их только в памяти.
+	Outbox string
+	// TLS проверяет сертификат родителя и предъявляет ему клиентский сертификат.
+	TLS *tls.Config
+}
+
+// Forwarder периодически отправляет данные локального хранилища родителю.
+type Forwarder struct {
+	logger  *zap.Logger
+	storage Snapshotter
+	cfg     Config
+	outbox  *Outbox
+	client  *http.Client
+
+	mu sync.Mutex
+	// batch — размер батча; уменьшается, если родитель ограничивает тело запроса сильнее.
+	batch int
+}
+
+var (
+	// errRejected — родитель отверг батч, и повторная отправка того же батча не поможет.
+	errRejected = errors.New("batch rejected by upstream")
+	// errTooLarge — тело запроса больше, чем принимает родитель; батч нужно разделить.
+	errTooLarge = errors.New("batch too large for upstream")
+)
+
+// NewForwarder возвращает nil, если адрес родителя не задан.
+func NewForwarder(logger *zap.Logger, storage Snapshotter, cfg Config) (*Forwarder, error) {
+	if cfg.URL == "" {
+		return nil, nil
+	}
+	if cfg.Edge == "" {
+		return nil, errors.New("edge label is required for upstream forwarding")
+	}
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("invalid upstream interval %s", cfg.Interval)
+	}
+	client := &http.Client{Timeout: upstreamTimeout}
+	scheme := "http://"
+	if cfg.TLS != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = cfg.TLS
+		client.Transport = transport
+		scheme = "https://"
+	}
+	if !strings.HasPrefix(cfg.URL, "http://") && !strings.HasPrefix(cfg.URL, "https://") {
+		cfg.URL = scheme + cfg.URL
+	}
+	cfg.URL = strings.TrimSuffix(cfg.URL, "/")
+
+	outbox, err := OpenOutbox(cfg.Outbox)
+	if err != nil {
+		return nil, fmt.Errorf("open upstream outbox: %w", err)
+	}
+	if cfg.Outbox == "" {
+		logger.Warn("Upstream outbox is kept in memory, unsent data is lost on restart")
+	}
+
+	return &Forwarder{
+		logger:  logger,
+		storage: storage,
+		cfg:     cfg,
+		outbox:  outbox,
+		client:  client,
+		batch:   batchSize,
+	}, nil
+}
+
+// Start отправляет данные раз в интервал, а при остановке делает последнюю попытку.
+func (f *Forwarder) Start(ctx context.Context) {
+	ticker := time.NewTicker(f.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			f.push(ctx)
+			cancel()
+			return
+		case <-ticker.C:
+			f.push(ctx)
+		}
+	}
+}
+
+func (f *Forwarder) push(ctx context.Context) {
+	if err := f.Push(ctx); err != nil {
+		f.logger.Warn("failed to forward metrics upstream",
+			zap.String("upstream", f.cfg.URL), zap.Int("pending", len(f.outbox.Pending())), zap.Error(err))
+	}
+}
+
+// Push снимает приращения с хранилища, добавляет их в outbox и отправляет всё
+// накопленное родителю. Доставка «хотя бы один раз»: если родитель принял батч,
+// но ответ не дошёл, приращения counter будут отправлены повторно.
+func (f *Forwarder) Push(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	all := f.storage.GetMetrics(ctx)
+	if all == nil {
+		return errors.New("unable to read local storage")
+	}
+
+	batch, sent := f.rollup(store.Flatten(all))
+	if err := f.outbox.Add(batch, sent); err != nil {
+		f.logger.Error("failed to save upstream outbox", zap.Error(err))
+	}
+
+	for pending := f.outbox.Pending(); len(pending) > 0; pending = f.outbox.Pending() {
+		part := pending
+		if len(part) > f.batch {
+			part = part[:f.batch]
+		}
+
+		err := f.send(ctx, part)
+		if errors.Is(err, errTooLarge) && len(part) > 1 {
+			f.batch = len(part) / 2
+			f.logger.Warn("upstream rejected batch as too large, splitting", zap.Int("batch", f.batch))
+			continue
+		}
+		if errors.Is(err, errTooLarge) || errors.Is(err, errRejected) {
+			f.logger.Error("dropping batch rejected by upstream", zap.Int("series", len(part)), zap.Error(err))
+		} else if err != nil {
+			return err
+		}
+
+		if err = f.outbox.Done(len(part)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rollup строит батч с текущими gauge и приращениями counter относительно последних
+// отправленных значений. Counter, ставший меньше (серию удалили и создали заново или
+// хранилище пограничного сервера не пережило перезапуск), отправляется целиком.
+func (f *Forwarder) rollup(metrics []types.Metrics) ([]types.Metrics, map[string]int64) {
+	prev := f.outbox.state.Sent
+	sent := make(map[string]int64, len(prev))
+
+	var batch []types.Metrics
+	for _, m := range metrics {
+		switch m.MType {
+		case types.Gauge:
+			batch = append(batch, types.Metrics{ID: f.label(m.ID), MType: m.MType, Value: m.Value})
+		case types.Counter:
+			total := *m.Delta
+			sent[m.ID] = total
+
+			d := total
+			if last, ok := prev[m.ID]; ok && total >= last {
+				d = total - last
+			}
+			if d == 0 {
+				continue
+			}
+			batch = append(batch, types.Metrics{ID: f.label(m.ID), MType: m.MType, Delta: &d})
+		}
+	}
+
+	return batch, sent
+}
+
+func (f *Forwarder) label(id string) string {
+	name, labels, err := types.ParseSeriesID(id)
+	if err != nil {
+		return id
+	}
+	if _, ok := labels[EdgeLabel]; ok {
+		return id
+	}
+	labels[EdgeLabel] = f.cfg.Edge
+	return types.SeriesID(name, labels)
+}
+
+func (f *Forwarder) send(ctx context.Context, metrics []types.Metrics) error {
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err = zw.Write(data); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.cfg.URL+"/updates/", &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	if f.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.cfg.Token)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	switch {
+	case resp.StatusCode == http.StatusRequestEntityTooLarge:
+		return fmt.Errorf("%w: %v", errTooLarge, err)
+	case resp.StatusCode == http.StatusBadRequest, resp.StatusCode == http.StatusUnprocessableEntity:
+		// Родитель отвечает 400 только на некорректные данные; сбой его хранилища — 5xx.
+		return fmt.Errorf("%w: %v", errRejected, err)
+	default:
+		// Остальные ответы (перегрузка, авторизация, недоступность) временные: батч
+		// остаётся в outbox до следующей попытки.
+		return err
+	}
+}
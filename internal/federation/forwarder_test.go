@@ -0,0 +1,211 @@
+package federation
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/server"
+	"github.com/shevchukeugeni/metrics/internal/store"
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+type parent struct {
+	storage *store.MemStorage
+	ts      *httptest.Server
+	down    atomic.Bool
+}
+
+func startParent(t *testing.T) *parent {
+	p := &parent{storage: store.NewMemStorage()}
+	router := server.SetupRouter(zap.NewNop(), p.storage, nil, nil)
+	p.ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p.down.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		router.ServeHTTP(w, r)
+	}))
+	t.Cleanup(p.ts.Close)
+	return p
+}
+
+func newForwarder(t *testing.T, edge *store.MemStorage, url, outbox string) *Forwarder {
+	f, err := NewForwarder(zap.NewNop(), edge, Config{URL: url, Edge: "dc1", Interval: time.Second, Outbox: outbox})
+	require.NoError(t, err)
+	return f
+}
+
+func TestForwarder_Push(t *testing.T) {
+	ctx := context.Background()
+	p := startParent(t)
+	edge := store.NewMemStorage()
+	f := newForwarder(t, edge, p.ts.URL, "")
+
+	_, err := edge.UpdateMetric(ctx, types.Counter, "PollCount", "5")
+	require.NoError(t, err)
+	_, err = edge.UpdateMetric(ctx, types.Gauge, `cpu{host="a"}`, "0.5")
+	require.NoError(t, err)
+	_, err = edge.UpdateMetric(ctx, types.Gauge, `cpu{edge="rack7",host="b"}`, "1")
+	require.NoError(t, err)
+	require.NoError(t, f.Push(ctx))
+
+	_, err = edge.UpdateMetric(ctx, types.Counter, "PollCount", "3")
+	require.NoError(t, err)
+	_, err = edge.UpdateMetric(ctx, types.Gauge, `cpu{host="a"}`, "0.75")
+	require.NoError(t, err)
+	require.NoError(t, f.Push(ctx))
+	require.NoError(t, f.Push(ctx))
+
+	assert.Equal(t, map[string]string{`PollCount{edge="dc1"}`: "8"}, p.storage.GetMetric(ctx, types.Counter))
+	assert.Equal(t, map[string]string{
+		`cpu{edge="dc1",host="a"}`:   "0.75",
+		`cpu{edge="rack7",host="b"}`: "1",
+	}, p.storage.GetMetric(ctx, types.Gauge))
+
+	// Counter, созданный заново, отправляется целиком.
+	_, err = edge.DeleteMetric(ctx, types.Counter, "PollCount")
+	require.NoError(t, err)
+	_, err = edge.UpdateMetric(ctx, types.Counter, "PollCount", "2")
+	require.NoError(t, err)
+	require.NoError(t, f.Push(ctx))
+	assert.Equal(t, "10", p.storage.GetMetric(ctx, types.Counter)[`PollCount{edge="dc1"}`])
+}
+
+func TestForwarder_Outage(t *testing.T) {
+	ctx := context.Background()
+	p := startParent(t)
+	edge := store.NewMemStorage()
+	dir := t.TempDir()
+	f := newForwarder(t, edge, p.ts.URL, dir)
+
+	p.down.Store(true)
+	for i := 0; i < 3; i++ {
+		_, err := edge.UpdateMetric(ctx, types.Counter, "PollCount", "1")
+		require.NoError(t, err)
+		_, err = edge.UpdateMetric(ctx, types.Gauge, "Alloc", strconv.Itoa(10+i))
+		require.NoError(t, err)
+		assert.Error(t, f.Push(ctx))
+	}
+	assert.Len(t, f.outbox.Pending(), 2, "pending batches are merged")
+
+	// Outbox переживает перезапуск пограничного сервера.
+	f = newForwarder(t, edge, p.ts.URL, dir)
+	_, err := edge.UpdateMetric(ctx, types.Counter, "PollCount", "1")
+	require.NoError(t, err)
+
+	p.down.Store(false)
+	require.NoError(t, f.Push(ctx))
+	assert.Empty(t, f.outbox.Pending())
+	assert.Equal(t, map[string]string{`PollCount{edge="dc1"}`: "4"}, p.storage.GetMetric(ctx, types.Counter))
+	assert.Equal(t, map[string]string{`Alloc{edge="dc1"}`: "12"}, p.storage.GetMetric(ctx, types.Gauge))
+}
+
+func TestForwarder_Rejected(t *testing.T) {
+	ctx := context.Background()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad batch", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	edge := store.NewMemStorage()
+	f := newForwarder(t, edge, ts.URL, "")
+	_, err := edge.UpdateMetric(ctx, types.Counter, "PollCount", "1")
+	require.NoError(t, err)
+
+	// Отвергнутый батч не блокирует outbox навсегда.
+	require.NoError(t, f.Push(ctx))
+	assert.Empty(t, f.outbox.Pending())
+}
+
+func TestForwarder_TransientErrors(t *testing.T) {
+	ctx := context.Background()
+	for _, code := range []int{http.StatusInternalServerError, http.StatusNotFound, http.StatusConflict} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "storage failure", code)
+		}))
+
+		edge := store.NewMemStorage()
+		f := newForwarder(t, edge, ts.URL, "")
+		_, err := edge.UpdateMetric(ctx, types.Counter, "PollCount", "1")
+		require.NoError(t, err)
+
+		// Только 400 означает неверный батч: остальное не должно терять приращения.
+		assert.Error(t, f.Push(ctx))
+		assert.Len(t, f.outbox.Pending(), 1, "status %d", code)
+		ts.Close()
+	}
+}
+
+func TestNewForwarder(t *testing.T) {
+	edge := store.NewMemStorage()
+
+	f, err := NewForwarder(zap.NewNop(), edge, Config{})
+	require.NoError(t, err)
+	assert.Nil(t, f)
+
+	_, err = NewForwarder(zap.NewNop(), edge, Config{URL: "parent:8080", Interval: time.Second})
+	assert.Error(t, err)
+
+	f, err = NewForwarder(zap.NewNop(), edge, Config{URL: "parent:8080/", Edge: "dc1", Interval: time.Second})
+	require.NoError(t, err)
+	assert.Equal(t, "http://parent:8080", f.cfg.URL)
+}
+
+func TestForwarder_Batches(t *testing.T) {
+	ctx := context.Background()
+	parent := store.NewMemStorage()
+	router := server.SetupRouter(zap.NewNop(), parent, nil, nil, server.WithLimits(server.Limits{MaxBatch: batchSize}))
+
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		router.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	edge := store.NewMemStorage()
+	var batch []types.Metrics
+	for i := 0; i < 2*batchSize+500; i++ {
+		v := float64(i)
+		batch = append(batch, types.Metrics{ID: "g" + strconv.Itoa(i), MType: types.Gauge, Value: &v})
+	}
+	require.NoError(t, edge.UpdateMetrics(ctx, batch))
+
+	// Батч больше ограничения родителя уходит частями.
+	f := newForwarder(t, edge, ts.URL, "")
+	require.NoError(t, f.Push(ctx))
+	assert.Equal(t, int32(3), requests.Load())
+	assert.Len(t, parent.GetMetric(ctx, types.Gauge), len(batch))
+}
+
+func TestForwarder_TooLarge(t *testing.T) {
+	ctx := context.Background()
+	parent := store.NewMemStorage()
+	router := server.SetupRouter(zap.NewNop(), parent, nil, nil, server.WithLimits(server.Limits{MaxDecompressedSize: 16 << 10}))
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	edge := store.NewMemStorage()
+	var batch []types.Metrics
+	for i := 0; i < batchSize; i++ {
+		v := float64(i)
+		batch = append(batch, types.Metrics{ID: "gauge" + strconv.Itoa(i), MType: types.Gauge, Value: &v})
+	}
+	require.NoError(t, edge.UpdateMetrics(ctx, batch))
+
+	// Батч, который родитель отверг как слишком большой, делится, а не отбрасывается.
+	f := newForwarder(t, edge, ts.URL, "")
+	require.NoError(t, f.Push(ctx))
+	assert.Empty(t, f.outbox.Pending())
+	assert.Len(t, parent.GetMetric(ctx, types.Gauge), len(batch))
+	assert.Less(t, f.batch, batchSize)
+}
@@ -0,0 +1,137 @@
+package federation
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+const outboxFile = "outbox.json"
+
+// Outbox хранит неотправленные данные и накопленные значения counter, от которых
+// считаются приращения. Новый батч сливается с ожидающим: приращения counter
+// складываются, gauge заменяются, поэтому размер outbox не растёт дольше числа серий.
+// Оба поля сохраняются одной атомарной записью: после перезапуска приращения не
+// теряются и не отправляются повторно.
+type Outbox struct {
+	path  string
+	state outboxState
+}
+
+type outboxState struct {
+	Sent    map[string]int64 `json:"sent"`
+	Pending []types.Metrics  `json:"pending,omitempty"`
+}
+
+// OpenOutbox читает outbox из каталога dir. С пустым dir outbox живёт только в памяти.
+func OpenOutbox(dir string) (*Outbox, error) {
+	o := &Outbox{state: outboxState{Sent: map[string]int64{}}}
+	if dir == "" {
+		return o, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	o.path = filepath.Join(dir, outboxFile)
+
+	data, err := os.ReadFile(o.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return o, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &o.state); err != nil {
+		return nil, err
+	}
+	if o.state.Sent == nil {
+		o.state.Sent = map[string]int64{}
+	}
+
+	return o, nil
+}
+
+// Pending возвращает данные, ожидающие отправки.
+func (o *Outbox) Pending() []types.Metrics {
+	return o.state.Pending
+}
+
+// Add добавляет батч к ожидающим и запоминает накопленные значения counter.
+func (o *Outbox) Add(batch []types.Metrics, sent map[string]int64) error {
+	o.state.Pending = mergeBatch(o.state.Pending, batch)
+	o.state.Sent = sent
+	return o.save()
+}
+
+// Done отмечает первые n ожидающих серий как доставленные.
+func (o *Outbox) Done(n int) error {
+	o.state.Pending = o.state.Pending[n:]
+	if len(o.state.Pending) == 0 {
+		o.state.Pending = nil
+	}
+	return o.save()
+}
+
+func (o *Outbox) save() error {
+	if o.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(o.state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(o.path), outboxFile+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), o.path)
+}
+
+// mergeBatch сливает batch в pending: приращения counter складываются, для gauge
+// остаётся последнее значение.
+func mergeBatch(pending, batch []types.Metrics) []types.Metrics {
+	idx := make(map[string]int, len(pending))
+	for i, m := range pending {
+		idx[m.MType+"/"+m.ID] = i
+	}
+
+	for _, m := range batch {
+		i, ok := idx[m.MType+"/"+m.ID]
+		if !ok {
+			idx[m.MType+"/"+m.ID] = len(pending)
+			pending = append(pending, m)
+			continue
+		}
+
+		switch m.MType {
+		case types.Counter:
+			d := *pending[i].Delta + *m.Delta
+			pending[i].Delta = &d
+		case types.Gauge:
+			v := *m.Value
+			pending[i].Value = &v
+		}
+	}
+
+	return pending
+}
@@ -1,11 +1,13 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: github.com/shevchukeugeni/metrics/internal/server (interfaces: MetricStorage)
+// Source: github.com/shevchukeugeni/metrics/internal/store (interfaces: MetricStorage)
 
 // Package mocks is a generated GoMock package.
 package mocks
 
 import (
+	context "context"
 	reflect "reflect"
+	time "time"
 
 	gomock "github.com/golang/mock/gomock"
 	store "github.com/shevchukeugeni/metrics/internal/store"
@@ -35,59 +37,119 @@ func (m *MockMetricStorage) EXPECT() *MockMetricStorageMockRecorder {
 	return m.recorder
 }
 
+// DeleteMetric mocks base method.
+func (m *MockMetricStorage) DeleteMetric(arg0 context.Context, arg1, arg2 string) (bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteMetric", arg0, arg1, arg2)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteMetric indicates an expected call of DeleteMetric.
+func (mr *MockMetricStorageMockRecorder) DeleteMetric(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteMetric", reflect.TypeOf((*MockMetricStorage)(nil).DeleteMetric), arg0, arg1, arg2)
+}
+
+// DeleteMetricsByLabel mocks base method.
+func (m *MockMetricStorage) DeleteMetricsByLabel(arg0 context.Context, arg1, arg2 string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteMetricsByLabel", arg0, arg1, arg2)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteMetricsByLabel indicates an expected call of DeleteMetricsByLabel.
+func (mr *MockMetricStorageMockRecorder) DeleteMetricsByLabel(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteMetricsByLabel", reflect.TypeOf((*MockMetricStorage)(nil).DeleteMetricsByLabel), arg0, arg1, arg2)
+}
+
+// DeleteMetricsByPrefix mocks base method.
+func (m *MockMetricStorage) DeleteMetricsByPrefix(arg0 context.Context, arg1 string) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteMetricsByPrefix", arg0, arg1)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DeleteMetricsByPrefix indicates an expected call of DeleteMetricsByPrefix.
+func (mr *MockMetricStorageMockRecorder) DeleteMetricsByPrefix(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteMetricsByPrefix", reflect.TypeOf((*MockMetricStorage)(nil).DeleteMetricsByPrefix), arg0, arg1)
+}
+
 // GetMetric mocks base method.
-func (m *MockMetricStorage) GetMetric(arg0 string) map[string]string {
+func (m *MockMetricStorage) GetMetric(arg0 context.Context, arg1 string) map[string]string {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetMetric", arg0)
+	ret := m.ctrl.Call(m, "GetMetric", arg0, arg1)
 	ret0, _ := ret[0].(map[string]string)
 	return ret0
 }
 
 // GetMetric indicates an expected call of GetMetric.
-func (mr *MockMetricStorageMockRecorder) GetMetric(arg0 interface{}) *gomock.Call {
+func (mr *MockMetricStorageMockRecorder) GetMetric(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMetric", reflect.TypeOf((*MockMetricStorage)(nil).GetMetric), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMetric", reflect.TypeOf((*MockMetricStorage)(nil).GetMetric), arg0, arg1)
 }
 
 // GetMetrics mocks base method.
-func (m *MockMetricStorage) GetMetrics() map[string]store.Metric {
+func (m *MockMetricStorage) GetMetrics(arg0 context.Context) map[string]store.Metric {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetMetrics")
+	ret := m.ctrl.Call(m, "GetMetrics", arg0)
 	ret0, _ := ret[0].(map[string]store.Metric)
 	return ret0
 }
 
 // GetMetrics indicates an expected call of GetMetrics.
-func (mr *MockMetricStorageMockRecorder) GetMetrics() *gomock.Call {
+func (mr *MockMetricStorageMockRecorder) GetMetrics(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMetrics", reflect.TypeOf((*MockMetricStorage)(nil).GetMetrics), arg0)
+}
+
+// PurgeStale mocks base method.
+func (m *MockMetricStorage) PurgeStale(arg0 context.Context, arg1 time.Time) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PurgeStale", arg0, arg1)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PurgeStale indicates an expected call of PurgeStale.
+func (mr *MockMetricStorageMockRecorder) PurgeStale(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMetrics", reflect.TypeOf((*MockMetricStorage)(nil).GetMetrics))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PurgeStale", reflect.TypeOf((*MockMetricStorage)(nil).PurgeStale), arg0, arg1)
 }
 
 // UpdateMetric mocks base method.
-func (m *MockMetricStorage) UpdateMetric(arg0, arg1, arg2 string) (interface{}, error) {
+func (m *MockMetricStorage) UpdateMetric(arg0 context.Context, arg1, arg2, arg3 string) (interface{}, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UpdateMetric", arg0, arg1, arg2)
+	ret := m.ctrl.Call(m, "UpdateMetric", arg0, arg1, arg2, arg3)
 	ret0, _ := ret[0].(interface{})
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // UpdateMetric indicates an expected call of UpdateMetric.
-func (mr *MockMetricStorageMockRecorder) UpdateMetric(arg0, arg1, arg2 interface{}) *gomock.Call {
+func (mr *MockMetricStorageMockRecorder) UpdateMetric(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateMetric", reflect.TypeOf((*MockMetricStorage)(nil).UpdateMetric), arg0, arg1, arg2)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateMetric", reflect.TypeOf((*MockMetricStorage)(nil).UpdateMetric), arg0, arg1, arg2, arg3)
 }
 
 // UpdateMetrics mocks base method.
-func (m *MockMetricStorage) UpdateMetrics(arg0 []types.Metrics) error {
+func (m *MockMetricStorage) UpdateMetrics(arg0 context.Context, arg1 []types.Metrics) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UpdateMetrics", arg0)
+	ret := m.ctrl.Call(m, "UpdateMetrics", arg0, arg1)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // UpdateMetrics indicates an expected call of UpdateMetrics.
-func (mr *MockMetricStorageMockRecorder) UpdateMetrics(arg0 interface{}) *gomock.Call {
+func (mr *MockMetricStorageMockRecorder) UpdateMetrics(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateMetrics", reflect.TypeOf((*MockMetricStorage)(nil).UpdateMetrics), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateMetrics", reflect.TypeOf((*MockMetricStorage)(nil).UpdateMetrics), arg0, arg1)
 }
@@ -0,0 +1,50 @@
+// Package ratelimit ограничивает частоту операций алгоритмом token bucket.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Bucket пополняется со скоростью rate токенов в секунду и вмещает не больше burst.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket создаёт полное ведро. При burst <= 0 ёмкость равна секундному запасу, но не меньше одного токена.
+func NewBucket(rate float64, burst int) *Bucket {
+	b := float64(burst)
+	if b <= 0 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &Bucket{rate: rate, burst: b, tokens: b}
+}
+
+// Take списывает n токенов. Если их не хватает, ничего не списывается и возвращается
+// время, через которое запрос пройдёт. Запрос больше ёмкости пропускается при полном
+// ведре и уводит его в минус, иначе он не прошёл бы никогда.
+func (b *Bucket) Take(now time.Time, n int) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	if now.After(b.last) {
+		b.last = now
+	}
+
+	need := math.Min(float64(n), b.burst)
+	if b.tokens >= need {
+		b.tokens -= float64(n)
+		return true, 0
+	}
+
+	wait := time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+	return false, wait
+}
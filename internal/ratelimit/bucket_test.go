@@ -0,0 +1,41 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucket_Take(t *testing.T) {
+	now := time.Now()
+	b := NewBucket(10, 20)
+
+	ok, _ := b.Take(now, 15)
+	assert.True(t, ok)
+	ok, wait := b.Take(now, 10)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	ok, _ = b.Take(now.Add(500*time.Millisecond), 10)
+	assert.True(t, ok)
+
+	// Батч больше ёмкости проходит только при полном ведре и оставляет долг.
+	later := now.Add(time.Hour)
+	ok, _ = b.Take(later, 30)
+	assert.True(t, ok)
+	ok, wait = b.Take(later, 1)
+	assert.False(t, ok)
+	assert.Equal(t, 1100*time.Millisecond, wait)
+}
+
+func TestNewBucket_DefaultBurst(t *testing.T) {
+	now := time.Now()
+
+	b := NewBucket(0.5, 0)
+	ok, _ := b.Take(now, 1)
+	assert.True(t, ok)
+	ok, wait := b.Take(now, 1)
+	assert.False(t, ok)
+	assert.Equal(t, 2*time.Second, wait)
+}
@@ -0,0 +1,46 @@
+// Package replication передаёт изменения хранилища с ведущего сервера на ведомые.
+//
+// Ведущий оборачивает своё хранилище в Leader: каждое успешное изменение получает
+// порядковый номер и рассылается подписчикам потоком JSON-событий (по одному в строке)
+// через GET /replication/stream. При подключении ведомый получает снимок хранилища или,
+// если он отстал ненадолго, пропущенные события из буфера ведущего. Counter передаются
+// приращениями, поэтому каждое событие применяется ровно один раз: снимок снимается
+// под той же блокировкой, что и запись с публикацией.
+package replication
+
+import (
+	"time"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+const (
+	// OpSnapshot заменяет всё хранилище ведомого; Seq — номер последнего вошедшего в снимок события.
+	OpSnapshot = "snapshot"
+	// OpResume сообщает, что вслед идут пропущенные события начиная с Seq+1.
+	OpResume = "resume"
+	// OpHeartbeat передаёт текущий номер ведущего, чтобы ведомый мог посчитать отставание.
+	OpHeartbeat = "heartbeat"
+
+	OpUpdate       = "update"
+	OpDelete       = "delete"
+	OpDeletePrefix = "delete_prefix"
+	OpDeleteLabel  = "delete_label"
+	OpPurge        = "purge"
+	// OpReplace заменяет всё хранилище ведомого, как снимок, но идёт в общем порядке событий.
+	OpReplace = "replace"
+)
+
+// Event — одно изменение хранилища ведущего.
+type Event struct {
+	Seq  uint64    `json:"seq"`
+	Op   string    `json:"op"`
+	Time time.Time `json:"ts"`
+	// Epoch меняется при каждом запуске ведущего: номера разных запусков несравнимы.
+	Epoch string `json:"epoch,omitempty"`
+
+	Metrics []types.Metrics `json:"metrics,omitempty"`
+	Key     string          `json:"key,omitempty"`
+	Value   string          `json:"value,omitempty"`
+	Before  *time.Time      `json:"before,omitempty"`
+}
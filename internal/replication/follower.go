@@ -0,0 +1,341 @@
+package replication
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/store"
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// streamTimeout — сколько ведомый ждёт любого события, включая heartbeat, прежде чем
+// считать соединение с ведущим зависшим и переподключиться.
+var streamTimeout = 5 * heartbeatInterval
+
+var errStreamStalled = errors.New("replication stream stalled: no events from leader")
+
+// Follower подписывается на поток ведущего и применяет события к своему хранилищу.
+type Follower struct {
+	logger  *zap.Logger
+	leader  string
+	token   string
+	client  *http.Client
+	storage store.MetricStorage
+
+	mu      sync.Mutex
+	status  FollowerStatus
+	cancel  context.CancelFunc
+	stopped bool
+}
+
+// FollowerStatus — состояние ведомого для /replication/status.
+type FollowerStatus struct {
+	Leader    string `json:"leader"`
+	Connected bool   `json:"connected"`
+	Promoted  bool   `json:"promoted,omitempty"`
+	Epoch     string `json:"epoch,omitempty"`
+	// AppliedSeq — номер последнего применённого события ведущего.
+	AppliedSeq uint64 `json:"applied_seq"`
+	// LeaderSeq — последний известный номер ведущего (из событий и heartbeat).
+	LeaderSeq uint64 `json:"leader_seq"`
+	// LagEvents — сколько событий ведущего ещё не применено.
+	LagEvents uint64 `json:"lag_events"`
+	// LagSeconds — задержка между публикацией последнего события на ведущем и его применением.
+	LagSeconds  float64    `json:"lag_seconds"`
+	LastEventAt *time.Time `json:"last_event_at,omitempty"`
+	Snapshots   uint64     `json:"snapshots"`
+	Reconnects  uint64     `json:"reconnects"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+// NewFollower создаёт ведомого для ведущего по адресу leader (например http://10.0.0.1:8080).
+// token передаётся в Authorization: Bearer, если на ведущем включены /admin эндпоинты.
+// С tc адрес без схемы считается https, а ведомый предъявляет ведущему сертификат из tc.
+func NewFollower(logger *zap.Logger, leader, token string, tc *tls.Config, ms store.MetricStorage) *Follower {
+	client := &http.Client{}
+	scheme := "http://"
+	if tc != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tc
+		client.Transport = transport
+		scheme = "https://"
+	}
+	if !strings.HasPrefix(leader, "http://") && !strings.HasPrefix(leader, "https://") {
+		leader = scheme + leader
+	}
+
+	return &Follower{
+		logger:  logger,
+		leader:  strings.TrimSuffix(leader, "/"),
+		token:   token,
+		client:  client,
+		storage: ms,
+		status:  FollowerStatus{Leader: leader},
+	}
+}
+
+// Start держит подписку до отмены ctx или Promote, переподключаясь с растущей паузой.
+func (f *Follower) Start(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	f.mu.Lock()
+	if f.stopped {
+		f.mu.Unlock()
+		cancel()
+		return
+	}
+	f.cancel = cancel
+	f.mu.Unlock()
+	defer cancel()
+
+	delay := minReconnectDelay
+	for {
+		err := f.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		f.mu.Lock()
+		f.status.Connected = false
+		f.status.Reconnects++
+		if err != nil {
+			f.status.LastError = err.Error()
+		}
+		applied := f.status.AppliedSeq
+		f.mu.Unlock()
+
+		f.logger.Warn("replication stream lost", zap.String("leader", f.leader), zap.Error(err),
+			zap.Uint64("applied_seq", applied), zap.Duration("retry_in", delay))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// Promote останавливает репликацию: после этого узел работает как самостоятельный сервер
+// с тем состоянием, которое успел получить.
+func (f *Follower) Promote() FollowerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.stopped = true
+	if f.cancel != nil {
+		f.cancel()
+	}
+	f.status.Connected = false
+	f.status.Promoted = true
+
+	f.logger.Info("replica promoted", zap.Uint64("applied_seq", f.status.AppliedSeq))
+
+	return f.status
+}
+
+// ReadOnly возвращает адрес ведущего и true, пока ведомый не повышен: до этого записи
+// принимает только ведущий.
+func (f *Follower) ReadOnly() (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.leader, !f.status.Promoted
+}
+
+func (f *Follower) Status() FollowerStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.status
+}
+
+func (f *Follower) follow(ctx context.Context) error {
+	f.mu.Lock()
+	q := url.Values{}
+	if f.status.Epoch != "" {
+		q.Set("epoch", f.status.Epoch)
+		q.Set("from", strconv.FormatUint(f.status.AppliedSeq, 10))
+	}
+	f.mu.Unlock()
+
+	// Ведущий шлёт heartbeat каждую секунду, поэтому тишина дольше streamTimeout значит, что
+	// соединение зависло (например, пропал сетевой путь без RST), и чтение нужно прервать.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	watchdog := time.AfterFunc(streamTimeout, func() { cancel(errStreamStalled) })
+	defer watchdog.Stop()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.leader+"/replication/stream?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return stalled(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader responded %s", resp.Status)
+	}
+
+	f.mu.Lock()
+	f.status.Connected = true
+	f.status.LastError = ""
+	f.mu.Unlock()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev Event
+		if err = dec.Decode(&ev); err != nil {
+			return stalled(ctx, err)
+		}
+		// Применение большого снимка может идти дольше streamTimeout: на это время сторож
+		// останавливается.
+		watchdog.Stop()
+		if err = f.apply(ctx, ev); err != nil {
+			// Состояние могло примениться частично: следующий раз начинаем со снимка.
+			f.mu.Lock()
+			f.status.Epoch = ""
+			f.mu.Unlock()
+			return err
+		}
+		watchdog.Reset(streamTimeout)
+	}
+}
+
+func (f *Follower) apply(ctx context.Context, ev Event) error {
+	f.mu.Lock()
+	applied, epoch := f.status.AppliedSeq, f.status.Epoch
+	f.mu.Unlock()
+
+	switch ev.Op {
+	case OpHeartbeat:
+		f.mu.Lock()
+		f.status.LeaderSeq = ev.Seq
+		f.status.LagEvents = lag(ev.Seq, f.status.AppliedSeq)
+		if f.status.LagEvents == 0 {
+			f.status.LagSeconds = 0
+		}
+		f.mu.Unlock()
+		return nil
+	case OpResume:
+		if ev.Epoch != epoch || ev.Seq != applied {
+			return fmt.Errorf("leader resumed from %s/%d, expected %s/%d", ev.Epoch, ev.Seq, epoch, applied)
+		}
+		return nil
+	case OpSnapshot:
+		if err := f.replace(ctx, ev.Metrics); err != nil {
+			return err
+		}
+		f.logger.Info("replica loaded snapshot", zap.Uint64("seq", ev.Seq), zap.Int("series", len(ev.Metrics)))
+
+		f.mu.Lock()
+		f.status.Epoch = ev.Epoch
+		f.status.Snapshots++
+		f.mu.Unlock()
+	default:
+		if ev.Seq != applied+1 {
+			return fmt.Errorf("replication gap: got event %d after %d", ev.Seq, applied)
+		}
+		if err := f.applyChange(ctx, ev); err != nil {
+			return fmt.Errorf("apply event %d: %w", ev.Seq, err)
+		}
+	}
+
+	now := time.Now()
+	f.mu.Lock()
+	f.status.AppliedSeq = ev.Seq
+	if ev.Seq > f.status.LeaderSeq {
+		f.status.LeaderSeq = ev.Seq
+	}
+	f.status.LagEvents = lag(f.status.LeaderSeq, ev.Seq)
+	f.status.LagSeconds = now.Sub(ev.Time).Seconds()
+	f.status.LastEventAt = &now
+	f.mu.Unlock()
+
+	return nil
+}
+
+func (f *Follower) applyChange(ctx context.Context, ev Event) error {
+	var err error
+	switch ev.Op {
+	case OpUpdate:
+		err = f.storage.UpdateMetrics(ctx, ev.Metrics)
+	case OpDelete:
+		for _, mtr := range ev.Metrics {
+			if _, err = f.storage.DeleteMetric(ctx, mtr.MType, mtr.ID); err != nil {
+				break
+			}
+		}
+	case OpDeletePrefix:
+		_, err = f.storage.DeleteMetricsByPrefix(ctx, ev.Key)
+	case OpDeleteLabel:
+		_, err = f.storage.DeleteMetricsByLabel(ctx, ev.Key, ev.Value)
+	case OpPurge:
+		if ev.Before == nil {
+			return errors.New("purge without boundary")
+		}
+		_, err = f.storage.PurgeStale(ctx, *ev.Before)
+	case OpReplace:
+		err = f.replace(ctx, ev.Metrics)
+	default:
+		return fmt.Errorf("unknown operation %q", ev.Op)
+	}
+	return err
+}
+
+// replace заменяет содержимое хранилища одним шагом, если оно это умеет, иначе очищает
+// его и загружает серии заново.
+func (f *Follower) replace(ctx context.Context, metrics []types.Metrics) error {
+	if rp, ok := f.storage.(store.Replacer); ok {
+		if err := rp.ReplaceMetrics(ctx, metrics); !errors.Is(err, types.ErrNoReplace) {
+			return err
+		}
+	}
+
+	if _, err := f.storage.DeleteMetricsByPrefix(ctx, ""); err != nil {
+		return err
+	}
+	if len(metrics) == 0 {
+		return nil
+	}
+	return f.storage.UpdateMetrics(ctx, metrics)
+}
+
+// stalled подменяет ошибку чтения причиной, если поток прервал сторож.
+func stalled(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); errors.Is(cause, errStreamStalled) {
+		return cause
+	}
+	return err
+}
+
+func lag(leader, applied uint64) uint64 {
+	if leader <= applied {
+		return 0
+	}
+	return leader - applied
+}
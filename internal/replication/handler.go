@@ -0,0 +1,91 @@
+package replication
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Status — ответ /replication/status; заполнены разделы тех ролей, что включены на узле.
+type Status struct {
+	Leader   *LeaderStatus   `json:"leader,omitempty"`
+	Follower *FollowerStatus `json:"follower,omitempty"`
+}
+
+// Handler отдаёт эндпоинты репликации для монтирования под /replication:
+// GET /stream (если задан leader), GET /status, GET /metrics и POST /promote (если задан follower).
+func Handler(leader *Leader, follower *Follower) http.Handler {
+	rtr := chi.NewRouter()
+
+	if leader != nil {
+		rtr.Get("/stream", leader.stream)
+	}
+	if follower != nil {
+		rtr.Post("/promote", func(w http.ResponseWriter, r *http.Request) {
+			st := follower.Promote()
+			writeJSON(w, Status{Follower: &st})
+		})
+	}
+	rtr.Get("/status", func(w http.ResponseWriter, r *http.Request) {
+		var res Status
+		if leader != nil {
+			st := leader.Status()
+			res.Leader = &st
+		}
+		if follower != nil {
+			st := follower.Status()
+			res.Follower = &st
+		}
+		writeJSON(w, res)
+	})
+	rtr.Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.WriteHeader(http.StatusOK)
+		if leader != nil {
+			writeLeaderMetrics(w, leader.Status())
+		}
+		if follower != nil {
+			writeFollowerMetrics(w, follower.Status())
+		}
+	})
+
+	return rtr
+}
+
+// writeLeaderMetrics и writeFollowerMetrics отдают состояние в текстовом формате Prometheus,
+// чтобы отставание ведомых можно было собирать и алертить без разбора JSON.
+func writeLeaderMetrics(w io.Writer, st LeaderStatus) {
+	fmt.Fprintf(w, "# TYPE replication_leader_seq counter\nreplication_leader_seq %d\n", st.Seq)
+	fmt.Fprintf(w, "# TYPE replication_leader_replicas gauge\nreplication_leader_replicas %d\n", st.Replicas)
+	if len(st.Streams) > 0 {
+		fmt.Fprint(w, "# TYPE replication_stream_lag_events gauge\n")
+	}
+	for _, s := range st.Streams {
+		fmt.Fprintf(w, "replication_stream_lag_events{remote=%q} %d\n", s.Remote, s.LagEvents)
+	}
+}
+
+func writeFollowerMetrics(w io.Writer, st FollowerStatus) {
+	fmt.Fprintf(w, "# TYPE replication_follower_connected gauge\nreplication_follower_connected %d\n", boolMetric(st.Connected))
+	fmt.Fprintf(w, "# TYPE replication_follower_promoted gauge\nreplication_follower_promoted %d\n", boolMetric(st.Promoted))
+	fmt.Fprintf(w, "# TYPE replication_follower_applied_seq counter\nreplication_follower_applied_seq %d\n", st.AppliedSeq)
+	fmt.Fprintf(w, "# TYPE replication_follower_lag_events gauge\nreplication_follower_lag_events %d\n", st.LagEvents)
+	fmt.Fprintf(w, "# TYPE replication_follower_lag_seconds gauge\nreplication_follower_lag_seconds %g\n", st.LagSeconds)
+	fmt.Fprintf(w, "# TYPE replication_follower_reconnects_total counter\nreplication_follower_reconnects_total %d\n", st.Reconnects)
+}
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(v)
+}
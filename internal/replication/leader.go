@@ -0,0 +1,378 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/store"
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+const (
+	// backlogSize — сколько последних событий хранится для ведомых, ненадолго потерявших связь.
+	backlogSize = 4096
+	// subscriberBuffer — очередь событий одного ведомого; переполнение означает, что ведомый
+	// не успевает, и его поток разрывается — после переподключения он догонит по снимку.
+	subscriberBuffer  = 1024
+	heartbeatInterval = time.Second
+	// stripeCount — число полос блокировки записей, степень двойки.
+	stripeCount = 64
+)
+
+// Leader — хранилище, которое публикует каждое успешное изменение для ведомых.
+// Чтение проходит напрямую во вложенное хранилище.
+type Leader struct {
+	store.MetricStorage
+
+	logger *zap.Logger
+	epoch  string
+
+	// Изменение серии держит её полосу из stripes вместе с публикацией: записи одной серии
+	// публикуются в том же порядке, в каком применены, и gauge на ведомом не расходится с
+	// ведущим, а записи разных серий от порядка не зависят и идут параллельно. Номер
+	// события выдаётся в publish под коротким mu. Изменения без одной серии (удаление по
+	// префиксу или метке, очистка, замена) и подписка берут all целиком: снимок содержит
+	// ровно события с номерами не больше своего.
+	all     sync.RWMutex
+	stripes [stripeCount]sync.Mutex
+
+	mu      sync.Mutex
+	seq     uint64
+	backlog []Event
+	subs    map[*subscriber]struct{}
+}
+
+type subscriber struct {
+	remote string
+	ch     chan Event
+	// sent — номер последнего события, отправленного ведомому.
+	sent atomic.Uint64
+}
+
+func NewLeader(logger *zap.Logger, ms store.MetricStorage) *Leader {
+	return &Leader{
+		MetricStorage: ms,
+		logger:        logger,
+		epoch:         strconv.FormatInt(time.Now().UnixNano(), 36),
+		subs:          make(map[*subscriber]struct{}),
+	}
+}
+
+func (l *Leader) UpdateMetric(ctx context.Context, mtype, name, value string) (any, error) {
+	defer l.lockSeries([]types.Metrics{{ID: name, MType: mtype}})()
+
+	res, err := l.MetricStorage.UpdateMetric(ctx, mtype, name, value)
+	if err != nil {
+		return nil, err
+	}
+
+	mtr := types.Metrics{ID: name, MType: mtype}
+	if mtype == types.Counter {
+		delta, _ := strconv.ParseInt(value, 10, 64)
+		mtr.Delta = &delta
+	} else {
+		v, _ := strconv.ParseFloat(value, 64)
+		mtr.Value = &v
+	}
+	l.publish(Event{Op: OpUpdate, Metrics: []types.Metrics{mtr}})
+
+	return res, nil
+}
+
+func (l *Leader) UpdateMetrics(ctx context.Context, metrics []types.Metrics) error {
+	defer l.lockSeries(metrics)()
+
+	if err := l.MetricStorage.UpdateMetrics(ctx, metrics); err != nil {
+		return err
+	}
+	if len(metrics) > 0 {
+		l.publish(Event{Op: OpUpdate, Metrics: append([]types.Metrics(nil), metrics...)})
+	}
+
+	return nil
+}
+
+func (l *Leader) DeleteMetric(ctx context.Context, mtype, name string) (bool, error) {
+	defer l.lockSeries([]types.Metrics{{ID: name, MType: mtype}})()
+
+	ok, err := l.MetricStorage.DeleteMetric(ctx, mtype, name)
+	if ok {
+		l.publish(Event{Op: OpDelete, Metrics: []types.Metrics{{ID: name, MType: mtype}}})
+	}
+
+	return ok, err
+}
+
+func (l *Leader) DeleteMetricsByPrefix(ctx context.Context, prefix string) (int, error) {
+	l.all.Lock()
+	defer l.all.Unlock()
+
+	n, err := l.MetricStorage.DeleteMetricsByPrefix(ctx, prefix)
+	if n > 0 {
+		l.publish(Event{Op: OpDeletePrefix, Key: prefix})
+	}
+
+	return n, err
+}
+
+func (l *Leader) DeleteMetricsByLabel(ctx context.Context, key, value string) (int, error) {
+	l.all.Lock()
+	defer l.all.Unlock()
+
+	n, err := l.MetricStorage.DeleteMetricsByLabel(ctx, key, value)
+	if n > 0 {
+		l.publish(Event{Op: OpDeleteLabel, Key: key, Value: value})
+	}
+
+	return n, err
+}
+
+// PurgeStale передаёт ведомым ту же границу: они применяют изменения почти одновременно
+// с ведущим, поэтому удаляют те же серии.
+func (l *Leader) PurgeStale(ctx context.Context, before time.Time) (int, error) {
+	l.all.Lock()
+	defer l.all.Unlock()
+
+	n, err := l.MetricStorage.PurgeStale(ctx, before)
+	if n > 0 {
+		l.publish(Event{Op: OpPurge, Before: &before})
+	}
+
+	return n, err
+}
+
+// ReplaceMetrics заменяет содержимое хранилища, если вложенное хранилище это умеет.
+func (l *Leader) ReplaceMetrics(ctx context.Context, metrics []types.Metrics) error {
+	rp, ok := l.MetricStorage.(store.Replacer)
+	if !ok {
+		return types.ErrNoReplace
+	}
+
+	l.all.Lock()
+	defer l.all.Unlock()
+
+	if err := rp.ReplaceMetrics(ctx, metrics); err != nil {
+		return err
+	}
+	l.publish(Event{Op: OpReplace, Metrics: append([]types.Metrics(nil), metrics...)})
+
+	return nil
+}
+
+// Samples пробрасывает чтение истории, если вложенное хранилище её хранит.
+func (l *Leader) Samples(ctx context.Context, mtype, name string, from, to time.Time) ([]types.Sample, error) {
+	hs, ok := l.MetricStorage.(store.HistoryStorage)
+	if !ok {
+		return nil, types.ErrNoHistory
+	}
+	return hs.Samples(ctx, mtype, name, from, to)
+}
+
+// lockSeries блокирует полосы серий metrics в порядке возрастания номера, чтобы пакеты с
+// пересекающимися сериями не взаимоблокировались, и возвращает функцию разблокировки.
+func (l *Leader) lockSeries(metrics []types.Metrics) func() {
+	var need [stripeCount]bool
+	for _, mtr := range metrics {
+		need[stripeIndex(mtr.MType, mtr.ID)] = true
+	}
+
+	l.all.RLock()
+	for i := range need {
+		if need[i] {
+			l.stripes[i].Lock()
+		}
+	}
+
+	return func() {
+		for i := range need {
+			if need[i] {
+				l.stripes[i].Unlock()
+			}
+		}
+		l.all.RUnlock()
+	}
+}
+
+func stripeIndex(mtype, name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(mtype))
+	h.Write([]byte{0})
+	h.Write([]byte(name))
+	return h.Sum32() & (stripeCount - 1)
+}
+
+func (l *Leader) publish(ev Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.seq++
+	ev.Seq, ev.Time = l.seq, time.Now()
+
+	if len(l.backlog) == backlogSize {
+		copy(l.backlog, l.backlog[1:])
+		l.backlog = l.backlog[:backlogSize-1]
+	}
+	l.backlog = append(l.backlog, ev)
+
+	for sub := range l.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			l.logger.Warn("replica is too slow, dropping stream", zap.String("remote", sub.remote))
+			delete(l.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// subscribe регистрирует ведомого и возвращает события, которые нужно отправить ему первыми:
+// пропущенные после from, если они ещё в буфере, иначе снимок хранилища.
+func (l *Leader) subscribe(ctx context.Context, remote, epoch string, from uint64) (*subscriber, []Event, error) {
+	l.all.Lock()
+	defer l.all.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var initial []Event
+	if epoch == l.epoch && l.canResume(from) {
+		initial = append(initial, Event{Op: OpResume, Seq: from, Epoch: l.epoch, Time: time.Now()})
+		for _, ev := range l.backlog {
+			if ev.Seq > from {
+				initial = append(initial, ev)
+			}
+		}
+	} else {
+		all := l.MetricStorage.GetMetrics(ctx)
+		if all == nil {
+			return nil, nil, errors.New("unable to read storage")
+		}
+		initial = append(initial, Event{
+			Op: OpSnapshot, Seq: l.seq, Epoch: l.epoch, Time: time.Now(), Metrics: store.Flatten(all),
+		})
+	}
+
+	sub := &subscriber{remote: remote, ch: make(chan Event, subscriberBuffer)}
+	l.subs[sub] = struct{}{}
+
+	return sub, initial, nil
+}
+
+func (l *Leader) canResume(from uint64) bool {
+	if from > l.seq {
+		return false
+	}
+	if from == l.seq {
+		return true
+	}
+	return len(l.backlog) > 0 && l.backlog[0].Seq <= from+1
+}
+
+func (l *Leader) unsubscribe(sub *subscriber) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.subs[sub]; ok {
+		delete(l.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// LeaderStatus — состояние ведущего для /replication/status.
+type LeaderStatus struct {
+	Epoch    string `json:"epoch"`
+	Seq      uint64 `json:"seq"`
+	Replicas int    `json:"replicas"`
+	// Streams — подключённые ведомые и их отставание по отправленным событиям.
+	Streams []StreamStatus `json:"streams,omitempty"`
+}
+
+// StreamStatus — поток одного ведомого на ведущем.
+type StreamStatus struct {
+	Remote    string `json:"remote"`
+	SentSeq   uint64 `json:"sent_seq"`
+	LagEvents uint64 `json:"lag_events"`
+}
+
+func (l *Leader) Status() LeaderStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	st := LeaderStatus{Epoch: l.epoch, Seq: l.seq, Replicas: len(l.subs)}
+	for sub := range l.subs {
+		sent := sub.sent.Load()
+		st.Streams = append(st.Streams, StreamStatus{Remote: sub.remote, SentSeq: sent, LagEvents: lag(l.seq, sent)})
+	}
+	sort.Slice(st.Streams, func(i, j int) bool { return st.Streams[i].Remote < st.Streams[j].Remote })
+
+	return st
+}
+
+// stream отдаёт ведомому поток событий: GET /replication/stream?epoch=...&from=...
+func (l *Leader) stream(w http.ResponseWriter, r *http.Request) {
+	var from uint64
+	if raw := r.URL.Query().Get("from"); raw != "" {
+		var err error
+		if from, err = strconv.ParseUint(raw, 10, 64); err != nil {
+			http.Error(w, "incorrect from", http.StatusBadRequest)
+			return
+		}
+	}
+
+	sub, initial, err := l.subscribe(r.Context(), r.RemoteAddr, r.URL.Query().Get("epoch"), from)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer l.unsubscribe(sub)
+
+	l.logger.Info("replica connected", zap.String("remote", r.RemoteAddr),
+		zap.String("start", initial[0].Op), zap.Uint64("seq", initial[0].Seq))
+
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	send := func(ev Event) bool {
+		if err := enc.Encode(ev); err != nil {
+			return false
+		}
+		if ev.Op != OpHeartbeat {
+			sub.sent.Store(ev.Seq)
+		}
+		return rc.Flush() == nil
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	for _, ev := range initial {
+		if !send(ev) {
+			return
+		}
+	}
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-sub.ch:
+			if !ok || !send(ev) {
+				return
+			}
+		case now := <-ticker.C:
+			if !send(Event{Op: OpHeartbeat, Seq: l.Status().Seq, Time: now}) {
+				return
+			}
+		}
+	}
+}
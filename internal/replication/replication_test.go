@@ -0,0 +1,372 @@
+package replication
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/server"
+	"github.com/shevchukeugeni/metrics/internal/store"
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+const token = "secret"
+
+type node struct {
+	storage *store.MemStorage
+	leader  *Leader
+	ts      *httptest.Server
+	handler atomic.Value
+}
+
+func newLeaderNode(t *testing.T) *node {
+	n := &node{storage: store.NewMemStorage()}
+	n.restart()
+	n.ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.handler.Load().(http.Handler).ServeHTTP(w, r)
+	}))
+	t.Cleanup(n.ts.Close)
+
+	return n
+}
+
+// restart имитирует перезапуск ведущего с тем же хранилищем.
+func (n *node) restart() {
+	n.leader = NewLeader(zap.NewNop(), n.storage)
+	n.handler.Store(server.SetupRouter(zap.NewNop(), n.leader, nil, nil,
+		server.WithAdmin(token), server.WithReplication(Handler(n.leader, nil))))
+}
+
+func startFollower(t *testing.T, leaderURL string) (*Follower, *store.MemStorage) {
+	ms := store.NewMemStorage()
+	f := NewFollower(zap.NewNop(), leaderURL, token, nil, ms)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		f.Start(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return f, ms
+}
+
+func counter(id string, d int64) types.Metrics {
+	return types.Metrics{ID: id, MType: types.Counter, Delta: &d}
+}
+
+func gauge(id string, v float64) types.Metrics {
+	return types.Metrics{ID: id, MType: types.Gauge, Value: &v}
+}
+
+// waitInSync ждёт, пока ведомый применит всё опубликованное ведущим, и сравнивает хранилища.
+func waitInSync(t *testing.T, leader *node, f *Follower, replica *store.MemStorage) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		return f.Status().AppliedSeq == leader.leader.Status().Seq && f.Status().Epoch != ""
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ctx := context.Background()
+	assert.Equal(t, leader.storage.GetMetric(ctx, types.Counter), replica.GetMetric(ctx, types.Counter))
+	assert.Equal(t, leader.storage.GetMetric(ctx, types.Gauge), replica.GetMetric(ctx, types.Gauge))
+}
+
+func TestReplication(t *testing.T) {
+	ctx := context.Background()
+	leader := newLeaderNode(t)
+
+	// Данные до подключения приходят снимком.
+	require.NoError(t, leader.leader.UpdateMetrics(ctx, []types.Metrics{counter("PollCount", 5), gauge("HeapAlloc", 1.5)}))
+
+	f, replica := startFollower(t, leader.ts.URL)
+	waitInSync(t, leader, f, replica)
+	assert.Equal(t, uint64(1), f.Status().Snapshots)
+
+	_, err := leader.leader.UpdateMetric(ctx, types.Counter, "PollCount", "2")
+	require.NoError(t, err)
+	_, err = leader.leader.UpdateMetric(ctx, types.Gauge, `cpu{host="a"}`, "10")
+	require.NoError(t, err)
+	_, err = leader.leader.UpdateMetric(ctx, types.Gauge, `cpu{host="b"}`, "20")
+	require.NoError(t, err)
+	_, err = leader.leader.UpdateMetric(ctx, types.Gauge, "Tmp", "1")
+	require.NoError(t, err)
+	waitInSync(t, leader, f, replica)
+
+	_, err = leader.leader.DeleteMetricsByLabel(ctx, "host", "a")
+	require.NoError(t, err)
+	_, err = leader.leader.DeleteMetric(ctx, types.Gauge, "Tmp")
+	require.NoError(t, err)
+	_, err = leader.leader.DeleteMetricsByPrefix(ctx, "cpu")
+	require.NoError(t, err)
+	waitInSync(t, leader, f, replica)
+	assert.Equal(t, map[string]string{"HeapAlloc": "1.5"}, replica.GetMetric(ctx, types.Gauge))
+
+	require.NoError(t, leader.leader.ReplaceMetrics(ctx, []types.Metrics{gauge("Restored", 3)}))
+	waitInSync(t, leader, f, replica)
+	assert.Equal(t, map[string]string{"Restored": "3"}, replica.GetMetric(ctx, types.Gauge))
+	assert.Empty(t, replica.GetMetric(ctx, types.Counter))
+
+	// Запрос без токена отклоняется.
+	resp, err := http.Get(leader.ts.URL + "/replication/stream")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestReplication_ConcurrentWritesDuringSnapshot(t *testing.T) {
+	ctx := context.Background()
+	leader := newLeaderNode(t)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				_, err := leader.leader.UpdateMetric(ctx, types.Counter, "requests", "1")
+				assert.NoError(t, err)
+				_, err = leader.leader.UpdateMetric(ctx, types.Gauge, "worker"+strconv.Itoa(w), strconv.Itoa(i))
+				assert.NoError(t, err)
+			}
+		}(w)
+	}
+
+	// Ведомый подключается посреди записи: ни одно приращение не должно потеряться или задвоиться.
+	f, replica := startFollower(t, leader.ts.URL)
+	wg.Wait()
+
+	waitInSync(t, leader, f, replica)
+	assert.Equal(t, map[string]string{"requests": "800"}, replica.GetMetric(ctx, types.Counter))
+}
+
+func TestReplication_Reconnect(t *testing.T) {
+	ctx := context.Background()
+	leader := newLeaderNode(t)
+
+	f, replica := startFollower(t, leader.ts.URL)
+	_, err := leader.leader.UpdateMetric(ctx, types.Counter, "PollCount", "1")
+	require.NoError(t, err)
+	waitInSync(t, leader, f, replica)
+
+	// Обрыв связи: пропущенные события догоняются из буфера ведущего, без нового снимка.
+	leader.ts.CloseClientConnections()
+	require.Eventually(t, func() bool { return !f.Status().Connected }, 5*time.Second, 10*time.Millisecond)
+	_, err = leader.leader.UpdateMetric(ctx, types.Counter, "PollCount", "2")
+	require.NoError(t, err)
+
+	waitInSync(t, leader, f, replica)
+	assert.Equal(t, uint64(1), f.Status().Snapshots)
+	assert.Equal(t, uint64(1), f.Status().Reconnects)
+	assert.Equal(t, map[string]string{"PollCount": "3"}, replica.GetMetric(ctx, types.Counter))
+
+	// После перезапуска ведущего номера начинаются заново, поэтому ведомый получает снимок.
+	leader.restart()
+	leader.ts.CloseClientConnections()
+	_, err = leader.leader.UpdateMetric(ctx, types.Counter, "PollCount", "4")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return f.Status().Snapshots == 2 }, 5*time.Second, 10*time.Millisecond)
+	waitInSync(t, leader, f, replica)
+	assert.Equal(t, map[string]string{"PollCount": "7"}, replica.GetMetric(ctx, types.Counter))
+}
+
+func TestReplication_StatusAndPromote(t *testing.T) {
+	ctx := context.Background()
+	leader := newLeaderNode(t)
+
+	f, replica := startFollower(t, leader.ts.URL)
+	replicaTS := httptest.NewServer(server.SetupRouter(zap.NewNop(), replica, nil, nil,
+		server.WithAdmin(token), server.WithReplication(Handler(nil, f))))
+	defer replicaTS.Close()
+
+	_, err := leader.leader.UpdateMetric(ctx, types.Counter, "PollCount", "1")
+	require.NoError(t, err)
+	waitInSync(t, leader, f, replica)
+
+	require.Eventually(t, func() bool { return leader.leader.Status().Replicas == 1 }, 5*time.Second, 10*time.Millisecond)
+	st := f.Status()
+	assert.True(t, st.Connected)
+	assert.Equal(t, uint64(0), st.LagEvents)
+	assert.Equal(t, leader.leader.Status().Epoch, st.Epoch)
+	require.Eventually(t, func() bool {
+		streams := leader.leader.Status().Streams
+		return len(streams) == 1 && streams[0].LagEvents == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	req, err := http.NewRequest(http.MethodGet, replicaTS.URL+"/replication/metrics", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "replication_follower_connected 1\n")
+	assert.Contains(t, string(body), "replication_follower_lag_events 0\n")
+
+	resp, err = http.Post(replicaTS.URL+"/replication/promote", "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	req, err = http.NewRequest(http.MethodPost, replicaTS.URL+"/replication/promote", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.Eventually(t, func() bool { return leader.leader.Status().Replicas == 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, f.Status().Promoted)
+
+	// После promote изменения ведущего больше не применяются.
+	_, err = leader.leader.UpdateMetric(ctx, types.Counter, "PollCount", "1")
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, map[string]string{"PollCount": "1"}, replica.GetMetric(ctx, types.Counter))
+}
+
+// slowStorage задерживает возврат из записи значения "1" уже после того, как оно применено.
+type slowStorage struct {
+	*store.MemStorage
+	applied chan struct{}
+}
+
+func (s slowStorage) UpdateMetric(ctx context.Context, mtype, name, value string) (any, error) {
+	res, err := s.MemStorage.UpdateMetric(ctx, mtype, name, value)
+	if value == "1" {
+		close(s.applied)
+		time.Sleep(100 * time.Millisecond)
+	}
+	return res, err
+}
+
+func TestReplication_PublishOrder(t *testing.T) {
+	ctx := context.Background()
+	n := &node{storage: store.NewMemStorage()}
+	slow := slowStorage{MemStorage: n.storage, applied: make(chan struct{})}
+	n.leader = NewLeader(zap.NewNop(), slow)
+	n.handler.Store(server.SetupRouter(zap.NewNop(), n.leader, nil, nil,
+		server.WithAdmin(token), server.WithReplication(Handler(n.leader, nil))))
+	n.ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.handler.Load().(http.Handler).ServeHTTP(w, r)
+	}))
+	t.Cleanup(n.ts.Close)
+
+	f, replica := startFollower(t, n.ts.URL)
+	waitInSync(t, n, f, replica)
+
+	// Вторая запись начинается, когда первая уже применена, но ещё не опубликована: ведомый
+	// должен получить их в порядке применения и закончить на том же значении, что и ведущий.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := n.leader.UpdateMetric(ctx, types.Gauge, "Load", "1")
+		assert.NoError(t, err)
+	}()
+	<-slow.applied
+	_, err := n.leader.UpdateMetric(ctx, types.Gauge, "Load", "2")
+	require.NoError(t, err)
+	<-done
+
+	waitInSync(t, n, f, replica)
+}
+
+// blockingStorage останавливает запись серии Blocked, пока не закрыт release.
+type blockingStorage struct {
+	*store.MemStorage
+	entered, release chan struct{}
+}
+
+func (s blockingStorage) UpdateMetric(ctx context.Context, mtype, name, value string) (any, error) {
+	if name == "Blocked" {
+		close(s.entered)
+		<-s.release
+	}
+	return s.MemStorage.UpdateMetric(ctx, mtype, name, value)
+}
+
+func TestLeader_ParallelSeries(t *testing.T) {
+	ctx := context.Background()
+	bs := blockingStorage{MemStorage: store.NewMemStorage(), entered: make(chan struct{}), release: make(chan struct{})}
+	leader := NewLeader(zap.NewNop(), bs)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := leader.UpdateMetric(ctx, types.Gauge, "Blocked", "1")
+		assert.NoError(t, err)
+	}()
+	<-bs.entered
+
+	// Запись другой серии не ждёт медленную: блокируется только полоса её серии.
+	wrote := make(chan struct{})
+	go func() {
+		defer close(wrote)
+		_, err := leader.UpdateMetric(ctx, types.Gauge, "Other", "2")
+		assert.NoError(t, err)
+	}()
+	select {
+	case <-wrote:
+	case <-time.After(time.Second):
+		t.Fatal("write of another series waited for the blocked one")
+	}
+	assert.Equal(t, uint64(1), leader.Status().Seq)
+
+	close(bs.release)
+	<-done
+	assert.Equal(t, uint64(2), leader.Status().Seq)
+}
+
+func TestFollower_StalledStream(t *testing.T) {
+	timeout := streamTimeout
+	streamTimeout = 100 * time.Millisecond
+	defer func() { streamTimeout = timeout }()
+
+	// Ведущий принял соединение и замолчал: ни событий, ни heartbeat.
+	var connects atomic.Int32
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connects.Add(1)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	f, _ := startFollower(t, ts.URL)
+	require.Eventually(t, func() bool { return f.Status().Reconnects > 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, f.Status().LastError, "stalled")
+}
+
+func TestHandler_RequiresToken(t *testing.T) {
+	leader := NewLeader(zap.NewNop(), store.NewMemStorage())
+	ts := httptest.NewServer(server.SetupRouter(zap.NewNop(), leader, nil, nil,
+		server.WithReplication(Handler(leader, nil))))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/replication/status")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
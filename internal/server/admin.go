@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/store"
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+const (
+	restoreModeMerge   = "merge"
+	restoreModeReplace = "replace"
+)
+
+// maxSnapshotSize ограничивает тело /admin/restore и его размер после распаковки.
+var maxSnapshotSize int64 = 1 << 30
+
+// WithAdmin включает эндпоинты /admin/ для снятия и загрузки снимков хранилища.
+// Запросы к ним должны передавать токен в заголовке Authorization: Bearer <token>;
+// с WithAuth этот токен действует как токен с ролью admin.
+func WithAdmin(token string) Option {
+	return func(ro *router) {
+		ro.adminToken = token
+	}
+}
+
+// getSnapshot отдаёт всё хранилище в формате файла дампа (?format=json|binary, ?compress=true для zstd).
+func (ro *router) getSnapshot(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = store.DumpFormatJSON
+	case store.DumpFormatJSON, store.DumpFormatBinary:
+	default:
+		http.Error(w, fmt.Sprintf("unknown dump format %q", format), http.StatusBadRequest)
+		return
+	}
+	var compress bool
+	if raw := r.URL.Query().Get("compress"); raw != "" {
+		var err error
+		if compress, err = strconv.ParseBool(raw); err != nil {
+			http.Error(w, "incorrect compress flag", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Снимок без серий недоступного узла выглядел бы как полная копия, поэтому неполная
+	// выборка — отказ.
+	metrics, err := store.ReadAll(r.Context(), ro.ms)
+	switch {
+	case errors.Is(err, types.ErrPartialResult):
+		http.Error(w, "Unable to read storage: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, "Unable to read storage: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Снимок пишется по мере сериализации, поэтому размер заранее неизвестен, а ошибку
+	// после начала ответа остаётся только записать в лог.
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="metrics-snapshot"`)
+	w.WriteHeader(http.StatusOK)
+	if err := store.WriteSnapshot(w, metrics, format, compress); err != nil {
+		ro.logger.Error("failed to write snapshot", zap.Error(err))
+	}
+}
+
+// restoreSnapshot загружает снимок. В режиме merge серии снимка применяются как обычные обновления:
+// gauge перезаписываются, counter прибавляются, остальные серии не трогаются. В режиме replace
+// хранилище одним шагом заменяется снимком; хранилищам, которые так не умеют, отвечаем 501.
+func (ro *router) restoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "":
+		mode = restoreModeMerge
+	case restoreModeMerge, restoreModeReplace:
+	default:
+		http.Error(w, "incorrect restore mode", http.StatusBadRequest)
+		return
+	}
+
+	metrics, err := store.ReadSnapshot(http.MaxBytesReader(w, r.Body, maxSnapshotSize), maxSnapshotSize)
+	if err != nil {
+		code := bodyErrorCode(err)
+		if errors.Is(err, store.ErrSnapshotTooLarge) {
+			code = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, "Unable to decode snapshot: "+err.Error(), code)
+		return
+	}
+
+	if mode == restoreModeReplace {
+		err = types.ErrNoReplace
+		if rp, ok := ro.ms.(store.Replacer); ok {
+			err = rp.ReplaceMetrics(r.Context(), metrics)
+		}
+	} else if len(metrics) > 0 {
+		err = ro.ms.UpdateMetrics(r.Context(), metrics)
+	}
+	if errors.Is(err, types.ErrNoReplace) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Unable to restore: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ro.logger.Info("snapshot restored", zap.String("mode", mode), zap.Int("series", len(metrics)))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(map[string]int{"restored": len(metrics)})
+	if err != nil {
+		http.Error(w, "Can't marshal data: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	//If DumpWorker was initialized and run in sync mode
+	if ro.dw != nil {
+		ro.dw.DumpSync()
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Role — право токена на группу эндпоинтов.
+type Role string
+
+const (
+	// RoleIngest разрешает запись метрик.
+	RoleIngest Role = "ingest"
+	// RoleRead разрешает чтение метрик, истории и алертов.
+	RoleRead Role = "read"
+	// RoleAdmin разрешает всё, включая удаление серий, /admin и служебные эндпоинты узлов.
+	RoleAdmin Role = "admin"
+)
+
+// Token — запись файла токенов. Сам токен в файле не хранится, только его SHA-256:
+// токены генерируются случайными, поэтому медленный хеш для них не нужен.
+type Token struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+	Roles  []Role `json:"roles"`
+}
+
+func (t *Token) has(role Role) bool {
+	for _, r := range t.Roles {
+		if r == role || r == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Tokens — набор токенов, загруженный из файла.
+type Tokens struct {
+	byHash map[[sha256.Size]byte]*Token
+}
+
+// HashToken возвращает значение поля sha256 для токена.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func LoadTokens(path string) (*Tokens, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Tokens []Token `json:"tokens"`
+	}
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	ts := &Tokens{byHash: make(map[[sha256.Size]byte]*Token, len(file.Tokens))}
+	for i := range file.Tokens {
+		t := &file.Tokens[i]
+		if t.Name == "" {
+			return nil, fmt.Errorf("token #%d without name", i+1)
+		}
+
+		raw, err := hex.DecodeString(t.SHA256)
+		if err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("token %s: sha256 must be %d hex characters", t.Name, 2*sha256.Size)
+		}
+		var sum [sha256.Size]byte
+		copy(sum[:], raw)
+		if _, ok := ts.byHash[sum]; ok {
+			return nil, fmt.Errorf("token %s: duplicate hash", t.Name)
+		}
+
+		if len(t.Roles) == 0 {
+			return nil, fmt.Errorf("token %s: no roles", t.Name)
+		}
+		for _, r := range t.Roles {
+			if r != RoleIngest && r != RoleRead && r != RoleAdmin {
+				return nil, fmt.Errorf("token %s: unknown role %q", t.Name, r)
+			}
+		}
+
+		ts.byHash[sum] = t
+	}
+
+	return ts, nil
+}
+
+// lookup ищет токен по хешу. Поиск в map по хешу не раскрывает через время ответа
+// ничего о самом токене.
+func (ts *Tokens) lookup(token string) (*Token, bool) {
+	t, ok := ts.byHash[sha256.Sum256([]byte(token))]
+	return t, ok
+}
+
+// WithAuth включает проверку токенов: запись требует роли ingest, чтение — read,
+// удаление серий, /admin и служебные эндпоинты — admin. /ping и /ready остаются открытыми.
+func WithAuth(tokens *Tokens) Option {
+	return func(ro *router) {
+		ro.tokens = tokens
+	}
+}
+
+// adminToken из WithAdmin продолжает работать и считается токеном с ролью admin.
+var legacyAdmin = &Token{Name: "admin-token", Roles: []Role{RoleAdmin}}
+
+// internalEnabled сообщает, защищены ли /admin и служебные эндпоинты: для них достаточно
+// токена из WithAdmin.
+func (ro *router) internalEnabled() bool {
+	return ro.tokens != nil || ro.adminToken != ""
+}
+
+func (ro *router) authenticate(r *http.Request) (*Token, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, false
+	}
+	if ro.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(ro.adminToken)) == 1 {
+		return legacyAdmin, true
+	}
+	if ro.tokens == nil {
+		return nil, false
+	}
+	return ro.tokens.lookup(token)
+}
+
+// authorize пропускает запрос с токеном, у которого есть роль role. Без WithAuth
+// эндпоинт остаётся открытым.
+func (ro *router) authorize(role Role) func(http.Handler) http.Handler {
+	return ro.guard(role, ro.tokens != nil)
+}
+
+// authorizeInternal защищает /admin и служебные эндпоинты узлов ролью admin.
+func (ro *router) authorizeInternal() func(http.Handler) http.Handler {
+	return ro.guard(RoleAdmin, ro.internalEnabled())
+}
+
+func (ro *router) guard(role Role, enabled bool) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		if !enabled {
+			return h
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t, ok := ro.authenticate(r)
+			if !ok {
+				ro.logger.Warn("authentication failed",
+					zap.String("uri", r.RequestURI), zap.String("method", r.Method), zap.String("remote", r.RemoteAddr),
+					zap.String("client", ClientIdentity(r)), zap.Bool("token_present", r.Header.Get("Authorization") != ""))
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeAuthError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid bearer token")
+				return
+			}
+			if !t.has(role) {
+				ro.logger.Warn("access denied",
+					zap.String("uri", r.RequestURI), zap.String("method", r.Method), zap.String("remote", r.RemoteAddr),
+					zap.String("client", ClientIdentity(r)), zap.String("token", t.Name), zap.String("required_role", string(role)))
+				writeAuthError(w, http.StatusForbidden, "forbidden", fmt.Sprintf("token %s has no %s role", t.Name, role))
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func writeAuthError(w http.ResponseWriter, code int, kind, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": kind, "message": msg})
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/store"
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+// defaultHistoryWindow — интервал истории, если from не задан.
+const defaultHistoryWindow = time.Hour
+
+// getHistory отдаёт историю серии: GET /history?type=gauge&id=HeapAlloc&from=...&to=...
+// Границы задаются в RFC 3339, по умолчанию — последний час.
+func (ro *router) getHistory(w http.ResponseWriter, r *http.Request) {
+	hs, ok := ro.ms.(store.HistoryStorage)
+	if !ok {
+		http.Error(w, types.ErrNoHistory.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	q := r.URL.Query()
+	mtype, name := q.Get("type"), q.Get("id")
+	if name == "" {
+		http.Error(w, "empty metric id", http.StatusBadRequest)
+		return
+	}
+
+	to := time.Now()
+	if v := q.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "incorrect to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		to = t
+	}
+	from := to.Add(-defaultHistoryWindow)
+	if v := q.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "incorrect from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+
+	samples, err := hs.Samples(r.Context(), mtype, name, from, to)
+	switch {
+	case errors.Is(err, types.ErrNoHistory):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	case errors.Is(err, types.ErrUnknownType):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		ro.logger.Error("failed to read history", zap.Error(err))
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err = json.NewEncoder(w).Encode(samples); err != nil {
+		ro.logger.Error("failed to write history", zap.Error(err))
+	}
+}
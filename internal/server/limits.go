@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/ratelimit"
+)
+
+// clientIdleTTL — через сколько без запросов ведро клиента забывается.
+const clientIdleTTL = 10 * time.Minute
+
+// Limits ограничивает запросы к API; нулевое значение снимает ограничение.
+type Limits struct {
+	// Rate и Burst — запросов записи в секунду и запас на одного клиента. Клиент определяется
+	// по токену при WithAuth, по сертификату при mTLS, иначе по IP.
+	Rate  float64
+	Burst int
+	// MaxBodySize — размер тела любого запроса API как он пришёл по сети, MaxDecompressedSize —
+	// после распаковки gzip: сжатое тело маленькое, а распакованное может занять всю память.
+	MaxBodySize         int64
+	MaxDecompressedSize int64
+	// MaxBatch — число метрик в одном запросе /updates/.
+	MaxBatch int
+}
+
+// WithLimits включает ограничения частоты записи и размера тел запросов.
+func WithLimits(l Limits) Option {
+	return func(ro *router) {
+		ro.limits = l
+		if l.Rate > 0 {
+			ro.clients = &clientLimiter{rate: l.Rate, burst: l.Burst, clients: make(map[string]*client)}
+		}
+	}
+}
+
+type clientLimiter struct {
+	rate  float64
+	burst int
+
+	mu      sync.Mutex
+	clients map[string]*client
+	swept   time.Time
+}
+
+type client struct {
+	bucket *ratelimit.Bucket
+	seen   time.Time
+}
+
+func (l *clientLimiter) take(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	if now.Sub(l.swept) > clientIdleTTL {
+		for k, c := range l.clients {
+			if now.Sub(c.seen) > clientIdleTTL {
+				delete(l.clients, k)
+			}
+		}
+		l.swept = now
+	}
+
+	c, ok := l.clients[key]
+	if !ok {
+		c = &client{bucket: ratelimit.NewBucket(l.rate, l.burst)}
+		l.clients[key] = c
+	}
+	c.seen = now
+	l.mu.Unlock()
+
+	return c.bucket.Take(now, 1)
+}
+
+// clientKey определяет клиента для ограничения частоты. Токен учитывается только
+// проверенный, иначе клиент обходил бы ограничение, меняя заголовок.
+func (ro *router) clientKey(r *http.Request) string {
+	if ro.tokens != nil {
+		if t, ok := ro.authenticate(r); ok {
+			return "token:" + t.Name
+		}
+	}
+	if id := ClientIdentity(r); id != "" {
+		return "cert:" + id
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// limitRate проверяет частоту запросов записи клиента.
+func (ro *router) limitRate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ro.clients != nil {
+			key := ro.clientKey(r)
+			if ok, wait := ro.clients.take(key, time.Now()); !ok {
+				ro.logger.Warn("client rate limit exceeded", zap.String("client", key), zap.String("uri", r.RequestURI))
+				w.Header().Set("Retry-After", retryAfter(wait))
+				http.Error(w, fmt.Sprintf("rate limit of %s requests/s exceeded", strconv.FormatFloat(ro.limits.Rate, 'f', -1, 64)), http.StatusTooManyRequests)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// limitBody читает тело в память с учётом ограничений, распаковывая gzip. Дальше запрос
+// идёт уже без Content-Encoding, поэтому gzipMiddleware не распаковывает его повторно.
+func (ro *router) limitBody(h http.Handler) http.Handler {
+	return ro.bodyLimit(ro.limits.MaxBodySize, ro.limits.MaxDecompressedSize)(h)
+}
+
+// limitInternalBody ограничивает тела запросов между узлами. Узел пересылает соседу уже
+// распакованные данные клиента, поэтому предел — размер после распаковки.
+func (ro *router) limitInternalBody(h http.Handler) http.Handler {
+	limit := ro.limits.MaxDecompressedSize
+	if limit > 0 && ro.limits.MaxBodySize > limit {
+		limit = ro.limits.MaxBodySize
+	}
+	return ro.bodyLimit(limit, limit)(h)
+}
+
+func (ro *router) bodyLimit(maxBody, maxData int64) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		if maxBody <= 0 && maxData <= 0 {
+			return h
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			data, code, err := readBody(w, r, maxBody, maxData)
+			if err != nil {
+				ro.logger.Warn("request body rejected", zap.String("client", ro.clientKey(r)), zap.String("uri", r.RequestURI), zap.Error(err))
+				http.Error(w, err.Error(), code)
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(data))
+			r.ContentLength = int64(len(data))
+			r.Header.Del("Content-Encoding")
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func readBody(w http.ResponseWriter, r *http.Request, maxBody, maxData int64) ([]byte, int, error) {
+	if maxBody > 0 && r.ContentLength > maxBody {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("request body exceeds %d bytes", maxBody)
+	}
+
+	var body io.Reader = r.Body
+	if maxBody > 0 {
+		body = http.MaxBytesReader(w, r.Body, maxBody)
+	}
+
+	if strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, bodyErrorCode(err), bodyError(err, maxBody, "invalid gzip body: %w")
+		}
+		defer zr.Close()
+		body = zr
+	} else if maxData <= 0 || (maxBody > 0 && maxBody < maxData) {
+		maxData = maxBody
+	}
+
+	if maxData > 0 {
+		body = io.LimitReader(body, maxData+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, bodyErrorCode(err), bodyError(err, maxBody, "unable to read body: %w")
+	}
+	if maxData > 0 && int64(len(data)) > maxData {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("decompressed body exceeds %d bytes", maxData)
+	}
+
+	return data, http.StatusOK, nil
+}
+
+func bodyErrorCode(err error) int {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+func bodyError(err error, maxBody int64, format string) error {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return fmt.Errorf("request body exceeds %d bytes", maxBody)
+	}
+	return fmt.Errorf(format, err)
+}
+
+// retryAfter переводит ожидание в значение заголовка Retry-After: целые секунды, не меньше одной.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(d.Seconds()))))
+}
@@ -24,3 +24,9 @@ func (r *LoggingResponseWriter) WriteHeader(statusCode int) {
 	r.ResponseWriter.WriteHeader(statusCode)
 	r.responseData.status = statusCode
 }
+
+// Unwrap позволяет http.ResponseController добраться до Flush исходного ResponseWriter,
+// например для потоковых ответов.
+func (r *LoggingResponseWriter) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/store"
+)
+
+// Readiness сообщает, какое хранилище активно и доступно ли оно.
+type Readiness interface {
+	Pinger
+	Status() store.StorageStatus
+}
+
+// WithReadiness включает эндпоинт /ready с описанием активного хранилища.
+func WithReadiness(r Readiness) Option {
+	return func(ro *router) {
+		ro.readiness = r
+	}
+}
+
+type readyResponse struct {
+	Ready bool `json:"ready"`
+	store.StorageStatus
+	Error string `json:"error,omitempty"`
+}
+
+func (ro *router) ready(w http.ResponseWriter, r *http.Request) {
+	res := readyResponse{Ready: true, StorageStatus: ro.readiness.Status()}
+	status := http.StatusOK
+
+	if err := ro.readiness.Ping(r.Context()); err != nil {
+		res.Ready, res.Error = false, err.Error()
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		ro.logger.Error("failed to write readiness", zap.Error(err))
+	}
+}
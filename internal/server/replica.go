@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net/http"
+)
+
+// Replica сообщает, принимает ли узел записи: ведомый до повышения применяет только поток
+// ведущего, а собственные записи разошлись бы с ним и пропали при следующем снимке.
+type Replica interface {
+	// ReadOnly возвращает адрес ведущего и true, пока узел остаётся ведомым.
+	ReadOnly() (leader string, ok bool)
+}
+
+// WithReplica отклоняет запись, удаление и восстановление из снимка с 503, пока узел —
+// ведомый; в заголовке X-Replication-Leader передаётся адрес ведущего.
+func WithReplica(r Replica) Option {
+	return func(ro *router) {
+		ro.replica = r
+	}
+}
+
+func (ro *router) rejectOnReplica(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if leader, ok := ro.replica.ReadOnly(); ok {
+			w.Header().Set("X-Replication-Leader", leader)
+			http.Error(w, "read-only replica, send writes to the leader "+leader, http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
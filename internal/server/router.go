@@ -1,8 +1,9 @@
 package server
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/jackc/pgerrcode"
 	"html/template"
@@ -15,6 +16,7 @@ import (
 	"github.com/go-chi/chi/v5"
 	"go.uber.org/zap"
 
+	"github.com/shevchukeugeni/metrics/internal/alert"
 	"github.com/shevchukeugeni/metrics/internal/store"
 	"github.com/shevchukeugeni/metrics/internal/types"
 )
@@ -40,27 +42,76 @@ const tpl = `
 </body>
 </html>`
 
+// maxBatchIDLen ограничивает types.BatchIDHeader: узлы кластера хранят идентификаторы
+// применённых батчей.
+const maxBatchIDLen = 128
+
 type router struct {
 	logger *zap.Logger
-	ms     MetricStorage
+	ms     store.MetricStorage
 	dw     *store.DumpWorker
-	db     *sql.DB
+	db     Pinger
+	alerts *alert.Engine
+
+	adminToken  string
+	readiness   Readiness
+	tokens      *Tokens
+	limits      Limits
+	clients     *clientLimiter
+	replication http.Handler
+	cluster     http.Handler
+	tenants     func(http.Handler) http.Handler
+	replica     Replica
+}
+
+// Option подключает к роутеру необязательные подсистемы сервера.
+type Option func(*router)
+
+// WithAlerts включает эндпоинт /alerts со списком текущих алертов.
+func WithAlerts(e *alert.Engine) Option {
+	return func(ro *router) {
+		ro.alerts = e
+	}
 }
 
-type MetricStorage interface {
-	GetMetrics() map[string]store.Metric
-	GetMetric(string) map[string]string
-	UpdateMetric(mtype, name, value string) (any, error)
-	UpdateMetrics([]types.Metrics) error
+// WithReplication монтирует эндпоинты репликации под /replication. Доступ к ним требует
+// того же токена, что и /admin; без WithAdmin или WithAuth они не монтируются.
+func WithReplication(h http.Handler) Option {
+	return func(ro *router) {
+		ro.replication = h
+	}
 }
 
-func SetupRouter(logger *zap.Logger, ms MetricStorage, dw *store.DumpWorker, db *sql.DB) http.Handler {
+// WithCluster монтирует внутренние эндпоинты кластера под /cluster; доступ к ним защищён
+// так же, как к /replication.
+func WithCluster(h http.Handler) Option {
+	return func(ro *router) {
+		ro.cluster = h
+	}
+}
+
+// WithTenants подключает определение арендатора ко всем эндпоинтам с метриками.
+func WithTenants(mw func(http.Handler) http.Handler) Option {
+	return func(ro *router) {
+		ro.tenants = mw
+	}
+}
+
+// Pinger проверяет доступность хранилища для /ping.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+func SetupRouter(logger *zap.Logger, ms store.MetricStorage, dw *store.DumpWorker, db Pinger, opts ...Option) http.Handler {
 	ro := &router{
 		logger: logger,
 		ms:     ms,
 		dw:     dw,
 		db:     db,
 	}
+	for _, opt := range opts {
+		opt(ro)
+	}
 	return ro.Handler()
 }
 
@@ -79,19 +130,113 @@ func (ro *router) Handler() http.Handler {
 	rtr := chi.NewRouter()
 	rtr.Use(ro.WithLogging)
 	rtr.Get("/ping", ro.dbPing)
-	rtr.Group(func(r chi.Router) {
-		r.Use(gzipMiddleware)
+	if ro.readiness != nil {
+		rtr.Get("/ready", ro.ready)
+	}
+	// Проверка токена идёт до распаковки и сжатия, чтобы отказ не попадал в gzip-поток.
+	ro.api(rtr, RoleRead, true, func(r chi.Router) {
 		r.Get("/", ro.getMetrics)
 		r.Post("/value/", ro.getMetricJSON)
+		r.Get("/history", ro.getHistory)
+		if ro.alerts != nil {
+			r.Get("/alerts", ro.getAlerts)
+		}
+	})
+	ro.api(rtr, RoleIngest, true, func(r chi.Router) {
 		r.Post("/update/", ro.updateMetricJSON)
 		r.Post("/updates/", ro.updateMetricsJSON)
 	})
+	ro.api(rtr, RoleAdmin, true, func(r chi.Router) {
+		r.Delete("/value/", ro.deleteMetrics)
+	})
+	if ro.internalEnabled() {
+		rtr.Route("/admin", func(r chi.Router) {
+			r.Use(ro.authorizeInternal())
+			r.Get("/snapshot", ro.getSnapshot)
+			r.With(ro.writes()...).Post("/restore", ro.restoreSnapshot)
+		})
+	}
+	ro.mountInternal(rtr, "/replication", ro.replication)
+	ro.mountInternal(rtr, "/cluster", ro.cluster)
 	//DEPRECATED
-	rtr.Get("/value/{mType}/{name}", ro.getMetric)
-	rtr.Post("/update/{mType}/{name}/{value}", ro.updateMetric)
+	ro.api(rtr, RoleRead, false, func(r chi.Router) {
+		r.Get("/value/{mType}/{name}", ro.getMetric)
+	})
+	ro.api(rtr, RoleIngest, false, func(r chi.Router) {
+		r.Post("/update/{mType}/{name}/{value}", ro.updateMetric)
+	})
 	return rtr
 }
 
+// api регистрирует эндпоинты с метриками: проверка роли, отказ в записи на ведомом,
+// определение арендатора, ограничение частоты записи, ограничения размера тела и, если
+// нужно, gzip.
+func (ro *router) api(rtr chi.Router, role Role, compress bool, fn func(r chi.Router)) {
+	rtr.Group(func(r chi.Router) {
+		r.Use(ro.authorize(role))
+		if role != RoleRead {
+			r.Use(ro.writes()...)
+		}
+		if ro.tenants != nil {
+			r.Use(ro.tenants)
+		}
+		if role == RoleIngest {
+			r.Use(ro.limitRate)
+		}
+		r.Use(ro.limitBody)
+		if compress {
+			r.Use(gzipMiddleware)
+		}
+		fn(r)
+	})
+}
+
+// writes возвращает middleware для эндпоинтов, меняющих хранилище.
+func (ro *router) writes() []func(http.Handler) http.Handler {
+	if ro.replica == nil {
+		return nil
+	}
+	return []func(http.Handler) http.Handler{ro.rejectOnReplica}
+}
+
+// writeUpdateError отвечает на ошибку записи: превышение квоты — 429 с Retry-After,
+// некорректные данные — 400, недоступный узел кластера — 503, сбой хранилища — 500,
+// чтобы клиент повторил запрос, а не отбросил его как неверный.
+func writeUpdateError(w http.ResponseWriter, prefix string, err error) {
+	var le *types.LimitError
+	switch {
+	case errors.As(err, &le):
+		if le.RetryAfter > 0 {
+			w.Header().Set("Retry-After", retryAfter(le.RetryAfter))
+		}
+		http.Error(w, le.Error(), http.StatusTooManyRequests)
+	case types.IsInvalid(err):
+		http.Error(w, prefix+err.Error(), http.StatusBadRequest)
+	case errors.Is(err, types.ErrPartialResult):
+		http.Error(w, prefix+err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, prefix+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// mountInternal подключает служебные эндпоинты между узлами; они требуют роли admin.
+// Без WithAdmin и WithAuth эндпоинты не монтируются: открытый /replication/promote или
+// /cluster/updates позволил бы любому в сети менять состояние узла.
+func (ro *router) mountInternal(rtr chi.Router, path string, h http.Handler) {
+	if h == nil {
+		return
+	}
+	if !ro.internalEnabled() {
+		ro.logger.Error("internal endpoints require an admin token, not mounting", zap.String("path", path))
+		return
+	}
+	rtr.Route(path, func(r chi.Router) {
+		r.Use(ro.authorizeInternal())
+		r.Use(ro.limitInternalBody)
+		r.Mount("/", h)
+	})
+}
+
 func (ro *router) getMetrics(w http.ResponseWriter, r *http.Request) {
 	type metric struct {
 		Metrictype string
@@ -105,7 +250,7 @@ func (ro *router) getMetrics(w http.ResponseWriter, r *http.Request) {
 
 	data := mdata{}
 
-	for k, v := range ro.ms.GetMetric(types.Counter) {
+	for k, v := range ro.ms.GetMetric(r.Context(), types.Counter) {
 		data.Metrics = append(data.Metrics, metric{
 			"Counter",
 			k,
@@ -113,7 +258,7 @@ func (ro *router) getMetrics(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	for k, v := range ro.ms.GetMetric(types.Gauge) {
+	for k, v := range ro.ms.GetMetric(r.Context(), types.Gauge) {
 		data.Metrics = append(data.Metrics, metric{
 			"Gauge",
 			k,
@@ -149,20 +294,19 @@ func (ro *router) getMetricJSON(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	metrics := ro.ms.GetMetric(req.MType)
-	if metrics == nil {
-		http.Error(w, "not found", http.StatusNotFound)
+	value, ok, err := ro.lookup(r.Context(), req.MType, req.ID)
+	if err != nil {
+		ro.logger.Error("failed to read metric", zap.Error(err))
+		http.Error(w, "Unable to read storage", http.StatusInternalServerError)
 		return
 	}
-
-	res := req
-
-	value, ok := metrics[req.ID]
 	if !ok {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
 
+	res := req
+
 	if req.MType == types.Counter {
 		intValue, err := strconv.ParseInt(value, 10, 64)
 		if err != nil {
@@ -210,7 +354,7 @@ func (ro *router) updateMetricJSON(w http.ResponseWriter, r *http.Request) {
 		}
 
 		err = ro.WithRetry(func() error {
-			newValue, innerErr = ro.ms.UpdateMetric(req.MType, req.ID, fmt.Sprint(*req.Delta))
+			newValue, innerErr = ro.ms.UpdateMetric(r.Context(), req.MType, req.ID, fmt.Sprint(*req.Delta))
 			if innerErr != nil {
 				if innerErr.Error() == pgerrcode.UniqueViolation {
 					return innerErr
@@ -225,7 +369,7 @@ func (ro *router) updateMetricJSON(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if innerErr != nil {
-			http.Error(w, innerErr.Error(), http.StatusBadRequest)
+			writeUpdateError(w, "", innerErr)
 			return
 		}
 
@@ -238,7 +382,7 @@ func (ro *router) updateMetricJSON(w http.ResponseWriter, r *http.Request) {
 		}
 
 		err = ro.WithRetry(func() error {
-			newValue, innerErr = ro.ms.UpdateMetric(req.MType, req.ID, fmt.Sprint(*req.Value))
+			newValue, innerErr = ro.ms.UpdateMetric(r.Context(), req.MType, req.ID, fmt.Sprint(*req.Value))
 			if innerErr != nil {
 				if innerErr.Error() == pgerrcode.UniqueViolation {
 					return innerErr
@@ -253,7 +397,7 @@ func (ro *router) updateMetricJSON(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if innerErr != nil {
-			http.Error(w, innerErr.Error(), http.StatusBadRequest)
+			writeUpdateError(w, "", innerErr)
 			return
 		}
 
@@ -286,11 +430,26 @@ func (ro *router) updateMetricsJSON(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unable to decode json: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	if ro.limits.MaxBatch > 0 && len(req) > ro.limits.MaxBatch {
+		http.Error(w, fmt.Sprintf("batch of %d metrics exceeds the limit of %d", len(req), ro.limits.MaxBatch), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Идентификатор батча нужен кластеру, чтобы повтор после частичного сбоя не записал
+	// приращения counter второй раз на узлах, которые свою часть уже приняли.
+	ctx := r.Context()
+	if id := r.Header.Get(types.BatchIDHeader); id != "" {
+		if len(id) > maxBatchIDLen {
+			http.Error(w, "batch id is too long", http.StatusBadRequest)
+			return
+		}
+		ctx = store.WithBatchID(ctx, id)
+	}
 
 	var innerErr error
 
 	err = ro.WithRetry(func() error {
-		innerErr = ro.ms.UpdateMetrics(req)
+		innerErr = ro.ms.UpdateMetrics(ctx, req)
 		if innerErr != nil {
 			if innerErr.Error() == pgerrcode.UniqueViolation {
 				return innerErr
@@ -301,11 +460,11 @@ func (ro *router) updateMetricsJSON(w http.ResponseWriter, r *http.Request) {
 		return nil
 	}, "failed to update metrics")
 	if err != nil {
-		http.Error(w, "Unable to update batch: "+err.Error(), http.StatusBadRequest)
+		writeUpdateError(w, "Unable to update batch: ", err)
 		return
 	}
 	if innerErr != nil {
-		http.Error(w, "Unable to update batch: "+innerErr.Error(), http.StatusBadRequest)
+		writeUpdateError(w, "Unable to update batch: ", innerErr)
 		return
 	}
 
@@ -318,6 +477,76 @@ func (ro *router) updateMetricsJSON(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// deleteMetrics удаляет одну серию (JSON с id и type в теле), все серии с префиксом
+// (?prefix=name) или все серии с меткой (?label=key=value).
+func (ro *router) deleteMetrics(w http.ResponseWriter, r *http.Request) {
+	var (
+		deleted int
+		err     error
+	)
+
+	prefix, label := r.URL.Query().Get("prefix"), r.URL.Query().Get("label")
+
+	switch {
+	case prefix != "":
+		deleted, err = ro.ms.DeleteMetricsByPrefix(r.Context(), prefix)
+	case label != "":
+		key, value, ok := strings.Cut(label, "=")
+		if !ok || key == "" {
+			http.Error(w, "incorrect label selector", http.StatusBadRequest)
+			return
+		}
+		deleted, err = ro.ms.DeleteMetricsByLabel(r.Context(), key, value)
+	default:
+		var req types.Metrics
+
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, "Unable to decode json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.MType != types.Counter && req.MType != types.Gauge {
+			http.Error(w, "incorrect metric type", http.StatusNotFound)
+			return
+		}
+
+		var ok bool
+		ok, err = ro.ms.DeleteMetric(r.Context(), req.MType, req.ID)
+		if err == nil && !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		deleted = 1
+	}
+	if err != nil {
+		http.Error(w, "Unable to delete: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(map[string]int{"deleted": deleted})
+	if err != nil {
+		http.Error(w, "Can't marshal data: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	//If DumpWorker was initialized and run in sync mode
+	if ro.dw != nil {
+		ro.dw.DumpSync()
+	}
+}
+
+func (ro *router) getAlerts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	err := json.NewEncoder(w).Encode(ro.alerts.Alerts())
+	if err != nil {
+		http.Error(w, "Can't marshal data: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
 func (ro *router) WithLogging(h http.Handler) http.Handler {
 	logFn := func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -334,13 +563,17 @@ func (ro *router) WithLogging(h http.Handler) http.Handler {
 
 		duration := time.Since(start)
 
-		ro.logger.Sugar().Infoln(
+		fields := []any{
 			"uri", r.RequestURI,
 			"method", r.Method,
 			"duration", duration,
 			"status", responseData.status,
 			"size", responseData.size,
-		)
+		}
+		if client := ClientIdentity(r); client != "" {
+			fields = append(fields, "client", client)
+		}
+		ro.logger.Sugar().Infoln(fields...)
 
 	}
 
@@ -397,13 +630,12 @@ func (ro *router) getMetric(w http.ResponseWriter, r *http.Request) {
 
 	name := chi.URLParam(r, "name")
 
-	metrics := ro.ms.GetMetric(mType)
-	if metrics == nil {
-		http.Error(w, "not found", http.StatusNotFound)
+	value, ok, err := ro.lookup(r.Context(), mType, name)
+	if err != nil {
+		ro.logger.Error("failed to read metric", zap.Error(err))
+		http.Error(w, "Unable to read storage", http.StatusInternalServerError)
 		return
 	}
-
-	value, ok := metrics[name]
 	if !ok {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
@@ -413,6 +645,17 @@ func (ro *router) getMetric(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, value)
 }
 
+// lookup читает одну серию: через store.ValueReader, если хранилище его поддерживает,
+// иначе из выборки всех серий типа.
+func (ro *router) lookup(ctx context.Context, mtype, name string) (string, bool, error) {
+	if vr, ok := ro.ms.(store.ValueReader); ok {
+		return vr.GetValue(ctx, mtype, name)
+	}
+
+	value, ok := ro.ms.GetMetric(ctx, mtype)[name]
+	return value, ok, nil
+}
+
 // DEPRECATED
 func (ro *router) updateMetric(w http.ResponseWriter, r *http.Request) {
 	mType := strings.ToLower(chi.URLParam(r, "mType"))
@@ -423,9 +666,9 @@ func (ro *router) updateMetric(w http.ResponseWriter, r *http.Request) {
 
 	name, value := chi.URLParam(r, "name"), chi.URLParam(r, "value")
 
-	_, err := ro.ms.UpdateMetric(mType, name, value)
+	_, err := ro.ms.UpdateMetric(r.Context(), mType, name, value)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeUpdateError(w, "", err)
 		return
 	}
 
@@ -433,7 +676,12 @@ func (ro *router) updateMetric(w http.ResponseWriter, r *http.Request) {
 }
 
 func (ro *router) dbPing(w http.ResponseWriter, r *http.Request) {
-	err := ro.db.Ping()
+	if ro.db == nil {
+		http.Error(w, "storage is not configured", http.StatusInternalServerError)
+		return
+	}
+
+	err := ro.db.Ping(r.Context())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -2,18 +2,40 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 
+	"github.com/shevchukeugeni/metrics/internal/alert"
 	"github.com/shevchukeugeni/metrics/internal/mocks"
+	"github.com/shevchukeugeni/metrics/internal/store"
+	"github.com/shevchukeugeni/metrics/internal/types"
 )
 
 var logger = zap.L()
@@ -31,9 +53,9 @@ func Test_router_updateMetric(t *testing.T) {
 
 	mockStorage := mocks.NewMockMetricStorage(mockCtrl)
 
-	mockStorage.EXPECT().UpdateMetric("counter", "test", "1").Return(int64(1), nil).Times(1)
-	mockStorage.EXPECT().UpdateMetric("gauge", "test", "1").Return(float64(2), nil).Times(1)
-	mockStorage.EXPECT().UpdateMetric("gauge", "test", "2").Return(nil, errors.New("Bad request")).Times(1)
+	mockStorage.EXPECT().UpdateMetric(gomock.Any(), "counter", "test", "1").Return(int64(1), nil).Times(1)
+	mockStorage.EXPECT().UpdateMetric(gomock.Any(), "gauge", "test", "1").Return(float64(2), nil).Times(1)
+	mockStorage.EXPECT().UpdateMetric(gomock.Any(), "gauge", "test", "2").Return(nil, errors.New("Bad request")).Times(1)
 
 	ts := httptest.NewServer(SetupRouter(logger, mockStorage, nil, nil))
 	defer ts.Close()
@@ -169,16 +191,16 @@ func Test_router_getMetrics(t *testing.T) {
 
 	mockStorage := mocks.NewMockMetricStorage(mockCtrl)
 
-	mockStorage.EXPECT().GetMetric("counter").Return(
+	mockStorage.EXPECT().GetMetric(gomock.Any(), "counter").Return(
 		map[string]string{
 			"test2": "4",
 		}).Times(1)
-	mockStorage.EXPECT().GetMetric("gauge").Return(nil).Times(1)
+	mockStorage.EXPECT().GetMetric(gomock.Any(), "gauge").Return(nil).Times(1)
 
 	tests := []struct {
 		name    string
 		method  string
-		storage MetricStorage
+		storage store.MetricStorage
 		want    want
 	}{
 		{
@@ -230,11 +252,11 @@ func Test_router_getMetric(t *testing.T) {
 
 	mockStorage := mocks.NewMockMetricStorage(mockCtrl)
 
-	mockStorage.EXPECT().GetMetric("counter").Return(
+	mockStorage.EXPECT().GetMetric(gomock.Any(), "counter").Return(
 		map[string]string{
 			"test1": "1",
 		}).Times(1)
-	mockStorage.EXPECT().GetMetric("gauge").Return(
+	mockStorage.EXPECT().GetMetric(gomock.Any(), "gauge").Return(
 		map[string]string{
 			"test2": "2.22",
 		}).Times(1)
@@ -314,6 +336,335 @@ func Test_router_getMetric(t *testing.T) {
 	}
 }
 
+func Test_router_getAlerts(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := mocks.NewMockMetricStorage(mockCtrl)
+
+	mockStorage.EXPECT().GetMetric(gomock.Any(), "gauge").Return(map[string]string{"HeapAlloc": "2048"}).Times(1)
+	mockStorage.EXPECT().GetMetric(gomock.Any(), "counter").Return(nil).Times(1)
+
+	engine := alert.NewEngine(logger, mockStorage, []alert.Rule{
+		{Name: "HighHeap", Kind: alert.KindThreshold, Metric: "HeapAlloc", Type: "gauge", Op: ">", Threshold: 1024},
+	}, time.Minute)
+	engine.Eval(context.Background(), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	ts := httptest.NewServer(SetupRouter(logger, mockStorage, nil, nil, WithAlerts(engine)))
+	defer ts.Close()
+
+	res, body := testRequest(t, ts, http.MethodGet, "/alerts", nil)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	assert.JSONEq(t, `[{"rule":"HighHeap","state":"firing","value":2048,
+		"labels":{"alertname":"HighHeap","metric":"HeapAlloc"},
+		"active_at":"2024-01-01T00:00:00Z","fired_at":"2024-01-01T00:00:00Z"}]`, body)
+}
+
+func Test_router_deleteMetrics(t *testing.T) {
+	type want struct {
+		code     int
+		response string
+	}
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := mocks.NewMockMetricStorage(mockCtrl)
+
+	mockStorage.EXPECT().DeleteMetric(gomock.Any(), "gauge", "HeapAlloc").Return(true, nil).Times(1)
+	mockStorage.EXPECT().DeleteMetric(gomock.Any(), "counter", "missing").Return(false, nil).Times(1)
+	mockStorage.EXPECT().DeleteMetricsByPrefix(gomock.Any(), "Heap").Return(3, nil).Times(1)
+	mockStorage.EXPECT().DeleteMetricsByLabel(gomock.Any(), "host", "a").Return(2, nil).Times(1)
+
+	ts := httptest.NewServer(SetupRouter(logger, mockStorage, nil, nil))
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		target string
+		body   []byte
+		want   want
+	}{
+		{
+			name:   "single series",
+			target: "/value/",
+			body:   []byte(`{"id":"HeapAlloc","type":"gauge"}`),
+			want:   want{code: 200, response: "{\"deleted\":1}\n"},
+		},
+		{
+			name:   "missing series",
+			target: "/value/",
+			body:   []byte(`{"id":"missing","type":"counter"}`),
+			want:   want{code: 404, response: "not found\n"},
+		},
+		{
+			name:   "by prefix",
+			target: "/value/?prefix=Heap",
+			want:   want{code: 200, response: "{\"deleted\":3}\n"},
+		},
+		{
+			name:   "by label",
+			target: "/value/?label=host=a",
+			want:   want{code: 200, response: "{\"deleted\":2}\n"},
+		},
+		{
+			name:   "bad label selector",
+			target: "/value/?label=host",
+			want:   want{code: 400, response: "incorrect label selector\n"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, body := testRequest(t, ts, http.MethodDelete, tt.target, tt.body)
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.want.code, res.StatusCode)
+			// http.Error пишет мимо gzip.Writer, поэтому за текстом ошибки следует пустой gzip-поток
+			assert.True(t, strings.HasPrefix(body, tt.want.response), body)
+		})
+	}
+}
+
+func Test_router_adminSnapshot(t *testing.T) {
+	src := store.NewMemStorage()
+	_, err := src.UpdateMetric(context.Background(), types.Counter, "PollCount", "5")
+	require.NoError(t, err)
+	_, err = src.UpdateMetric(context.Background(), types.Gauge, "HeapAlloc", "1.5")
+	require.NoError(t, err)
+
+	dst := store.NewMemStorage()
+	_, err = dst.UpdateMetric(context.Background(), types.Counter, "PollCount", "2")
+	require.NoError(t, err)
+	_, err = dst.UpdateMetric(context.Background(), types.Gauge, "Stale", "1")
+	require.NoError(t, err)
+
+	srcTS := httptest.NewServer(SetupRouter(logger, src, nil, nil, WithAdmin("secret")))
+	defer srcTS.Close()
+	dstTS := httptest.NewServer(SetupRouter(logger, dst, nil, nil, WithAdmin("secret")))
+	defer dstTS.Close()
+
+	adminRequest := func(ts *httptest.Server, method, path, token string, body []byte) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		respBody, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		return resp, respBody
+	}
+
+	res, _ := adminRequest(srcTS, http.MethodGet, "/admin/snapshot", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	res, _ = adminRequest(srcTS, http.MethodGet, "/admin/snapshot", "wrong", nil)
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+	res, snapshot := adminRequest(srcTS, http.MethodGet, "/admin/snapshot?format=binary&compress=true", "secret", nil)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/octet-stream", res.Header.Get("Content-Type"))
+
+	res, _ = adminRequest(dstTS, http.MethodPost, "/admin/restore?mode=overwrite", "secret", snapshot)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res, body := adminRequest(dstTS, http.MethodPost, "/admin/restore", "secret", snapshot)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.JSONEq(t, `{"restored":2}`, string(body))
+	assert.Equal(t, map[string]string{"PollCount": "7"}, dst.GetMetric(context.Background(), types.Counter))
+	assert.Equal(t, map[string]string{"HeapAlloc": "1.5", "Stale": "1"}, dst.GetMetric(context.Background(), types.Gauge))
+
+	// Битый снимок в режиме replace не должен очистить хранилище.
+	broken := []byte(`{"Metrics":[{"type":"gauge","name":"HeapAlloc","value":"2"},{"type":"histogram","name":"X","value":"1"}]}`)
+	res, _ = adminRequest(dstTS, http.MethodPost, "/admin/restore?mode=replace", "secret", broken)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equal(t, map[string]string{"HeapAlloc": "1.5", "Stale": "1"}, dst.GetMetric(context.Background(), types.Gauge))
+
+	res, _ = adminRequest(dstTS, http.MethodPost, "/admin/restore?mode=replace", "secret", snapshot)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, map[string]string{"PollCount": "5"}, dst.GetMetric(context.Background(), types.Counter))
+	assert.Equal(t, map[string]string{"HeapAlloc": "1.5"}, dst.GetMetric(context.Background(), types.Gauge))
+
+	res, _ = adminRequest(srcTS, http.MethodGet, "/admin/snapshot?format=xml", "secret", nil)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	limit := maxSnapshotSize
+	maxSnapshotSize = 64
+	defer func() { maxSnapshotSize = limit }()
+	res, _ = adminRequest(dstTS, http.MethodPost, "/admin/restore", "secret", bytes.Repeat([]byte(" "), 128))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+}
+
+func Test_router_adminRestoreUnsupported(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	// Хранилище без ReplaceMetrics не очищается по частям: replace для него недоступен.
+	mockStorage := mocks.NewMockMetricStorage(mockCtrl)
+	ts := httptest.NewServer(SetupRouter(logger, mockStorage, nil, nil, WithAdmin("secret")))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/admin/restore?mode=replace", strings.NewReader(`{"Metrics":[]}`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	resp, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+}
+
+func Test_router_updateErrors(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockStorage := mocks.NewMockMetricStorage(mockCtrl)
+	mockStorage.EXPECT().UpdateMetrics(gomock.Any(), gomock.Any()).Return(types.ErrEmptyValue).Times(1)
+	mockStorage.EXPECT().UpdateMetrics(gomock.Any(), gomock.Any()).Return(errors.New("connection refused")).Times(1)
+	mockStorage.EXPECT().UpdateMetric(gomock.Any(), "counter", "a", "x").Return(nil, &strconv.NumError{Func: "ParseInt", Num: "x", Err: strconv.ErrSyntax}).Times(1)
+	mockStorage.EXPECT().UpdateMetric(gomock.Any(), "counter", "a", "1").Return(nil, errors.New("connection refused")).Times(1)
+	ts := httptest.NewServer(SetupRouter(logger, mockStorage, nil, nil))
+	defer ts.Close()
+
+	// Клиент должен отличать неверные данные от сбоя хранилища, который можно переждать.
+	for _, code := range []int{http.StatusBadRequest, http.StatusInternalServerError} {
+		resp, err := ts.Client().Post(ts.URL+"/updates/", "application/json", strings.NewReader(`[{"id":"a","type":"counter","delta":1}]`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, code, resp.StatusCode)
+	}
+	for value, code := range map[string]int{"x": http.StatusBadRequest, "1": http.StatusInternalServerError} {
+		resp, err := ts.Client().Post(ts.URL+"/update/counter/a/"+value, "text/plain", nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, code, resp.StatusCode)
+	}
+}
+
+type fakeReadiness struct {
+	status store.StorageStatus
+	err    error
+}
+
+func (f fakeReadiness) Ping(context.Context) error { return f.err }
+
+func (f fakeReadiness) Status() store.StorageStatus { return f.status }
+
+func Test_router_ready(t *testing.T) {
+	tests := []struct {
+		name      string
+		readiness fakeReadiness
+		code      int
+		body      string
+	}{
+		{
+			name:      "ready",
+			readiness: fakeReadiness{status: store.StorageStatus{Backend: "postgres"}},
+			code:      http.StatusOK,
+			body:      `{"ready":true,"backend":"postgres"}`,
+		},
+		{
+			name: "fallback",
+			readiness: fakeReadiness{status: store.StorageStatus{
+				Backend: "file", Requested: "postgres", Fallback: "connection refused",
+			}},
+			code: http.StatusOK,
+			body: `{"ready":true,"backend":"file","requested":"postgres","fallback":"connection refused"}`,
+		},
+		{
+			name:      "unavailable",
+			readiness: fakeReadiness{status: store.StorageStatus{Backend: "sqlite"}, err: errors.New("database is closed")},
+			code:      http.StatusServiceUnavailable,
+			body:      `{"ready":false,"backend":"sqlite","error":"database is closed"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(SetupRouter(logger, nil, nil, tt.readiness, WithReadiness(tt.readiness)))
+			defer ts.Close()
+
+			res, body := testRequest(t, ts, http.MethodGet, "/ready", nil)
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.code, res.StatusCode)
+			assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+			assert.JSONEq(t, tt.body, body)
+		})
+	}
+}
+
+type historyStorage struct {
+	*store.MemStorage
+	from, to time.Time
+}
+
+func (h *historyStorage) Samples(_ context.Context, mtype, name string, from, to time.Time) ([]types.Sample, error) {
+	if mtype != types.Gauge && mtype != types.Counter {
+		return nil, types.ErrUnknownType
+	}
+	h.from, h.to = from, to
+	v := 1.5
+	return []types.Sample{{Time: from, Value: &v}}, nil
+}
+
+func Test_router_getHistory(t *testing.T) {
+	plain := httptest.NewServer(SetupRouter(logger, store.NewMemStorage(), nil, nil))
+	defer plain.Close()
+
+	res, _ := testRequest(t, plain, http.MethodGet, "/history?type=gauge&id=HeapAlloc", nil)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotImplemented, res.StatusCode)
+
+	hs := &historyStorage{MemStorage: store.NewMemStorage()}
+	ts := httptest.NewServer(SetupRouter(logger, hs, nil, nil))
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		target string
+		code   int
+		body   string
+	}{
+		{
+			name:   "ok",
+			target: "/history?type=gauge&id=HeapAlloc&from=2024-01-01T00:00:00Z&to=2024-01-02T00:00:00Z",
+			code:   http.StatusOK,
+			body:   `[{"ts":"2024-01-01T00:00:00Z","value":1.5}]`,
+		},
+		{name: "no id", target: "/history?type=gauge", code: http.StatusBadRequest},
+		{name: "bad from", target: "/history?type=gauge&id=x&from=yesterday", code: http.StatusBadRequest},
+		{
+			name:   "empty interval",
+			target: "/history?type=gauge&id=x&from=2024-01-02T00:00:00Z&to=2024-01-01T00:00:00Z",
+			code:   http.StatusBadRequest,
+		},
+		{name: "bad type", target: "/history?type=histogram&id=x", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, body := testRequest(t, ts, http.MethodGet, tt.target, nil)
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.code, res.StatusCode)
+			if tt.body != "" {
+				assert.JSONEq(t, tt.body, body)
+			}
+		})
+	}
+
+	res, _ = testRequest(t, ts, http.MethodGet, "/history?type=counter&id=PollCount&to=2024-01-01T12:00:00Z", nil)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, time.Hour, hs.to.Sub(hs.from))
+}
+
 func testRequest(t *testing.T, ts *httptest.Server,
 	method, path string, body []byte) (*http.Response, string) {
 	bodyReader := bytes.NewReader(body)
@@ -329,3 +680,368 @@ func testRequest(t *testing.T, ts *httptest.Server,
 
 	return resp, string(respBody)
 }
+
+func Test_router_auth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"tokens":[
+		{"name":"agent","sha256":"`+HashToken("ingest-token")+`","roles":["ingest"]},
+		{"name":"grafana","sha256":"`+HashToken("read-token")+`","roles":["read"]},
+		{"name":"ops","sha256":"`+HashToken("admin-token")+`","roles":["admin"]}
+	]}`), 0600))
+	tokens, err := LoadTokens(path)
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(SetupRouter(logger, store.NewMemStorage(), nil, nil, WithAuth(tokens)))
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		body   string
+		code   int
+		err    string
+	}{
+		{name: "no token", method: http.MethodPost, target: "/update/counter/PollCount/1", code: http.StatusUnauthorized, err: "unauthorized"},
+		{name: "unknown token", method: http.MethodPost, target: "/update/counter/PollCount/1", token: "guess", code: http.StatusUnauthorized, err: "unauthorized"},
+		{name: "ingest", method: http.MethodPost, target: "/update/counter/PollCount/1", token: "ingest-token", code: http.StatusOK},
+		{name: "ingest cannot read", method: http.MethodGet, target: "/value/counter/PollCount", token: "ingest-token", code: http.StatusForbidden, err: "forbidden"},
+		{name: "read", method: http.MethodGet, target: "/value/counter/PollCount", token: "read-token", code: http.StatusOK},
+		{name: "read cannot write", method: http.MethodPost, target: "/updates/", token: "read-token", body: `[]`, code: http.StatusForbidden, err: "forbidden"},
+		{name: "read cannot delete", method: http.MethodDelete, target: "/value/?prefix=Poll", token: "read-token", code: http.StatusForbidden, err: "forbidden"},
+		{name: "admin snapshot", method: http.MethodGet, target: "/admin/snapshot", token: "admin-token", code: http.StatusOK},
+		{name: "admin delete", method: http.MethodDelete, target: "/value/?prefix=Poll", token: "admin-token", code: http.StatusOK},
+		{name: "probes stay open", method: http.MethodGet, target: "/ping", code: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.target, strings.NewReader(tt.body))
+			require.NoError(t, err)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			res, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.code, res.StatusCode)
+			if tt.err != "" {
+				var body map[string]string
+				require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+				assert.Equal(t, tt.err, body["error"])
+				assert.NotEmpty(t, body["message"])
+			}
+		})
+	}
+}
+
+func TestLoadTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		wantErr bool
+	}{
+		{name: "valid", file: `{"tokens":[{"name":"a","sha256":"` + HashToken("a") + `","roles":["read","ingest"]}]}`},
+		{name: "plain token instead of hash", file: `{"tokens":[{"name":"a","sha256":"secret","roles":["read"]}]}`, wantErr: true},
+		{name: "unknown role", file: `{"tokens":[{"name":"a","sha256":"` + HashToken("a") + `","roles":["write"]}]}`, wantErr: true},
+		{name: "no roles", file: `{"tokens":[{"name":"a","sha256":"` + HashToken("a") + `"}]}`, wantErr: true},
+		{name: "duplicate", file: `{"tokens":[{"name":"a","sha256":"` + HashToken("a") + `","roles":["read"]},{"name":"b","sha256":"` + HashToken("a") + `","roles":["read"]}]}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tokens.json")
+			require.NoError(t, os.WriteFile(path, []byte(tt.file), 0600))
+
+			tokens, err := LoadTokens(path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			tok, ok := tokens.lookup("a")
+			require.True(t, ok)
+			assert.True(t, tok.has(RoleRead))
+			assert.False(t, tok.has(RoleAdmin))
+		})
+	}
+}
+
+// writeTestCerts выпускает в памяти CA, сертификат сервера для 127.0.0.1 и клиентский
+// сертификат с CN client и сохраняет их в PEM-файлы в dir.
+func writeTestCerts(t *testing.T, dir, client string) (ca, serverCert, serverKey, clientCert, clientKey string) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+
+	issue := func(serial int64, tmpl *x509.Certificate, name string) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		tmpl.SerialNumber = big.NewInt(serial)
+		tmpl.NotBefore, tmpl.NotAfter = time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caTmpl, &key.PublicKey, caKey)
+		require.NoError(t, err)
+		keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+		require.NoError(t, err)
+
+		certPath, keyPath := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+		require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+		require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+		return certPath, keyPath
+	}
+
+	ca = filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600))
+	serverCert, serverKey = issue(2, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "metrics server"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, "server")
+	clientCert, clientKey = issue(3, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: client, Organization: []string{"dc1"}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, "client")
+
+	return ca, serverCert, serverKey, clientCert, clientKey
+}
+
+func Test_router_mTLS(t *testing.T) {
+	ca, serverCert, serverKey, clientCert, clientKey := writeTestCerts(t, t.TempDir(), "agent-dc1")
+
+	cfg, err := NewTLSConfig(TLSConfig{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: ca, RequireClientCert: true})
+	require.NoError(t, err)
+
+	core, logs := observer.New(zap.InfoLevel)
+	ts := httptest.NewUnstartedServer(SetupRouter(zap.New(core), store.NewMemStorage(), nil, nil))
+	ts.TLS = cfg
+	ts.StartTLS()
+	defer ts.Close()
+
+	pool, err := LoadCertPool(ca)
+	require.NoError(t, err)
+	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	require.NoError(t, err)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}}}}
+	res, err := client.Post(ts.URL+"/update/counter/PollCount/1", "text/plain", nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, 1, logs.FilterMessageSnippet("client agent-dc1").Len(), "certificate subject identifies the agent")
+
+	// Без клиентского сертификата сервер обрывает рукопожатие.
+	anon := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	_, err = anon.Post(ts.URL+"/update/counter/PollCount/1", "text/plain", nil)
+	assert.Error(t, err)
+
+	_, err = NewTLSConfig(TLSConfig{CertFile: serverCert, KeyFile: serverKey, RequireClientCert: true})
+	assert.Error(t, err)
+	_, err = NewTLSConfig(TLSConfig{CertFile: serverCert})
+	assert.Error(t, err)
+	_, err = NewTLSConfig(TLSConfig{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: serverKey})
+	assert.Error(t, err)
+}
+
+func TestNewPeerTLSConfig(t *testing.T) {
+	ca, serverCert, serverKey, clientCert, clientKey := writeTestCerts(t, t.TempDir(), "metrics-edge")
+
+	cfg, err := NewTLSConfig(TLSConfig{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: ca, RequireClientCert: true})
+	require.NoError(t, err)
+	ts := httptest.NewUnstartedServer(SetupRouter(zap.NewNop(), store.NewMemStorage(), nil, nil))
+	ts.TLS = cfg
+	ts.StartTLS()
+	defer ts.Close()
+
+	peer := PeerTLSConfig{CAFile: ca, CertFile: clientCert, KeyFile: clientKey}
+	require.True(t, peer.Enabled())
+	tc, err := NewPeerTLSConfig(peer)
+	require.NoError(t, err)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+	res, err := client.Post(ts.URL+"/update/counter/PollCount/1", "text/plain", nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	assert.False(t, PeerTLSConfig{}.Enabled())
+	_, err = NewPeerTLSConfig(PeerTLSConfig{CertFile: clientCert})
+	assert.Error(t, err)
+	_, err = NewPeerTLSConfig(PeerTLSConfig{CAFile: clientKey})
+	assert.Error(t, err)
+}
+
+func Test_router_limits(t *testing.T) {
+	gzipped := func(data []byte) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+		return buf.Bytes()
+	}
+	bomb := gzipped(bytes.Repeat([]byte(" "), 1<<20))
+	require.Less(t, len(bomb), 4<<10)
+
+	ms := store.NewMemStorage()
+	ts := httptest.NewServer(SetupRouter(logger, ms, nil, nil, WithLimits(Limits{
+		MaxBodySize:         4 << 10,
+		MaxDecompressedSize: 64 << 10,
+		MaxBatch:            2,
+	})))
+	defer ts.Close()
+
+	tests := []struct {
+		name string
+		body []byte
+		gzip bool
+		code int
+		want string
+	}{
+		{name: "gzip batch", body: gzipped([]byte(`[{"id":"a","type":"counter","delta":1}]`)), gzip: true, code: http.StatusOK},
+		{name: "plain batch", body: []byte(`[{"id":"a","type":"counter","delta":1}]`), code: http.StatusOK},
+		{name: "body too large", body: bytes.Repeat([]byte(" "), 5<<10), code: http.StatusRequestEntityTooLarge, want: "request body exceeds 4096 bytes"},
+		{name: "gzip bomb", body: bomb, gzip: true, code: http.StatusRequestEntityTooLarge, want: "decompressed body exceeds 65536 bytes"},
+		{name: "invalid gzip", body: []byte("not gzip"), gzip: true, code: http.StatusBadRequest, want: "invalid gzip body"},
+		{
+			name: "batch too long",
+			body: []byte(`[{"id":"a","type":"counter","delta":1},{"id":"b","type":"counter","delta":1},{"id":"c","type":"counter","delta":1}]`),
+			code: http.StatusRequestEntityTooLarge,
+			want: "batch of 3 metrics exceeds the limit of 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, ts.URL+"/updates/", bytes.NewReader(tt.body))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", "application/json")
+			if tt.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+
+			res, err := ts.Client().Do(req)
+			require.NoError(t, err)
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.code, res.StatusCode)
+			assert.Contains(t, string(body), tt.want)
+		})
+	}
+	assert.Equal(t, map[string]string{"a": "2"}, ms.GetMetric(context.Background(), types.Counter))
+
+	// Ограничения действуют на все эндпоинты, читающие тело, а не только на запись.
+	for _, method := range []string{http.MethodPost, http.MethodDelete} {
+		req, err := http.NewRequest(method, ts.URL+"/value/", bytes.NewReader(bomb))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+
+		res, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode, method)
+		assert.Contains(t, string(body), "decompressed body exceeds 65536 bytes")
+	}
+}
+
+func Test_router_clientRateLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"tokens":[
+		{"name":"dc1","sha256":"`+HashToken("token-1")+`","roles":["ingest"]},
+		{"name":"dc2","sha256":"`+HashToken("token-2")+`","roles":["ingest"]}
+	]}`), 0600))
+	tokens, err := LoadTokens(path)
+	require.NoError(t, err)
+
+	ts := httptest.NewServer(SetupRouter(logger, store.NewMemStorage(), nil, nil,
+		WithAuth(tokens), WithLimits(Limits{Rate: 0.5, Burst: 2})))
+	defer ts.Close()
+
+	update := func(token string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/update/counter/PollCount/1", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		return res
+	}
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusOK, update("token-1").StatusCode)
+	}
+	res := update("token-1")
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.Equal(t, "2", res.Header.Get("Retry-After"))
+
+	// У другого клиента своё ведро, хотя запросы идут с того же адреса.
+	assert.Equal(t, http.StatusOK, update("token-2").StatusCode)
+
+	// Чтение не ограничивается.
+	res, _ = testRequest(t, ts, http.MethodGet, "/ping", nil)
+	res.Body.Close()
+	assert.NotEqual(t, http.StatusTooManyRequests, res.StatusCode)
+}
+
+type fakeReplica struct {
+	promoted atomic.Bool
+}
+
+func (f *fakeReplica) ReadOnly() (string, bool) { return "http://leader:8080", !f.promoted.Load() }
+
+func Test_router_replicaRejectsWrites(t *testing.T) {
+	ms := store.NewMemStorage()
+	_, err := ms.UpdateMetric(context.Background(), types.Gauge, "Load", "1")
+	require.NoError(t, err)
+
+	replica := &fakeReplica{}
+	ts := httptest.NewServer(SetupRouter(logger, ms, nil, nil, WithAdmin("secret"), WithReplica(replica)))
+	defer ts.Close()
+
+	writes := []struct {
+		method, path, body string
+	}{
+		{http.MethodPost, "/update/gauge/Load/2", ""},
+		{http.MethodPost, "/update/", `{"id":"Load","type":"gauge","value":2}`},
+		{http.MethodPost, "/updates/", `[{"id":"Load","type":"gauge","value":2}]`},
+		{http.MethodDelete, "/value/?prefix=Load", ""},
+		{http.MethodPost, "/admin/restore", `{}`},
+	}
+	for _, tt := range writes {
+		req, err := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.body))
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, tt.path)
+		assert.Equal(t, "http://leader:8080", resp.Header.Get("X-Replication-Leader"), tt.path)
+	}
+
+	// Чтение на ведомом работает, и ни одна запись не дошла до хранилища.
+	resp, body := testRequest(t, ts, http.MethodGet, "/value/gauge/Load", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "1", body)
+
+	replica.promoted.Store(true)
+	resp, _ = testRequest(t, ts, http.MethodPost, "/update/gauge/Load/2", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// TLSConfig — файлы сертификатов сервера. С ClientCAFile сервер проверяет сертификаты
+// клиентов (mTLS); RequireClientCert отклоняет соединения без сертификата.
+type TLSConfig struct {
+	CertFile          string
+	KeyFile           string
+	ClientCAFile      string
+	RequireClientCert bool
+}
+
+// Enabled сообщает, включён ли TLS.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+func NewTLSConfig(c TLSConfig) (*tls.Config, error) {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("both tls certificate and key are required")
+	}
+	if c.RequireClientCert && c.ClientCAFile == "" {
+		return nil, errors.New("client certificate verification requires a client CA")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load tls key pair: %w", err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCAFile == "" {
+		return cfg, nil
+	}
+
+	pool, err := LoadCertPool(c.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if c.RequireClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+// PeerTLSConfig — сертификаты для запросов сервера к другим узлам (ведущему, соседям по
+// кластеру, родителю): CAFile проверяет их сертификаты, CertFile и KeyFile предъявляются
+// им при mTLS.
+type PeerTLSConfig struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// Enabled сообщает, что к другим узлам нужно ходить по https.
+func (c PeerTLSConfig) Enabled() bool {
+	return c.CAFile != "" || c.CertFile != "" || c.KeyFile != ""
+}
+
+func NewPeerTLSConfig(c PeerTLSConfig) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if c.CAFile != "" {
+		pool, err := LoadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, errors.New("both peer client certificate and key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load peer client key pair: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
+
+// LoadCertPool читает PEM-файл с одним или несколькими сертификатами CA.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return pool, nil
+}
+
+// ClientIdentity возвращает имя клиента из проверенного сертификата: CommonName субъекта,
+// а если он пуст — субъект целиком. Без mTLS возвращается пустая строка.
+func ClientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if subject.CommonName != "" {
+		return subject.CommonName
+	}
+	return subject.String()
+}
@@ -0,0 +1,163 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/store"
+	"github.com/shevchukeugeni/metrics/internal/store/postgres"
+	"github.com/shevchukeugeni/metrics/internal/store/sqlite"
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+const (
+	Memory   = "memory"
+	File     = "file"
+	Postgres = "postgres"
+	SQLite   = "sqlite"
+)
+
+// Config выбирает хранилище. Пустой Backend сохраняет прежнее поведение: postgres, если задан
+// DSN, иначе память с дампом в файл, если задан путь, иначе просто память.
+type Config struct {
+	Backend string
+	// Strict запрещает переход на запасное хранилище: если выбранное недоступно, Open возвращает ошибку.
+	Strict bool
+
+	Dump     *types.DumpConfig
+	Postgres postgres.Config
+	SQLite   sqlite.Config
+}
+
+// Backend — открытое хранилище вместе с ресурсами, которые нужно освободить при остановке.
+type Backend struct {
+	Storage store.MetricStorage
+	// Dump не nil только для файлового хранилища; запускать его должен вызывающий.
+	Dump *store.DumpWorker
+	// Partitions не nil для postgres с включённой историей; запускать его должен вызывающий.
+	Partitions *postgres.PartitionManager
+
+	status  store.StorageStatus
+	ping    func(context.Context) error
+	closers []func()
+}
+
+// Open открывает хранилище из конфигурации. Если оно недоступно и Strict не задан, сервер
+// переходит на файловое хранилище (или память, когда путь к дампу не задан), а причина
+// перехода сохраняется в Status.
+func Open(ctx context.Context, logger *zap.Logger, cfg Config, wg *sync.WaitGroup) (*Backend, error) {
+	requested := cfg.Backend
+	if requested == "" {
+		requested = auto(cfg)
+	}
+
+	b, err := open(ctx, logger, requested, cfg, wg)
+	if err == nil {
+		return b, nil
+	}
+	if cfg.Strict {
+		return nil, fmt.Errorf("storage backend %s: %w", requested, err)
+	}
+
+	fallback := Memory
+	if cfg.Dump != nil && cfg.Dump.FileStoragePath != "" && requested != File {
+		fallback = File
+	}
+	logger.Error("storage backend unavailable, falling back",
+		zap.String("backend", requested), zap.String("fallback", fallback), zap.Error(err))
+
+	b, ferr := open(ctx, logger, fallback, cfg, wg)
+	if ferr != nil {
+		return nil, errors.Join(err, ferr)
+	}
+	b.status.Requested = requested
+	b.status.Fallback = err.Error()
+
+	return b, nil
+}
+
+func auto(cfg Config) string {
+	switch {
+	case cfg.Postgres.URL != "":
+		return Postgres
+	case cfg.Dump != nil && cfg.Dump.FileStoragePath != "":
+		return File
+	default:
+		return Memory
+	}
+}
+
+func open(ctx context.Context, logger *zap.Logger, name string, cfg Config, wg *sync.WaitGroup) (*Backend, error) {
+	b := &Backend{status: store.StorageStatus{Backend: name}}
+
+	switch name {
+	case Memory:
+		b.Storage = store.NewMemStorage()
+	case File:
+		if cfg.Dump == nil || cfg.Dump.FileStoragePath == "" {
+			return nil, errors.New("file storage path is not set")
+		}
+		ms := store.NewMemStorage()
+		b.Dump = store.NewDumpWorker(logger, cfg.Dump, ms, wg)
+		b.Storage = ms
+	case Postgres:
+		pool, err := postgres.NewPostgresDB(ctx, cfg.Postgres)
+		if err != nil {
+			return nil, err
+		}
+		st := postgres.NewStore(logger, pool, cfg.Postgres.QueryTimeout)
+		if pm := postgres.NewPartitionManager(logger, st, cfg.Postgres.SampleRetention); pm != nil {
+			// История включается только после успешного обслуживания; при неудаче
+			// PartitionManager повторит попытку сам.
+			if err = pm.Maintain(ctx, time.Now()); err != nil {
+				logger.Error("metric history delayed: failed to prepare partitions", zap.Error(err))
+			}
+			b.Partitions = pm
+		}
+		b.Storage = st
+		b.ping = pool.Ping
+		b.closers = append(b.closers, pool.Close)
+	case SQLite:
+		db, err := sqlite.NewSQLiteDB(ctx, cfg.SQLite)
+		if err != nil {
+			return nil, err
+		}
+		b.Storage = sqlite.NewStore(logger, db, cfg.SQLite.QueryTimeout)
+		b.ping = db.PingContext
+		b.closers = append(b.closers, func() {
+			if err := db.Close(); err != nil {
+				logger.Error("failed to close sqlite database", zap.Error(err))
+			}
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", name)
+	}
+
+	logger.Info("storage backend ready", zap.String("backend", name))
+
+	return b, nil
+}
+
+// Status реализует server.Readiness.
+func (b *Backend) Status() store.StorageStatus {
+	return b.status
+}
+
+// Ping проверяет соединение с базой; хранилищам в памяти проверять нечего.
+func (b *Backend) Ping(ctx context.Context) error {
+	if b.ping == nil {
+		return nil
+	}
+	return b.ping(ctx)
+}
+
+func (b *Backend) Close() {
+	for _, c := range b.closers {
+		c()
+	}
+}
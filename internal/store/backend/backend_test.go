@@ -0,0 +1,104 @@
+package backend
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/store"
+	"github.com/shevchukeugeni/metrics/internal/store/postgres"
+	"github.com/shevchukeugeni/metrics/internal/store/sqlite"
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+// unreachableDSN указывает на закрытый порт, чтобы подключение падало сразу.
+const unreachableDSN = "postgres://metrics@127.0.0.1:1/metrics?sslmode=disable"
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	dump := &types.DumpConfig{FileStoragePath: filepath.Join(dir, "metrics.json")}
+	pg := postgres.Config{URL: unreachableDSN, ConnectTimeout: time.Second}
+
+	tests := []struct {
+		name    string
+		cfg     Config
+		want    store.StorageStatus
+		dump    bool
+		wantErr bool
+	}{
+		{
+			name: "auto memory",
+			cfg:  Config{Dump: &types.DumpConfig{}},
+			want: store.StorageStatus{Backend: Memory},
+		},
+		{
+			name: "auto file",
+			cfg:  Config{Dump: dump},
+			want: store.StorageStatus{Backend: File},
+			dump: true,
+		},
+		{
+			name: "sqlite",
+			cfg:  Config{Backend: SQLite, SQLite: sqlite.Config{Path: filepath.Join(dir, "metrics.db")}},
+			want: store.StorageStatus{Backend: SQLite},
+		},
+		{
+			name: "file without path",
+			cfg:  Config{Backend: File, Dump: &types.DumpConfig{}},
+			want: store.StorageStatus{Backend: Memory, Requested: File, Fallback: "file storage path is not set"},
+		},
+		{
+			name: "postgres falls back to file",
+			cfg:  Config{Postgres: pg, Dump: dump},
+			want: store.StorageStatus{Backend: File, Requested: Postgres},
+			dump: true,
+		},
+		{
+			name:    "postgres strict",
+			cfg:     Config{Backend: Postgres, Strict: true, Postgres: pg, Dump: dump},
+			wantErr: true,
+		},
+		{
+			name:    "sqlite strict without path",
+			cfg:     Config{Backend: SQLite, Strict: true},
+			wantErr: true,
+		},
+		{
+			name:    "unknown backend strict",
+			cfg:     Config{Backend: "cassandra", Strict: true},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			b, err := Open(context.Background(), zap.NewNop(), tt.cfg, &wg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			defer b.Close()
+
+			status := b.Status()
+			if tt.want.Requested != "" && tt.want.Fallback == "" {
+				// Текст ошибки подключения зависит от окружения, важно лишь, что причина сохранена.
+				assert.NotEmpty(t, status.Fallback)
+				status.Fallback = ""
+			}
+			assert.Equal(t, tt.want, status)
+			assert.Equal(t, tt.dump, b.Dump != nil)
+			assert.NoError(t, b.Ping(context.Background()))
+
+			_, err = b.Storage.UpdateMetric(context.Background(), types.Counter, "PollCount", "1")
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{"PollCount": "1"}, b.Storage.GetMetric(context.Background(), types.Counter))
+		})
+	}
+}
@@ -2,8 +2,7 @@ package store
 
 import (
 	"context"
-	"encoding/json"
-	"io"
+	"errors"
 	"os"
 	"sync"
 	"time"
@@ -13,17 +12,31 @@ import (
 	"github.com/shevchukeugeni/metrics/internal/types"
 )
 
+// defaultCheckpointInterval используется, когда STORE_INTERVAL=0, а изменения
+// и так сохраняются журналом или синхронным дампом.
+const defaultCheckpointInterval = 300 * time.Second
+
 type DumpWorker struct {
 	logger   *zap.Logger
 	cfg      *types.DumpConfig
 	storage  *MemStorage
+	wal      *WAL
 	syncMode bool
 
+	// mu не даёт синхронному дампу из обработчиков и периодическому дампу писать одновременно.
+	mu sync.Mutex
+	// retained — сегменты журнала, с которых доигрываются хранимые поколения дампа, от новых
+	// к старым. Журнал обрезается только до самого старого: иначе восстановление из
+	// предыдущего поколения потеряло бы изменения.
+	retained []uint64
+
 	wg *sync.WaitGroup
 }
 
 type dumpData struct {
 	Metrics []metric
+	// WALSegment — первый сегмент журнала, изменения из которого в дамп не вошли.
+	WALSegment uint64 `json:"wal_segment,omitempty"`
 }
 
 type metric struct {
@@ -38,36 +51,123 @@ func NewDumpWorker(logger *zap.Logger, cfg *types.DumpConfig, storage *MemStorag
 		return nil
 	}
 
+	switch cfg.DumpFormat {
+	case "", DumpFormatJSON, DumpFormatBinary:
+	default:
+		logger.Error("unknown dump format, falling back to json", zap.String("format", cfg.DumpFormat))
+		cfg.DumpFormat = DumpFormatJSON
+	}
+
+	var walSegment uint64
+
 	if cfg.Restore {
-		data, err := restore(cfg.FileStoragePath)
+		data, err := restore(logger, cfg.FileStoragePath, cfg.DumpGenerations)
 		if err != nil || data == nil {
 			logger.Error("failed to restore", zap.Error(err))
 		} else {
 			for _, m := range data.Metrics {
-				_, err = storage.UpdateMetric(m.MType, m.Name, m.Value)
+				_, err = storage.UpdateMetric(context.Background(), m.MType, m.Name, m.Value)
 				if err != nil {
 					logger.Error("failed to restore", zap.Error(err))
 				}
 			}
+			walSegment = data.WALSegment
+		}
+	}
+
+	var wal *WAL
+	if cfg.WALPath != "" {
+		var err error
+		wal, err = openWAL(logger, cfg, storage, walSegment)
+		if err != nil {
+			logger.Error("failed to open wal, falling back to dumps only", zap.Error(err))
+			wal = nil
 		}
 	}
 
-	return &DumpWorker{
+	dw := &DumpWorker{
 		logger:   logger,
 		cfg:      cfg,
 		storage:  storage,
-		syncMode: cfg.StoreInterval == 0,
+		wal:      wal,
+		syncMode: cfg.StoreInterval == 0 && wal == nil,
 		wg:       wg,
 	}
+	if wal != nil {
+		dw.retained = retainedSegments(cfg.FileStoragePath, cfg.DumpGenerations)
+	}
+
+	return dw
+}
+
+// retainedSegments читает из поколений дампа, с какого сегмента журнала их доигрывать.
+// Повреждённые поколения не учитываются: восстановиться из них всё равно нельзя.
+func retainedSegments(path string, generations uint) []uint64 {
+	var segments []uint64
+	for i := uint(0); i <= generations; i++ {
+		data, err := restoreFile(generationPath(path, i))
+		if err != nil {
+			continue
+		}
+		segments = append(segments, data.WALSegment)
+	}
+	return segments
+}
+
+// openWAL открывает журнал и доигрывает изменения, не попавшие в восстановленный дамп.
+// Без восстановления журнал начинается заново.
+func openWAL(logger *zap.Logger, cfg *types.DumpConfig, storage *MemStorage, from uint64) (*WAL, error) {
+	wal, err := OpenWAL(logger, cfg.WALPath, cfg.WALFsync, time.Duration(cfg.WALSyncInterval)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Restore {
+		n, err := wal.Replay(from, storage.ApplyWAL)
+		if err != nil {
+			wal.Close()
+			return nil, err
+		}
+		logger.Info("wal replayed", zap.Int("records", n))
+	} else {
+		seq, err := wal.Rotate()
+		if err != nil {
+			wal.Close()
+			return nil, err
+		}
+		if err = wal.Prune(seq); err != nil {
+			wal.Close()
+			return nil, err
+		}
+	}
+
+	storage.SetWAL(wal)
+
+	return wal, nil
 }
 
 func (dw *DumpWorker) Start(ctx context.Context) {
 	dw.wg.Add(1)
-	ticker := time.NewTicker(time.Duration(dw.cfg.StoreInterval) * time.Second)
+
+	if dw.wal != nil {
+		go dw.wal.Start(ctx)
+	}
+
+	interval := time.Duration(dw.cfg.StoreInterval) * time.Second
+	if interval == 0 {
+		interval = defaultCheckpointInterval
+	}
+
+	ticker := time.NewTicker(interval)
 	for {
 		select {
 		case <-ctx.Done():
 			dw.dump()
+			if dw.wal != nil {
+				if err := dw.wal.Close(); err != nil {
+					dw.logger.Error("failed to close wal", zap.Error(err))
+				}
+			}
 			dw.wg.Done()
 			return
 		case <-ticker.C:
@@ -83,42 +183,81 @@ func (dw *DumpWorker) DumpSync() {
 	}
 }
 
+// dump сохраняет чекпоинт. Сегменты журнала удаляются только после успешной записи файла
+// и только те, что не нужны ни одному из хранимых поколений.
 func (dw *DumpWorker) dump() {
-	var dmp dumpData
-	counters := dw.storage.GetMetric(types.Counter)
-	for k, v := range counters {
-		dmp.Metrics = append(dmp.Metrics, metric{MType: types.Counter, Name: k, Value: v})
-	}
-	gauges := dw.storage.GetMetric(types.Gauge)
-	for k, v := range gauges {
-		dmp.Metrics = append(dmp.Metrics, metric{MType: types.Gauge, Name: k, Value: v})
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+
+	metrics, walSegment, err := dw.storage.Checkpoint()
+	if err != nil {
+		dw.logger.Error("failed to checkpoint", zap.Error(err))
+		return
 	}
 
-	data, err := json.MarshalIndent(dmp, "", "   ")
+	data, err := encodeDump(metrics, walSegment, dw.cfg.DumpFormat, dw.cfg.DumpCompress)
 	if err != nil {
-		dw.logger.Error("failed to marshal json", zap.Error(err))
+		dw.logger.Error("failed to encode dump", zap.Error(err))
+		return
 	}
 
-	err = os.WriteFile(dw.cfg.FileStoragePath, data, 0666)
+	err = writeDumpFile(dw.cfg.FileStoragePath, data, dw.cfg.DumpGenerations)
 	if err != nil {
-		dw.logger.Error("failed to save json", zap.Error(err))
+		dw.logger.Error("failed to save dump", zap.Error(err))
+		return
+	}
+
+	if dw.wal == nil {
+		return
+	}
+
+	dw.retained = append([]uint64{walSegment}, dw.retained...)
+	if len(dw.retained) > int(dw.cfg.DumpGenerations)+1 {
+		dw.retained = dw.retained[:dw.cfg.DumpGenerations+1]
+	}
+
+	oldest := walSegment
+	for _, seq := range dw.retained {
+		if seq < oldest {
+			oldest = seq
+		}
+	}
+	if err = dw.wal.Prune(oldest); err != nil {
+		dw.logger.Error("failed to prune wal", zap.Error(err))
 	}
 }
 
-func restore(path string) (*dumpData, error) {
-	jsonFile, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// restore загружает самую свежую целую версию дампа: основной файл или,
+// если он повреждён, одно из предыдущих поколений.
+func restore(logger *zap.Logger, path string, generations uint) (*dumpData, error) {
+	var errs []error
+
+	for i := uint(0); i <= generations; i++ {
+		gpath := generationPath(path, i)
+
+		data, err := restoreFile(gpath)
+		if err == nil {
+			if i > 0 {
+				logger.Warn("restored from previous dump generation", zap.String("path", gpath))
+			}
+			return data, nil
+		}
+		if errors.Is(err, os.ErrNotExist) && i > 0 {
+			continue
+		}
+
+		logger.Error("failed to restore dump", zap.String("path", gpath), zap.Error(err))
+		errs = append(errs, err)
 	}
-	defer jsonFile.Close()
 
-	jsonData, err := io.ReadAll(jsonFile)
+	return nil, errors.Join(errs...)
+}
+
+func restoreFile(path string) (*dumpData, error) {
+	payload, err := readDumpFile(path)
 	if err != nil {
 		return nil, err
 	}
-	data := &dumpData{}
-	if err := json.Unmarshal(jsonData, data); err != nil {
-		return nil, err
-	}
-	return data, nil
+
+	return decodeDump(payload)
 }
@@ -0,0 +1,233 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+func TestDumpWorker_Generations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics-db.json")
+	cfg := &types.DumpConfig{StoreInterval: 300, FileStoragePath: path, DumpGenerations: 2}
+
+	var wg sync.WaitGroup
+	ms := NewMemStorage()
+	dw := NewDumpWorker(zap.NewNop(), cfg, ms, &wg)
+
+	for i := 0; i < 4; i++ {
+		_, err := ms.UpdateMetric(context.Background(), types.Counter, "PollCount", "1")
+		require.NoError(t, err)
+		dw.dump()
+	}
+
+	for gen, want := range map[uint]string{0: "4", 1: "3", 2: "2"} {
+		data, err := restoreFile(generationPath(path, gen))
+		require.NoError(t, err)
+		require.Len(t, data.Metrics, 1)
+		assert.Equal(t, want, data.Metrics[0].Value)
+	}
+	_, err := os.Stat(generationPath(path, 3))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	matches, err := filepath.Glob(path + ".tmp-*")
+	require.NoError(t, err)
+	assert.Empty(t, matches, "temporary files must not be left behind")
+
+	// Повреждаем основной файл — восстановление берёт предыдущее поколение.
+	raw, err := os.ReadFile(path)
+	require.NoError(t, err)
+	raw[len(raw)-3] ^= 0xff
+	require.NoError(t, os.WriteFile(path, raw, 0644))
+
+	_, err = restoreFile(path)
+	require.ErrorIs(t, err, ErrDumpChecksum)
+
+	cfg.Restore = true
+	restored := NewMemStorage()
+	NewDumpWorker(zap.NewNop(), cfg, restored, &wg)
+	assert.Equal(t, map[string]string{"PollCount": "3"}, restored.GetMetric(context.Background(), types.Counter))
+}
+
+func TestRestore_LegacyAndTruncated(t *testing.T) {
+	dir := t.TempDir()
+
+	legacy := filepath.Join(dir, "legacy.json")
+	require.NoError(t, os.WriteFile(legacy,
+		[]byte(`{"Metrics":[{"type":"gauge","name":"HeapAlloc","value":"1.5"}]}`), 0644))
+
+	data, err := restore(zap.NewNop(), legacy, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []metric{{MType: types.Gauge, Name: "HeapAlloc", Value: "1.5"}}, data.Metrics)
+
+	truncated := filepath.Join(dir, "truncated.json")
+	require.NoError(t, writeDumpFile(truncated, []byte(`{"Metrics":[]}`), 0))
+	raw, err := os.ReadFile(truncated)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(truncated, raw[:len(raw)-2], 0644))
+
+	_, err = restore(zap.NewNop(), truncated, 3)
+	assert.ErrorIs(t, err, ErrDumpChecksum)
+}
+
+func TestDumpWorker_Formats(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		compress bool
+	}{
+		{name: "json", format: DumpFormatJSON},
+		{name: "json zstd", format: DumpFormatJSON, compress: true},
+		{name: "binary", format: DumpFormatBinary},
+		{name: "binary zstd", format: DumpFormatBinary, compress: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &types.DumpConfig{
+				StoreInterval:   300,
+				FileStoragePath: filepath.Join(t.TempDir(), "metrics-db"),
+				DumpFormat:      tt.format,
+				DumpCompress:    tt.compress,
+			}
+
+			var wg sync.WaitGroup
+			ms := NewMemStorage()
+			dw := NewDumpWorker(zap.NewNop(), cfg, ms, &wg)
+
+			_, err := ms.UpdateMetric(context.Background(), types.Counter, "PollCount", "-42")
+			require.NoError(t, err)
+			_, err = ms.UpdateMetric(context.Background(), types.Gauge, `HeapAlloc{host="a"}`, "0.1")
+			require.NoError(t, err)
+			_, err = ms.UpdateMetric(context.Background(), types.Gauge, "RandomValue", "1e-300")
+			require.NoError(t, err)
+			dw.dump()
+
+			// Формат при восстановлении определяется по содержимому, а не по настройке.
+			cfg.Restore, cfg.DumpFormat, cfg.DumpCompress = true, "", false
+			restored := NewMemStorage()
+			NewDumpWorker(zap.NewNop(), cfg, restored, &wg)
+			assert.Equal(t, ms.GetMetric(context.Background(), types.Counter), restored.GetMetric(context.Background(), types.Counter))
+			assert.Equal(t, ms.GetMetric(context.Background(), types.Gauge), restored.GetMetric(context.Background(), types.Gauge))
+		})
+	}
+}
+
+func TestDecodeDump_Malformed(t *testing.T) {
+	ms := NewMemStorage()
+	_, err := ms.UpdateMetric(context.Background(), types.Gauge, "HeapAlloc", "1.5")
+	require.NoError(t, err)
+	_, err = ms.UpdateMetric(context.Background(), types.Counter, "PollCount", "7")
+	require.NoError(t, err)
+
+	payload, err := encodeDump(ms.GetMetrics(context.Background()), 3, DumpFormatBinary, false)
+	require.NoError(t, err)
+
+	data, err := decodeDump(payload)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), data.WALSegment)
+	assert.ElementsMatch(t, []metric{
+		{MType: types.Gauge, Name: "HeapAlloc", Value: "1.5"},
+		{MType: types.Counter, Name: "PollCount", Value: "7"},
+	}, data.Metrics)
+
+	for i := len(binaryDumpMagic) + 1; i < len(payload); i++ {
+		_, err = decodeDump(payload[:i])
+		assert.ErrorIs(t, err, ErrDumpFormat, "truncated at %d", i)
+	}
+	_, err = decodeDump(append(payload, 0))
+	assert.ErrorIs(t, err, ErrDumpFormat)
+}
+
+func TestReadSnapshot(t *testing.T) {
+	ms := NewMemStorage()
+	_, err := ms.UpdateMetric(context.Background(), types.Gauge, "HeapAlloc", "1.5")
+	require.NoError(t, err)
+	_, err = ms.UpdateMetric(context.Background(), types.Counter, "PollCount", "7")
+	require.NoError(t, err)
+	metrics := ms.GetMetrics(context.Background())
+
+	for _, format := range []string{DumpFormatJSON, DumpFormatBinary} {
+		for _, compress := range []bool{false, true} {
+			var buf bytes.Buffer
+			require.NoError(t, WriteSnapshot(&buf, metrics, format, compress))
+
+			res, err := ReadSnapshot(&buf, 1<<20)
+			require.NoError(t, err, "%s compress=%v", format, compress)
+			require.Len(t, res, 2)
+			require.NoError(t, ms.ReplaceMetrics(context.Background(), res))
+			assert.Equal(t, map[string]string{"HeapAlloc": "1.5"}, ms.GetMetric(context.Background(), types.Gauge))
+			assert.Equal(t, map[string]string{"PollCount": "7"}, ms.GetMetric(context.Background(), types.Counter))
+		}
+	}
+
+	// Файл дампа с заголовком тоже принимается, а контрольная сумма проверяется.
+	payload, err := encodeDump(metrics, 0, DumpFormatBinary, true)
+	require.NoError(t, err)
+	file := append([]byte(dumpHeader(payload)), payload...)
+	res, err := ReadSnapshot(bytes.NewReader(file), 1<<20)
+	require.NoError(t, err)
+	assert.Len(t, res, 2)
+
+	file[len(file)-1] ^= 0xff
+	_, err = ReadSnapshot(bytes.NewReader(file), 1<<20)
+	assert.Error(t, err)
+	_, err = ReadSnapshot(bytes.NewReader(append(append([]byte(dumpHeader(payload)), payload...), 0)), 1<<20)
+	assert.ErrorIs(t, err, ErrDumpChecksum)
+
+	// За JSON-документом допускаются только пробелы.
+	var buf bytes.Buffer
+	require.NoError(t, WriteSnapshot(&buf, metrics, DumpFormatJSON, false))
+	doc := buf.String()
+	_, err = ReadSnapshot(strings.NewReader(doc+"\n"), 1<<20)
+	assert.NoError(t, err)
+	for _, tail := range []string{"junk", doc, "]"} {
+		_, err = ReadSnapshot(strings.NewReader(doc+tail), 1<<20)
+		assert.ErrorIs(t, err, ErrDumpFormat, tail)
+	}
+}
+
+func TestReadSnapshot_TooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	require.NoError(t, err)
+	_, err = zw.Write(bytes.Repeat([]byte(" "), 10<<20))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	require.Less(t, buf.Len(), 1<<16)
+
+	_, err = ReadSnapshot(bytes.NewReader(buf.Bytes()), 1<<16)
+	assert.ErrorIs(t, err, ErrSnapshotTooLarge)
+
+	_, err = ReadSnapshot(bytes.NewReader(bytes.Repeat([]byte(" "), 1<<17)), 1<<16)
+	assert.ErrorIs(t, err, ErrSnapshotTooLarge)
+}
+
+func BenchmarkEncodeDump(b *testing.B) {
+	ms := NewMemStorage()
+	for i := 0; i < 100000; i++ {
+		_, err := ms.UpdateMetric(context.Background(), types.Gauge, fmt.Sprintf(`metric_%d{host="node-%d"}`, i, i%100), fmt.Sprint(float64(i)/3))
+		require.NoError(b, err)
+	}
+	metrics := ms.GetMetrics(context.Background())
+
+	for _, format := range []string{DumpFormatJSON, DumpFormatBinary} {
+		b.Run(format, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				payload, err := encodeDump(metrics, 0, format, false)
+				require.NoError(b, err)
+				b.SetBytes(int64(len(payload)))
+			}
+		})
+	}
+}
@@ -0,0 +1,472 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+const (
+	DumpFormatJSON   = "json"
+	DumpFormatBinary = "binary"
+
+	binaryDumpVersion = 1
+
+	binaryGauge   = 1
+	binaryCounter = 2
+)
+
+var (
+	binaryDumpMagic = []byte("MTRCDUMP")
+	zstdMagic       = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+	// ErrDumpFormat — дамп повреждён или за ним в файле есть посторонние данные.
+	ErrDumpFormat = errors.New("malformed dump")
+	// ErrSnapshotTooLarge — распакованный снимок больше допустимого размера.
+	ErrSnapshotTooLarge = errors.New("snapshot exceeds size limit")
+)
+
+// encodeDump сериализует снимок хранилища в выбранном формате и при необходимости сжимает его zstd.
+func encodeDump(metrics map[string]Metric, walSegment uint64, format string, compress bool) ([]byte, error) {
+	var (
+		payload []byte
+		err     error
+	)
+
+	switch format {
+	case "", DumpFormatJSON:
+		payload, err = json.MarshalIndent(newDumpData(metrics, walSegment), "", "   ")
+	case DumpFormatBinary:
+		payload, err = encodeBinaryDump(metrics, walSegment)
+	default:
+		return nil, fmt.Errorf("unknown dump format %q", format)
+	}
+	if err != nil || !compress {
+		return payload, err
+	}
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer enc.Close()
+
+	return enc.EncodeAll(payload, nil), nil
+}
+
+// decodeDump определяет формат по первым байтам: сжатые данные распаковываются,
+// бинарный формат узнаётся по сигнатуре, всё остальное считается JSON.
+func decodeDump(payload []byte) (*dumpData, error) {
+	if bytes.HasPrefix(payload, zstdMagic) {
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+
+		if payload, err = dec.DecodeAll(payload, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if bytes.HasPrefix(payload, binaryDumpMagic) {
+		return decodeBinaryDump(payload)
+	}
+
+	data := &dumpData{}
+	if err := json.Unmarshal(payload, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteSnapshot пишет снимок хранилища в w по мере сериализации, не собирая его целиком
+// в памяти. Заголовок с контрольной суммой не пишется — её не посчитать заранее, а
+// ReadSnapshot и восстановление из FILE_STORAGE_PATH принимают данные и без него.
+func WriteSnapshot(w io.Writer, metrics map[string]Metric, format string, compress bool) error {
+	switch format {
+	case "", DumpFormatJSON, DumpFormatBinary:
+	default:
+		return fmt.Errorf("unknown dump format %q", format)
+	}
+
+	var zw *zstd.Encoder
+	if compress {
+		var err error
+		if zw, err = zstd.NewWriter(w); err != nil {
+			return err
+		}
+		w = zw
+	}
+
+	bw := bufio.NewWriter(w)
+	var err error
+	if format == DumpFormatBinary {
+		err = writeBinaryDump(bw, metrics, 0)
+	} else {
+		err = writeJSONDump(bw, metrics)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+
+	if zw != nil {
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// writeJSONDump пишет серии по одной в том же виде, что и json-дамп.
+func writeJSONDump(w io.Writer, metrics map[string]Metric) error {
+	if _, err := io.WriteString(w, `{"Metrics":[`); err != nil {
+		return err
+	}
+
+	first := true
+	write := func(mtype string, values map[string]string) error {
+		for name, value := range values {
+			data, err := json.Marshal(metric{MType: mtype, Name: name, Value: value})
+			if err != nil {
+				return err
+			}
+			if !first {
+				data = append([]byte{','}, data...)
+			}
+			first = false
+			if _, err = w.Write(data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := write(types.Counter, metrics[types.Counter].Get()); err != nil {
+		return err
+	}
+	if err := write(types.Gauge, metrics[types.Gauge].Get()); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "]}")
+	return err
+}
+
+// ReadSnapshot разбирает снимок или файл дампа любого поддерживаемого формата по мере
+// чтения r и возвращает серии батчем обновлений. limit ограничивает размер данных после
+// распаковки; при превышении возвращается ErrSnapshotTooLarge.
+func ReadSnapshot(r io.Reader, limit int64) ([]types.Metrics, error) {
+	br := bufio.NewReader(&limitedReader{r: r, n: limit})
+
+	if prefix, _ := br.Peek(len(dumpHeaderPrefix)); string(prefix) != dumpHeaderPrefix {
+		dmp, err := readDump(br, limit)
+		if err != nil {
+			return nil, err
+		}
+		return dmp.updates()
+	}
+
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, errors.New("truncated header")
+	}
+	sum, size, err := parseDumpHeader(line[:len(line)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	check := &checkedReader{r: io.LimitReader(br, int64(size)), hash: crc32.NewIEEE()}
+	payload := bufio.NewReader(check)
+	dmp, err := readDump(payload, limit)
+	if err != nil {
+		return nil, err
+	}
+	// Сумма и размер сверяются по всем данным после заголовка, а не только по разобранным.
+	if _, err = io.Copy(io.Discard, payload); err != nil {
+		return nil, err
+	}
+	if extra, _ := br.Peek(1); len(extra) > 0 || check.n != int64(size) || check.hash.Sum32() != sum {
+		return nil, ErrDumpChecksum
+	}
+	return dmp.updates()
+}
+
+// readDump определяет формат потока так же, как decodeDump.
+func readDump(br *bufio.Reader, limit int64) (*dumpData, error) {
+	if prefix, _ := br.Peek(len(zstdMagic)); bytes.Equal(prefix, zstdMagic) {
+		dec, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(limit)))
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+
+		br = bufio.NewReader(&limitedReader{r: zstdLimitReader{dec}, n: limit})
+	}
+
+	if prefix, _ := br.Peek(len(binaryDumpMagic)); bytes.Equal(prefix, binaryDumpMagic) {
+		return readBinaryDump(br)
+	}
+
+	data := &dumpData{}
+	dec := json.NewDecoder(br)
+	if err := dec.Decode(data); err != nil {
+		return nil, err
+	}
+	// После документа допускаются только пробелы, как и в бинарном формате.
+	var syntaxErr *json.SyntaxError
+	if _, err := dec.Token(); err == nil || errors.As(err, &syntaxErr) {
+		return nil, fmt.Errorf("%w: trailing data after json dump", ErrDumpFormat)
+	} else if !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return data, nil
+}
+
+// updates переводит серии дампа в батч обновлений.
+func (dmp *dumpData) updates() ([]types.Metrics, error) {
+	res := make([]types.Metrics, 0, len(dmp.Metrics))
+	for _, m := range dmp.Metrics {
+		mtr := types.Metrics{ID: m.Name, MType: m.MType}
+		switch m.MType {
+		case types.Gauge:
+			value, err := strconv.ParseFloat(m.Value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("series %s: %w", m.Name, err)
+			}
+			mtr.Value = &value
+		case types.Counter:
+			delta, err := strconv.ParseInt(m.Value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("series %s: %w", m.Name, err)
+			}
+			mtr.Delta = &delta
+		default:
+			return nil, fmt.Errorf("series %s: %w", m.Name, types.ErrUnknownType)
+		}
+		res = append(res, mtr)
+	}
+
+	return res, nil
+}
+
+// limitedReader отдаёт не больше n байт и возвращает ErrSnapshotTooLarge, если данных больше.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// Ровно n байт — не ошибка: проверяем, что за ними ничего нет.
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			return 0, ErrSnapshotTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// zstdLimitReader переводит отказ декодера по лимиту памяти в ErrSnapshotTooLarge.
+type zstdLimitReader struct {
+	*zstd.Decoder
+}
+
+func (z zstdLimitReader) Read(p []byte) (int, error) {
+	n, err := z.Decoder.Read(p)
+	if errors.Is(err, zstd.ErrWindowSizeExceeded) || errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+		err = ErrSnapshotTooLarge
+	}
+	return n, err
+}
+
+// checkedReader считает размер и контрольную сумму прочитанных данных.
+type checkedReader struct {
+	r    io.Reader
+	hash hash.Hash32
+	n    int64
+}
+
+func (c *checkedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	c.n += int64(n)
+	return n, err
+}
+
+func newDumpData(metrics map[string]Metric, walSegment uint64) dumpData {
+	dmp := dumpData{WALSegment: walSegment}
+	for k, v := range metrics[types.Counter].Get() {
+		dmp.Metrics = append(dmp.Metrics, metric{MType: types.Counter, Name: k, Value: v})
+	}
+	for k, v := range metrics[types.Gauge].Get() {
+		dmp.Metrics = append(dmp.Metrics, metric{MType: types.Gauge, Name: k, Value: v})
+	}
+	return dmp
+}
+
+// encodeBinaryDump пишет сигнатуру, версию, WALSegment и число серий, затем сами серии:
+// байт типа, имя с длиной в uvarint и значение — 8 байт float64 для gauge, varint для counter.
+func encodeBinaryDump(metrics map[string]Metric, walSegment uint64) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeBinaryDump(&buf, metrics, walSegment); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeBinaryDump(w io.Writer, metrics map[string]Metric, walSegment uint64) error {
+	gauge, ok := metrics[types.Gauge].(Gauge)
+	if !ok {
+		return errors.New("binary dump: unexpected gauge snapshot type")
+	}
+	counter, ok := metrics[types.Counter].(Counter)
+	if !ok {
+		return errors.New("binary dump: unexpected counter snapshot type")
+	}
+
+	buf := make([]byte, 0, len(binaryDumpMagic)+1+2*binary.MaxVarintLen64)
+	buf = append(buf, binaryDumpMagic...)
+	buf = append(buf, binaryDumpVersion)
+	buf = binary.AppendUvarint(buf, walSegment)
+	buf = binary.AppendUvarint(buf, uint64(len(gauge)+len(counter)))
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+
+	for name, v := range gauge {
+		buf = append(buf[:0], binaryGauge)
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+		buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v))
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	for name, v := range counter {
+		buf = append(buf[:0], binaryCounter)
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+		buf = binary.AppendVarint(buf, v)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func decodeBinaryDump(payload []byte) (*dumpData, error) {
+	return readBinaryDump(bufio.NewReader(bytes.NewReader(payload)))
+}
+
+// readBinaryDump читает бинарный дамп из потока. Счётчику серий и длинам имён не доверяем:
+// память выделяется по мере того, как данные действительно приходят.
+func readBinaryDump(r *bufio.Reader) (*dumpData, error) {
+	if _, err := r.Discard(len(binaryDumpMagic)); err != nil {
+		return nil, binaryDumpError(err)
+	}
+
+	version, err := r.ReadByte()
+	if err != nil {
+		return nil, binaryDumpError(err)
+	}
+	if version != binaryDumpVersion {
+		return nil, fmt.Errorf("unsupported binary dump version %d", version)
+	}
+
+	walSegment, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, binaryDumpError(err)
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, binaryDumpError(err)
+	}
+
+	data := &dumpData{WALSegment: walSegment, Metrics: make([]metric, 0, minCount(count, 1024))}
+	for i := uint64(0); i < count; i++ {
+		mtype, err := r.ReadByte()
+		if err != nil {
+			return nil, binaryDumpError(err)
+		}
+
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, binaryDumpError(err)
+		}
+		var name strings.Builder
+		n, err := io.Copy(&name, io.LimitReader(r, int64(minCount(size, math.MaxInt64))))
+		if err != nil {
+			return nil, binaryDumpError(err)
+		}
+		if uint64(n) != size {
+			return nil, ErrDumpFormat
+		}
+
+		m := metric{Name: name.String()}
+		switch mtype {
+		case binaryGauge:
+			var bits [8]byte
+			if _, err = io.ReadFull(r, bits[:]); err != nil {
+				return nil, binaryDumpError(err)
+			}
+			m.MType = types.Gauge
+			m.Value = strconv.FormatFloat(math.Float64frombits(binary.LittleEndian.Uint64(bits[:])), 'g', -1, 64)
+		case binaryCounter:
+			v, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, binaryDumpError(err)
+			}
+			m.MType = types.Counter
+			m.Value = strconv.FormatInt(v, 10)
+		default:
+			return nil, fmt.Errorf("%w: unknown metric type %d", ErrDumpFormat, mtype)
+		}
+
+		data.Metrics = append(data.Metrics, m)
+	}
+
+	if _, err = r.ReadByte(); !errors.Is(err, io.EOF) {
+		if err == nil {
+			return nil, ErrDumpFormat
+		}
+		return nil, binaryDumpError(err)
+	}
+
+	return data, nil
+}
+
+// binaryDumpError сводит ошибки чтения к ErrDumpFormat, кроме превышения размера снимка.
+func binaryDumpError(err error) error {
+	if errors.Is(err, ErrSnapshotTooLarge) {
+		return err
+	}
+	return ErrDumpFormat
+}
+
+func minCount(n, limit uint64) uint64 {
+	if n < limit {
+		return n
+	}
+	return limit
+}
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const dumpHeaderPrefix = "# metrics-dump v1 "
+
+var ErrDumpChecksum = errors.New("dump checksum mismatch")
+
+// writeDumpFile атомарно заменяет файл дампа: данные пишутся во временный файл рядом
+// с целевым, сбрасываются на диск и переименовываются поверх. Предыдущие версии
+// сохраняются как path.1 … path.<generations>.
+func writeDumpFile(path string, payload []byte, generations uint) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.WriteString(dumpHeader(payload)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err = tmp.Write(payload); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0666); err != nil {
+		return err
+	}
+
+	if err = rotateGenerations(path, generations); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// rotateGenerations сдвигает path → path.1 → … → path.<generations>, отбрасывая самую старую версию.
+func rotateGenerations(path string, generations uint) error {
+	if generations == 0 {
+		return nil
+	}
+
+	for i := generations; i > 0; i-- {
+		src := generationPath(path, i-1)
+		if _, err := os.Stat(src); errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err := os.Rename(src, generationPath(path, i)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func generationPath(path string, n uint) string {
+	if n == 0 {
+		return path
+	}
+	return path + "." + strconv.FormatUint(uint64(n), 10)
+}
+
+// readDumpFile читает дамп и проверяет контрольную сумму из заголовка.
+// Файлы старого формата без заголовка возвращаются как есть.
+func readDumpFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := parseDumpFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return payload, nil
+}
+
+func dumpHeader(payload []byte) string {
+	return fmt.Sprintf("%scrc32=%08x size=%d\n", dumpHeaderPrefix, crc32.ChecksumIEEE(payload), len(payload))
+}
+
+// parseDumpFile отделяет заголовок от данных и сверяет контрольную сумму.
+func parseDumpFile(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(dumpHeaderPrefix)) {
+		return data, nil
+	}
+
+	idx := bytes.IndexByte(data, '\n')
+	if idx < 0 {
+		return nil, errors.New("truncated header")
+	}
+
+	sum, size, err := parseDumpHeader(string(data[:idx]))
+	if err != nil {
+		return nil, err
+	}
+
+	payload := data[idx+1:]
+	if len(payload) != size || crc32.ChecksumIEEE(payload) != sum {
+		return nil, ErrDumpChecksum
+	}
+
+	return payload, nil
+}
+
+// parseDumpHeader разбирает строку заголовка без перевода строки.
+func parseDumpHeader(line string) (sum uint32, size int, err error) {
+	if _, err = fmt.Sscanf(strings.TrimPrefix(line, dumpHeaderPrefix), "crc32=%x size=%d", &sum, &size); err != nil {
+		return 0, 0, fmt.Errorf("malformed header: %w", err)
+	}
+	return sum, size, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	// Не все файловые системы позволяют fsync каталога; сам rename к этому моменту уже выполнен.
+	_ = d.Sync()
+
+	return nil
+}
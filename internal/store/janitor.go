@@ -0,0 +1,67 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Expirer — хранилище, умеющее удалять серии, которые давно не обновлялись.
+type Expirer interface {
+	PurgeStale(ctx context.Context, before time.Time) (int, error)
+}
+
+// Janitor периодически удаляет серии, не обновлявшиеся дольше ttl,
+// например gauge выведенных из эксплуатации агентов.
+type Janitor struct {
+	logger   *zap.Logger
+	storage  Expirer
+	ttl      time.Duration
+	interval time.Duration
+}
+
+func NewJanitor(logger *zap.Logger, storage Expirer, ttl time.Duration) *Janitor {
+	if ttl <= 0 {
+		logger.Info("Stale series expiry disabled")
+		return nil
+	}
+
+	interval := time.Minute
+	if ttl/2 < interval {
+		interval = ttl / 2
+	}
+
+	return &Janitor{
+		logger:   logger,
+		storage:  storage,
+		ttl:      ttl,
+		interval: interval,
+	}
+}
+
+func (j *Janitor) Start(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			j.Purge(ctx, now)
+		}
+	}
+}
+
+// Purge удаляет серии, устаревшие на момент now.
+func (j *Janitor) Purge(ctx context.Context, now time.Time) {
+	n, err := j.storage.PurgeStale(ctx, now.Add(-j.ttl))
+	if err != nil {
+		j.logger.Error("failed to purge stale series", zap.Error(err))
+		return
+	}
+	if n > 0 {
+		j.logger.Info("purged stale series", zap.Int("count", n))
+	}
+}
@@ -1,54 +1,131 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 
 	"github.com/golang-migrate/migrate/v4"
 	migratepgx "github.com/golang-migrate/migrate/v4/database/pgx"
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
 
-	_ "github.com/shevchukeugeni/metrics/internal/store/postgres/migrations"
+	"github.com/shevchukeugeni/metrics/internal/store/postgres/migrations"
 )
 
+const (
+	defaultQueryTimeout = 5 * time.Second
+	migrationsTable     = "schema_migration"
+)
+
+// Config описывает подключение к базе и настройки пула. Нулевые значения оставляют умолчания pgxpool.
 type Config struct {
 	URL string
+
+	MaxConns        int32         `env:"DB_MAX_CONNS"`
+	MinConns        int32         `env:"DB_MIN_CONNS"`
+	MaxConnLifetime time.Duration `env:"DB_MAX_CONN_LIFETIME"`
+	MaxConnIdleTime time.Duration `env:"DB_MAX_CONN_IDLE_TIME"`
+	ConnectTimeout  time.Duration `env:"DB_CONNECT_TIMEOUT"`
+	// QueryTimeout ограничивает каждый запрос хранилища сверх контекста запроса клиента.
+	QueryTimeout time.Duration `env:"DB_QUERY_TIMEOUT"`
+	// SkipMigrations отключает миграции при подключении; схемой тогда управляют командой migrate.
+	SkipMigrations bool `env:"DB_SKIP_MIGRATIONS"`
+	// SampleRetention — сколько хранить историю значений в metric_samples; 0 отключает историю.
+	SampleRetention time.Duration `env:"DB_SAMPLE_RETENTION"`
 }
 
-func NewPostgresDB(cfg Config) (*sql.DB, error) {
+func NewPostgresDB(ctx context.Context, cfg Config) (*pgxpool.Pool, error) {
 	if cfg.URL == "" {
 		return nil, errors.New("incorrect URL")
 	}
 
-	db, err := sql.Open("pgx", cfg.URL)
+	poolCfg, err := pgxpool.ParseConfig(cfg.URL)
 	if err != nil {
 		return nil, err
 	}
-	err = db.Ping()
+	if cfg.MaxConns > 0 {
+		poolCfg.MaxConns = cfg.MaxConns
+	}
+	if cfg.MinConns > 0 {
+		poolCfg.MinConns = cfg.MinConns
+	}
+	if cfg.MaxConnLifetime > 0 {
+		poolCfg.MaxConnLifetime = cfg.MaxConnLifetime
+	}
+	if cfg.MaxConnIdleTime > 0 {
+		poolCfg.MaxConnIdleTime = cfg.MaxConnIdleTime
+	}
+	if cfg.ConnectTimeout > 0 {
+		poolCfg.ConnConfig.ConnectTimeout = cfg.ConnectTimeout
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolCfg)
 	if err != nil {
 		return nil, err
 	}
+	if err = pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	if cfg.SkipMigrations {
+		return pool, nil
+	}
+
+	// golang-migrate работает через database/sql, поэтому миграции идут через обёртку над пулом.
+	db := stdlib.OpenDBFromPool(pool)
+	defer db.Close()
 
-	if err = migrateDB(db, "schema_migration"); err != nil {
+	if err = migrateDB(db); err != nil {
+		pool.Close()
 		return nil, err
 	}
 
-	return db, nil
+	return pool, nil
+}
+
+// NewMigrator подключается к базе отдельным соединением для ручного управления схемой.
+// Close мигратора закрывает и соединение.
+func NewMigrator(ctx context.Context, cfg Config) (*migrate.Migrate, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("incorrect URL")
+	}
+
+	db, err := sql.Open("pgx", cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
 
+	m, err := newMigrator(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return m, nil
 }
 
-func migrateDB(db *sql.DB, table string) error {
-	driver, err := migratepgx.WithInstance(db, &migratepgx.Config{MigrationsTable: table})
+func newMigrator(db *sql.DB) (*migrate.Migrate, error) {
+	driver, err := migratepgx.WithInstance(db, &migratepgx.Config{MigrationsTable: migrationsTable})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	migrator, err := migrate.NewWithDatabaseInstance("embed://", table, driver)
+	return migrations.NewMigrator(migrations.DialectPostgres, driver)
+}
+
+func migrateDB(db *sql.DB) error {
+	migrator, err := newMigrator(db)
 	if err != nil {
 		return err
 	}
 
 	err = migrator.Up()
-	if err != nil && err.Error() == "no change" { // "no change" is not an error
+	if errors.Is(err, migrate.ErrNoChange) {
 		err = nil
 	}
 	return err
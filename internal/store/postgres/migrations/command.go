@@ -0,0 +1,106 @@
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+
+	"github.com/golang-migrate/migrate/v4"
+)
+
+// Usage описывает аргументы Run.
+const Usage = "migrate up [N] | down [N] | version | force V"
+
+// Run выполняет команду миграций и печатает в out итоговую версию схемы:
+//
+//	up [N]    — применить все или N следующих миграций;
+//	down [N]  — откатить N миграций (по умолчанию одну);
+//	version   — показать текущую версию;
+//	force V   — записать версию V без выполнения скриптов, чтобы снять флаг dirty после сбоя.
+func Run(m *migrate.Migrate, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing command, usage: %s", Usage)
+	}
+
+	var err error
+	switch cmd, rest := args[0], args[1:]; cmd {
+	case "up":
+		n, perr := count(rest, 0)
+		if perr != nil {
+			return perr
+		}
+		if n == 0 {
+			err = m.Up()
+		} else {
+			err = m.Steps(n)
+		}
+	case "down":
+		n, perr := count(rest, 1)
+		if perr != nil {
+			return perr
+		}
+		err = m.Steps(-n)
+	case "version":
+		if len(rest) != 0 {
+			return fmt.Errorf("version takes no arguments, usage: %s", Usage)
+		}
+	case "force":
+		if len(rest) != 1 {
+			return fmt.Errorf("force requires a version, usage: %s", Usage)
+		}
+		v, perr := strconv.Atoi(rest[0])
+		if perr != nil {
+			return fmt.Errorf("incorrect version %q: %w", rest[0], perr)
+		}
+		err = m.Force(v)
+	default:
+		return fmt.Errorf("unknown command %q, usage: %s", cmd, Usage)
+	}
+
+	switch {
+	case errors.Is(err, migrate.ErrNoChange):
+		fmt.Fprintln(out, "no change")
+	case errors.Is(err, fs.ErrNotExist):
+		// Так golang-migrate сообщает, что шагов больше, чем доступных миграций.
+		return fmt.Errorf("not enough migrations to %s: %w", args[0], err)
+	case err != nil:
+		return err
+	}
+
+	return printVersion(m, out)
+}
+
+func count(args []string, def int) (int, error) {
+	switch len(args) {
+	case 0:
+		return def, nil
+	case 1:
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("incorrect number of steps %q", args[0])
+		}
+		return n, nil
+	default:
+		return 0, fmt.Errorf("too many arguments, usage: %s", Usage)
+	}
+}
+
+func printVersion(m *migrate.Migrate, out io.Writer) error {
+	v, dirty, err := m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		fmt.Fprintln(out, "version: none")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if dirty {
+		fmt.Fprintf(out, "version: %d (dirty)\n", v)
+	} else {
+		fmt.Fprintf(out, "version: %d\n", v)
+	}
+	return nil
+}
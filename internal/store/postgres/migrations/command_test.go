@@ -0,0 +1,48 @@
+package migrations_test
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/shevchukeugeni/metrics/internal/store/postgres/migrations"
+	"github.com/shevchukeugeni/metrics/internal/store/sqlite"
+)
+
+func TestRun(t *testing.T) {
+	m, err := sqlite.NewMigrator(context.Background(), sqlite.Config{Path: filepath.Join(t.TempDir(), "metrics.db")})
+	require.NoError(t, err)
+	defer m.Close()
+
+	tests := []struct {
+		args    []string
+		out     string
+		wantErr bool
+	}{
+		{args: []string{"version"}, out: "version: none\n"},
+		{args: []string{"up"}, out: "version: 1\n"},
+		{args: []string{"up"}, out: "no change\nversion: 1\n"},
+		{args: []string{"up", "1"}, wantErr: true},
+		{args: []string{"down"}, out: "version: none\n"},
+		{args: []string{"force", "1"}, out: "version: 1\n"},
+		{args: []string{"down", "0"}, wantErr: true},
+		{args: []string{"force"}, wantErr: true},
+		{args: []string{"version", "1"}, wantErr: true},
+		{args: []string{"sideways"}, wantErr: true},
+		{args: nil, wantErr: true},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		err := migrations.Run(m, tt.args, &out)
+		if tt.wantErr {
+			assert.Error(t, err, tt.args)
+			continue
+		}
+		require.NoError(t, err, tt.args)
+		assert.Equal(t, tt.out, out.String(), tt.args)
+	}
+}
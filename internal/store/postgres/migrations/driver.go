@@ -2,13 +2,24 @@ package migrations
 
 import (
 	"embed"
+	"fmt"
 	"net/http"
+	"strings"
 
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
 	"github.com/golang-migrate/migrate/v4/source"
 	"github.com/golang-migrate/migrate/v4/source/httpfs"
 )
 
-//go:embed *.sql
+const (
+	DialectPostgres = "postgres"
+	DialectSQLite   = "sqlite"
+)
+
+// Скрипты каждого диалекта лежат в своём каталоге и нумеруются независимо.
+//
+//go:embed postgres/*.sql sqlite/*.sql
 var static embed.FS
 
 func init() {
@@ -19,10 +30,28 @@ type driver struct {
 	httpfs.PartialDriver
 }
 
+// Open принимает адрес вида embed://<диалект>; embed:// без диалекта означает postgres.
 func (d *driver) Open(url string) (source.Driver, error) {
-	err := d.PartialDriver.Init(http.FS(static), ".")
+	dialect := strings.TrimPrefix(url, "embed://")
+	if dialect == "" {
+		dialect = DialectPostgres
+	}
+
+	nd := &driver{}
+	err := nd.PartialDriver.Init(http.FS(static), dialect)
 	if err != nil {
 		return nil, err
 	}
-	return d, err
+	return nd, err
+}
+
+// NewMigrator создаёт мигратор встроенных скриптов диалекта для уже открытой базы.
+func NewMigrator(dialect string, db database.Driver) (*migrate.Migrate, error) {
+	switch dialect {
+	case DialectPostgres, DialectSQLite:
+	default:
+		return nil, fmt.Errorf("unknown migrations dialect %q", dialect)
+	}
+
+	return migrate.NewWithDatabaseInstance("embed://"+dialect, dialect, db)
 }
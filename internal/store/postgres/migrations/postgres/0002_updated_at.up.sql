@@ -0,0 +1,4 @@
+ALTER TABLE metrics
+    ADD COLUMN IF NOT EXISTS updated_at timestamptz NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS metrics_updated_at_idx ON metrics (updated_at);
@@ -0,0 +1,6 @@
+UPDATE metrics
+SET value = delta
+WHERE type = 'counter';
+
+ALTER TABLE metrics
+    DROP COLUMN IF EXISTS delta;
@@ -0,0 +1,7 @@
+ALTER TABLE metrics
+    ADD COLUMN IF NOT EXISTS delta bigint;
+
+UPDATE metrics
+SET delta = round(value)::bigint,
+    value = NULL
+WHERE type = 'counter';
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS metric_samples
+(
+    type  metric_category NOT NULL,
+    name  varchar NOT NULL,
+    value double precision,
+    delta bigint,
+    ts    timestamptz NOT NULL
+) PARTITION BY RANGE (ts);
+
+CREATE INDEX IF NOT EXISTS metric_samples_series_idx ON metric_samples (type, name, ts);
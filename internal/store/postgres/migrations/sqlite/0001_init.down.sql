@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS metrics_updated_at_idx;
+DROP TABLE IF EXISTS metrics;
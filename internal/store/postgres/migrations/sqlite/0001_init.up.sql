@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS metrics
+(
+    type       TEXT    NOT NULL CHECK (type IN ('counter', 'gauge')),
+    name       TEXT    NOT NULL,
+    value      REAL,
+    delta      INTEGER,
+    updated_at INTEGER NOT NULL DEFAULT 0,
+
+    CONSTRAINT metric_unique UNIQUE (type, name)
+);
+
+CREATE INDEX IF NOT EXISTS metrics_updated_at_idx ON metrics (updated_at);
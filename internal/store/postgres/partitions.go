@@ -0,0 +1,200 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+const (
+	samplesTable    = "metric_samples"
+	partitionPrefix = samplesTable + "_p"
+	partitionLayout = "20060102"
+	// defaultPartition принимает строки, для которых нет дневной партиции: если обслуживание
+	// отстало, запись метрик не должна падать из-за истории.
+	defaultPartition = samplesTable + "_default"
+	day              = 24 * time.Hour
+
+	// premakeDays — на сколько дней вперёд создаются партиции, чтобы запись не упёрлась
+	// в отсутствующую партицию, если обслуживание какое-то время не запускалось.
+	premakeDays         = 3
+	maintenanceInterval = time.Hour
+	// maintenanceRetry — пауза до следующей попытки, пока история не включена.
+	maintenanceRetry = time.Minute
+)
+
+// PartitionManager обслуживает таблицу истории metric_samples, разбитую на партиции по дням
+// (UTC): заранее создаёт партиции на ближайшие дни и удаляет те, что целиком старше retention.
+// Удаление партиции дешевле DELETE по миллиардам строк и не оставляет мёртвых кортежей.
+//
+// Историю в storage PartitionManager включает сам после первого успешного обслуживания, так что
+// если при старте база была недоступна, история заработает со следующей удачной попытки.
+type PartitionManager struct {
+	logger    *zap.Logger
+	db        *pgxpool.Pool
+	storage   *DBStore
+	retention time.Duration
+}
+
+func NewPartitionManager(logger *zap.Logger, storage *DBStore, retention time.Duration) *PartitionManager {
+	if retention <= 0 {
+		logger.Info("Metric history disabled")
+		return nil
+	}
+
+	return &PartitionManager{
+		logger:    logger,
+		db:        storage.db,
+		storage:   storage,
+		retention: retention,
+	}
+}
+
+func (pm *PartitionManager) Start(ctx context.Context) {
+	timer := time.NewTimer(pm.next())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-timer.C:
+			if err := pm.Maintain(ctx, now); err != nil {
+				pm.logger.Error("failed to maintain sample partitions", zap.Error(err))
+			}
+			timer.Reset(pm.next())
+		}
+	}
+}
+
+// next возвращает паузу до следующего обслуживания: пока история не включена, пробуем чаще.
+func (pm *PartitionManager) next() time.Duration {
+	if pm.storage.samples.Load() {
+		return maintenanceInterval
+	}
+	return maintenanceRetry
+}
+
+// Maintain приводит набор партиций в соответствие с моментом now и включает запись истории.
+func (pm *PartitionManager) Maintain(ctx context.Context, now time.Time) error {
+	_, err := pm.db.Exec(ctx, "CREATE TABLE IF NOT EXISTS "+defaultPartition+" PARTITION OF "+samplesTable+" DEFAULT;")
+	if err != nil {
+		return fmt.Errorf("create default partition: %w", err)
+	}
+
+	existing, err := pm.partitions(ctx)
+	if err != nil {
+		return err
+	}
+
+	create, drop := planPartitions(existing, now, pm.retention)
+
+	for _, d := range create {
+		if err = pm.createPartition(ctx, d); err != nil {
+			return fmt.Errorf("create partition for %s: %w", d.Format(time.DateOnly), err)
+		}
+		pm.logger.Info("created sample partition", zap.String("partition", partitionName(d)))
+	}
+
+	for _, name := range drop {
+		if _, err = pm.db.Exec(ctx, "DROP TABLE IF EXISTS "+pgx.Identifier{name}.Sanitize()+";"); err != nil {
+			return fmt.Errorf("drop partition %s: %w", name, err)
+		}
+		pm.logger.Info("dropped expired sample partition", zap.String("partition", name))
+	}
+
+	// Строки, попавшие в партицию по умолчанию, хранятся столько же, сколько остальные.
+	_, err = pm.db.Exec(ctx, "DELETE FROM "+defaultPartition+" WHERE ts < $1;", now.Add(-pm.retention))
+	if err != nil {
+		return fmt.Errorf("expire default partition: %w", err)
+	}
+
+	pm.storage.EnableSamples()
+
+	return nil
+}
+
+// createPartition создаёт партицию дня d. Строки этого дня, успевшие попасть в партицию по
+// умолчанию, переносятся в новую в той же транзакции: иначе Postgres не даст её подключить.
+func (pm *PartitionManager) createPartition(ctx context.Context, d time.Time) error {
+	name := pgx.Identifier{partitionName(d)}.Sanitize()
+	from, to := d.Format(time.RFC3339), d.Add(day).Format(time.RFC3339)
+
+	tx, err := pm.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			pm.logger.Error("tx rollback err", zap.Error(err))
+		}
+	}()
+
+	for _, stmt := range []string{
+		fmt.Sprintf("CREATE TABLE %s (LIKE %s INCLUDING DEFAULTS INCLUDING CONSTRAINTS);", name, samplesTable),
+		fmt.Sprintf("WITH moved AS (DELETE FROM %s WHERE ts >= '%s' AND ts < '%s' RETURNING *) INSERT INTO %s SELECT * FROM moved;",
+			defaultPartition, from, to, name),
+		fmt.Sprintf("ALTER TABLE %s ATTACH PARTITION %s FOR VALUES FROM ('%s') TO ('%s');", samplesTable, name, from, to),
+	} {
+		if _, err = tx.Exec(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (pm *PartitionManager) partitions(ctx context.Context) ([]string, error) {
+	rows, err := pm.db.Query(ctx, "SELECT c.relname::text FROM pg_inherits i "+
+		"JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = '"+samplesTable+"'::regclass;")
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+func partitionName(d time.Time) string {
+	return partitionPrefix + d.Format(partitionLayout)
+}
+
+// planPartitions вычисляет, какие дни нужно создать и какие партиции удалить. Партиции с
+// чужими именами не трогаются.
+func planPartitions(existing []string, now time.Time, retention time.Duration) (create []time.Time, drop []string) {
+	have := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		have[name] = true
+	}
+
+	today := now.UTC().Truncate(day)
+	for i := 0; i <= premakeDays; i++ {
+		if d := today.Add(time.Duration(i) * day); !have[partitionName(d)] {
+			create = append(create, d)
+		}
+	}
+
+	horizon := now.Add(-retention)
+	for _, name := range existing {
+		suffix, ok := strings.CutPrefix(name, partitionPrefix)
+		if !ok {
+			continue
+		}
+		d, err := time.Parse(partitionLayout, suffix)
+		if err != nil {
+			continue
+		}
+		if !d.Add(day).After(horizon) {
+			drop = append(drop, name)
+		}
+	}
+	sort.Strings(drop)
+
+	return create, drop
+}
@@ -0,0 +1,129 @@
+package postgres
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+func date(y int, m time.Month, d int) time.Time {
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestPlanPartitions(t *testing.T) {
+	now := time.Date(2024, 3, 10, 15, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		existing  []string
+		now       time.Time
+		retention time.Duration
+		create    []time.Time
+		drop      []string
+	}{
+		{
+			name:      "empty table",
+			now:       now,
+			retention: 7 * day,
+			create:    []time.Time{date(2024, 3, 10), date(2024, 3, 11), date(2024, 3, 12), date(2024, 3, 13)},
+		},
+		{
+			name: "expired dropped, foreign names kept",
+			existing: []string{
+				"metric_samples_p20240301", "metric_samples_p20240302", "metric_samples_p20240303",
+				"metric_samples_p20240310", "metric_samples_p20240311", "metric_samples_p20240312",
+				"metric_samples_p20240313", "metric_samples_default", "metric_samples_pbroken",
+			},
+			now:       now,
+			retention: 7 * day,
+			// 2024-03-03 заканчивается в полночь 04.03, а горизонт — 03.03 15:30: партиция ещё нужна.
+			drop: []string{"metric_samples_p20240301", "metric_samples_p20240302"},
+		},
+		{
+			name:      "non-UTC clock",
+			existing:  []string{"metric_samples_p20240310"},
+			now:       time.Date(2024, 3, 11, 1, 0, 0, 0, time.FixedZone("MSK", 3*3600)),
+			retention: day,
+			create:    []time.Time{date(2024, 3, 11), date(2024, 3, 12), date(2024, 3, 13)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			create, drop := planPartitions(tt.existing, tt.now, tt.retention)
+			assert.Equal(t, tt.create, create)
+			assert.Equal(t, tt.drop, drop)
+		})
+	}
+}
+
+func TestPartitionManager(t *testing.T) {
+	ctx := context.Background()
+	dbs := newTestStore(t)
+
+	pm := NewPartitionManager(zap.NewNop(), dbs, 2*day)
+	// Партиции, оставшиеся от прошлых запусков, не должны влиять на тест.
+	existing, err := pm.partitions(ctx)
+	require.NoError(t, err)
+	for _, name := range existing {
+		_, err = dbs.db.Exec(ctx, "DROP TABLE "+name+";")
+		require.NoError(t, err)
+	}
+
+	old := time.Now().Add(-10 * day)
+	require.NoError(t, pm.Maintain(ctx, old))
+	assert.True(t, dbs.samples.Load())
+
+	// Обслуживание отстало: сегодняшние строки уходят в партицию по умолчанию, а запись
+	// метрик продолжает работать.
+	_, err = dbs.UpdateMetric(ctx, types.Counter, "PollCount", "2")
+	require.NoError(t, err)
+
+	require.NoError(t, pm.Maintain(ctx, time.Now()))
+
+	parts, err := pm.partitions(ctx)
+	require.NoError(t, err)
+	assert.Len(t, parts, premakeDays+2)
+	assert.Contains(t, parts, defaultPartition)
+	assert.NotContains(t, parts, partitionName(old.UTC().Truncate(day)))
+
+	var stray int
+	require.NoError(t, dbs.db.QueryRow(ctx, "SELECT count(*) FROM "+defaultPartition+";").Scan(&stray))
+	assert.Zero(t, stray)
+
+	require.NoError(t, dbs.UpdateMetrics(ctx, []types.Metrics{counter("PollCount", 3), gauge("HeapAlloc", 1.5)}))
+
+	now := time.Now()
+	samples, err := dbs.Samples(ctx, types.Counter, "PollCount", now.Add(-time.Hour), now.Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, samples, 2)
+	assert.Equal(t, int64(2), *samples[0].Delta)
+	assert.Equal(t, int64(5), *samples[1].Delta)
+
+	samples, err = dbs.Samples(ctx, types.Gauge, "HeapAlloc", now.Add(-time.Hour), now.Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, samples, 1)
+	assert.Equal(t, 1.5, *samples[0].Value)
+
+	// Запрос за сегодняшний день должен читать только одну партицию.
+	today := now.UTC().Truncate(day)
+	rows, err := dbs.db.Query(ctx, "EXPLAIN SELECT ts FROM metric_samples WHERE type='gauge' AND name='HeapAlloc' "+
+		"AND ts >= '"+today.Format(time.RFC3339)+"' AND ts < '"+today.Add(day).Format(time.RFC3339)+"';")
+	require.NoError(t, err)
+	var plan []string
+	for rows.Next() {
+		var line string
+		require.NoError(t, rows.Scan(&line))
+		plan = append(plan, line)
+	}
+	require.NoError(t, rows.Err())
+	text := strings.Join(plan, "\n")
+	assert.Contains(t, text, partitionName(today))
+	assert.NotContains(t, text, partitionName(today.Add(day)))
+}
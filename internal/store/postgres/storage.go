@@ -1,12 +1,16 @@
 package postgres
 
 import (
-	"database/sql"
+	"context"
 	"errors"
 	"fmt"
-	"math"
+	"sort"
 	"strconv"
+	"sync/atomic"
+	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"go.uber.org/zap"
 
 	"github.com/shevchukeugeni/metrics/internal/store"
@@ -14,21 +18,45 @@ import (
 )
 
 type DBStore struct {
-	logger *zap.Logger
-	db     *sql.DB
+	logger       *zap.Logger
+	db           *pgxpool.Pool
+	queryTimeout time.Duration
+
+	// samples включает запись истории в metric_samples.
+	samples atomic.Bool
 }
 
-func NewStore(logger *zap.Logger, db *sql.DB) *DBStore {
+func NewStore(logger *zap.Logger, db *pgxpool.Pool, queryTimeout time.Duration) *DBStore {
+	if queryTimeout <= 0 {
+		queryTimeout = defaultQueryTimeout
+	}
+
 	return &DBStore{
-		logger: logger,
-		db:     db,
+		logger:       logger,
+		db:           db,
+		queryTimeout: queryTimeout,
 	}
 }
 
-func (dbs *DBStore) GetMetric(mtype string) map[string]string {
+// EnableSamples включает запись истории значений. PartitionManager вызывает его после
+// первого успешного обслуживания, когда партиции для записи уже созданы.
+func (dbs *DBStore) EnableSamples() {
+	dbs.samples.Store(true)
+}
+
+// withTimeout ограничивает операцию хранилища: она прерывается и по отмене запроса клиента,
+// и по истечении queryTimeout.
+func (dbs *DBStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, dbs.queryTimeout)
+}
+
+func (dbs *DBStore) GetMetric(ctx context.Context, mtype string) map[string]string {
+	ctx, cancel := dbs.withTimeout(ctx)
+	defer cancel()
+
 	metrics := make(map[string]string)
 
-	rows, err := dbs.db.Query("SELECT name, value from metrics WHERE type=$1", mtype)
+	rows, err := dbs.db.Query(ctx, "SELECT name, value, delta from metrics WHERE type=$1", mtype)
 	if err != nil {
 		dbs.logger.Error("failed to select from database", zap.Error(err))
 		return nil
@@ -37,8 +65,9 @@ func (dbs *DBStore) GetMetric(mtype string) map[string]string {
 
 	for rows.Next() {
 		var name string
-		var value float64
-		err = rows.Scan(&name, &value)
+		var value *float64
+		var delta *int64
+		err = rows.Scan(&name, &value, &delta)
 		if err != nil {
 			dbs.logger.Error("failed to scan", zap.Error(err))
 			return nil
@@ -46,9 +75,9 @@ func (dbs *DBStore) GetMetric(mtype string) map[string]string {
 
 		switch mtype {
 		case types.Gauge:
-			metrics[name] = fmt.Sprint(value)
+			metrics[name] = fmt.Sprint(deref(value))
 		case types.Counter:
-			metrics[name] = fmt.Sprint(int64(math.Round(value)))
+			metrics[name] = fmt.Sprint(deref(delta))
 		}
 	}
 
@@ -60,11 +89,14 @@ func (dbs *DBStore) GetMetric(mtype string) map[string]string {
 	return metrics
 }
 
-func (dbs *DBStore) GetMetrics() map[string]store.Metric {
+func (dbs *DBStore) GetMetrics(ctx context.Context) map[string]store.Metric {
+	ctx, cancel := dbs.withTimeout(ctx)
+	defer cancel()
+
 	gauge := make(map[string]float64)
 	counter := make(map[string]int64)
 
-	rows, err := dbs.db.Query("SELECT * from metrics")
+	rows, err := dbs.db.Query(ctx, "SELECT type, name, value, delta from metrics")
 	if err != nil {
 		dbs.logger.Error("failed to select from database", zap.Error(err))
 		return nil
@@ -73,8 +105,9 @@ func (dbs *DBStore) GetMetrics() map[string]store.Metric {
 
 	for rows.Next() {
 		var mtype, name string
-		var value float64
-		err = rows.Scan(&mtype, &name, &value)
+		var value *float64
+		var delta *int64
+		err = rows.Scan(&mtype, &name, &value, &delta)
 		if err != nil {
 			dbs.logger.Error("failed to scan", zap.Error(err))
 			return nil
@@ -82,9 +115,9 @@ func (dbs *DBStore) GetMetrics() map[string]store.Metric {
 
 		switch mtype {
 		case types.Gauge:
-			gauge[name] = value
+			gauge[name] = deref(value)
 		case types.Counter:
-			counter[name] = int64(math.Round(value))
+			counter[name] = deref(delta)
 		}
 	}
 
@@ -99,59 +132,325 @@ func (dbs *DBStore) GetMetrics() map[string]store.Metric {
 	}
 }
 
-func (dbs *DBStore) UpdateMetric(mtype, name, value string) (any, error) {
-	tx, err := dbs.db.Begin()
+func (dbs *DBStore) UpdateMetric(ctx context.Context, mtype, name, value string) (any, error) {
+	ctx, cancel := dbs.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := dbs.db.Begin(ctx)
 	if err != nil {
 		return nil, err
 	}
-	val, err := updateMetric(tx, mtype, name, value)
+	val, err := updateMetric(ctx, tx, mtype, name, value)
+	if err == nil && dbs.samples.Load() {
+		err = recordSamples(ctx, tx, mtype, []string{name})
+	}
 	if err != nil {
-		if err2 := tx.Rollback(); err2 != nil {
+		if err2 := tx.Rollback(ctx); err2 != nil {
 			dbs.logger.Error("tx rollback err", zap.Error(err2))
 		}
 		return nil, err
 	}
-	if err2 := tx.Commit(); err2 != nil {
+	if err2 := tx.Commit(ctx); err2 != nil {
 		dbs.logger.Error("tx commit err", zap.Error(err2))
 		return nil, err2
 	}
 	return val, nil
 }
 
-func (dbs *DBStore) UpdateMetrics(metrics []types.Metrics) error {
+// UpdateMetrics применяет весь батч в одной транзакции: по одному многострочному upsert
+// на тип метрики, counter прибавляются атомарно на стороне базы. Повторы counter внутри
+// батча предварительно суммируются, для gauge остаётся последнее значение.
+func (dbs *DBStore) UpdateMetrics(ctx context.Context, metrics []types.Metrics) error {
+	ctx, cancel := dbs.withTimeout(ctx)
+	defer cancel()
 
-	for _, mtr := range metrics {
-		var val string
-		switch mtr.MType {
-		case types.Gauge:
-			val = fmt.Sprint(*mtr.Value)
-		case types.Counter:
-			val = fmt.Sprint(*mtr.Delta)
-		default:
-			return types.ErrUnknownType
+	gauges, counters, err := aggregateBatch(metrics)
+	if err != nil {
+		return err
+	}
+	if len(gauges.names) == 0 && len(counters.names) == 0 {
+		return nil
+	}
+
+	tx, err := dbs.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			dbs.logger.Error("tx rollback err", zap.Error(err))
+		}
+	}()
+
+	if err = dbs.applyBatch(ctx, tx, gauges, counters); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// ReplaceMetrics заменяет содержимое таблицы батчем в одной транзакции. История серий
+// не удаляется.
+func (dbs *DBStore) ReplaceMetrics(ctx context.Context, metrics []types.Metrics) error {
+	ctx, cancel := dbs.withTimeout(ctx)
+	defer cancel()
+
+	gauges, counters, err := aggregateBatch(metrics)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbs.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			dbs.logger.Error("tx rollback err", zap.Error(err))
 		}
+	}()
 
-		tx, err := dbs.db.Begin()
+	if _, err = tx.Exec(ctx, "DELETE FROM metrics;"); err != nil {
+		return err
+	}
+	if err = dbs.applyBatch(ctx, tx, gauges, counters); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (dbs *DBStore) applyBatch(ctx context.Context, tx pgx.Tx, gauges batchColumns[float64], counters batchColumns[int64]) error {
+	if len(gauges.names) > 0 {
+		_, err := tx.Exec(ctx, "INSERT INTO metrics (type,name,value) "+
+			"SELECT $1::metric_category, n, v FROM unnest($2::varchar[], $3::double precision[]) AS t(n, v) "+
+			"ON CONFLICT ON CONSTRAINT metric_unique "+
+			"DO UPDATE SET value=EXCLUDED.value, updated_at=now();", types.Gauge, gauges.names, gauges.values)
 		if err != nil {
 			return err
 		}
-		_, err = updateMetric(tx, mtr.MType, mtr.ID, val)
+	}
+
+	if len(counters.names) > 0 {
+		_, err := tx.Exec(ctx, "INSERT INTO metrics (type,name,delta) "+
+			"SELECT $1::metric_category, n, d FROM unnest($2::varchar[], $3::bigint[]) AS t(n, d) "+
+			"ON CONFLICT ON CONSTRAINT metric_unique "+
+			"DO UPDATE SET delta=metrics.delta+EXCLUDED.delta, updated_at=now();", types.Counter, counters.names, counters.values)
 		if err != nil {
-			if err2 := tx.Rollback(); err2 != nil {
-				dbs.logger.Error("tx rollback err", zap.Error(err2))
-			}
 			return err
 		}
-		if err2 := tx.Commit(); err2 != nil {
-			dbs.logger.Error("tx commit err", zap.Error(err2))
-			return err2
+	}
+
+	if dbs.samples.Load() {
+		if err := recordSamples(ctx, tx, types.Gauge, gauges.names); err != nil {
+			return err
+		}
+		if err := recordSamples(ctx, tx, types.Counter, counters.names); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func updateMetric(tx *sql.Tx, mtype, name, value string) (any, error) {
+// recordSamples копирует только что записанные значения серий в историю. Значения берутся
+// из metrics внутри той же транзакции, поэтому для counter в историю попадает накопленная сумма.
+func recordSamples(ctx context.Context, tx pgx.Tx, mtype string, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(ctx, "INSERT INTO metric_samples (type,name,value,delta,ts) "+
+		"SELECT type, name, value, delta, updated_at FROM metrics WHERE type=$1 AND name = ANY($2);",
+		mtype, names)
+	return err
+}
+
+// Samples возвращает историю серии за полуинтервал [from, to). Условие на ts позволяет
+// планировщику отбросить партиции вне интервала.
+func (dbs *DBStore) Samples(ctx context.Context, mtype, name string, from, to time.Time) ([]types.Sample, error) {
+	if !dbs.samples.Load() {
+		return nil, types.ErrNoHistory
+	}
+	if mtype != types.Gauge && mtype != types.Counter {
+		return nil, types.ErrUnknownType
+	}
+
+	ctx, cancel := dbs.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := dbs.db.Query(ctx, "SELECT ts, value, delta FROM metric_samples "+
+		"WHERE type=$1 AND name=$2 AND ts >= $3 AND ts < $4 ORDER BY ts;", mtype, name, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := []types.Sample{}
+	for rows.Next() {
+		var s types.Sample
+		if err = rows.Scan(&s.Time, &s.Value, &s.Delta); err != nil {
+			return nil, err
+		}
+		samples = append(samples, s)
+	}
+
+	return samples, rows.Err()
+}
+
+// batchColumns — имена и значения серий одного типа в виде массивов для unnest.
+type batchColumns[V float64 | int64] struct {
+	names  []string
+	values []V
+}
+
+// aggregateBatch проверяет батч и сворачивает повторяющиеся серии. Имена сортируются, чтобы
+// конкурентные батчи блокировали строки в одном порядке и не упирались в deadlock.
+func aggregateBatch(metrics []types.Metrics) (g batchColumns[float64], c batchColumns[int64], err error) {
+	gauges := make(map[string]float64)
+	counters := make(map[string]int64)
+
+	for _, mtr := range metrics {
+		if mtr.ID == "" {
+			return g, c, types.ErrIncorrectName
+		}
+		switch mtr.MType {
+		case types.Gauge:
+			if mtr.Value == nil {
+				return g, c, types.ErrEmptyValue
+			}
+			gauges[mtr.ID] = *mtr.Value
+		case types.Counter:
+			if mtr.Delta == nil {
+				return g, c, types.ErrEmptyValue
+			}
+			counters[mtr.ID] += *mtr.Delta
+		default:
+			return g, c, types.ErrUnknownType
+		}
+	}
+
+	for _, name := range sortedKeys(gauges) {
+		g.names = append(g.names, name)
+		g.values = append(g.values, gauges[name])
+	}
+	for _, name := range sortedKeys(counters) {
+		c.names = append(c.names, name)
+		c.values = append(c.values, counters[name])
+	}
+
+	return g, c, nil
+}
+
+func deref[V any](v *V) V {
+	var zero V
+	if v == nil {
+		return zero
+	}
+	return *v
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (dbs *DBStore) DeleteMetric(ctx context.Context, mtype, name string) (bool, error) {
+	ctx, cancel := dbs.withTimeout(ctx)
+	defer cancel()
+
+	if mtype != types.Gauge && mtype != types.Counter {
+		return false, types.ErrUnknownType
+	}
+
+	res, err := dbs.db.Exec(ctx, "DELETE FROM metrics WHERE type=$1 and name=$2;", mtype, name)
+	if err != nil {
+		return false, err
+	}
+
+	return res.RowsAffected() > 0, nil
+}
+
+func (dbs *DBStore) DeleteMetricsByPrefix(ctx context.Context, prefix string) (int, error) {
+	ctx, cancel := dbs.withTimeout(ctx)
+	defer cancel()
+
+	res, err := dbs.db.Exec(ctx, "DELETE FROM metrics WHERE left(name, length($1)) = $1;", prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(res.RowsAffected()), nil
+}
+
+// DeleteMetricsByLabel удаляет серии с меткой key=value. Метки хранятся в имени серии,
+// поэтому кандидаты отбираются в базе, а точное совпадение проверяется разбором имени.
+func (dbs *DBStore) DeleteMetricsByLabel(ctx context.Context, key, value string) (int, error) {
+	ctx, cancel := dbs.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := dbs.db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := tx.Rollback(ctx); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+			dbs.logger.Error("tx rollback err", zap.Error(err))
+		}
+	}()
+
+	rows, err := tx.Query(ctx, "SELECT type, name FROM metrics WHERE strpos(name, $1) > 0 FOR UPDATE;", key+`="`)
+	if err != nil {
+		return 0, err
+	}
+
+	var victims [][2]string
+	for rows.Next() {
+		var mtype, name string
+		if err = rows.Scan(&mtype, &name); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if types.HasLabel(name, key, value) {
+			victims = append(victims, [2]string{mtype, name})
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, v := range victims {
+		if _, err = tx.Exec(ctx, "DELETE FROM metrics WHERE type=$1 and name=$2;", v[0], v[1]); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	return len(victims), nil
+}
+
+// PurgeStale удаляет серии, которые не обновлялись с момента before.
+func (dbs *DBStore) PurgeStale(ctx context.Context, before time.Time) (int, error) {
+	ctx, cancel := dbs.withTimeout(ctx)
+	defer cancel()
+
+	res, err := dbs.db.Exec(ctx, "DELETE FROM metrics WHERE updated_at < $1;", before)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(res.RowsAffected()), nil
+}
+
+func updateMetric(ctx context.Context, tx pgx.Tx, mtype, name, value string) (any, error) {
 	switch mtype {
 	case types.Gauge:
 		fValue, err := strconv.ParseFloat(value, 64)
@@ -160,12 +459,12 @@ func updateMetric(tx *sql.Tx, mtype, name, value string) (any, error) {
 		}
 
 		if name == "" {
-			return nil, errors.New("incorrect name")
+			return nil, types.ErrIncorrectName
 		}
 
-		_, err = tx.Exec("INSERT INTO metrics (type,name,value) VALUES ($1,$2,$3) "+
+		_, err = tx.Exec(ctx, "INSERT INTO metrics (type,name,value) VALUES ($1,$2,$3) "+
 			"ON CONFLICT ON CONSTRAINT metric_unique "+
-			"DO UPDATE SET value=EXCLUDED.value;", mtype, name, fValue)
+			"DO UPDATE SET value=EXCLUDED.value, updated_at=now();", mtype, name, fValue)
 		if err != nil {
 			return nil, err
 		}
@@ -178,34 +477,21 @@ func updateMetric(tx *sql.Tx, mtype, name, value string) (any, error) {
 		}
 
 		if name == "" {
-			return nil, errors.New("incorrect name")
+			return nil, types.ErrIncorrectName
 		}
 
-		row := tx.QueryRow("SELECT value FROM metrics WHERE type=$1 and name=$2;", mtype, name)
-		var (
-			val float64
-		)
-
-		err = row.Scan(&val)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				_, err = tx.Exec("INSERT INTO metrics (type,name,value) VALUES ($1,$2,$3);", mtype, name, iValue)
-				if err != nil {
-					return nil, err
-				}
-				return iValue, nil
-			} else {
-				return nil, err
-			}
-		}
-
-		_, err = tx.Exec("UPDATE metrics SET value=$1 WHERE type=$2 and name =$3;",
-			int64(math.Round(val))+iValue, mtype, name)
+		// Прибавление выполняется одним запросом под блокировкой строки, поэтому конкурентные
+		// инкременты одной серии не теряются.
+		var delta int64
+		err = tx.QueryRow(ctx, "INSERT INTO metrics (type,name,delta) VALUES ($1,$2,$3) "+
+			"ON CONFLICT ON CONSTRAINT metric_unique "+
+			"DO UPDATE SET delta=metrics.delta+EXCLUDED.delta, updated_at=now() "+
+			"RETURNING delta;", mtype, name, iValue).Scan(&delta)
 		if err != nil {
 			return nil, err
 		}
 
-		return int64(math.Round(val)) + iValue, nil
+		return delta, nil
 	default:
 		return nil, types.ErrUnknownType
 	}
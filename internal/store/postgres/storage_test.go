@@ -0,0 +1,201 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/store"
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+// testDSNEnv указывает на отдельную базу для тестов: таблица metrics в ней очищается.
+const testDSNEnv = "TEST_DATABASE_DSN"
+
+func newTestStore(tb testing.TB) *DBStore {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		tb.Skipf("%s is not set", testDSNEnv)
+	}
+
+	db, err := NewPostgresDB(context.Background(), Config{URL: dsn})
+	require.NoError(tb, err)
+	tb.Cleanup(db.Close)
+
+	_, err = db.Exec(context.Background(), "DELETE FROM metrics;")
+	require.NoError(tb, err)
+
+	return NewStore(zap.NewNop(), db, 0)
+}
+
+func gauge(id string, v float64) types.Metrics {
+	return types.Metrics{ID: id, MType: types.Gauge, Value: &v}
+}
+
+func counter(id string, d int64) types.Metrics {
+	return types.Metrics{ID: id, MType: types.Counter, Delta: &d}
+}
+
+func TestAggregateBatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		metrics  []types.Metrics
+		gauges   batchColumns[float64]
+		counters batchColumns[int64]
+		wantErr  bool
+	}{
+		{
+			name: "duplicates folded",
+			metrics: []types.Metrics{
+				counter("PollCount", 1), gauge("HeapAlloc", 1), counter("PollCount", 2),
+				gauge("HeapAlloc", 3), counter("Errors", -1),
+			},
+			gauges:   batchColumns[float64]{names: []string{"HeapAlloc"}, values: []float64{3}},
+			counters: batchColumns[int64]{names: []string{"Errors", "PollCount"}, values: []int64{-1, 3}},
+		},
+		{
+			name:    "empty value",
+			metrics: []types.Metrics{counter("PollCount", 1), {ID: "HeapAlloc", MType: types.Gauge}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown type",
+			metrics: []types.Metrics{{ID: "x", MType: "histogram"}},
+			wantErr: true,
+		},
+		{
+			name:    "empty name",
+			metrics: []types.Metrics{gauge("", 1)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gauges, counters, err := aggregateBatch(tt.metrics)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.gauges, gauges)
+			assert.Equal(t, tt.counters, counters)
+		})
+	}
+}
+
+func TestDBStore_UpdateMetrics(t *testing.T) {
+	dbs := newTestStore(t)
+
+	require.NoError(t, dbs.UpdateMetrics(context.Background(), []types.Metrics{
+		counter("PollCount", 1), counter("PollCount", 2), gauge("HeapAlloc", 1.5),
+	}))
+	require.NoError(t, dbs.UpdateMetrics(context.Background(), []types.Metrics{counter("PollCount", 4), gauge("HeapAlloc", 2.5)}))
+
+	// Некорректный батч не применяется даже частично.
+	require.Error(t, dbs.UpdateMetrics(context.Background(), []types.Metrics{counter("PollCount", 100), {ID: "bad", MType: types.Gauge}}))
+
+	assert.Equal(t, map[string]string{"PollCount": "7"}, dbs.GetMetric(context.Background(), types.Counter))
+	assert.Equal(t, map[string]string{"HeapAlloc": "2.5"}, dbs.GetMetric(context.Background(), types.Gauge))
+}
+
+func TestDBStore_ConcurrentCounters(t *testing.T) {
+	dbs := newTestStore(t)
+
+	const (
+		writers    = 8
+		increments = 50
+	)
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				var err error
+				if w%2 == 0 {
+					_, err = dbs.UpdateMetric(context.Background(), types.Counter, "requests", "1")
+				} else {
+					err = dbs.UpdateMetrics(context.Background(), []types.Metrics{counter("requests", 1), counter("requests", 1)})
+				}
+				assert.NoError(t, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	want := writers / 2 * increments * 3
+	assert.Equal(t, map[string]string{"requests": strconv.Itoa(want)}, dbs.GetMetric(context.Background(), types.Counter))
+}
+
+func TestDBStore_CounterPrecision(t *testing.T) {
+	dbs := newTestStore(t)
+
+	// 2^53 + 1 не представимо в double precision.
+	v, err := dbs.UpdateMetric(context.Background(), types.Counter, "bytes", "9007199254740993")
+	require.NoError(t, err)
+	assert.Equal(t, int64(9007199254740993), v)
+
+	v, err = dbs.UpdateMetric(context.Background(), types.Counter, "bytes", "2")
+	require.NoError(t, err)
+	assert.Equal(t, int64(9007199254740995), v)
+
+	assert.Equal(t, int64(9007199254740995), dbs.GetMetrics(context.Background())[types.Counter].(store.Counter)["bytes"])
+}
+
+func TestDBStore_Context(t *testing.T) {
+	dbs := newTestStore(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := dbs.UpdateMetric(ctx, types.Counter, "requests", "1")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	dbs.queryTimeout = time.Nanosecond
+	err = dbs.UpdateMetrics(context.Background(), []types.Metrics{counter("requests", 1)})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// updateMetricsPerTx — прежняя реализация батча: отдельная транзакция на каждую метрику.
+func updateMetricsPerTx(dbs *DBStore, metrics []types.Metrics) error {
+	for _, mtr := range metrics {
+		val := fmt.Sprint(*mtr.Delta)
+		if mtr.MType == types.Gauge {
+			val = fmt.Sprint(*mtr.Value)
+		}
+		if _, err := dbs.UpdateMetric(context.Background(), mtr.MType, mtr.ID, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func BenchmarkDBStore_UpdateMetrics(b *testing.B) {
+	dbs := newTestStore(b)
+
+	// Типичный батч агента: рантайм-метрики плюс PollCount.
+	batch := make([]types.Metrics, 0, 40)
+	for i := 0; i < 39; i++ {
+		batch = append(batch, gauge(fmt.Sprintf("Gauge%d", i), float64(i)))
+	}
+	batch = append(batch, counter("PollCount", 1))
+
+	b.Run("per-metric tx", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			require.NoError(b, updateMetricsPerTx(dbs, batch))
+		}
+	})
+	b.Run("single tx", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			require.NoError(b, dbs.UpdateMetrics(context.Background(), batch))
+		}
+	})
+}
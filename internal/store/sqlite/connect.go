@@ -0,0 +1,110 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	migratesqlite "github.com/golang-migrate/migrate/v4/database/sqlite"
+	_ "modernc.org/sqlite"
+
+	"github.com/shevchukeugeni/metrics/internal/store/postgres/migrations"
+)
+
+const (
+	defaultQueryTimeout = 5 * time.Second
+	busyTimeout         = "5000"
+	migrationsTable     = "schema_migration"
+)
+
+type Config struct {
+	Path         string        `env:"SQLITE_PATH"`
+	QueryTimeout time.Duration `env:"DB_QUERY_TIMEOUT"`
+	// SkipMigrations отключает миграции при открытии; схемой тогда управляют командой migrate.
+	SkipMigrations bool `env:"DB_SKIP_MIGRATIONS"`
+}
+
+// NewSQLiteDB открывает файл базы в режиме WAL и применяет миграции. SQLite допускает
+// одного писателя, поэтому пул ограничен одним соединением — запросы сериализуются в Go,
+// а не упираются в SQLITE_BUSY.
+func NewSQLiteDB(ctx context.Context, cfg Config) (*sql.DB, error) {
+	db, err := open(ctx, cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.SkipMigrations {
+		return db, nil
+	}
+
+	if err = migrateDB(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// NewMigrator открывает базу для ручного управления схемой. Close мигратора закрывает и базу.
+func NewMigrator(ctx context.Context, cfg Config) (*migrate.Migrate, error) {
+	db, err := open(ctx, cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := newMigrator(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func open(ctx context.Context, path string) (*sql.DB, error) {
+	if path == "" {
+		return nil, errors.New("empty sqlite path")
+	}
+
+	dsn := "file:" + path + "?" + url.Values{"_pragma": {
+		"journal_mode(WAL)",
+		"synchronous(NORMAL)",
+		"busy_timeout(" + busyTimeout + ")",
+	}}.Encode()
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	if err = db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func newMigrator(db *sql.DB) (*migrate.Migrate, error) {
+	driver, err := migratesqlite.WithInstance(db, &migratesqlite.Config{MigrationsTable: migrationsTable})
+	if err != nil {
+		return nil, err
+	}
+	return migrations.NewMigrator(migrations.DialectSQLite, driver)
+}
+
+func migrateDB(db *sql.DB) error {
+	migrator, err := newMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	err = migrator.Up()
+	if errors.Is(err, migrate.ErrNoChange) {
+		err = nil
+	}
+	return err
+}
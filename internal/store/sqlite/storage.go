@@ -0,0 +1,353 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/store"
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+// DBStore хранит метрики во встроенной базе SQLite. Время обновления серии хранится
+// в наносекундах Unix.
+type DBStore struct {
+	logger       *zap.Logger
+	db           *sql.DB
+	queryTimeout time.Duration
+}
+
+func NewStore(logger *zap.Logger, db *sql.DB, queryTimeout time.Duration) *DBStore {
+	if queryTimeout <= 0 {
+		queryTimeout = defaultQueryTimeout
+	}
+
+	return &DBStore{
+		logger:       logger,
+		db:           db,
+		queryTimeout: queryTimeout,
+	}
+}
+
+func (dbs *DBStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, dbs.queryTimeout)
+}
+
+func (dbs *DBStore) GetMetric(ctx context.Context, mtype string) map[string]string {
+	if mtype != types.Gauge && mtype != types.Counter {
+		return nil
+	}
+
+	ctx, cancel := dbs.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := dbs.db.QueryContext(ctx, "SELECT name, value, delta FROM metrics WHERE type=?", mtype)
+	if err != nil {
+		dbs.logger.Error("failed to select from database", zap.Error(err))
+		return nil
+	}
+	defer rows.Close()
+
+	metrics := make(map[string]string)
+	for rows.Next() {
+		var name string
+		var value sql.NullFloat64
+		var delta sql.NullInt64
+		if err = rows.Scan(&name, &value, &delta); err != nil {
+			dbs.logger.Error("failed to scan", zap.Error(err))
+			return nil
+		}
+
+		if mtype == types.Gauge {
+			metrics[name] = fmt.Sprint(value.Float64)
+		} else {
+			metrics[name] = fmt.Sprint(delta.Int64)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		dbs.logger.Error("rowserrorcheck", zap.Error(err))
+		return nil
+	}
+
+	return metrics
+}
+
+func (dbs *DBStore) GetMetrics(ctx context.Context) map[string]store.Metric {
+	ctx, cancel := dbs.withTimeout(ctx)
+	defer cancel()
+
+	rows, err := dbs.db.QueryContext(ctx, "SELECT type, name, value, delta FROM metrics")
+	if err != nil {
+		dbs.logger.Error("failed to select from database", zap.Error(err))
+		return nil
+	}
+	defer rows.Close()
+
+	gauge, counter := store.Gauge{}, store.Counter{}
+	for rows.Next() {
+		var mtype, name string
+		var value sql.NullFloat64
+		var delta sql.NullInt64
+		if err = rows.Scan(&mtype, &name, &value, &delta); err != nil {
+			dbs.logger.Error("failed to scan", zap.Error(err))
+			return nil
+		}
+
+		switch mtype {
+		case types.Gauge:
+			gauge[name] = value.Float64
+		case types.Counter:
+			counter[name] = delta.Int64
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		dbs.logger.Error("rowserrorcheck", zap.Error(err))
+		return nil
+	}
+
+	return map[string]store.Metric{
+		types.Gauge:   gauge,
+		types.Counter: counter,
+	}
+}
+
+func (dbs *DBStore) UpdateMetric(ctx context.Context, mtype, name, value string) (any, error) {
+	mtr := types.Metrics{ID: name, MType: mtype}
+	switch mtype {
+	case types.Gauge:
+		fValue, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, err
+		}
+		mtr.Value = &fValue
+	case types.Counter:
+		iValue, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		mtr.Delta = &iValue
+	default:
+		return nil, types.ErrUnknownType
+	}
+	if name == "" {
+		return nil, types.ErrIncorrectName
+	}
+
+	ctx, cancel := dbs.withTimeout(ctx)
+	defer cancel()
+
+	return upsert(ctx, dbs.db, mtr, time.Now())
+}
+
+// UpdateMetrics применяет батч в одной транзакции; некорректный батч не применяется даже частично.
+func (dbs *DBStore) UpdateMetrics(ctx context.Context, metrics []types.Metrics) error {
+	for _, mtr := range metrics {
+		if err := validate(mtr); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := dbs.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := dbs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			dbs.logger.Error("tx rollback err", zap.Error(err))
+		}
+	}()
+
+	now := time.Now()
+	for _, mtr := range metrics {
+		if _, err = upsert(ctx, tx, mtr, now); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ReplaceMetrics заменяет содержимое таблицы батчем в одной транзакции.
+func (dbs *DBStore) ReplaceMetrics(ctx context.Context, metrics []types.Metrics) error {
+	for _, mtr := range metrics {
+		if err := validate(mtr); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := dbs.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := dbs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			dbs.logger.Error("tx rollback err", zap.Error(err))
+		}
+	}()
+
+	if _, err = tx.ExecContext(ctx, "DELETE FROM metrics;"); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, mtr := range metrics {
+		if _, err = upsert(ctx, tx, mtr, now); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (dbs *DBStore) DeleteMetric(ctx context.Context, mtype, name string) (bool, error) {
+	if mtype != types.Gauge && mtype != types.Counter {
+		return false, types.ErrUnknownType
+	}
+
+	ctx, cancel := dbs.withTimeout(ctx)
+	defer cancel()
+
+	res, err := dbs.db.ExecContext(ctx, "DELETE FROM metrics WHERE type=? AND name=?;", mtype, name)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (dbs *DBStore) DeleteMetricsByPrefix(ctx context.Context, prefix string) (int, error) {
+	ctx, cancel := dbs.withTimeout(ctx)
+	defer cancel()
+
+	res, err := dbs.db.ExecContext(ctx, "DELETE FROM metrics WHERE substr(name, 1, length(?1)) = ?1;", prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// DeleteMetricsByLabel удаляет серии с меткой key=value: кандидаты отбираются в базе,
+// точное совпадение проверяется разбором имени.
+func (dbs *DBStore) DeleteMetricsByLabel(ctx context.Context, key, value string) (int, error) {
+	ctx, cancel := dbs.withTimeout(ctx)
+	defer cancel()
+
+	tx, err := dbs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			dbs.logger.Error("tx rollback err", zap.Error(err))
+		}
+	}()
+
+	rows, err := tx.QueryContext(ctx, "SELECT type, name FROM metrics WHERE instr(name, ?) > 0;", key+`="`)
+	if err != nil {
+		return 0, err
+	}
+
+	var victims [][2]string
+	for rows.Next() {
+		var mtype, name string
+		if err = rows.Scan(&mtype, &name); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if types.HasLabel(name, key, value) {
+			victims = append(victims, [2]string{mtype, name})
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, v := range victims {
+		if _, err = tx.ExecContext(ctx, "DELETE FROM metrics WHERE type=? AND name=?;", v[0], v[1]); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(victims), nil
+}
+
+// PurgeStale удаляет серии, которые не обновлялись с момента before.
+func (dbs *DBStore) PurgeStale(ctx context.Context, before time.Time) (int, error) {
+	ctx, cancel := dbs.withTimeout(ctx)
+	defer cancel()
+
+	res, err := dbs.db.ExecContext(ctx, "DELETE FROM metrics WHERE updated_at < ?;", before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func validate(mtr types.Metrics) error {
+	if mtr.ID == "" {
+		return types.ErrIncorrectName
+	}
+	switch mtr.MType {
+	case types.Gauge:
+		if mtr.Value == nil {
+			return types.ErrEmptyValue
+		}
+	case types.Counter:
+		if mtr.Delta == nil {
+			return types.ErrEmptyValue
+		}
+	default:
+		return types.ErrUnknownType
+	}
+	return nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// upsert записывает одну серию; counter прибавляется в том же запросе и возвращается новое значение.
+func upsert(ctx context.Context, db execer, mtr types.Metrics, now time.Time) (any, error) {
+	if mtr.MType == types.Gauge {
+		_, err := db.ExecContext(ctx, "INSERT INTO metrics (type,name,value,updated_at) VALUES (?,?,?,?) "+
+			"ON CONFLICT (type,name) DO UPDATE SET value=excluded.value, updated_at=excluded.updated_at;",
+			mtr.MType, mtr.ID, *mtr.Value, now.UnixNano())
+		if err != nil {
+			return nil, err
+		}
+		return *mtr.Value, nil
+	}
+
+	var delta int64
+	err := db.QueryRowContext(ctx, "INSERT INTO metrics (type,name,delta,updated_at) VALUES (?,?,?,?) "+
+		"ON CONFLICT (type,name) DO UPDATE SET delta=metrics.delta+excluded.delta, updated_at=excluded.updated_at "+
+		"RETURNING delta;", mtr.MType, mtr.ID, *mtr.Delta, now.UnixNano()).Scan(&delta)
+	if err != nil {
+		return nil, err
+	}
+	return delta, nil
+}
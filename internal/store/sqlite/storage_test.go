@@ -0,0 +1,132 @@
+package sqlite
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+func newTestStore(t *testing.T, path string) *DBStore {
+	db, err := NewSQLiteDB(context.Background(), Config{Path: path})
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	return NewStore(zap.NewNop(), db, 0)
+}
+
+func gauge(id string, v float64) types.Metrics {
+	return types.Metrics{ID: id, MType: types.Gauge, Value: &v}
+}
+
+func counter(id string, d int64) types.Metrics {
+	return types.Metrics{ID: id, MType: types.Counter, Delta: &d}
+}
+
+func TestDBStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.db")
+	dbs := newTestStore(t, path)
+
+	v, err := dbs.UpdateMetric(ctx, types.Counter, "PollCount", "9007199254740993")
+	require.NoError(t, err)
+	assert.Equal(t, int64(9007199254740993), v)
+
+	v, err = dbs.UpdateMetric(ctx, types.Gauge, "HeapAlloc", "1.5")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, v)
+
+	_, err = dbs.UpdateMetric(ctx, "histogram", "x", "1")
+	assert.ErrorIs(t, err, types.ErrUnknownType)
+
+	require.NoError(t, dbs.UpdateMetrics(ctx, []types.Metrics{
+		counter("PollCount", 2), counter("PollCount", 3), gauge(`cpu{host="a"}`, 10), gauge(`cpu{host="b"}`, 20),
+	}))
+	// Некорректный батч не применяется даже частично.
+	require.Error(t, dbs.UpdateMetrics(ctx, []types.Metrics{counter("PollCount", 100), {ID: "bad", MType: types.Gauge}}))
+
+	assert.Equal(t, map[string]string{"PollCount": "9007199254740998"}, dbs.GetMetric(ctx, types.Counter))
+	assert.Equal(t, map[string]string{"HeapAlloc": "1.5", `cpu{host="a"}`: "10", `cpu{host="b"}`: "20"},
+		dbs.GetMetric(ctx, types.Gauge))
+	assert.Nil(t, dbs.GetMetric(ctx, "histogram"))
+
+	n, err := dbs.DeleteMetricsByLabel(ctx, "host", "a")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	n, err = dbs.DeleteMetricsByPrefix(ctx, "cpu")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	ok, err := dbs.DeleteMetric(ctx, types.Gauge, "HeapAlloc")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	n, err = dbs.PurgeStale(ctx, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Empty(t, dbs.GetMetrics(ctx)[types.Counter])
+
+	// Данные переживают переоткрытие файла, а повторные миграции ничего не ломают.
+	_, err = dbs.UpdateMetric(ctx, types.Counter, "PollCount", "5")
+	require.NoError(t, err)
+	require.NoError(t, dbs.db.Close())
+
+	reopened := newTestStore(t, path)
+	assert.Equal(t, map[string]string{"PollCount": "5"}, reopened.GetMetric(ctx, types.Counter))
+
+	// Замена целиком: невалидный батч ничего не трогает, валидный заменяет всё.
+	require.Error(t, reopened.ReplaceMetrics(ctx, []types.Metrics{gauge("HeapAlloc", 2), {ID: "bad", MType: types.Gauge}}))
+	assert.Equal(t, map[string]string{"PollCount": "5"}, reopened.GetMetric(ctx, types.Counter))
+	require.NoError(t, reopened.ReplaceMetrics(ctx, []types.Metrics{gauge("HeapAlloc", 2)}))
+	assert.Empty(t, reopened.GetMetric(ctx, types.Counter))
+	assert.Equal(t, map[string]string{"HeapAlloc": "2"}, reopened.GetMetric(ctx, types.Gauge))
+}
+
+func TestDBStore_ConcurrentCounters(t *testing.T) {
+	ctx := context.Background()
+	dbs := newTestStore(t, filepath.Join(t.TempDir(), "metrics.db"))
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				_, err := dbs.UpdateMetric(ctx, types.Counter, "requests", "1")
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, map[string]string{"requests": "400"}, dbs.GetMetric(ctx, types.Counter))
+}
+
+func TestNewSQLiteDB_SkipMigrations(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{Path: filepath.Join(t.TempDir(), "metrics.db"), SkipMigrations: true}
+
+	db, err := NewSQLiteDB(ctx, cfg)
+	require.NoError(t, err)
+	_, err = NewStore(zap.NewNop(), db, 0).UpdateMetric(ctx, types.Counter, "PollCount", "1")
+	assert.ErrorContains(t, err, "no such table")
+	require.NoError(t, db.Close())
+
+	m, err := NewMigrator(ctx, cfg)
+	require.NoError(t, err)
+	require.NoError(t, m.Up())
+	_, err = m.Close()
+	require.NoError(t, err)
+
+	dbs := newTestStore(t, cfg.Path)
+	_, err = dbs.UpdateMetric(ctx, types.Counter, "PollCount", "1")
+	assert.NoError(t, err)
+}
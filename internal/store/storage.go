@@ -1,87 +1,489 @@
 package store
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"hash/fnv"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/shevchukeugeni/metrics/internal/types"
 )
 
+// shardCount — число независимых сегментов хранилища; степень двойки, чтобы индекс считался маской.
+const shardCount = 64
+
+// MemStorage хранит серии в сегментах, каждый под своей блокировкой, поэтому
+// конкурентные обновления разных серий почти не мешают друг другу.
 type MemStorage struct {
-	metrics map[string]Metric
+	shards [shardCount]shard
+	wal    *WAL
+}
+
+type shard struct {
+	mu     sync.RWMutex
+	series map[seriesKey]*series
+}
+
+type seriesKey struct {
+	mtype string
+	name  string
+}
+
+type series struct {
+	gauge   float64
+	counter int64
+	updated time.Time
 }
 
 func NewMemStorage() *MemStorage {
-	return &MemStorage{
-		map[string]Metric{
-			types.Gauge:   Gauge{},
-			types.Counter: Counter{},
-		},
+	ms := &MemStorage{}
+	for i := range ms.shards {
+		ms.shards[i].series = make(map[seriesKey]*series)
 	}
+	return ms
 }
 
-func (ms *MemStorage) GetMetric(mtype string) map[string]string {
-	mtrc, ok := ms.metrics[mtype]
-	if !ok {
+// SetWAL включает журналирование изменений. Вызывается после восстановления данных и до
+// начала обработки запросов.
+func (ms *MemStorage) SetWAL(wal *WAL) {
+	ms.wal = wal
+}
+
+// Checkpoint атомарно снимает снимок хранилища и переключает журнал на новый сегмент:
+// снимок содержит ровно те изменения, что записаны в сегменты с номерами меньше возвращённого.
+func (ms *MemStorage) Checkpoint() (map[string]Metric, uint64, error) {
+	for i := range ms.shards {
+		ms.shards[i].mu.Lock()
+	}
+	defer func() {
+		for i := range ms.shards {
+			ms.shards[i].mu.Unlock()
+		}
+	}()
+
+	var seq uint64
+	if ms.wal != nil {
+		var err error
+		if seq, err = ms.wal.Rotate(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	gauge, counter := Gauge{}, Counter{}
+	for i := range ms.shards {
+		for key, s := range ms.shards[i].series {
+			if key.mtype == types.Gauge {
+				gauge[key.name] = s.gauge
+			} else {
+				counter[key.name] = s.counter
+			}
+		}
+	}
+
+	return map[string]Metric{
+		types.Gauge:   gauge,
+		types.Counter: counter,
+	}, seq, nil
+}
+
+// ApplyWAL применяет запись журнала при восстановлении.
+func (ms *MemStorage) ApplyWAL(op string, metrics []types.Metrics) error {
+	switch op {
+	case walOpUpdate:
+		return ms.UpdateMetrics(context.Background(), metrics)
+	case walOpReplace:
+		return ms.ReplaceMetrics(context.Background(), metrics)
+	case walOpDelete:
+		for _, m := range metrics {
+			if _, err := ms.DeleteMetric(context.Background(), m.MType, m.ID); err != nil {
+				return err
+			}
+		}
 		return nil
-	} else {
-		return mtrc.Get()
+	default:
+		return fmt.Errorf("unknown wal operation %q", op)
 	}
 }
 
-func (ms *MemStorage) GetMetrics() map[string]Metric {
-	return ms.metrics
+func (ms *MemStorage) shard(key seriesKey) *shard {
+	return &ms.shards[shardIndex(key)]
 }
 
-func (ms *MemStorage) UpdateMetric(mtype, name, value string) (any, error) {
-	mtrc, ok := ms.metrics[mtype]
-	if !ok {
-		return nil, types.ErrUnknownType
+func shardIndex(key seriesKey) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key.mtype))
+	h.Write([]byte{0})
+	h.Write([]byte(key.name))
+	return h.Sum32() & (shardCount - 1)
+}
+
+func (ms *MemStorage) GetMetric(_ context.Context, mtype string) map[string]string {
+	if mtype != types.Gauge && mtype != types.Counter {
+		return nil
 	}
 
-	return mtrc.Update(name, value)
+	res := make(map[string]string)
+	ms.each(func(key seriesKey, s *series) {
+		if key.mtype != mtype {
+			return
+		}
+		if mtype == types.Gauge {
+			res[key.name] = fmt.Sprint(s.gauge)
+		} else {
+			res[key.name] = fmt.Sprint(s.counter)
+		}
+	})
+
+	return res
 }
 
-func (ms *MemStorage) UpdateMetrics(metrics []types.Metrics) error {
+// GetMetrics возвращает снимок всех серий.
+func (ms *MemStorage) GetMetrics(_ context.Context) map[string]Metric {
+	gauge, counter := Gauge{}, Counter{}
+	ms.each(func(key seriesKey, s *series) {
+		if key.mtype == types.Gauge {
+			gauge[key.name] = s.gauge
+		} else {
+			counter[key.name] = s.counter
+		}
+	})
+
+	return map[string]Metric{
+		types.Gauge:   gauge,
+		types.Counter: counter,
+	}
+}
+
+func (ms *MemStorage) UpdateMetric(_ context.Context, mtype, name, value string) (any, error) {
+	op, err := parseUpdate(mtype, name, value)
+	if err != nil {
+		return nil, err
+	}
+
+	sh := ms.shard(op.key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if ms.wal != nil {
+		if err = ms.wal.Append([]types.Metrics{op.metrics()}); err != nil {
+			return nil, err
+		}
+	}
+
+	s := sh.apply(op, time.Now())
+	if mtype == types.Gauge {
+		return s.gauge, nil
+	}
+	return s.counter, nil
+}
+
+// UpdateMetrics сначала проверяет весь батч, а затем применяет его, захватывая
+// каждый сегмент один раз, — некорректный батч не применяется даже частично.
+// В журнал батч попадает одной записью, поэтому и после падения он восстанавливается целиком.
+func (ms *MemStorage) UpdateMetrics(_ context.Context, metrics []types.Metrics) error {
+	ops, err := parseBatch(metrics)
+	if err != nil {
+		return err
+	}
+
+	var byShard [shardCount][]update
+	for _, op := range ops {
+		idx := shardIndex(op.key)
+		byShard[idx] = append(byShard[idx], op)
+	}
+
+	// Сегменты захватываются по возрастанию номера, как в Checkpoint, и держатся до конца
+	// применения: запись журнала и изменения в памяти не разделяются чекпоинтом, а порядок
+	// конкурентных батчей в журнале совпадает с порядком их применения.
+	for i := range byShard {
+		if len(byShard[i]) > 0 {
+			ms.shards[i].mu.Lock()
+			defer ms.shards[i].mu.Unlock()
+		}
+	}
+
+	if ms.wal != nil {
+		record := make([]types.Metrics, len(ops))
+		for i, op := range ops {
+			record[i] = op.metrics()
+		}
+		if err := ms.wal.Append(record); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	for i := range byShard {
+		for _, op := range byShard[i] {
+			ms.shards[i].apply(op, now)
+		}
+	}
+
+	return nil
+}
+
+// ReplaceMetrics заменяет содержимое хранилища батчем. Батч проверяется до того, как
+// что-либо удаляется, а в журнал замена попадает одной записью.
+func (ms *MemStorage) ReplaceMetrics(_ context.Context, metrics []types.Metrics) error {
+	ops, err := parseBatch(metrics)
+	if err != nil {
+		return err
+	}
+
+	for i := range ms.shards {
+		ms.shards[i].mu.Lock()
+		defer ms.shards[i].mu.Unlock()
+	}
+
+	if ms.wal != nil {
+		record := make([]types.Metrics, len(ops))
+		for i, op := range ops {
+			record[i] = op.metrics()
+		}
+		if err = ms.wal.AppendReplace(record); err != nil {
+			return err
+		}
+	}
+
+	for i := range ms.shards {
+		ms.shards[i].series = make(map[seriesKey]*series)
+	}
+	now := time.Now()
+	for _, op := range ops {
+		ms.shard(op.key).apply(op, now)
+	}
+
+	return nil
+}
+
+// parseBatch проверяет батч целиком до применения.
+func parseBatch(metrics []types.Metrics) ([]update, error) {
+	ops := make([]update, 0, len(metrics))
 	for _, mtr := range metrics {
+		op := update{key: seriesKey{mtr.MType, mtr.ID}}
 		switch mtr.MType {
 		case types.Gauge:
 			if mtr.Value == nil {
-				return errors.New("empty metric value")
-			}
-			mtrc, ok := ms.metrics[mtr.MType]
-			if !ok {
-				return types.ErrUnknownType
-			}
-
-			_, err := mtrc.Update(mtr.ID, fmt.Sprint(*mtr.Value))
-			if err != nil {
-				return err
+				return nil, types.ErrEmptyValue
 			}
+			op.gauge = *mtr.Value
 		case types.Counter:
 			if mtr.Delta == nil {
-				return errors.New("empty metric value")
-			}
-			mtrc, ok := ms.metrics[mtr.MType]
-			if !ok {
-				return types.ErrUnknownType
-			}
-
-			_, err := mtrc.Update(mtr.ID, fmt.Sprint(*mtr.Delta))
-			if err != nil {
-				return err
+				return nil, types.ErrEmptyValue
 			}
+			op.delta = *mtr.Delta
 		default:
-			return errors.New("unknown metric type")
+			return nil, types.ErrUnknownType
+		}
+		if mtr.ID == "" {
+			return nil, types.ErrIncorrectName
 		}
+		ops = append(ops, op)
 	}
-	return nil
+	return ops, nil
+}
+
+// UpdatedAt возвращает время последнего обновления серии.
+func (ms *MemStorage) UpdatedAt(mtype, name string) (time.Time, bool) {
+	key := seriesKey{mtype, name}
+	sh := ms.shard(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	s, ok := sh.series[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	return s.updated, true
+}
+
+func (ms *MemStorage) DeleteMetric(_ context.Context, mtype, name string) (bool, error) {
+	if mtype != types.Gauge && mtype != types.Counter {
+		return false, types.ErrUnknownType
+	}
+
+	key := seriesKey{mtype, name}
+	sh := ms.shard(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	_, ok := sh.series[key]
+	if !ok {
+		return false, nil
+	}
+
+	if ms.wal != nil {
+		if err := ms.wal.AppendDelete([]types.Metrics{{ID: name, MType: mtype}}); err != nil {
+			return false, err
+		}
+	}
+	delete(sh.series, key)
+
+	return true, nil
+}
+
+func (ms *MemStorage) DeleteMetricsByPrefix(_ context.Context, prefix string) (int, error) {
+	return ms.deleteWhere(func(key seriesKey, _ *series) bool {
+		return strings.HasPrefix(key.name, prefix)
+	})
+}
+
+func (ms *MemStorage) DeleteMetricsByLabel(_ context.Context, key, value string) (int, error) {
+	return ms.deleteWhere(func(k seriesKey, _ *series) bool {
+		return types.HasLabel(k.name, key, value)
+	})
+}
+
+// PurgeStale удаляет серии, которые не обновлялись с момента before.
+func (ms *MemStorage) PurgeStale(_ context.Context, before time.Time) (int, error) {
+	return ms.deleteWhere(func(_ seriesKey, s *series) bool {
+		return s.updated.Before(before)
+	})
+}
+
+func (ms *MemStorage) deleteWhere(match func(seriesKey, *series) bool) (int, error) {
+	var deleted int
+	for i := range ms.shards {
+		n, err := ms.deleteInShard(&ms.shards[i], match)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+func (ms *MemStorage) deleteInShard(sh *shard, match func(seriesKey, *series) bool) (int, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	var victims []seriesKey
+	for key, s := range sh.series {
+		if match(key, s) {
+			victims = append(victims, key)
+		}
+	}
+	if len(victims) == 0 {
+		return 0, nil
+	}
+
+	if ms.wal != nil {
+		record := make([]types.Metrics, len(victims))
+		for i, key := range victims {
+			record[i] = types.Metrics{ID: key.name, MType: key.mtype}
+		}
+		if err := ms.wal.AppendDelete(record); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, key := range victims {
+		delete(sh.series, key)
+	}
+
+	return len(victims), nil
+}
+
+// each обходит все серии, удерживая блокировку на чтение одного сегмента за раз.
+func (ms *MemStorage) each(fn func(seriesKey, *series)) {
+	for i := range ms.shards {
+		sh := &ms.shards[i]
+		sh.mu.RLock()
+		for key, s := range sh.series {
+			fn(key, s)
+		}
+		sh.mu.RUnlock()
+	}
+}
+
+type update struct {
+	key   seriesKey
+	gauge float64
+	delta int64
+}
+
+func (op update) metrics() types.Metrics {
+	m := types.Metrics{ID: op.key.name, MType: op.key.mtype}
+	if op.key.mtype == types.Gauge {
+		value := op.gauge
+		m.Value = &value
+	} else {
+		delta := op.delta
+		m.Delta = &delta
+	}
+	return m
+}
+
+func parseUpdate(mtype, name, value string) (update, error) {
+	op := update{key: seriesKey{mtype, name}}
+
+	switch mtype {
+	case types.Gauge:
+		fValue, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return op, err
+		}
+		op.gauge = fValue
+	case types.Counter:
+		iValue, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return op, err
+		}
+		op.delta = iValue
+	default:
+		return op, types.ErrUnknownType
+	}
+
+	if name == "" {
+		return op, types.ErrIncorrectName
+	}
+
+	return op, nil
+}
+
+// apply применяет обновление; вызывается под блокировкой сегмента.
+func (sh *shard) apply(op update, now time.Time) *series {
+	s, ok := sh.series[op.key]
+	if !ok {
+		s = &series{}
+		sh.series[op.key] = s
+	}
+
+	if op.key.mtype == types.Gauge {
+		s.gauge = op.gauge
+	} else {
+		s.counter += op.delta
+	}
+	s.updated = now
+
+	return s
+}
+
+// Flatten переводит результат GetMetrics в список серий; counter передаются накопленным значением.
+func Flatten(all map[string]Metric) []types.Metrics {
+	var metrics []types.Metrics
+	if gauge, ok := all[types.Gauge].(Gauge); ok {
+		for name, v := range gauge {
+			v := v
+			metrics = append(metrics, types.Metrics{ID: name, MType: types.Gauge, Value: &v})
+		}
+	}
+	if counter, ok := all[types.Counter].(Counter); ok {
+		for name, d := range counter {
+			d := d
+			metrics = append(metrics, types.Metrics{ID: name, MType: types.Counter, Delta: &d})
+		}
+	}
+	return metrics
 }
 
 type Metric interface {
 	Get() map[string]string
 	Update(name, value string) (any, error)
+	Delete(name string) bool
 }
 
 type Gauge map[string]float64
@@ -102,13 +504,19 @@ func (g Gauge) Update(name, value string) (any, error) {
 	}
 
 	if name == "" {
-		return nil, errors.New("incorrect name")
+		return nil, types.ErrIncorrectName
 	}
 
 	g[name] = fValue
 	return fValue, nil
 }
 
+func (g Gauge) Delete(name string) bool {
+	_, ok := g[name]
+	delete(g, name)
+	return ok
+}
+
 type Counter map[string]int64
 
 func (c Counter) Get() map[string]string {
@@ -127,9 +535,15 @@ func (c Counter) Update(name, value string) (any, error) {
 	}
 
 	if name == "" {
-		return nil, errors.New("incorrect name")
+		return nil, types.ErrIncorrectName
 	}
 
 	c[name] += iValue
 	return c[name], nil
 }
+
+func (c Counter) Delete(name string) bool {
+	_, ok := c[name]
+	delete(c, name)
+	return ok
+}
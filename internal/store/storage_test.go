@@ -1,9 +1,18 @@
 package store
 
 import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
 )
 
 func TestCounter_Update(t *testing.T) {
@@ -153,6 +162,7 @@ func TestMemStorage_UpdateMetric(t *testing.T) {
 		name    string
 		fields  fields
 		args    args
+		want    map[string]Metric
 		wantErr bool
 	}{
 		{
@@ -171,6 +181,14 @@ func TestMemStorage_UpdateMetric(t *testing.T) {
 				name:  "test2",
 				value: "1",
 			},
+			want: map[string]Metric{
+				"gauge": Gauge{
+					"test1": 0.5,
+				},
+				"counter": Counter{
+					"test2": 5,
+				},
+			},
 			wantErr: false,
 		},
 		{
@@ -189,20 +207,215 @@ func TestMemStorage_UpdateMetric(t *testing.T) {
 				name:  "test2",
 				value: "1",
 			},
+			want: map[string]Metric{
+				"gauge": Gauge{
+					"test1": 0.5,
+				},
+				"counter": Counter{
+					"test2": 4,
+				},
+			},
 			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			ms := &MemStorage{
-				metrics: tt.fields.Metrics,
+			ms := NewMemStorage()
+			for mtype, mtrc := range tt.fields.Metrics {
+				for name, value := range mtrc.Get() {
+					_, err := ms.UpdateMetric(context.Background(), mtype, name, value)
+					require.NoError(t, err)
+				}
 			}
-			if _, err := ms.UpdateMetric(tt.args.mtype, tt.args.name, tt.args.value); (err != nil) != tt.wantErr {
+
+			if _, err := ms.UpdateMetric(context.Background(), tt.args.mtype, tt.args.name, tt.args.value); (err != nil) != tt.wantErr {
 				t.Errorf("UpdateMetric() error = %v, wantErr %v", err, tt.wantErr)
 			}
 
-			require.Equal(t, ms.GetMetric("gauge"), tt.fields.Metrics["gauge"].Get())
-			require.Equal(t, ms.GetMetric("counter"), tt.fields.Metrics["counter"].Get())
+			require.Equal(t, ms.GetMetric(context.Background(), "gauge"), tt.want["gauge"].Get())
+			require.Equal(t, ms.GetMetric(context.Background(), "counter"), tt.want["counter"].Get())
+			require.Equal(t, ms.GetMetrics(context.Background()), tt.want)
+		})
+	}
+}
+
+func TestMemStorage_Delete(t *testing.T) {
+	ms := NewMemStorage()
+	for _, name := range []string{"HeapAlloc", "HeapSys", `cpu{host="a"}`, `cpu{host="b"}`, `mem{host="a"}`} {
+		_, err := ms.UpdateMetric(context.Background(), "gauge", name, "1")
+		require.NoError(t, err)
+	}
+	_, err := ms.UpdateMetric(context.Background(), "counter", "PollCount", "1")
+	require.NoError(t, err)
+
+	ok, err := ms.DeleteMetric(context.Background(), "counter", "PollCount")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	ok, err = ms.DeleteMetric(context.Background(), "counter", "PollCount")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, err = ms.DeleteMetric(context.Background(), "counter-f", "PollCount")
+	require.ErrorIs(t, err, types.ErrUnknownType)
+
+	n, err := ms.DeleteMetricsByPrefix(context.Background(), "Heap")
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	n, err = ms.DeleteMetricsByLabel(context.Background(), "host", "a")
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	require.Equal(t, map[string]string{`cpu{host="b"}`: "1"}, ms.GetMetric(context.Background(), "gauge"))
+	require.Empty(t, ms.GetMetric(context.Background(), "counter"))
+}
+
+func TestJanitor_Purge(t *testing.T) {
+	ms := NewMemStorage()
+	_, err := ms.UpdateMetric(context.Background(), "gauge", "old", "1")
+	require.NoError(t, err)
+
+	key := seriesKey{"gauge", "old"}
+	ms.shard(key).series[key].updated = time.Now().Add(-2 * time.Hour)
+
+	_, err = ms.UpdateMetric(context.Background(), "gauge", "fresh", "1")
+	require.NoError(t, err)
+
+	updated, ok := ms.UpdatedAt("gauge", "fresh")
+	require.True(t, ok)
+	require.WithinDuration(t, time.Now(), updated, time.Minute)
+
+	require.Nil(t, NewJanitor(zap.NewNop(), ms, 0))
+
+	j := NewJanitor(zap.NewNop(), ms, time.Hour)
+	j.Purge(context.Background(), time.Now())
+
+	require.Equal(t, map[string]string{"fresh": "1"}, ms.GetMetric(context.Background(), "gauge"))
+	_, ok = ms.UpdatedAt("gauge", "old")
+	require.False(t, ok)
+}
+
+func TestMemStorage_UpdateMetricsInvalidBatch(t *testing.T) {
+	ms := NewMemStorage()
+	delta := int64(1)
+
+	err := ms.UpdateMetrics(context.Background(), []types.Metrics{
+		{ID: "ok", MType: types.Counter, Delta: &delta},
+		{ID: "broken", MType: types.Gauge},
+	})
+	require.Error(t, err)
+	require.Empty(t, ms.GetMetric(context.Background(), types.Counter), "invalid batch must not be applied partially")
+}
+
+// TestMemStorage_Concurrent запускается с -race: обновления, чтения, удаления
+// и дамп работают одновременно, а итоговые значения счётчиков должны сойтись.
+func TestMemStorage_Concurrent(t *testing.T) {
+	const (
+		writers = 16
+		rounds  = 500
+		names   = 32
+	)
+
+	ms := NewMemStorage()
+	dcfg := &types.DumpConfig{FileStoragePath: filepath.Join(t.TempDir(), "dump.json")}
+	var dwg sync.WaitGroup
+	dw := NewDumpWorker(zap.NewNop(), dcfg, ms, &dwg)
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			delta := int64(1)
+			for i := 0; i < rounds; i++ {
+				name := "c" + strconv.Itoa(i%names)
+				if i%2 == 0 {
+					_, err := ms.UpdateMetric(context.Background(), types.Counter, name, "1")
+					assert.NoError(t, err)
+				} else {
+					value := float64(w)
+					assert.NoError(t, ms.UpdateMetrics(context.Background(), []types.Metrics{
+						{ID: name, MType: types.Counter, Delta: &delta},
+						{ID: "g" + strconv.Itoa(w), MType: types.Gauge, Value: &value},
+					}))
+				}
+			}
+		}(w)
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				ms.GetMetric(context.Background(), types.Counter)
+				ms.GetMetrics(context.Background())
+				dw.dump()
+				_, err := ms.DeleteMetricsByPrefix(context.Background(), "tmp")
+				assert.NoError(t, err)
+				_, err = ms.PurgeStale(context.Background(), time.Now().Add(-time.Hour))
+				assert.NoError(t, err)
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	var total int64
+	for _, v := range ms.GetMetrics(context.Background())[types.Counter].(Counter) {
+		total += v
+	}
+	require.Equal(t, int64(writers*rounds), total)
+	require.Len(t, ms.GetMetric(context.Background(), types.Gauge), writers)
+}
+
+func BenchmarkMemStorage_UpdateMetrics(b *testing.B) {
+	for _, size := range []int{40, 1000, 100000} {
+		batch := make([]types.Metrics, size)
+		for i := range batch {
+			value, delta := float64(i), int64(i)
+			if i%2 == 0 {
+				batch[i] = types.Metrics{ID: "gauge" + strconv.Itoa(i), MType: types.Gauge, Value: &value}
+			} else {
+				batch[i] = types.Metrics{ID: "counter" + strconv.Itoa(i), MType: types.Counter, Delta: &delta}
+			}
+		}
+
+		b.Run("batch="+strconv.Itoa(size), func(b *testing.B) {
+			ms := NewMemStorage()
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if err := ms.UpdateMetrics(context.Background(), batch); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.ReportMetric(float64(size*b.N)/b.Elapsed().Seconds(), "series/s")
 		})
 	}
 }
+
+func BenchmarkMemStorage_UpdateMetric(b *testing.B) {
+	ms := NewMemStorage()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			if _, err := ms.UpdateMetric(context.Background(), types.Counter, "c"+strconv.Itoa(i%1024), "1"); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
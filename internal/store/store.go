@@ -0,0 +1,84 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+// MetricStorage — хранилище метрик, с которым работают сервер и обёртки над хранилищем
+// (репликация, кластер, арендаторы).
+type MetricStorage interface {
+	GetMetrics(ctx context.Context) map[string]Metric
+	GetMetric(ctx context.Context, mtype string) map[string]string
+	UpdateMetric(ctx context.Context, mtype, name, value string) (any, error)
+	UpdateMetrics(ctx context.Context, metrics []types.Metrics) error
+	DeleteMetric(ctx context.Context, mtype, name string) (bool, error)
+	DeleteMetricsByPrefix(ctx context.Context, prefix string) (int, error)
+	DeleteMetricsByLabel(ctx context.Context, key, value string) (int, error)
+	PurgeStale(ctx context.Context, before time.Time) (int, error)
+}
+
+// ValueReader — хранилище, которое читает одну серию, не выбирая остальные (например,
+// кластер спрашивает только владельца серии).
+type ValueReader interface {
+	// GetValue возвращает значение серии; ok == false, если серии нет.
+	GetValue(ctx context.Context, mtype, name string) (value string, ok bool, err error)
+}
+
+type batchKey struct{}
+
+// WithBatchID возвращает контекст записи батча с идентификатором id из запроса клиента.
+func WithBatchID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, batchKey{}, id)
+}
+
+// BatchID возвращает идентификатор батча записи или пустую строку, если клиент его не передал.
+func BatchID(ctx context.Context) string {
+	id, _ := ctx.Value(batchKey{}).(string)
+	return id
+}
+
+// CompleteReader — хранилище, у которого GetMetrics может вернуть неполную выборку
+// (кластер с недоступным узлом). GetCompleteMetrics в этом случае возвращает ошибку с
+// types.ErrPartialResult.
+type CompleteReader interface {
+	GetCompleteMetrics(ctx context.Context) (map[string]Metric, error)
+}
+
+// ReadAll возвращает все серии хранилища или ошибку, если их не удалось прочитать
+// полностью. Ею пользуются те, кому неполная выборка хуже отказа: снимок и подсчёт квот.
+func ReadAll(ctx context.Context, ms MetricStorage) (map[string]Metric, error) {
+	if cr, ok := ms.(CompleteReader); ok {
+		return cr.GetCompleteMetrics(ctx)
+	}
+
+	all := ms.GetMetrics(ctx)
+	if all == nil {
+		return nil, errors.New("unable to read storage")
+	}
+	return all, nil
+}
+
+// HistoryStorage — хранилище, которое хранит историю значений серий.
+type HistoryStorage interface {
+	Samples(ctx context.Context, mtype, name string, from, to time.Time) ([]types.Sample, error)
+}
+
+// StorageStatus описывает хранилище, с которым работает сервер.
+type StorageStatus struct {
+	// Backend — фактически используемое хранилище.
+	Backend string `json:"backend"`
+	// Requested — хранилище из конфигурации, если сервер работает на запасном.
+	Requested string `json:"requested,omitempty"`
+	// Fallback — причина перехода на запасное хранилище.
+	Fallback string `json:"fallback,omitempty"`
+}
+
+// Replacer — хранилище, которое заменяет всё своё содержимое одним шагом: если замена
+// не удалась, прежние данные остаются на месте.
+type Replacer interface {
+	ReplaceMetrics(ctx context.Context, metrics []types.Metrics) error
+}
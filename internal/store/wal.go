@@ -0,0 +1,354 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+const (
+	FsyncAlways   = "always"
+	FsyncInterval = "interval"
+	FsyncNever    = "never"
+
+	walOpUpdate  = "update"
+	walOpDelete  = "delete"
+	walOpReplace = "replace"
+
+	walSuffix = ".wal"
+)
+
+var (
+	// ErrWALSegmentMissing — журнал не содержит сегментов, нужных для доигрывания дампа.
+	ErrWALSegmentMissing = errors.New("wal segments are missing")
+	// ErrWALCorrupt — повреждена запись журнала, за которой есть другие записи.
+	ErrWALCorrupt = errors.New("wal record is corrupted")
+)
+
+// walRecord — одна строка журнала: батч обновлений, удалённые серии или новое содержимое хранилища.
+type walRecord struct {
+	Op      string          `json:"op"`
+	Metrics []types.Metrics `json:"metrics"`
+}
+
+// WAL — журнал изменений MemStorage, разбитый на сегменты <seq>.wal в каталоге dir.
+// Каждая запись дописывается до применения к памяти; при чекпоинте DumpWorker переключает
+// журнал на новый сегмент, а сегменты, целиком попавшие в дамп, удаляются.
+type WAL struct {
+	logger   *zap.Logger
+	dir      string
+	policy   string
+	interval time.Duration
+
+	mu    sync.Mutex
+	f     *os.File
+	seq   uint64
+	dirty bool
+}
+
+func OpenWAL(logger *zap.Logger, dir, policy string, interval time.Duration) (*WAL, error) {
+	switch policy {
+	case "":
+		policy = FsyncInterval
+	case FsyncAlways, FsyncInterval, FsyncNever:
+	default:
+		return nil, fmt.Errorf("unknown wal fsync policy %q", policy)
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	w := &WAL{
+		logger:   logger,
+		dir:      dir,
+		policy:   policy,
+		interval: interval,
+	}
+
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	seq := uint64(1)
+	if len(segments) > 0 {
+		seq = segments[len(segments)-1]
+	}
+	if err = w.open(seq); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Start периодически сбрасывает журнал на диск при политике interval.
+func (w *WAL) Start(ctx context.Context) {
+	if w.policy != FsyncInterval {
+		return
+	}
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.Sync(); err != nil {
+				w.logger.Error("failed to sync wal", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Append дописывает запись об обновлении серий.
+func (w *WAL) Append(metrics []types.Metrics) error {
+	return w.write(walRecord{Op: walOpUpdate, Metrics: metrics})
+}
+
+// AppendDelete дописывает запись об удалении серий.
+func (w *WAL) AppendDelete(metrics []types.Metrics) error {
+	return w.write(walRecord{Op: walOpDelete, Metrics: metrics})
+}
+
+// AppendReplace дописывает запись о замене всего содержимого хранилища.
+func (w *WAL) AppendReplace(metrics []types.Metrics) error {
+	return w.write(walRecord{Op: walOpReplace, Metrics: metrics})
+}
+
+func (w *WAL) write(rec walRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.f == nil {
+		return errors.New("wal is closed")
+	}
+	if _, err = w.f.Write(data); err != nil {
+		return err
+	}
+
+	if w.policy == FsyncAlways {
+		return w.f.Sync()
+	}
+	w.dirty = true
+
+	return nil
+}
+
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.f == nil || !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.f.Sync()
+}
+
+// Rotate закрывает текущий сегмент и начинает новый. Возвращает номер нового сегмента:
+// всё, что записано в сегменты с меньшими номерами, должно попасть в чекпоинт.
+func (w *WAL) Rotate() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.closeFile(); err != nil {
+		return 0, err
+	}
+	if err := w.open(w.seq + 1); err != nil {
+		return 0, err
+	}
+
+	return w.seq, nil
+}
+
+// Prune удаляет сегменты с номерами меньше before.
+func (w *WAL) Prune(before uint64) error {
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+
+	for _, seq := range segments {
+		if seq >= before {
+			break
+		}
+		if err = os.Remove(w.path(seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Replay последовательно передаёт в apply записи сегментов начиная с from.
+// Оборванная при падении последняя запись самого нового сегмента отбрасывается. Любая
+// другая повреждённая запись — ошибка: пропустив её, журнал применил бы следующие записи
+// поверх пробела. Если сегмент from уже удалён, изменения после дампа потеряны,
+// и Replay тоже возвращает ошибку.
+func (w *WAL) Replay(from uint64, apply func(op string, metrics []types.Metrics) error) (int, error) {
+	segments, err := w.segments()
+	if err != nil {
+		return 0, err
+	}
+	if from > 0 && len(segments) > 0 && segments[0] > from {
+		return 0, fmt.Errorf("%w: need segment %d, oldest is %d", ErrWALSegmentMissing, from, segments[0])
+	}
+
+	var replayed int
+	for i, seq := range segments {
+		if seq < from {
+			continue
+		}
+
+		n, err := w.replaySegment(seq, i == len(segments)-1, apply)
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+	}
+
+	return replayed, nil
+}
+
+func (w *WAL) replaySegment(seq uint64, newest bool, apply func(op string, metrics []types.Metrics) error) (int, error) {
+	f, err := os.Open(w.path(seq))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var (
+		replayed int
+		offset   int64
+	)
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) == 0 {
+				return replayed, nil
+			}
+			// Запись без перевода строки — недописанная при падении; бывает только в конце
+			// сегмента, в который шла запись.
+			if !newest {
+				return replayed, fmt.Errorf("%w: torn record in segment %d offset %d", ErrWALCorrupt, seq, offset)
+			}
+			return replayed, w.truncateTail(seq, offset)
+		}
+		if err != nil {
+			return replayed, err
+		}
+
+		var rec walRecord
+		if err = json.Unmarshal(line, &rec); err != nil {
+			return replayed, fmt.Errorf("%w: segment %d offset %d: %v", ErrWALCorrupt, seq, offset, err)
+		}
+
+		if err = apply(rec.Op, rec.Metrics); err != nil {
+			return replayed, fmt.Errorf("wal segment %d offset %d: %w", seq, offset, err)
+		}
+
+		offset += int64(len(line))
+		replayed++
+	}
+}
+
+// truncateTail отрезает недописанный хвост, чтобы новые записи не продолжали битую строку.
+func (w *WAL) truncateTail(seq uint64, offset int64) error {
+	w.logger.Warn("truncating torn wal tail", zap.Uint64("segment", seq), zap.Int64("offset", offset))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Файл открыт с O_APPEND, поэтому после усечения запись продолжится с новой границы.
+	if seq == w.seq && w.f != nil {
+		return w.f.Truncate(offset)
+	}
+
+	return os.Truncate(w.path(seq), offset)
+}
+
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.closeFile()
+}
+
+func (w *WAL) closeFile() error {
+	if w.f == nil {
+		return nil
+	}
+
+	err := w.f.Sync()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.f, w.dirty = nil, false
+
+	return err
+}
+
+func (w *WAL) open(seq uint64) error {
+	f, err := os.OpenFile(w.path(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.f, w.seq = f, seq
+
+	return nil
+}
+
+func (w *WAL) path(seq uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", seq, walSuffix))
+}
+
+func (w *WAL) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, walSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, walSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, seq)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+
+	return segments, nil
+}
@@ -0,0 +1,329 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+func TestWAL_ReplayTornTail(t *testing.T) {
+	dir := t.TempDir()
+
+	wal, err := OpenWAL(zap.NewNop(), dir, FsyncAlways, 0)
+	require.NoError(t, err)
+
+	ms := NewMemStorage()
+	ms.SetWAL(wal)
+
+	_, err = ms.UpdateMetric(context.Background(), types.Counter, "PollCount", "2")
+	require.NoError(t, err)
+	_, err = ms.UpdateMetric(context.Background(), types.Gauge, "HeapAlloc", "1.5")
+	require.NoError(t, err)
+	_, err = ms.DeleteMetric(context.Background(), types.Gauge, "HeapAlloc")
+	require.NoError(t, err)
+	require.NoError(t, wal.Close())
+
+	// Имитируем падение посреди записи.
+	f, err := os.OpenFile(wal.path(1), os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"op":"update","metrics":[{"id":"Poll`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	wal, err = OpenWAL(zap.NewNop(), dir, FsyncNever, 0)
+	require.NoError(t, err)
+	defer wal.Close()
+
+	restored := NewMemStorage()
+	n, err := wal.Replay(0, restored.ApplyWAL)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, ms.GetMetrics(context.Background()), restored.GetMetrics(context.Background()))
+
+	// После усечения хвоста новые записи читаются нормально.
+	restored.SetWAL(wal)
+	_, err = restored.UpdateMetric(context.Background(), types.Counter, "PollCount", "1")
+	require.NoError(t, err)
+
+	again := NewMemStorage()
+	_, err = wal.Replay(0, again.ApplyWAL)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"PollCount": "3"}, again.GetMetric(context.Background(), types.Counter))
+}
+
+func TestWAL_ReplayCorrupted(t *testing.T) {
+	counter := func(id string) []types.Metrics {
+		d := int64(1)
+		return []types.Metrics{{ID: id, MType: types.Counter, Delta: &d}}
+	}
+	// corrupt подменяет первую запись сегмента строкой, которая не разбирается.
+	corrupt := func(t *testing.T, path string) {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		lines := strings.SplitAfter(string(data), "\n")
+		lines[0] = "{garbage}\n"
+		require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "")), 0644))
+	}
+
+	tests := []struct {
+		name string
+		// damage портит журнал из двух сегментов по две записи.
+		damage func(t *testing.T, wal *WAL)
+	}{
+		{name: "middle of the active segment", damage: func(t *testing.T, wal *WAL) {
+			corrupt(t, wal.path(2))
+		}},
+		{name: "non-final segment", damage: func(t *testing.T, wal *WAL) {
+			corrupt(t, wal.path(1))
+		}},
+		{name: "torn record in a non-final segment", damage: func(t *testing.T, wal *WAL) {
+			f, err := os.OpenFile(wal.path(1), os.O_APPEND|os.O_WRONLY, 0644)
+			require.NoError(t, err)
+			_, err = f.WriteString(`{"op":"update","metrics":[{"id":"Poll`)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			wal, err := OpenWAL(zap.NewNop(), dir, FsyncAlways, 0)
+			require.NoError(t, err)
+			require.NoError(t, wal.Append(counter("a")))
+			require.NoError(t, wal.Append(counter("b")))
+			_, err = wal.Rotate()
+			require.NoError(t, err)
+			require.NoError(t, wal.Append(counter("c")))
+			require.NoError(t, wal.Append(counter("d")))
+			require.NoError(t, wal.Close())
+
+			tt.damage(t, wal)
+
+			wal, err = OpenWAL(zap.NewNop(), dir, FsyncNever, 0)
+			require.NoError(t, err)
+			defer wal.Close()
+			_, err = wal.Replay(0, NewMemStorage().ApplyWAL)
+			assert.ErrorIs(t, err, ErrWALCorrupt)
+
+			// Журнал не усечён: записи после повреждения остаются для разбора.
+			data, err := os.ReadFile(wal.path(2))
+			require.NoError(t, err)
+			assert.Equal(t, 2, strings.Count(string(data), "\n"))
+		})
+	}
+}
+
+func TestDumpWorker_WALRecovery(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &types.DumpConfig{
+		StoreInterval:   300,
+		FileStoragePath: filepath.Join(dir, "dump.json"),
+		Restore:         true,
+		WALPath:         filepath.Join(dir, "wal"),
+		WALFsync:        FsyncNever,
+	}
+
+	var wg sync.WaitGroup
+	ms := NewMemStorage()
+	dw := NewDumpWorker(zap.NewNop(), cfg, ms, &wg)
+	require.NotNil(t, dw.wal)
+	require.False(t, dw.syncMode)
+
+	delta := int64(5)
+	require.NoError(t, ms.UpdateMetrics(context.Background(), []types.Metrics{{ID: "requests", MType: types.Counter, Delta: &delta}}))
+	dw.dump()
+
+	_, err := ms.UpdateMetric(context.Background(), types.Counter, "requests", "3")
+	require.NoError(t, err)
+	_, err = ms.UpdateMetric(context.Background(), types.Gauge, "HeapAlloc", "42")
+	require.NoError(t, err)
+
+	// Чекпоинт записан, но сегменты, попавшие в него, остались на диске —
+	// при восстановлении они не должны примениться повторно.
+	_, seq, err := ms.Checkpoint()
+	require.NoError(t, err)
+	metrics := ms.GetMetrics(context.Background())
+	data := dumpData{WALSegment: seq}
+	for k, v := range metrics[types.Counter].Get() {
+		data.Metrics = append(data.Metrics, metric{MType: types.Counter, Name: k, Value: v})
+	}
+	for k, v := range metrics[types.Gauge].Get() {
+		data.Metrics = append(data.Metrics, metric{MType: types.Gauge, Name: k, Value: v})
+	}
+	writeDump(t, cfg.FileStoragePath, data)
+
+	_, err = ms.UpdateMetric(context.Background(), types.Counter, "requests", "1")
+	require.NoError(t, err)
+	require.NoError(t, dw.wal.Close()) // падение без финального дампа
+
+	restored := NewMemStorage()
+	dw2 := NewDumpWorker(zap.NewNop(), cfg, restored, &wg)
+	defer dw2.wal.Close()
+
+	assert.Equal(t, map[string]string{"requests": "9"}, restored.GetMetric(context.Background(), types.Counter))
+	assert.Equal(t, map[string]string{"HeapAlloc": "42"}, restored.GetMetric(context.Background(), types.Gauge))
+}
+
+func TestDumpWorker_WALWithoutRestore(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &types.DumpConfig{
+		FileStoragePath: filepath.Join(dir, "dump.json"),
+		Restore:         true,
+		WALPath:         filepath.Join(dir, "wal"),
+	}
+
+	var wg sync.WaitGroup
+	ms := NewMemStorage()
+	dw := NewDumpWorker(zap.NewNop(), cfg, ms, &wg)
+	_, err := ms.UpdateMetric(context.Background(), types.Counter, "requests", "3")
+	require.NoError(t, err)
+	require.NoError(t, dw.wal.Close())
+
+	cfg.Restore = false
+	fresh := NewMemStorage()
+	dw = NewDumpWorker(zap.NewNop(), cfg, fresh, &wg)
+	defer dw.wal.Close()
+
+	assert.Empty(t, fresh.GetMetric(context.Background(), types.Counter))
+
+	n, err := dw.wal.Replay(0, NewMemStorage().ApplyWAL)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func writeDump(t *testing.T, path string, data dumpData) {
+	raw, err := json.Marshal(data)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, raw, 0644))
+}
+
+func TestMemStorage_UpdateMetricsSingleRecord(t *testing.T) {
+	wal, err := OpenWAL(zap.NewNop(), t.TempDir(), FsyncAlways, 0)
+	require.NoError(t, err)
+	defer wal.Close()
+
+	ms := NewMemStorage()
+	ms.SetWAL(wal)
+
+	batch := make([]types.Metrics, 0, 2*shardCount)
+	for i := 0; i < cap(batch); i++ {
+		delta := int64(i)
+		batch = append(batch, types.Metrics{ID: fmt.Sprintf("c%d", i), MType: types.Counter, Delta: &delta})
+	}
+	require.NoError(t, ms.UpdateMetrics(context.Background(), batch))
+
+	var records []int
+	_, err = wal.Replay(0, func(_ string, metrics []types.Metrics) error {
+		records = append(records, len(metrics))
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []int{len(batch)}, records, "a batch must be journaled as one record")
+}
+
+func TestDumpWorker_WALKeepsGenerations(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &types.DumpConfig{
+		StoreInterval:   300,
+		FileStoragePath: filepath.Join(dir, "dump.json"),
+		DumpGenerations: 1,
+		Restore:         true,
+		WALPath:         filepath.Join(dir, "wal"),
+		WALFsync:        FsyncNever,
+	}
+
+	var wg sync.WaitGroup
+	ms := NewMemStorage()
+	dw := NewDumpWorker(zap.NewNop(), cfg, ms, &wg)
+	for i := 0; i < 3; i++ {
+		_, err := ms.UpdateMetric(context.Background(), types.Counter, "requests", "1")
+		require.NoError(t, err)
+		dw.dump()
+	}
+	_, err := ms.UpdateMetric(context.Background(), types.Counter, "requests", "1")
+	require.NoError(t, err)
+	require.NoError(t, dw.wal.Close())
+
+	// Основной дамп повреждён: восстановление из предыдущего поколения доигрывает журнал,
+	// который ещё не удалён.
+	raw, err := os.ReadFile(cfg.FileStoragePath)
+	require.NoError(t, err)
+	raw[len(raw)-3] ^= 0xff
+	require.NoError(t, os.WriteFile(cfg.FileStoragePath, raw, 0644))
+
+	restored := NewMemStorage()
+	dw = NewDumpWorker(zap.NewNop(), cfg, restored, &wg)
+	require.NotNil(t, dw.wal)
+	defer dw.wal.Close()
+	assert.Equal(t, map[string]string{"requests": "4"}, restored.GetMetric(context.Background(), types.Counter))
+}
+
+func TestWAL_ReplayMissingSegments(t *testing.T) {
+	wal, err := OpenWAL(zap.NewNop(), t.TempDir(), FsyncNever, 0)
+	require.NoError(t, err)
+	defer wal.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err = wal.Rotate()
+		require.NoError(t, err)
+	}
+	require.NoError(t, wal.Prune(4))
+
+	_, err = wal.Replay(2, NewMemStorage().ApplyWAL)
+	assert.ErrorIs(t, err, ErrWALSegmentMissing)
+	_, err = wal.Replay(4, NewMemStorage().ApplyWAL)
+	assert.NoError(t, err)
+}
+
+func TestMemStorage_ReplaceMetrics(t *testing.T) {
+	dir := t.TempDir()
+
+	wal, err := OpenWAL(zap.NewNop(), dir, FsyncAlways, 0)
+	require.NoError(t, err)
+
+	ms := NewMemStorage()
+	ms.SetWAL(wal)
+
+	_, err = ms.UpdateMetric(context.Background(), types.Gauge, "Stale", "1")
+	require.NoError(t, err)
+	_, err = ms.UpdateMetric(context.Background(), types.Counter, "PollCount", "2")
+	require.NoError(t, err)
+
+	value, delta := 1.5, int64(5)
+	// Невалидный батч не трогает хранилище.
+	err = ms.ReplaceMetrics(context.Background(), []types.Metrics{
+		{ID: "HeapAlloc", MType: types.Gauge, Value: &value},
+		{ID: "Broken", MType: "histogram"},
+	})
+	require.Error(t, err)
+	assert.Equal(t, map[string]string{"Stale": "1"}, ms.GetMetric(context.Background(), types.Gauge))
+
+	require.NoError(t, ms.ReplaceMetrics(context.Background(), []types.Metrics{
+		{ID: "HeapAlloc", MType: types.Gauge, Value: &value},
+		{ID: "PollCount", MType: types.Counter, Delta: &delta},
+	}))
+	assert.Equal(t, map[string]string{"HeapAlloc": "1.5"}, ms.GetMetric(context.Background(), types.Gauge))
+	assert.Equal(t, map[string]string{"PollCount": "5"}, ms.GetMetric(context.Background(), types.Counter))
+	require.NoError(t, wal.Close())
+
+	wal, err = OpenWAL(zap.NewNop(), dir, FsyncAlways, 0)
+	require.NoError(t, err)
+	defer wal.Close()
+
+	replayed := NewMemStorage()
+	_, err = wal.Replay(0, replayed.ApplyWAL)
+	require.NoError(t, err)
+	assert.Equal(t, ms.GetMetric(context.Background(), types.Gauge), replayed.GetMetric(context.Background(), types.Gauge))
+	assert.Equal(t, ms.GetMetric(context.Background(), types.Counter), replayed.GetMetric(context.Background(), types.Counter))
+}
@@ -0,0 +1,92 @@
+package tenant
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+var validID = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Limits — квоты арендатора; нулевое значение снимает ограничение.
+type Limits struct {
+	// MaxSeries — максимальное число серий (gauge и counter считаются отдельно).
+	MaxSeries int `json:"max_series"`
+	// IngestRate — значений в секунду; одно значение батча считается за одно.
+	IngestRate  float64 `json:"ingest_rate"`
+	IngestBurst int     `json:"ingest_burst"`
+}
+
+type Tenant struct {
+	ID      string   `json:"id"`
+	APIKeys []string `json:"api_keys"`
+	// Limits заменяет DefaultLimits для этого арендатора.
+	Limits *Limits `json:"limits"`
+}
+
+// Config описывает арендаторов. Запрос без ключа попадает к арендатору по умолчанию,
+// если разрешён AllowAnonymous. Заголовок X-Tenant-ID учитывается только при TrustHeader,
+// когда сервер стоит за шлюзом, который сам проверяет клиентов.
+type Config struct {
+	Tenants        []Tenant `json:"tenants"`
+	AllowAnonymous bool     `json:"allow_anonymous"`
+	TrustHeader    bool     `json:"trust_header"`
+	DefaultLimits  Limits   `json:"default_limits"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err = json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	if err = cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) validate() error {
+	ids := make(map[string]struct{}, len(cfg.Tenants))
+	keys := make(map[string]struct{})
+	for _, t := range cfg.Tenants {
+		if !validID.MatchString(t.ID) {
+			return fmt.Errorf("invalid tenant id %q", t.ID)
+		}
+		if _, ok := ids[t.ID]; ok {
+			return fmt.Errorf("duplicate tenant %s", t.ID)
+		}
+		ids[t.ID] = struct{}{}
+
+		for _, k := range t.APIKeys {
+			if k == "" {
+				return fmt.Errorf("tenant %s: empty api key", t.ID)
+			}
+			if _, ok := keys[k]; ok {
+				return fmt.Errorf("tenant %s: api key is used by another tenant", t.ID)
+			}
+			keys[k] = struct{}{}
+		}
+	}
+	if len(cfg.Tenants) == 0 && !cfg.AllowAnonymous {
+		return errors.New("no tenants configured and anonymous access is disabled")
+	}
+	return nil
+}
+
+// limits возвращает квоты арендатора id; пустой id — арендатор по умолчанию.
+func (cfg *Config) limits(id string) Limits {
+	for _, t := range cfg.Tenants {
+		if t.ID == id && t.Limits != nil {
+			return *t.Limits
+		}
+	}
+	return cfg.DefaultLimits
+}
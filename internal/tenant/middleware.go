@@ -0,0 +1,69 @@
+package tenant
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+const (
+	HeaderAPIKey = "X-API-Key"
+	HeaderTenant = "X-Tenant-ID"
+)
+
+// Middleware определяет арендатора запроса и кладёт его в контекст. Ключ передаётся
+// в X-API-Key; неизвестный ключ или запрос без ключа при выключенном AllowAnonymous
+// получают 401.
+func Middleware(logger *zap.Logger, cfg *Config) func(http.Handler) http.Handler {
+	type entry struct {
+		sum    [sha256.Size]byte
+		tenant string
+	}
+	var keys []entry
+	ids := make(map[string]struct{}, len(cfg.Tenants))
+	for _, t := range cfg.Tenants {
+		ids[t.ID] = struct{}{}
+		for _, k := range t.APIKeys {
+			keys = append(keys, entry{sum: sha256.Sum256([]byte(k)), tenant: t.ID})
+		}
+	}
+
+	// Сравниваются хеши ключей, чтобы время проверки не зависело от длины совпавшего префикса.
+	lookup := func(key string) (string, bool) {
+		sum := sha256.Sum256([]byte(key))
+		found, id := false, ""
+		for _, e := range keys {
+			if subtle.ConstantTimeCompare(sum[:], e.sum[:]) == 1 {
+				found, id = true, e.tenant
+			}
+		}
+		return id, found
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var (
+				id string
+				ok bool
+			)
+			switch {
+			case r.Header.Get(HeaderAPIKey) != "":
+				id, ok = lookup(r.Header.Get(HeaderAPIKey))
+			case cfg.TrustHeader && r.Header.Get(HeaderTenant) != "":
+				id = r.Header.Get(HeaderTenant)
+				_, ok = ids[id]
+			default:
+				ok = cfg.AllowAnonymous
+			}
+			if !ok {
+				logger.Warn("unknown tenant", zap.String("uri", r.RequestURI), zap.String("remote", r.RemoteAddr))
+				http.Error(w, "unknown tenant or api key", http.StatusUnauthorized)
+				return
+			}
+
+			h.ServeHTTP(w, r.WithContext(WithTenant(r.Context(), id)))
+		})
+	}
+}
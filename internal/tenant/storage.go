@@ -0,0 +1,496 @@
+// Package tenant разделяет одно хранилище между несколькими командами.
+//
+// Middleware определяет арендатора по API-ключу и кладёт его в контекст запроса. Storage
+// оборачивает любое хранилище сервера: серии арендатора хранятся с дополнительной меткой
+// __tenant__, которая добавляется при записи и снимается при чтении, а чтение и удаление
+// видят только серии своего арендатора. Поэтому разделение одинаково работает для
+// MemStorage, DBStore и SQLite, а WAL, дампы, репликация и кластер переносят серии
+// без изменений форматов. Серии арендатора по умолчанию хранятся без метки — это
+// данные, записанные до включения арендаторов.
+//
+// Запросы без арендатора в контексте (служебные эндпоинты, уборщик, алерты) работают
+// со всем хранилищем.
+package tenant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shevchukeugeni/metrics/internal/ratelimit"
+	"github.com/shevchukeugeni/metrics/internal/store"
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+// Label — служебная метка с идентификатором арендатора.
+const Label = "__tenant__"
+
+var errReservedLabel = fmt.Errorf("%w: label %s is reserved", types.ErrInvalidSeriesID, Label)
+
+type ctxKey struct{}
+
+// WithTenant возвращает контекст запроса арендатора id; пустой id — арендатор по умолчанию.
+func WithTenant(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// FromContext возвращает арендатора запроса; ok == false, если запрос не привязан к арендатору.
+func FromContext(ctx context.Context) (id string, ok bool) {
+	id, ok = ctx.Value(ctxKey{}).(string)
+	return id, ok
+}
+
+// Storage — хранилище с разделением серий по арендаторам и квотами на запись.
+type Storage struct {
+	store.MetricStorage
+	cfg *Config
+
+	mu     sync.Mutex
+	quotas map[string]*quota
+}
+
+func NewStorage(ms store.MetricStorage, cfg *Config) *Storage {
+	return &Storage{
+		MetricStorage: ms,
+		cfg:           cfg,
+		quotas:        make(map[string]*quota),
+	}
+}
+
+// quota — состояние квот одного арендатора. Множество серий загружается из хранилища
+// при первой записи и сбрасывается после удалений и сбоев записи, чтобы не расходиться
+// с хранилищем.
+type quota struct {
+	limits Limits
+	bucket *ratelimit.Bucket
+
+	mu     sync.Mutex
+	series map[string]struct{}
+}
+
+func (s *Storage) quota(id string) *quota {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, ok := s.quotas[id]
+	if !ok {
+		q = &quota{limits: s.cfg.limits(id)}
+		if q.limits.IngestRate > 0 {
+			q.bucket = ratelimit.NewBucket(q.limits.IngestRate, q.limits.IngestBurst)
+		}
+		s.quotas[id] = q
+	}
+	return q
+}
+
+// reset сбрасывает множество серий арендатора id: после удаления его нужно перечитать
+// из хранилища.
+func (s *Storage) reset(id string) {
+	s.mu.Lock()
+	q, ok := s.quotas[id]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	q.mu.Lock()
+	q.series = nil
+	q.mu.Unlock()
+}
+
+// resetAll сбрасывает множества серий всех арендаторов после изменений всего хранилища.
+func (s *Storage) resetAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, q := range s.quotas {
+		q.mu.Lock()
+		q.series = nil
+		q.mu.Unlock()
+	}
+}
+
+// validate отклоняет некорректную запись до проверки квот: она не должна расходовать
+// квоту и сбрасывать учёт серий. Ошибки совпадают с ошибками хранилищ.
+func validate(mtype, name string, value func() error) error {
+	switch mtype {
+	case types.Gauge, types.Counter:
+	default:
+		return types.ErrUnknownType
+	}
+	if err := value(); err != nil {
+		return err
+	}
+	if name == "" {
+		return types.ErrIncorrectName
+	}
+	return nil
+}
+
+func validateValue(mtype, name, value string) error {
+	return validate(mtype, name, func() error {
+		var err error
+		if mtype == types.Gauge {
+			_, err = strconv.ParseFloat(value, 64)
+		} else {
+			_, err = strconv.ParseInt(value, 10, 64)
+		}
+		return err
+	})
+}
+
+func validateMetric(m types.Metrics) error {
+	return validate(m.MType, m.ID, func() error {
+		if (m.MType == types.Gauge && m.Value == nil) || (m.MType == types.Counter && m.Delta == nil) {
+			return types.ErrEmptyValue
+		}
+		return nil
+	})
+}
+
+// admit проверяет квоты арендатора id перед записью серий metrics (с уже добавленной меткой).
+// Сначала проверяется число серий: запись, отклонённая им, не расходует частоту записи.
+func (s *Storage) admit(ctx context.Context, id string, metrics []types.Metrics) error {
+	q := s.quota(id)
+
+	if q.limits.MaxSeries <= 0 {
+		return q.take(id, len(metrics))
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Без серий недоступного узла кластера арендатор получил бы лишние серии сверх квоты,
+	// поэтому квоту считают только по полной выборке.
+	if q.series == nil {
+		all, err := store.ReadAll(ctx, s.MetricStorage)
+		if err != nil {
+			return err
+		}
+		q.series = make(map[string]struct{})
+		for mtype, m := range all {
+			for sid := range m.Get() {
+				if owner, _ := unscope(sid); owner == id {
+					q.series[mtype+"/"+sid] = struct{}{}
+				}
+			}
+		}
+	}
+
+	var added []string
+	rollback := func() {
+		for _, k := range added {
+			delete(q.series, k)
+		}
+	}
+	for _, m := range metrics {
+		key := m.MType + "/" + m.ID
+		if _, ok := q.series[key]; ok {
+			continue
+		}
+		if len(q.series)+1 > q.limits.MaxSeries {
+			rollback()
+			return &types.LimitError{Reason: fmt.Sprintf("tenant %s: series limit of %d exceeded", display(id), q.limits.MaxSeries)}
+		}
+		q.series[key] = struct{}{}
+		added = append(added, key)
+	}
+
+	if err := q.take(id, len(metrics)); err != nil {
+		rollback()
+		return err
+	}
+	return nil
+}
+
+// take списывает n значений с ограничения частоты записи арендатора.
+func (q *quota) take(id string, n int) error {
+	if q.bucket == nil {
+		return nil
+	}
+	if ok, wait := q.bucket.Take(time.Now(), n); !ok {
+		return &types.LimitError{
+			Reason:     fmt.Sprintf("tenant %s: ingest rate limit of %s values/s exceeded", display(id), strconv.FormatFloat(q.limits.IngestRate, 'f', -1, 64)),
+			RetryAfter: wait,
+		}
+	}
+	return nil
+}
+
+func display(id string) string {
+	if id == "" {
+		return "default"
+	}
+	return id
+}
+
+// scope добавляет к идентификатору серии метку арендатора.
+func scope(id, sid string) (string, error) {
+	name, labels, err := types.ParseSeriesID(sid)
+	if err != nil {
+		if id == "" {
+			return sid, nil
+		}
+		return "", err
+	}
+	if _, ok := labels[Label]; ok {
+		return "", errReservedLabel
+	}
+	if id == "" {
+		return sid, nil
+	}
+
+	labels[Label] = id
+	return types.SeriesID(name, labels), nil
+}
+
+// unscope возвращает арендатора серии и её идентификатор без служебной метки.
+func unscope(sid string) (string, string) {
+	if !strings.Contains(sid, Label) {
+		return "", sid
+	}
+	name, labels, err := types.ParseSeriesID(sid)
+	if err != nil {
+		return "", sid
+	}
+	id, ok := labels[Label]
+	if !ok {
+		return "", sid
+	}
+	delete(labels, Label)
+	return id, types.SeriesID(name, labels)
+}
+
+// own оставляет серии арендатора id, снимая с них метку.
+func own[T any](id string, in map[string]T) map[string]T {
+	out := make(map[string]T)
+	for sid, v := range in {
+		if owner, plain := unscope(sid); owner == id {
+			out[plain] = v
+		}
+	}
+	return out
+}
+
+func (s *Storage) GetMetrics(ctx context.Context) map[string]store.Metric {
+	return ownMetrics(ctx, s.MetricStorage.GetMetrics(ctx))
+}
+
+// GetCompleteMetrics — GetMetrics, который отказывает, если выборка неполна.
+func (s *Storage) GetCompleteMetrics(ctx context.Context) (map[string]store.Metric, error) {
+	all, err := store.ReadAll(ctx, s.MetricStorage)
+	if err != nil {
+		return nil, err
+	}
+	return ownMetrics(ctx, all), nil
+}
+
+// ownMetrics оставляет в выборке серии арендатора из ctx, если он задан.
+func ownMetrics(ctx context.Context, all map[string]store.Metric) map[string]store.Metric {
+	id, ok := FromContext(ctx)
+	if !ok || all == nil {
+		return all
+	}
+
+	res := make(map[string]store.Metric, len(all))
+	for mtype, m := range all {
+		switch v := m.(type) {
+		case store.Gauge:
+			res[mtype] = store.Gauge(own(id, v))
+		case store.Counter:
+			res[mtype] = store.Counter(own(id, v))
+		}
+	}
+	return res
+}
+
+func (s *Storage) GetMetric(ctx context.Context, mtype string) map[string]string {
+	res := s.MetricStorage.GetMetric(ctx, mtype)
+	id, ok := FromContext(ctx)
+	if !ok || res == nil {
+		return res
+	}
+	return own(id, res)
+}
+
+// GetValue читает одну серию арендатора; если вложенное хранилище не умеет читать серию
+// отдельно, она берётся из выборки всех серий типа.
+func (s *Storage) GetValue(ctx context.Context, mtype, name string) (string, bool, error) {
+	if id, ok := FromContext(ctx); ok {
+		sid, err := scope(id, name)
+		if err != nil {
+			return "", false, nil
+		}
+		name = sid
+	}
+
+	if vr, ok := s.MetricStorage.(store.ValueReader); ok {
+		return vr.GetValue(ctx, mtype, name)
+	}
+	value, ok := s.MetricStorage.GetMetric(ctx, mtype)[name]
+	return value, ok, nil
+}
+
+func (s *Storage) UpdateMetric(ctx context.Context, mtype, name, value string) (any, error) {
+	id, ok := FromContext(ctx)
+	if !ok {
+		return s.MetricStorage.UpdateMetric(ctx, mtype, name, value)
+	}
+
+	if err := validateValue(mtype, name, value); err != nil {
+		return nil, err
+	}
+	sid, err := scope(id, name)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.admit(ctx, id, []types.Metrics{{ID: sid, MType: mtype}}); err != nil {
+		return nil, err
+	}
+
+	res, err := s.MetricStorage.UpdateMetric(ctx, mtype, sid, value)
+	if err != nil {
+		s.reset(id)
+	}
+	return res, err
+}
+
+func (s *Storage) UpdateMetrics(ctx context.Context, metrics []types.Metrics) error {
+	id, ok := FromContext(ctx)
+	if !ok {
+		return s.MetricStorage.UpdateMetrics(ctx, metrics)
+	}
+
+	scoped := make([]types.Metrics, len(metrics))
+	for i, m := range metrics {
+		if err := validateMetric(m); err != nil {
+			return err
+		}
+		sid, err := scope(id, m.ID)
+		if err != nil {
+			return err
+		}
+		m.ID = sid
+		scoped[i] = m
+	}
+	if err := s.admit(ctx, id, scoped); err != nil {
+		return err
+	}
+
+	err := s.MetricStorage.UpdateMetrics(ctx, scoped)
+	if err != nil {
+		s.reset(id)
+	}
+	return err
+}
+
+func (s *Storage) DeleteMetric(ctx context.Context, mtype, name string) (bool, error) {
+	id, ok := FromContext(ctx)
+	if !ok {
+		defer s.resetAll()
+		return s.MetricStorage.DeleteMetric(ctx, mtype, name)
+	}
+
+	sid, err := scope(id, name)
+	if err != nil {
+		return false, err
+	}
+	defer s.reset(id)
+	return s.MetricStorage.DeleteMetric(ctx, mtype, sid)
+}
+
+func (s *Storage) DeleteMetricsByPrefix(ctx context.Context, prefix string) (int, error) {
+	if _, ok := FromContext(ctx); !ok {
+		defer s.resetAll()
+		return s.MetricStorage.DeleteMetricsByPrefix(ctx, prefix)
+	}
+	return s.deleteWhere(ctx, func(sid string) bool {
+		return strings.HasPrefix(sid, prefix)
+	})
+}
+
+func (s *Storage) DeleteMetricsByLabel(ctx context.Context, key, value string) (int, error) {
+	if _, ok := FromContext(ctx); !ok {
+		defer s.resetAll()
+		return s.MetricStorage.DeleteMetricsByLabel(ctx, key, value)
+	}
+	if key == Label {
+		return 0, errReservedLabel
+	}
+	return s.deleteWhere(ctx, func(sid string) bool {
+		return types.HasLabel(sid, key, value)
+	})
+}
+
+// deleteWhere удаляет серии арендатора по одной: удаление по префиксу или метке во
+// вложенном хранилище задело бы серии других арендаторов.
+func (s *Storage) deleteWhere(ctx context.Context, match func(string) bool) (int, error) {
+	id, _ := FromContext(ctx)
+	defer s.reset(id)
+
+	all, err := store.ReadAll(ctx, s.MetricStorage)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		deleted int
+		errs    []error
+	)
+	for mtype, m := range all {
+		for sid := range m.Get() {
+			owner, plain := unscope(sid)
+			if owner != id || !match(plain) {
+				continue
+			}
+			ok, err := s.MetricStorage.DeleteMetric(ctx, mtype, sid)
+			if ok {
+				deleted++
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	return deleted, errors.Join(errs...)
+}
+
+// ReplaceMetrics заменяет всё хранилище и доступна только запросам без арендатора:
+// замена своих серий одним шагом вложенному хранилищу не выразить.
+func (s *Storage) ReplaceMetrics(ctx context.Context, metrics []types.Metrics) error {
+	rp, ok := s.MetricStorage.(store.Replacer)
+	if _, scoped := FromContext(ctx); scoped || !ok {
+		return types.ErrNoReplace
+	}
+	defer s.resetAll()
+
+	return rp.ReplaceMetrics(ctx, metrics)
+}
+
+// PurgeStale работает со всем хранилищем: уборщик один на всех арендаторов.
+func (s *Storage) PurgeStale(ctx context.Context, before time.Time) (int, error) {
+	n, err := s.MetricStorage.PurgeStale(ctx, before)
+	if n > 0 {
+		s.resetAll()
+	}
+	return n, err
+}
+
+// Samples пробрасывает чтение истории серии арендатора, если вложенное хранилище её хранит.
+func (s *Storage) Samples(ctx context.Context, mtype, name string, from, to time.Time) ([]types.Sample, error) {
+	hs, ok := s.MetricStorage.(store.HistoryStorage)
+	if !ok {
+		return nil, types.ErrNoHistory
+	}
+	if id, ok := FromContext(ctx); ok {
+		sid, err := scope(id, name)
+		if err != nil {
+			return nil, err
+		}
+		name = sid
+	}
+	return hs.Samples(ctx, mtype, name, from, to)
+}
@@ -0,0 +1,311 @@
+package tenant
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/shevchukeugeni/metrics/internal/server"
+	"github.com/shevchukeugeni/metrics/internal/store"
+	"github.com/shevchukeugeni/metrics/internal/types"
+)
+
+func testConfig() *Config {
+	return &Config{
+		Tenants: []Tenant{
+			{ID: "team-a", APIKeys: []string{"key-a"}},
+			{ID: "team-b", APIKeys: []string{"key-b"}, Limits: &Limits{MaxSeries: 2}},
+			{ID: "team-c", APIKeys: []string{"key-c"}, Limits: &Limits{IngestRate: 1, IngestBurst: 3}},
+		},
+		AllowAnonymous: true,
+	}
+}
+
+func startServer(t *testing.T, cfg *Config) (*store.MemStorage, *httptest.Server) {
+	local := store.NewMemStorage()
+	ts := httptest.NewServer(server.SetupRouter(zap.NewNop(), NewStorage(local, cfg), nil, nil,
+		server.WithTenants(Middleware(zap.NewNop(), cfg))))
+	t.Cleanup(ts.Close)
+	return local, ts
+}
+
+func do(t *testing.T, method, url, key string, body any) *http.Response {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, url, r)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set(HeaderAPIKey, key)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func counter(id string, d int64) types.Metrics {
+	return types.Metrics{ID: id, MType: types.Counter, Delta: &d}
+}
+
+func readValue(t *testing.T, url, key, id string) (int, string) {
+	resp := do(t, http.MethodPost, url+"/value/", key, types.Metrics{ID: id, MType: types.Counter})
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(data)
+}
+
+func TestStorage_Isolation(t *testing.T) {
+	ctx := context.Background()
+	local, ts := startServer(t, testConfig())
+
+	for key, delta := range map[string]int64{"key-a": 1, "key-b": 10, "": 100} {
+		resp := do(t, http.MethodPost, ts.URL+"/updates/", key, []types.Metrics{counter(`requests{host="h1"}`, delta)})
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	code, body := readValue(t, ts.URL, "key-a", `requests{host="h1"}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"id":"requests{host=\"h1\"}","type":"counter","delta":1}`, body)
+	_, body = readValue(t, ts.URL, "key-b", `requests{host="h1"}`)
+	assert.JSONEq(t, `{"id":"requests{host=\"h1\"}","type":"counter","delta":10}`, body)
+	_, body = readValue(t, ts.URL, "", `requests{host="h1"}`)
+	assert.JSONEq(t, `{"id":"requests{host=\"h1\"}","type":"counter","delta":100}`, body)
+
+	// В хранилище серии различаются служебной меткой; серия по умолчанию хранится как есть.
+	assert.Equal(t, map[string]string{
+		`requests{__tenant__="team-a",host="h1"}`: "1",
+		`requests{__tenant__="team-b",host="h1"}`: "10",
+		`requests{host="h1"}`:                     "100",
+	}, local.GetMetric(ctx, types.Counter))
+
+	// Удаление по префиксу не задевает чужие серии.
+	resp := do(t, http.MethodDelete, ts.URL+"/value/?prefix=requests", "key-a", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	code, _ = readValue(t, ts.URL, "key-a", `requests{host="h1"}`)
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Len(t, local.GetMetric(ctx, types.Counter), 2)
+
+	// Служебную метку нельзя передать самому.
+	resp = do(t, http.MethodPost, ts.URL+"/updates/", "", []types.Metrics{counter(`requests{__tenant__="team-b"}`, 1)})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = do(t, http.MethodDelete, ts.URL+"/value/?label=__tenant__=team-b", "", nil)
+	assert.NotEqual(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, local.GetMetric(ctx, types.Counter), 2)
+}
+
+func TestMiddleware(t *testing.T) {
+	cfg := testConfig()
+	_, ts := startServer(t, cfg)
+
+	resp := do(t, http.MethodPost, ts.URL+"/update/counter/PollCount/1", "wrong-key", nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	cfg.AllowAnonymous = false
+	_, ts = startServer(t, cfg)
+	resp = do(t, http.MethodPost, ts.URL+"/update/counter/PollCount/1", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = do(t, http.MethodPost, ts.URL+"/update/counter/PollCount/1", "key-a", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Заголовок с арендатором учитывается только при TrustHeader.
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/update/counter/PollCount/1", nil)
+	require.NoError(t, err)
+	req.Header.Set(HeaderTenant, "team-a")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	cfg.TrustHeader = true
+	_, ts = startServer(t, cfg)
+	req.URL.Host = ts.Listener.Addr().String()
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestStorage_Limits(t *testing.T) {
+	_, ts := startServer(t, testConfig())
+
+	batch := []types.Metrics{counter("a", 1), counter("b", 1)}
+	resp := do(t, http.MethodPost, ts.URL+"/updates/", "key-b", batch)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = do(t, http.MethodPost, ts.URL+"/updates/", "key-b", batch)
+	require.Equal(t, http.StatusOK, resp.StatusCode, "existing series do not count twice")
+
+	resp = do(t, http.MethodPost, ts.URL+"/update/", "key-b", counter("c", 1))
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	msg, _ := io.ReadAll(resp.Body)
+	assert.Contains(t, string(msg), "tenant team-b: series limit of 2 exceeded")
+	assert.Empty(t, resp.Header.Get("Retry-After"))
+
+	// После удаления серии место освобождается.
+	resp = do(t, http.MethodDelete, ts.URL+"/value/", "key-b", counter("a", 0))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = do(t, http.MethodPost, ts.URL+"/update/", "key-b", counter("c", 1))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Частота записи ограничена по числу значений.
+	resp = do(t, http.MethodPost, ts.URL+"/updates/", "key-c", []types.Metrics{counter("a", 1), counter("b", 1), counter("c", 1)})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = do(t, http.MethodPost, ts.URL+"/update/counter/a/1", "key-c", nil)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	// Квоты одного арендатора не влияют на других.
+	resp = do(t, http.MethodPost, ts.URL+"/update/counter/a/1", "key-a", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{
+			name:   "valid",
+			config: `{"tenants":[{"id":"team-a","api_keys":["k1"],"limits":{"max_series":10}}],"default_limits":{"ingest_rate":100}}`,
+		},
+		{
+			name:    "invalid id",
+			config:  `{"tenants":[{"id":"team a","api_keys":["k1"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "duplicate key",
+			config:  `{"tenants":[{"id":"a","api_keys":["k1"]},{"id":"b","api_keys":["k1"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "nobody can write",
+			config:  `{"tenants":[]}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tenants.json")
+			require.NoError(t, os.WriteFile(path, []byte(tt.config), 0600))
+
+			cfg, err := LoadConfig(path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, Limits{MaxSeries: 10}, cfg.limits("team-a"))
+			assert.Equal(t, Limits{IngestRate: 100}, cfg.limits(""))
+		})
+	}
+}
+
+// countingStorage считает полные чтения хранилища, которыми квоты загружают серии.
+type countingStorage struct {
+	*store.MemStorage
+	reads int
+}
+
+func (c *countingStorage) GetMetrics(ctx context.Context) map[string]store.Metric {
+	c.reads++
+	return c.MemStorage.GetMetrics(ctx)
+}
+
+func TestStorage_QuotaReset(t *testing.T) {
+	inner := &countingStorage{MemStorage: store.NewMemStorage()}
+	s := NewStorage(inner, &Config{DefaultLimits: Limits{MaxSeries: 10}})
+	a, b := WithTenant(context.Background(), "team-a"), WithTenant(context.Background(), "team-b")
+
+	_, err := s.UpdateMetric(a, types.Counter, "a", "1")
+	require.NoError(t, err)
+	_, err = s.UpdateMetric(b, types.Counter, "b", "1")
+	require.NoError(t, err)
+	require.Equal(t, 2, inner.reads)
+
+	// Некорректные записи не доходят до квот и не заставляют перечитывать хранилище.
+	_, err = s.UpdateMetric(a, types.Counter, "a", "x")
+	require.Error(t, err)
+	err = s.UpdateMetrics(a, []types.Metrics{{ID: "a", MType: types.Gauge}})
+	require.EqualError(t, err, "empty metric value")
+	_, err = s.UpdateMetric(a, "histogram", "a", "1")
+	require.ErrorIs(t, err, types.ErrUnknownType)
+	_, err = s.UpdateMetric(a, types.Counter, "a", "1")
+	require.NoError(t, err)
+	assert.Equal(t, 2, inner.reads)
+
+	// Удаление сбрасывает учёт только своего арендатора.
+	_, err = s.DeleteMetric(a, types.Counter, "a")
+	require.NoError(t, err)
+	_, err = s.UpdateMetric(b, types.Counter, "b", "1")
+	require.NoError(t, err)
+	assert.Equal(t, 2, inner.reads)
+	_, err = s.UpdateMetric(a, types.Counter, "a", "1")
+	require.NoError(t, err)
+	assert.Equal(t, 3, inner.reads)
+}
+
+func TestStorage_SeriesLimitKeepsRate(t *testing.T) {
+	s := NewStorage(store.NewMemStorage(), &Config{DefaultLimits: Limits{MaxSeries: 1, IngestRate: 0.001, IngestBurst: 2}})
+	ctx := WithTenant(context.Background(), "team-a")
+
+	_, err := s.UpdateMetric(ctx, types.Counter, "a", "1")
+	require.NoError(t, err)
+
+	// Запись, отклонённая по числу серий, не расходует частоту записи.
+	var le *types.LimitError
+	_, err = s.UpdateMetric(ctx, types.Counter, "b", "1")
+	require.ErrorAs(t, err, &le)
+	assert.Contains(t, le.Reason, "series limit")
+
+	_, err = s.UpdateMetric(ctx, types.Counter, "a", "1")
+	require.NoError(t, err)
+	_, err = s.UpdateMetric(ctx, types.Counter, "a", "1")
+	require.ErrorAs(t, err, &le)
+	assert.Contains(t, le.Reason, "ingest rate limit")
+}
+
+// partialStorage изображает кластер, у которого недоступен один из узлов.
+type partialStorage struct {
+	*store.MemStorage
+	partial bool
+}
+
+func (p *partialStorage) GetCompleteMetrics(ctx context.Context) (map[string]store.Metric, error) {
+	if p.partial {
+		return p.MemStorage.GetMetrics(ctx), types.ErrPartialResult
+	}
+	return p.MemStorage.GetMetrics(ctx), nil
+}
+
+func TestStorage_QuotaRefusesPartialRead(t *testing.T) {
+	inner := &partialStorage{MemStorage: store.NewMemStorage(), partial: true}
+	s := NewStorage(inner, &Config{DefaultLimits: Limits{MaxSeries: 1}})
+	ctx := WithTenant(context.Background(), "team-a")
+
+	// Серии арендатора на недоступном узле не посчитаны бы, и квота пропустила бы лишние.
+	_, err := s.UpdateMetric(ctx, types.Counter, "a", "1")
+	require.ErrorIs(t, err, types.ErrPartialResult)
+	assert.Empty(t, inner.GetMetric(ctx, types.Counter))
+
+	inner.partial = false
+	_, err = s.UpdateMetric(ctx, types.Counter, "a", "1")
+	require.NoError(t, err)
+}
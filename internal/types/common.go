@@ -1,14 +1,28 @@
 package types
 
+import "time"
+
 const (
 	Counter = "counter"
 	Gauge   = "gauge"
 )
 
+// BatchIDHeader — заголовок /updates/ с идентификатором батча. Клиент повторяет неудачную
+// отправку тем же батчем с тем же идентификатором, а узлы кластера применяют свою часть
+// батча не больше одного раза.
+const BatchIDHeader = "X-Batch-ID"
+
 type DumpConfig struct {
 	StoreInterval   uint   `env:"STORE_INTERVAL"`
 	FileStoragePath string `env:"FILE_STORAGE_PATH"`
 	Restore         bool   `env:"RESTORE"`
+	DumpGenerations uint   `env:"DUMP_GENERATIONS"`
+	DumpFormat      string `env:"DUMP_FORMAT"`
+	DumpCompress    bool   `env:"DUMP_COMPRESS"`
+
+	WALPath         string `env:"WAL_PATH"`
+	WALFsync        string `env:"WAL_FSYNC"`
+	WALSyncInterval uint   `env:"WAL_SYNC_INTERVAL"`
 }
 
 type Metrics struct {
@@ -17,3 +31,10 @@ type Metrics struct {
 	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
 	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
 }
+
+// Sample — значение серии на момент Time; для counter хранится накопленное значение.
+type Sample struct {
+	Time  time.Time `json:"ts"`
+	Delta *int64    `json:"delta,omitempty"`
+	Value *float64  `json:"value,omitempty"`
+}
@@ -0,0 +1,40 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Duration позволяет задавать интервалы в JSON-конфигах строкой вида "10s" или числом секунд.
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(value * float64(time.Second))
+		return nil
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+		return nil
+	default:
+		return errors.New("invalid duration")
+	}
+}
@@ -1,7 +1,37 @@
 package types
 
-import "errors"
+import (
+	"errors"
+	"strconv"
+	"time"
+)
 
 var (
-	ErrUnknownType error = errors.New("unknown metric type")
+	ErrUnknownType   error = errors.New("unknown metric type")
+	ErrIncorrectName error = errors.New("incorrect name")
+	ErrEmptyValue    error = errors.New("empty metric value")
+	// ErrInvalidMetric — узел, которому переслали запись, отклонил её данные.
+	ErrInvalidMetric error = errors.New("invalid metric")
+	ErrNoHistory     error = errors.New("metric history is disabled")
+	ErrNoReplace     error = errors.New("storage does not support replacing all series at once")
+	// ErrPartialResult — часть узлов кластера недоступна, и выборка всех серий неполна.
+	ErrPartialResult error = errors.New("partial result: some cluster nodes are unavailable")
 )
+
+// IsInvalid сообщает, что запись отклонена из-за некорректных данных и её повтор не поможет.
+// Остальные ошибки записи — сбои хранилища, после которых запрос можно повторить.
+func IsInvalid(err error) bool {
+	var ne *strconv.NumError
+	return errors.Is(err, ErrUnknownType) || errors.Is(err, ErrIncorrectName) || errors.Is(err, ErrEmptyValue) ||
+		errors.Is(err, ErrInvalidMetric) || errors.Is(err, ErrInvalidSeriesID) || errors.As(err, &ne)
+}
+
+// LimitError — запрос отклонён квотой. RetryAfter > 0, если тот же запрос пройдёт через это время.
+type LimitError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	return e.Reason
+}
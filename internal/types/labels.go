@@ -0,0 +1,120 @@
+package types
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var ErrInvalidSeriesID = errors.New("invalid series id")
+
+// SeriesID собирает идентификатор серии из имени и набора меток в виде name{k1="v1",k2="v2"}.
+// Метки сортируются по ключу, чтобы один и тот же набор всегда давал одинаковый идентификатор.
+func SeriesID(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabelValue(labels[k]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+// ParseSeriesID разбирает идентификатор, собранный SeriesID. Идентификатор без меток
+// возвращается как имя с пустым набором меток.
+func ParseSeriesID(id string) (string, map[string]string, error) {
+	start := strings.IndexByte(id, '{')
+	if start < 0 {
+		return id, map[string]string{}, nil
+	}
+	if !strings.HasSuffix(id, "}") {
+		return "", nil, ErrInvalidSeriesID
+	}
+
+	name, body := id[:start], id[start+1:len(id)-1]
+	labels := make(map[string]string)
+
+	for len(body) > 0 {
+		eq := strings.Index(body, `="`)
+		if eq <= 0 {
+			return "", nil, ErrInvalidSeriesID
+		}
+		key := body[:eq]
+		body = body[eq+2:]
+
+		var (
+			value   strings.Builder
+			escaped bool
+			closed  bool
+			i       int
+		)
+		for i = 0; i < len(body); i++ {
+			c := body[i]
+			if escaped {
+				value.WriteByte(c)
+				escaped = false
+				continue
+			}
+			if c == '\\' {
+				escaped = true
+				continue
+			}
+			if c == '"' {
+				closed = true
+				break
+			}
+			value.WriteByte(c)
+		}
+		if !closed {
+			return "", nil, ErrInvalidSeriesID
+		}
+		labels[key] = value.String()
+
+		body = body[i+1:]
+		if strings.HasPrefix(body, ",") {
+			body = body[1:]
+		} else if body != "" {
+			return "", nil, ErrInvalidSeriesID
+		}
+	}
+
+	return name, labels, nil
+}
+
+// HasLabel проверяет, что у серии есть метка key со значением value.
+func HasLabel(id, key, value string) bool {
+	if !strings.Contains(id, "{") {
+		return false
+	}
+	_, labels, err := ParseSeriesID(id)
+	if err != nil {
+		return false
+	}
+	v, ok := labels[key]
+	return ok && v == value
+}
+
+func escapeLabelValue(v string) string {
+	if !strings.ContainsAny(v, `"\`) {
+		return v
+	}
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v)
+}
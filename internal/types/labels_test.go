@@ -0,0 +1,56 @@
+package types
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeriesID(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric string
+		labels map[string]string
+		want   string
+	}{
+		{
+			name:   "no labels",
+			metric: "HeapAlloc",
+			want:   "HeapAlloc",
+		},
+		{
+			name:   "sorted labels",
+			metric: "cpu",
+			labels: map[string]string{"pid": "1", "name": "init"},
+			want:   `cpu{name="init",pid="1"}`,
+		},
+		{
+			name:   "escaped value",
+			metric: "m",
+			labels: map[string]string{"v": `a"b\c`},
+			want:   `m{v="a\"b\\c"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := SeriesID(tt.metric, tt.labels)
+			assert.Equal(t, tt.want, id)
+
+			name, labels, err := ParseSeriesID(id)
+			require.NoError(t, err)
+			assert.Equal(t, tt.metric, name)
+			if tt.labels == nil {
+				tt.labels = map[string]string{}
+			}
+			assert.Equal(t, tt.labels, labels)
+		})
+	}
+}
+
+func TestParseSeriesID_Invalid(t *testing.T) {
+	for _, id := range []string{`m{a="b"`, `m{a=b}`, `m{="b"}`, `m{a="b"c}`} {
+		_, _, err := ParseSeriesID(id)
+		assert.ErrorIs(t, err, ErrInvalidSeriesID, id)
+	}
+}